@@ -0,0 +1,228 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"media-indexer/models"
+	"media-indexer/services/fsck"
+	"media-indexer/services/scrub"
+)
+
+type AdminController struct {
+	FsckService  fsck.FsckService
+	ScrubService scrub.ScrubService
+
+	// running allows a single fsck at a time; a check walks the whole
+	// storage and media table.
+	running sync.Mutex
+}
+
+// ScrubbedMedia reports when the stored file of a media was last scrubbed.
+type ScrubbedMedia struct {
+	ID              uuid.UUID  `json:"id"`
+	Name            string     `json:"name"`
+	StorageProvider string     `json:"storageProvider"`
+	StorageKey      string     `json:"storageKey"`
+	ContentHash     string     `json:"contentHash"`
+	ScrubbedAt      *time.Time `json:"scrubbedAt,omitempty"`
+	VerifiedAt      *time.Time `json:"verifiedAt,omitempty"`
+	CorruptAt       *time.Time `json:"corruptAt,omitempty"`
+}
+
+type PaginatedScrubbedMedia struct {
+	Media      []ScrubbedMedia `json:"media"`
+	Page       int             `json:"page"`
+	PageSize   int             `json:"pageSize"`
+	TotalItems int64           `json:"totalItems"`
+	TotalPages int             `json:"totalPages"`
+}
+
+type ScrubResponse struct {
+	ScrubbedMedia
+	Result scrub.Result `json:"result"`
+}
+
+func NewAdminController(fsckService fsck.FsckService, scrubService scrub.ScrubService) *AdminController {
+	return &AdminController{FsckService: fsckService, ScrubService: scrubService}
+}
+
+// RequireToken rejects requests not carrying "Authorization: Bearer <token>".
+func RequireToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// CheckStorage godoc
+// @Summary Check storage consistency
+// @Description Report blobs no media points at, media whose blob is missing and, with verify, blobs whose checksum does not match their media. Nothing is changed.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param verify query bool false "Hash every referenced blob"
+// @Success 200 {object} fsck.Report "Consistency report"
+// @Failure 401 {object} gin.H "Invalid admin token"
+// @Failure 409 {object} gin.H "A check is already running"
+// @Failure 500 {object} gin.H "Check failed"
+// @Router /admin/fsck [get]
+func (ac *AdminController) CheckStorage(c *gin.Context) {
+	verify, _ := strconv.ParseBool(c.Query("verify"))
+	ac.runFsck(c, fsck.Options{Verify: verify})
+}
+
+// CollectGarbage godoc
+// @Summary Delete orphaned blobs
+// @Description Run a consistency check and delete blobs no media points at that are older than the grace period. Missing blobs and checksum mismatches are only reported.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param gracePeriod query string false "Minimum age of collected blobs, e.g. 48h (default 24h)"
+// @Param verify query bool false "Hash every referenced blob"
+// @Success 200 {object} fsck.Report "Consistency report, collected blobs are flagged"
+// @Failure 400 {object} gin.H "Invalid grace period"
+// @Failure 401 {object} gin.H "Invalid admin token"
+// @Failure 409 {object} gin.H "A check is already running"
+// @Failure 500 {object} gin.H "Check failed"
+// @Router /admin/fsck/gc [post]
+func (ac *AdminController) CollectGarbage(c *gin.Context) {
+	gracePeriod := fsck.DefaultGracePeriod
+	if value := c.Query("gracePeriod"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid grace period"})
+			return
+		}
+		gracePeriod = parsed
+	}
+	verify, _ := strconv.ParseBool(c.Query("verify"))
+
+	ac.runFsck(c, fsck.Options{Verify: verify, Repair: true, GracePeriod: gracePeriod})
+}
+
+func (ac *AdminController) runFsck(c *gin.Context, options fsck.Options) {
+	if !ac.running.TryLock() {
+		c.JSON(http.StatusConflict, gin.H{"error": "A storage check is already running"})
+		return
+	}
+	defer ac.running.Unlock()
+
+	report, err := ac.FsckService.Check(c.Request.Context(), options)
+	if err != nil {
+		log.Printf("Error checking storage: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// ListCorruptMedia godoc
+// @Summary List corrupt media
+// @Description List the media whose stored file the scrub job found missing or no longer matching the content hash saved at upload time, those corrupt longest first
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param page query int false "Page number"
+// @Param pageSize query int false "Number of media per page"
+// @Success 200 {object} PaginatedScrubbedMedia "Corrupt media"
+// @Failure 400 {object} gin.H "Invalid page number or page size"
+// @Failure 401 {object} gin.H "Invalid admin token"
+// @Failure 500 {object} gin.H "Listing failed"
+// @Router /admin/scrub/corrupt [get]
+func (ac *AdminController) ListCorruptMedia(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "10"))
+	if page <= 0 || pageSize <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page number or page size"})
+		return
+	}
+
+	media, totalItems, err := ac.ScrubService.ListCorrupt(page, pageSize)
+	if err != nil {
+		log.Printf("Error listing corrupt media: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list corrupt media"})
+		return
+	}
+
+	response := PaginatedScrubbedMedia{
+		Media:      []ScrubbedMedia{},
+		Page:       page,
+		PageSize:   pageSize,
+		TotalItems: totalItems,
+		TotalPages: int((totalItems + int64(pageSize) - 1) / int64(pageSize)),
+	}
+	for i := range media {
+		response.Media = append(response.Media, scrubbedMedia(&media[i]))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// ScrubMedia godoc
+// @Summary Scrub a media
+// @Description Read the stored file of a media back right away and compare it with the content hash saved at upload time, e.g. after restoring it from a backup. An intact file clears the corrupt flag.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param id path string true "Media ID"
+// @Success 200 {object} ScrubResponse "Scrub result"
+// @Failure 400 {object} gin.H "Invalid media id or external media"
+// @Failure 401 {object} gin.H "Invalid admin token"
+// @Failure 404 {object} gin.H "Media not found"
+// @Failure 500 {object} gin.H "Scrub failed"
+// @Failure 503 {object} gin.H "Stored file could not be read"
+// @Router /admin/scrub/media/{id} [post]
+func (ac *AdminController) ScrubMedia(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid media id"})
+		return
+	}
+
+	media, result, err := ac.ScrubService.ScrubMedia(c.Request.Context(), id)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+		return
+	case errors.Is(err, scrub.ErrExternalMedia):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "External media have no stored file"})
+		return
+	case err != nil:
+		log.Printf("Error scrubbing media %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scrub media"})
+		return
+	}
+	if result == scrub.ResultError {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Stored file could not be read"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ScrubResponse{ScrubbedMedia: scrubbedMedia(media), Result: result})
+}
+
+func scrubbedMedia(m *models.Media) ScrubbedMedia {
+	return ScrubbedMedia{
+		ID:              m.ID,
+		Name:            m.Name,
+		StorageProvider: m.StorageProvider,
+		StorageKey:      m.StorageKey,
+		ContentHash:     m.ContentHash,
+		ScrubbedAt:      m.ScrubbedAt,
+		VerifiedAt:      m.VerifiedAt,
+		CorruptAt:       m.CorruptAt,
+	}
+}
@@ -0,0 +1,208 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"media-indexer/models"
+	"media-indexer/services/fsck"
+	"media-indexer/services/scrub"
+)
+
+type MockFsckService struct {
+	Options []fsck.Options
+}
+
+func (m *MockFsckService) Check(_ctx context.Context, options fsck.Options) (*fsck.Report, error) {
+	m.Options = append(m.Options, options)
+	return &fsck.Report{
+		CheckedMedia: 2,
+		CheckedBlobs: 3,
+		Orphans:      []fsck.OrphanBlob{{Key: "orphan.txt", Collected: options.Repair}},
+	}, nil
+}
+
+// MockScrubService scrubs the media it holds to Results, or to intact.
+type MockScrubService struct {
+	scrub.ScrubService
+	Media   map[uuid.UUID]*models.Media
+	Results map[uuid.UUID]scrub.Result
+}
+
+func (m *MockScrubService) ScrubMedia(_ctx context.Context, id uuid.UUID) (*models.Media, scrub.Result, error) {
+	media, ok := m.Media[id]
+	if !ok {
+		return nil, "", gorm.ErrRecordNotFound
+	}
+	if media.External {
+		return nil, "", scrub.ErrExternalMedia
+	}
+	result, ok := m.Results[id]
+	if !ok {
+		result = scrub.ResultIntact
+	}
+	return media, result, nil
+}
+
+func (m *MockScrubService) ListCorrupt(page int, pageSize int) ([]models.Media, int64, error) {
+	var corrupt []models.Media
+	for _, media := range m.Media {
+		if media.CorruptAt != nil {
+			corrupt = append(corrupt, *media)
+		}
+	}
+	total := int64(len(corrupt))
+	start := min((page-1)*pageSize, len(corrupt))
+	return corrupt[start:min(start+pageSize, len(corrupt))], total, nil
+}
+
+func SetupAdminTestRouter() (*gin.Engine, *MockFsckService, *MockScrubService) {
+	service := &MockFsckService{}
+	scrubService := &MockScrubService{Media: map[uuid.UUID]*models.Media{}, Results: map[uuid.UUID]scrub.Result{}}
+	adminController := NewAdminController(service, scrubService)
+
+	router := gin.Default()
+	admin := router.Group("/admin", RequireToken("secret"))
+	admin.GET("/fsck", adminController.CheckStorage)
+	admin.POST("/fsck/gc", adminController.CollectGarbage)
+	admin.GET("/scrub/corrupt", adminController.ListCorruptMedia)
+	admin.POST("/scrub/media/:id", adminController.ScrubMedia)
+	return router, service, scrubService
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+func adminRequest(method string, target string, token string) *http.Request {
+	req, _ := http.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestCheckStorage(t *testing.T) {
+	router, service, _ := SetupAdminTestRouter()
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, adminRequest(http.MethodGet, "/admin/fsck?verify=true", "secret"))
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var report fsck.Report
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &report))
+	assert.Equal(t, 2, report.CheckedMedia)
+	assert.False(t, report.Orphans[0].Collected)
+	assert.Equal(t, []fsck.Options{{Verify: true}}, service.Options)
+}
+
+func TestCheckStorage_RequiresToken(t *testing.T) {
+	router, service, _ := SetupAdminTestRouter()
+
+	for _, token := range []string{"", "wrong"} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, adminRequest(http.MethodGet, "/admin/fsck", token))
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	}
+	assert.Empty(t, service.Options)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	router, service, _ := SetupAdminTestRouter()
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, adminRequest(http.MethodPost, "/admin/fsck/gc?gracePeriod=48h", "secret"))
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, []fsck.Options{{Repair: true, GracePeriod: 48 * time.Hour}}, service.Options)
+}
+
+func TestCollectGarbage_InvalidGracePeriod(t *testing.T) {
+	router, service, _ := SetupAdminTestRouter()
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, adminRequest(http.MethodPost, "/admin/fsck/gc?gracePeriod=-1h", "secret"))
+
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Empty(t, service.Options)
+}
+
+func TestListCorruptMedia(t *testing.T) {
+	router, _, scrubService := SetupAdminTestRouter()
+	corruptAt := time.Now()
+	corrupt := &models.Media{ID: uuid.New(), Name: "rotten", StorageKey: "abc.jpg", ContentHash: "abc", CorruptAt: &corruptAt}
+	scrubService.Media[corrupt.ID] = corrupt
+	intact := &models.Media{ID: uuid.New(), Name: "fine"}
+	scrubService.Media[intact.ID] = intact
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, adminRequest(http.MethodGet, "/admin/scrub/corrupt", "secret"))
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var page PaginatedScrubbedMedia
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &page))
+	assert.Equal(t, int64(1), page.TotalItems)
+	assert.Equal(t, 1, page.TotalPages)
+	require.Len(t, page.Media, 1)
+	assert.Equal(t, corrupt.ID, page.Media[0].ID)
+	assert.Equal(t, "abc.jpg", page.Media[0].StorageKey)
+	assert.NotNil(t, page.Media[0].CorruptAt)
+}
+
+func TestListCorruptMedia_InvalidPage(t *testing.T) {
+	router, _, _ := SetupAdminTestRouter()
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, adminRequest(http.MethodGet, "/admin/scrub/corrupt?page=0", "secret"))
+
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestScrubMedia(t *testing.T) {
+	router, _, scrubService := SetupAdminTestRouter()
+	intact := &models.Media{ID: uuid.New()}
+	scrubService.Media[intact.ID] = intact
+	unreadable := &models.Media{ID: uuid.New()}
+	scrubService.Media[unreadable.ID] = unreadable
+	scrubService.Results[unreadable.ID] = scrub.ResultError
+	external := &models.Media{ID: uuid.New(), External: true}
+	scrubService.Media[external.ID] = external
+
+	tests := []struct {
+		name string
+		id   string
+		code int
+	}{
+		{"intact", intact.ID.String(), http.StatusOK},
+		{"unreadable", unreadable.ID.String(), http.StatusServiceUnavailable},
+		{"external", external.ID.String(), http.StatusBadRequest},
+		{"unknown", uuid.NewString(), http.StatusNotFound},
+		{"invalid id", "nope", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, adminRequest(http.MethodPost, "/admin/scrub/media/"+tt.id, "secret"))
+			assert.Equal(t, tt.code, resp.Code)
+		})
+	}
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, adminRequest(http.MethodPost, "/admin/scrub/media/"+intact.ID.String(), "secret"))
+	var result ScrubResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &result))
+	assert.Equal(t, intact.ID, result.ID)
+	assert.Equal(t, scrub.ResultIntact, result.Result)
+}
@@ -0,0 +1,88 @@
+package files
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"media-indexer/storage"
+)
+
+// FileController serves blobs behind URLs signed by providers that sign URLs
+// themselves, such as local storage. Providers delegating signing to their
+// backend (S3 presigned URLs) never send clients here.
+type FileController struct {
+	Storage storage.StorageProvider
+}
+
+func NewFileController(storageProvider storage.StorageProvider) *FileController {
+	return &FileController{Storage: storageProvider}
+}
+
+// ServeFile godoc
+// @Summary Download a stored file
+// @Description Serve a stored file through a signed, expiring URL issued by the storage provider
+// @Tags files
+// @Produce octet-stream
+// @Param path path string true "Path of the stored file"
+// @Param expires query int true "Unix time the URL expires at"
+// @Param signature query string true "URL signature"
+// @Success 200 {file} file "File content"
+// @Failure 403 {object} gin.H "Forbidden"
+// @Failure 404 {object} gin.H "Not Found"
+// @Failure 503 {object} gin.H "Storage unavailable"
+// @Router /files/{path} [get]
+func (fc *FileController) ServeFile(c *gin.Context) {
+	verifier, ok := fc.Storage.(storage.URLVerifier)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	key := path.Base(c.Param("path"))
+	if err := verifier.VerifySignedURL(key, c.Request.URL.Query()); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	info, err := fc.Storage.Stat(ctx, key)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if errors.Is(err, storage.ErrUnavailable) {
+		log.Printf("failed to stat stored file %s: %v", key, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage is unavailable, try again later"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to stat stored file %s: %v", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	reader, err := fc.Storage.Open(ctx, key)
+	if err != nil {
+		log.Printf("failed to open stored file %s: %v", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer reader.Close()
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", info.ContentType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	// Files other than images, video and audio could carry scripts, so
+	// browsers download them instead of displaying them.
+	if !storage.DisplayInline(info.ContentType) {
+		header.Set("Content-Disposition", "attachment")
+		header.Set("Content-Security-Policy", "sandbox")
+	}
+	header.Set("ETag", `"`+strings.TrimSuffix(key, path.Ext(key))+`"`)
+	http.ServeContent(c.Writer, c.Request, key, info.LastModified, reader)
+}
@@ -0,0 +1,117 @@
+package files
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"media-indexer/storage"
+)
+
+func SetupFileTestRouter(t *testing.T) (*gin.Engine, *storage.LocalStorage) {
+	localStorage, err := storage.NewLocalStorage(storage.LocalConfig{
+		RootDir:    t.TempDir(),
+		BaseURL:    "http://localhost:8080/files",
+		SigningKey: "test-signing-key",
+	})
+	require.NoError(t, err)
+
+	router := gin.Default()
+	fileController := NewFileController(localStorage)
+	router.GET("/files/*path", fileController.ServeFile)
+	return router, localStorage
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+func signedPath(t *testing.T, localStorage *storage.LocalStorage, key string, expiry time.Duration) string {
+	signedURL, err := localStorage.SignedURL(context.Background(), key, expiry)
+	require.NoError(t, err)
+	parsed, err := url.Parse(signedURL)
+	require.NoError(t, err)
+	return parsed.RequestURI()
+}
+
+func TestServeFile(t *testing.T) {
+	router, localStorage := SetupFileTestRouter(t)
+	object, err := localStorage.UploadFile(context.Background(), strings.NewReader("file content"), "notes.txt")
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodGet, signedPath(t, localStorage, object.Key, time.Minute), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "file content", resp.Body.String())
+	assert.Equal(t, "text/plain", resp.Header().Get("Content-Type"))
+	assert.Equal(t, `"`+object.ContentHash+`"`, resp.Header().Get("ETag"))
+	assert.Equal(t, "nosniff", resp.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "attachment", resp.Header().Get("Content-Disposition"))
+}
+
+func TestServeFile_HTMLIsDownloaded(t *testing.T) {
+	router, localStorage := SetupFileTestRouter(t)
+	object, err := localStorage.UploadFile(context.Background(), strings.NewReader("<html><script>alert(1)</script></html>"), "page.html")
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodGet, signedPath(t, localStorage, object.Key, time.Minute), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "text/html", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "attachment", resp.Header().Get("Content-Disposition"))
+	assert.Equal(t, "sandbox", resp.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "nosniff", resp.Header().Get("X-Content-Type-Options"))
+}
+
+func TestServeFile_InvalidSignature(t *testing.T) {
+	router, localStorage := SetupFileTestRouter(t)
+	object, err := localStorage.UploadFile(context.Background(), strings.NewReader("file content"), "notes.txt")
+	require.NoError(t, err)
+
+	path := signedPath(t, localStorage, object.Key, time.Minute)
+	path = path[:len(path)-4] + "0000"
+	req, _ := http.NewRequest(http.MethodGet, path, nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestServeFile_Expired(t *testing.T) {
+	router, localStorage := SetupFileTestRouter(t)
+	object, err := localStorage.UploadFile(context.Background(), strings.NewReader("file content"), "notes.txt")
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodGet, signedPath(t, localStorage, object.Key, -time.Minute), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestServeFile_Unsigned(t *testing.T) {
+	router, localStorage := SetupFileTestRouter(t)
+	object, err := localStorage.UploadFile(context.Background(), strings.NewReader("file content"), "notes.txt")
+	require.NoError(t, err)
+
+	parsed, _ := url.Parse(object.URL)
+	req, _ := http.NewRequest(http.MethodGet, parsed.Path, nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
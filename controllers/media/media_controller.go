@@ -1,42 +1,134 @@
 package media
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 
+	"media-indexer/models"
+	mediaRepo "media-indexer/repositories/media"
+	"media-indexer/services/ingest"
+	"media-indexer/services/link"
 	"media-indexer/services/media"
+	"media-indexer/services/quota"
+	"media-indexer/services/staging"
 	"media-indexer/storage"
 )
 
 type MediaController struct {
-	MediaService media.MediaService
-	Storage      storage.StorageProvider
+	MediaService   media.MediaService
+	Storage        storage.StorageProvider
+	LinkService    link.LinkService
+	QuotaService   quota.QuotaService
+	IngestService  ingest.IngestService
+	StagingService staging.StagingService
 }
 
-func NewMediaController(mediaService media.MediaService) *MediaController {
-	storageProvider := storage.StorageFactory()
-
-	return &MediaController{MediaService: mediaService, Storage: storageProvider}
+func NewMediaController(mediaService media.MediaService, storageProvider storage.StorageProvider, linkService link.LinkService, quotaService quota.QuotaService, ingestService ingest.IngestService, stagingService staging.StagingService) *MediaController {
+	return &MediaController{MediaService: mediaService, Storage: storageProvider, LinkService: linkService, QuotaService: quotaService, IngestService: ingestService, StagingService: stagingService}
 }
 
 type MediaResponse struct {
-	ID   uuid.UUID `json:"id"`
-	Name string    `json:"name"`
-	Link string    `json:"link"`
-	Tags []string  `json:"tags"`
+	ID               uuid.UUID     `json:"id"`
+	Name             string        `json:"name"`
+	Link             string        `json:"link"`
+	ContentType      string        `json:"contentType"`
+	Size             int64         `json:"size"`
+	OriginalFilename string        `json:"originalFilename"`
+	SourceURL        string        `json:"sourceUrl,omitempty"`
+	External         bool          `json:"external,omitempty"`
+	Width            int           `json:"width,omitempty"`
+	Height           int           `json:"height,omitempty"`
+	AspectRatio      float64       `json:"aspectRatio,omitempty"`
+	Orientation      string        `json:"orientation,omitempty"`
+	Exif             *ExifResponse `json:"exif,omitempty"`
+	Tags             []string      `json:"tags"`
+	// Thumbnails lists the renditions generated for images, if any.
+	Thumbnails []ThumbnailResponse `json:"thumbnails,omitempty"`
+}
+
+// ThumbnailResponse is a scaled-down copy of an image: Size is the name of
+// its configured size, the one GET /media/{id}/thumbnail takes.
+type ThumbnailResponse struct {
+	Size   string `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// ExifResponse is the EXIF metadata of an image; fields it does not record
+// are left out. CapturedAt only carries a UTC offset if the camera recorded
+// one, e.g. "2024-05-01T18:30:15+02:00" or "2024-05-01T18:30:15".
+type ExifResponse struct {
+	Make      string `json:"make,omitempty"`
+	Model     string `json:"model,omitempty"`
+	LensModel string `json:"lensModel,omitempty"`
+	// ExposureTime is in seconds, FocalLength in millimetres.
+	ExposureTime *float64          `json:"exposureTime,omitempty"`
+	FNumber      *float64          `json:"fNumber,omitempty"`
+	ISO          *int              `json:"iso,omitempty"`
+	FocalLength  *float64          `json:"focalLength,omitempty"`
+	Orientation  int               `json:"orientation,omitempty"`
+	CapturedAt   string            `json:"capturedAt,omitempty"`
+	Location     *LocationResponse `json:"location,omitempty"`
+}
+
+// LocationResponse is where an image was taken: decimal degrees and, if
+// recorded, metres above sea level.
+type LocationResponse struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// CreateMediaFromURLRequest is the JSON variant of the create media form. It
+// either fetches the file from SourceURL instead of receiving it, or creates
+// external media that only link to ExternalURL and store nothing.
+type CreateMediaFromURLRequest struct {
+	Name        string   `json:"name"`
+	Tags        []string `json:"tags"`
+	SourceURL   string   `json:"sourceUrl,omitempty"`
+	ExternalURL string   `json:"externalUrl,omitempty"`
 }
 
 type SearchMediaResponse struct {
-	ID      uuid.UUID `json:"id"`
-	Name    string    `json:"name"`
-	Tags    []string  `json:"tags"`
-	FileURL string    `json:"fileUrl"`
+	ID               uuid.UUID `json:"id"`
+	Name             string    `json:"name"`
+	Tags             []string  `json:"tags"`
+	FileURL          string    `json:"fileUrl"`
+	ContentType      string    `json:"contentType"`
+	Size             int64     `json:"size"`
+	OriginalFilename string    `json:"originalFilename"`
+	SourceURL        string    `json:"sourceUrl,omitempty"`
+	External         bool      `json:"external,omitempty"`
+	Width            int       `json:"width,omitempty"`
+	Height           int       `json:"height,omitempty"`
+	AspectRatio      float64   `json:"aspectRatio,omitempty"`
+	Orientation      string    `json:"orientation,omitempty"`
+	// LinkStatus, LinkCheckedAt and LinkBroken report the last check of
+	// the link of external media.
+	LinkStatus    int           `json:"linkStatus,omitempty"`
+	LinkCheckedAt *time.Time    `json:"linkCheckedAt,omitempty"`
+	LinkBroken    bool          `json:"linkBroken,omitempty"`
+	Exif          *ExifResponse `json:"exif,omitempty"`
+	// Thumbnails lists the renditions generated for images, if any.
+	Thumbnails []ThumbnailResponse `json:"thumbnails,omitempty"`
 }
 
 type PaginatedMediaResponse struct {
@@ -47,40 +139,124 @@ type PaginatedMediaResponse struct {
 	TotalPages int                   `json:"totalPages"`
 }
 
+// SimilarMediaResponse is media found similar to another, Distance bits of
+// their perceptual hashes apart.
+type SimilarMediaResponse struct {
+	SearchMediaResponse
+	Distance int `json:"distance"`
+}
+
+type PaginatedSimilarMediaResponse struct {
+	Media      []SimilarMediaResponse `json:"media"`
+	Page       int                    `json:"page"`
+	PageSize   int                    `json:"pageSize"`
+	TotalItems int64                  `json:"totalItems"`
+	TotalPages int                    `json:"totalPages"`
+}
+
 // CreateMedia godoc
 // @Summary Create media
-// @Description Create a new media item with associated tags
+// @Description Create a new media item with associated tags. The file is streamed to a staging area as it arrives, so it should be the last part of the form, and only moved to storage once the media and its tags have been committed. Instead of a form, a JSON body with a sourceUrl makes the server fetch the file from an allowed host, and one with an externalUrl creates external media that only link to content hosted elsewhere. Uploads are limited in size by content type and charged to the quota of the API key
 // @Tags media
-// @Accept multipart/form-data
+// @Accept multipart/form-data,json
 // @Produce json
-// @Param name formData string true "Name of the media"
-// @Param tags formData array true "Tags associated with the media"
-// @Param file formData file true "File to upload"
+// @Param X-API-Key header string false "API key the upload is charged to, required when API keys are configured"
+// @Param name formData string false "Name of the media"
+// @Param tags formData array false "Tags associated with the media"
+// @Param file formData file false "File to upload"
+// @Param media body CreateMediaFromURLRequest false "Media to fetch from or link to a URL, sent as JSON instead of a form"
 // @Success 201 {object} MediaResponse "Created media"
 // @Failure 400 {object} gin.H "Bad Request"
+// @Failure 401 {object} gin.H "Invalid API key"
+// @Failure 403 {object} gin.H "Source host or address not allowed"
 // @Failure 409 {object} gin.H "Conflict"
+// @Failure 413 {object} gin.H "File too large for its content type"
+// @Failure 502 {object} gin.H "Source could not be fetched"
+// @Failure 503 {object} gin.H "Storage unavailable"
+// @Failure 504 {object} gin.H "Fetching the source timed out"
+// @Failure 507 {object} gin.H "Storage quota exceeded"
 // @Router /media [post]
 func (mc *MediaController) CreateMedia(c *gin.Context) {
-	var input struct {
-		Name string                `form:"name" binding:"required"`
-		Tags []string              `form:"tags" binding:"required"`
-		File *multipart.FileHeader `form:"file" binding:"required"`
+	owner, err := mc.QuotaService.Owner(c.GetHeader("X-API-Key"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		return
 	}
-	if err := c.ShouldBind(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	var reader *multipart.Reader
+	var request *CreateMediaFromURLRequest
+	if c.ContentType() == "application/json" {
+		if request, err = decodeURLRequest(c.Request.Body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if request.ExternalURL != "" {
+			mc.createExternalMedia(c, owner, request)
+			return
+		}
+	} else if reader, err = c.Request.MultipartReader(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request must be multipart/form-data or JSON"})
 		return
 	}
 
-	fileName := filepath.Base(input.File.Filename)
-	fileURL, err := mc.Storage.UploadFile(input.File, fileName)
+	charge, err := mc.QuotaService.Begin(owner)
+	if errors.Is(err, quota.ErrQuotaExceeded) {
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Storage quota exceeded"})
+		return
+	}
 	if err != nil {
-		log.Printf("failed to upload file to storage: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to upload file to storage"})
+		log.Printf("failed to check the storage quota of %q: %v", owner, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create media"})
+		return
+	}
+	defer charge.Done()
+
+	ctx := c.Request.Context()
+	var form *createMediaForm
+	if request != nil {
+		form, err = mc.fetchForm(ctx, request, charge)
+	} else {
+		form, err = mc.receiveForm(reader, charge)
+	}
+	switch {
+	case errors.Is(err, errInvalidForm), errors.Is(err, ingest.ErrInvalidURL):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, ingest.ErrHostNotAllowed), errors.Is(err, ingest.ErrAddressNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, ingest.ErrSourceTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, ingest.ErrSourceTimeout):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, ingest.ErrSourceUnreachable), errors.Is(err, ingest.ErrTooManyRedirects):
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, quota.ErrFileTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, quota.ErrQuotaExceeded):
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Storage quota exceeded"})
+		return
+	case err != nil:
+		log.Printf("failed to receive file: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to receive file"})
 		return
 	}
 
-	media, tags, err := mc.MediaService.CreateMedia(input.Name, fileURL, input.Tags)
+	media, tags, err := mc.StagingService.Commit(ctx, form.Staged, &models.Media{
+		Name:      form.Name,
+		SourceURL: form.SourceURL,
+		Owner:     owner,
+	}, form.Tags)
+	if errors.Is(err, storage.ErrUnavailable) {
+		log.Printf("failed to upload file to storage: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage is unavailable, try again later"})
+		return
+	}
 	if err != nil {
+		log.Printf("failed to create media: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create media"})
 		return
 	}
@@ -90,14 +266,203 @@ func (mc *MediaController) CreateMedia(c *gin.Context) {
 		tagNames[i] = tag.Name
 	}
 
+	link, err := mc.LinkService.Resolve(ctx, media)
+	if err != nil {
+		log.Printf("failed to resolve link of media %s: %v", media.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create media"})
+		return
+	}
+	thumbnails, err := mc.thumbnailResponses(ctx, media)
+	if err != nil {
+		log.Printf("failed to resolve thumbnail links of media %s: %v", media.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create media"})
+		return
+	}
+
 	c.JSON(http.StatusCreated, MediaResponse{
-		ID:   media.ID,
-		Name: media.Name,
-		Link: media.Link,
-		Tags: tagNames,
+		ID:               media.ID,
+		Name:             media.Name,
+		Link:             link,
+		ContentType:      media.ContentType,
+		Size:             media.Size,
+		OriginalFilename: media.OriginalFilename,
+		SourceURL:        media.SourceURL,
+		Width:            media.Width,
+		Height:           media.Height,
+		AspectRatio:      media.AspectRatio,
+		Orientation:      string(media.Orientation),
+		Exif:             exifResponse(media.Exif),
+		Tags:             tagNames,
+		Thumbnails:       thumbnails,
 	})
 }
 
+// maxFieldSize limits the form values sent along with the file.
+const maxFieldSize = 64 << 10
+
+var errInvalidForm = errors.New("invalid form")
+
+type createMediaForm struct {
+	Name      string
+	Tags      []string
+	FileName  string
+	SourceURL string
+	Staged    *staging.StagedFile
+}
+
+// receiveForm reads the parts of a create media form in the order they
+// arrive. The file is streamed to the staging area without being buffered,
+// checked against the size limit of its sniffed content type and charged to
+// the quota as it goes. If the form turns out to be invalid afterwards, the
+// staged file is discarded again.
+func (mc *MediaController) receiveForm(reader *multipart.Reader, charge *quota.Charge) (_ *createMediaForm, err error) {
+	form := &createMediaForm{}
+	defer func() {
+		if err != nil && form.Staged != nil {
+			mc.StagingService.Discard(form.Staged)
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidForm, err)
+		}
+
+		switch part.FormName() {
+		case "name":
+			form.Name, err = readField(part)
+		case "tags":
+			var tag string
+			tag, err = readField(part)
+			form.Tags = append(form.Tags, tag)
+		case "file":
+			if form.Staged != nil {
+				err = fmt.Errorf("%w: only one file may be uploaded", errInvalidForm)
+				break
+			}
+			form.FileName = filepath.Base(part.FileName())
+			form.Staged, err = mc.stageFile(part, form.FileName, charge)
+		}
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case form.Name == "":
+		return nil, fmt.Errorf("%w: name is required", errInvalidForm)
+	case len(form.Tags) == 0:
+		return nil, fmt.Errorf("%w: tags are required", errInvalidForm)
+	case form.Staged == nil:
+		return nil, fmt.Errorf("%w: file is required", errInvalidForm)
+	}
+	return form, nil
+}
+
+// fetchForm reads a CreateMediaFromURLRequest and stores the file fetched
+// from its source URL, with the same limits as an uploaded one.
+func (mc *MediaController) fetchForm(ctx context.Context, request *CreateMediaFromURLRequest, charge *quota.Charge) (*createMediaForm, error) {
+	download, err := mc.IngestService.Fetch(ctx, request.SourceURL)
+	if err != nil {
+		return nil, err
+	}
+	defer download.Body.Close()
+
+	staged, err := mc.stageFile(download.Body, download.FileName, charge)
+	if err != nil {
+		return nil, err
+	}
+	return &createMediaForm{
+		Name:      request.Name,
+		Tags:      request.Tags,
+		FileName:  download.FileName,
+		SourceURL: request.SourceURL,
+		Staged:    staged,
+	}, nil
+}
+
+func decodeURLRequest(body io.Reader) (*CreateMediaFromURLRequest, error) {
+	var request CreateMediaFromURLRequest
+	if err := json.NewDecoder(io.LimitReader(body, maxFieldSize)).Decode(&request); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidForm, err)
+	}
+	switch {
+	case request.Name == "":
+		return nil, fmt.Errorf("%w: name is required", errInvalidForm)
+	case len(request.Tags) == 0:
+		return nil, fmt.Errorf("%w: tags are required", errInvalidForm)
+	case request.SourceURL == "" && request.ExternalURL == "":
+		return nil, fmt.Errorf("%w: sourceUrl or externalUrl is required", errInvalidForm)
+	case request.SourceURL != "" && request.ExternalURL != "":
+		return nil, fmt.Errorf("%w: only one of sourceUrl and externalUrl may be given", errInvalidForm)
+	}
+	return &request, nil
+}
+
+// createExternalMedia creates media that only link to content hosted
+// elsewhere. Nothing is stored, so nothing is charged to the quota.
+func (mc *MediaController) createExternalMedia(c *gin.Context, owner string, request *CreateMediaFromURLRequest) {
+	u, err := url.Parse(request.ExternalURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "externalUrl must be an http or https URL"})
+		return
+	}
+
+	media, tags, err := mc.MediaService.CreateMedia(&models.Media{
+		Name:        request.Name,
+		External:    true,
+		ExternalURL: u.String(),
+		Owner:       owner,
+	}, request.Tags)
+	if err != nil {
+		log.Printf("failed to create external media: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create media"})
+		return
+	}
+
+	tagNames := make([]string, len(tags))
+	for i, tag := range tags {
+		tagNames[i] = tag.Name
+	}
+	c.JSON(http.StatusCreated, MediaResponse{
+		ID:       media.ID,
+		Name:     media.Name,
+		Link:     media.ExternalURL,
+		External: true,
+		Tags:     tagNames,
+	})
+}
+
+func (mc *MediaController) stageFile(file io.Reader, fileName string, charge *quota.Charge) (*staging.StagedFile, error) {
+	contentType, file, err := storage.SniffContentType(file)
+	if err != nil {
+		return nil, err
+	}
+	maxSize := mc.QuotaService.MaxSize(contentType)
+
+	staged, err := mc.StagingService.Stage(quota.NewMeter(file, maxSize, charge), fileName)
+	if errors.Is(err, quota.ErrFileTooLarge) {
+		return nil, fmt.Errorf("%w: %s files may not exceed %d bytes", quota.ErrFileTooLarge, contentType, maxSize)
+	}
+	return staged, err
+}
+
+func readField(part *multipart.Part) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, maxFieldSize+1))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidForm, err)
+	}
+	if len(value) > maxFieldSize {
+		return "", fmt.Errorf("%w: %s exceeds %d bytes", errInvalidForm, part.FormName(), maxFieldSize)
+	}
+	return string(value), nil
+}
+
 // SearchMediaByTag godoc
 // @Summary Search media by tag
 // @Description Search for media items by tag name
@@ -107,6 +472,19 @@ func (mc *MediaController) CreateMedia(c *gin.Context) {
 // @Param tag query array true "Tag name(s) to search for"
 // @Param page query int false "Page number"
 // @Param pageSize query int false "Number of media items per page"
+// @Param broken query bool false "Only return external media whose link check failed when true, leave them out when false"
+// @Param cameraMake query string false "Camera make recorded in the EXIF metadata, ignoring case"
+// @Param cameraModel query string false "Camera model recorded in the EXIF metadata, ignoring case"
+// @Param lensModel query string false "Lens model recorded in the EXIF metadata, ignoring case"
+// @Param minIso query int false "Minimum ISO speed"
+// @Param maxIso query int false "Maximum ISO speed"
+// @Param capturedAfter query string false "Only images taken at or after this RFC 3339 time"
+// @Param capturedBefore query string false "Only images taken at or before this RFC 3339 time"
+// @Param hasLocation query bool false "Only images with GPS coordinates when true, only those without when false"
+// @Param bbox query string false "Only images taken inside minLongitude,minLatitude,maxLongitude,maxLatitude"
+// @Param minWidth query int false "Minimum displayed width of images in pixels"
+// @Param minHeight query int false "Minimum displayed height of images in pixels"
+// @Param orientation query string false "Only images of this orientation" Enums(landscape, portrait, square)
 // @Success 200 {object} PaginatedMediaResponse "Search results"
 // @Failure 400 {object} gin.H "Bad Request"
 // @Router /media [get]
@@ -124,7 +502,13 @@ func (mc *MediaController) SearchMediaByTag(c *gin.Context) {
 		return
 	}
 
-	media, totalItems, err := mc.MediaService.SearchMediaByTags(tagNames, page, pageSize)
+	filter, err := parseSearchFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	media, totalItems, err := mc.MediaService.SearchMediaByTags(tagNames, filter, page, pageSize)
 	if err != nil {
 		log.Printf("Error searching media by tags: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search media"})
@@ -135,16 +519,13 @@ func (mc *MediaController) SearchMediaByTag(c *gin.Context) {
 
 	var mediaResponses []SearchMediaResponse
 	for _, m := range media {
-		var tags []string
-		for _, tag := range m.Tags {
-			tags = append(tags, tag.Name)
+		response, err := mc.searchMediaResponse(c.Request.Context(), &m)
+		if err != nil {
+			log.Printf("failed to resolve links of media %s: %v", m.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search media"})
+			return
 		}
-		mediaResponses = append(mediaResponses, SearchMediaResponse{
-			ID:      m.ID,
-			Name:    m.Name,
-			Tags:    tags,
-			FileURL: m.Link,
-		})
+		mediaResponses = append(mediaResponses, response)
 	}
 
 	c.JSON(http.StatusOK, PaginatedMediaResponse{
@@ -155,3 +536,450 @@ func (mc *MediaController) SearchMediaByTag(c *gin.Context) {
 		TotalPages: totalPages,
 	})
 }
+
+// searchMediaResponse describes media found by a search, with links to its
+// file and thumbnails.
+func (mc *MediaController) searchMediaResponse(ctx context.Context, m *models.Media) (SearchMediaResponse, error) {
+	var tags []string
+	for _, tag := range m.Tags {
+		tags = append(tags, tag.Name)
+	}
+	fileURL, err := mc.LinkService.Resolve(ctx, m)
+	if err != nil {
+		return SearchMediaResponse{}, err
+	}
+	thumbnails, err := mc.thumbnailResponses(ctx, m)
+	if err != nil {
+		return SearchMediaResponse{}, fmt.Errorf("resolve thumbnails: %w", err)
+	}
+	return SearchMediaResponse{
+		ID:               m.ID,
+		Name:             m.Name,
+		Tags:             tags,
+		FileURL:          fileURL,
+		ContentType:      m.ContentType,
+		Size:             m.Size,
+		OriginalFilename: m.OriginalFilename,
+		SourceURL:        m.SourceURL,
+		External:         m.External,
+		Width:            m.Width,
+		Height:           m.Height,
+		AspectRatio:      m.AspectRatio,
+		Orientation:      string(m.Orientation),
+		LinkStatus:       m.LinkStatus,
+		LinkCheckedAt:    m.LinkCheckedAt,
+		LinkBroken:       m.LinkBroken(),
+		Exif:             exifResponse(m.Exif),
+		Thumbnails:       thumbnails,
+	}, nil
+}
+
+// Similar media are looked up by their perceptual hash chunks within a
+// quarter of the distance asked for. Up to 15 bits that is 697 chunks each,
+// beyond it thousands, so larger distances are refused.
+const (
+	defaultSimilarDistance = 10
+	maxSimilarDistance     = 15
+)
+
+// GetSimilarMedia godoc
+// @Summary Find similar media
+// @Description Find the images that look like an image: near-duplicates with a different size, compression or a slightly different crop. Images are compared by the Hamming distance between their perceptual hashes, out of 64 bits; mirrored or rotated copies are not found
+// @Tags media
+// @Produce json
+// @Param id path string true "Media ID"
+// @Param maxDistance query int false "Maximum number of bits the perceptual hashes may differ in, from 0 to 15" default(10)
+// @Param page query int false "Page number"
+// @Param pageSize query int false "Number of media items per page"
+// @Success 200 {object} PaginatedSimilarMediaResponse "Similar media, closest first"
+// @Failure 400 {object} gin.H "Bad Request"
+// @Failure 404 {object} gin.H "Not Found"
+// @Failure 422 {object} gin.H "Media is not an image that could be decoded"
+// @Router /media/{id}/similar [get]
+func (mc *MediaController) GetSimilarMedia(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid media id"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "10"))
+	if page <= 0 || pageSize <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page number or page size"})
+		return
+	}
+	maxDistance, err := strconv.Atoi(c.DefaultQuery("maxDistance", strconv.Itoa(defaultSimilarDistance)))
+	if err != nil || maxDistance < 0 || maxDistance > maxSimilarDistance {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("maxDistance must be a number from 0 to %d", maxSimilarDistance)})
+		return
+	}
+
+	similar, totalItems, err := mc.MediaService.FindSimilarMedia(id, maxDistance, page, pageSize)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+		return
+	}
+	if errors.Is(err, media.ErrNoPerceptualHash) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Media is not an image that could be decoded"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error finding media similar to %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find similar media"})
+		return
+	}
+
+	mediaResponses := []SimilarMediaResponse{}
+	for _, s := range similar {
+		response, err := mc.searchMediaResponse(c.Request.Context(), &s.Media)
+		if err != nil {
+			log.Printf("failed to resolve links of media %s: %v", s.Media.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find similar media"})
+			return
+		}
+		mediaResponses = append(mediaResponses, SimilarMediaResponse{SearchMediaResponse: response, Distance: s.Distance})
+	}
+
+	c.JSON(http.StatusOK, PaginatedSimilarMediaResponse{
+		Media:      mediaResponses,
+		Page:       page,
+		PageSize:   pageSize,
+		TotalItems: totalItems,
+		TotalPages: int((totalItems + int64(pageSize) - 1) / int64(pageSize)),
+	})
+}
+
+// parseSearchFilter reads the filters of a search from its query.
+func parseSearchFilter(c *gin.Context) (mediaRepo.SearchFilter, error) {
+	filter := mediaRepo.SearchFilter{
+		CameraMake:  c.Query("cameraMake"),
+		CameraModel: c.Query("cameraModel"),
+		LensModel:   c.Query("lensModel"),
+	}
+
+	var err error
+	if filter.Broken, err = parseBoolQuery(c, "broken"); err != nil {
+		return filter, err
+	}
+	if filter.HasLocation, err = parseBoolQuery(c, "hasLocation"); err != nil {
+		return filter, err
+	}
+	for name, target := range map[string]**int{
+		"minIso": &filter.MinISO, "maxIso": &filter.MaxISO,
+		"minWidth": &filter.MinWidth, "minHeight": &filter.MinHeight,
+	} {
+		if value := c.Query(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return filter, fmt.Errorf("%s must be a non-negative number", name)
+			}
+			*target = &n
+		}
+	}
+	for name, target := range map[string]**time.Time{"capturedAfter": &filter.CapturedAfter, "capturedBefore": &filter.CapturedBefore} {
+		if value := c.Query(name); value != "" {
+			capturedAt, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			*target = &capturedAt
+		}
+	}
+	if value := c.Query("bbox"); value != "" {
+		if filter.Within, err = parseBoundingBox(value); err != nil {
+			return filter, err
+		}
+	}
+	switch orientation := models.Orientation(c.Query("orientation")); orientation {
+	case "", models.OrientationLandscape, models.OrientationPortrait, models.OrientationSquare:
+		filter.Orientation = orientation
+	default:
+		return filter, errors.New("orientation must be landscape, portrait or square")
+	}
+	return filter, nil
+}
+
+func parseBoolQuery(c *gin.Context, name string) (*bool, error) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be true or false", name)
+	}
+	return &parsed, nil
+}
+
+// parseBoundingBox parses "minLongitude,minLatitude,maxLongitude,maxLatitude",
+// the order GeoJSON uses.
+func parseBoundingBox(value string) (*mediaRepo.BoundingBox, error) {
+	errInvalid := errors.New("bbox must be minLongitude,minLatitude,maxLongitude,maxLatitude")
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, errInvalid
+	}
+	var coordinates [4]float64
+	for i, part := range parts {
+		coordinate, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, errInvalid
+		}
+		coordinates[i] = coordinate
+	}
+	box := &mediaRepo.BoundingBox{
+		MinLongitude: coordinates[0], MinLatitude: coordinates[1],
+		MaxLongitude: coordinates[2], MaxLatitude: coordinates[3],
+	}
+	if box.MinLatitude < -90 || box.MaxLatitude > 90 || box.MinLongitude < -180 || box.MaxLongitude > 180 ||
+		box.MinLatitude > box.MaxLatitude || box.MinLongitude > box.MaxLongitude {
+		return nil, errInvalid
+	}
+	return box, nil
+}
+
+// thumbnailResponses links to the renditions of media, smallest first.
+func (mc *MediaController) thumbnailResponses(ctx context.Context, media *models.Media) ([]ThumbnailResponse, error) {
+	var thumbnails []ThumbnailResponse
+	for i := range media.Renditions {
+		rendition := &media.Renditions[i]
+		link, err := mc.LinkService.ResolveRendition(ctx, media, rendition)
+		if err != nil {
+			return nil, err
+		}
+		thumbnails = append(thumbnails, ThumbnailResponse{Size: rendition.Name, Width: rendition.Width, Height: rendition.Height, URL: link})
+	}
+	sort.SliceStable(thumbnails, func(i, j int) bool {
+		return thumbnails[i].Width*thumbnails[i].Height < thumbnails[j].Width*thumbnails[j].Height
+	})
+	return thumbnails, nil
+}
+
+// exifResponse returns the EXIF metadata of media, or nil if there is none.
+func exifResponse(e models.Exif) *ExifResponse {
+	if e == (models.Exif{}) {
+		return nil
+	}
+	response := &ExifResponse{
+		Make:         e.Make,
+		Model:        e.Model,
+		LensModel:    e.LensModel,
+		ExposureTime: e.ExposureTime,
+		FNumber:      e.FNumber,
+		ISO:          e.ISO,
+		FocalLength:  e.FocalLength,
+		Orientation:  e.Orientation,
+	}
+	if e.CapturedAt != nil {
+		response.CapturedAt = e.CapturedAt.UTC().Format("2006-01-02T15:04:05")
+		if zone, err := time.Parse("-07:00", e.CaptureOffset); err == nil {
+			_, offset := zone.Zone()
+			response.CapturedAt = e.CapturedAt.In(time.FixedZone(e.CaptureOffset, offset)).Format(time.RFC3339)
+		}
+	}
+	if e.Latitude != nil && e.Longitude != nil {
+		response.Location = &LocationResponse{Latitude: *e.Latitude, Longitude: *e.Longitude, Altitude: e.Altitude}
+	}
+	return response
+}
+
+// DeleteMedia godoc
+// @Summary Delete media
+// @Description Delete a media item and release its stored file, if it has one, and its thumbnails
+// @Tags media
+// @Param id path string true "Media ID"
+// @Success 204 "Deleted"
+// @Failure 400 {object} gin.H "Bad Request"
+// @Failure 404 {object} gin.H "Not Found"
+// @Router /media/{id} [delete]
+func (mc *MediaController) DeleteMedia(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid media id"})
+		return
+	}
+
+	media, err := mc.MediaService.DeleteMedia(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting media %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete media"})
+		return
+	}
+
+	if !media.External {
+		instance := storage.InstanceNamed(mc.Storage, media.StorageProvider)
+		if err := instance.Release(c.Request.Context(), media.StorageKey); err != nil {
+			log.Printf("failed to release stored file of media %s: %v", id, err)
+		}
+	}
+	for _, rendition := range media.Renditions {
+		instance := storage.InstanceNamed(mc.Storage, rendition.StorageProvider)
+		if err := instance.Release(c.Request.Context(), rendition.StorageKey); err != nil {
+			log.Printf("failed to release thumbnail %s of media %s: %v", rendition.Name, id, err)
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetMediaContent godoc
+// @Summary Download media content
+// @Description Stream the stored file of a media item. Supports Range requests and conditional GETs via ETag and Last-Modified. External media redirect to their URL
+// @Tags media
+// @Produce octet-stream
+// @Param id path string true "Media ID"
+// @Param Range header string false "Byte range to return, e.g. bytes=0-1023"
+// @Param If-None-Match header string false "ETag of a cached copy"
+// @Success 200 {file} file "Media content"
+// @Success 206 {file} file "Partial media content"
+// @Success 302 "Redirect to the URL of external media"
+// @Success 304 "Not Modified"
+// @Failure 400 {object} gin.H "Bad Request"
+// @Failure 404 {object} gin.H "Not Found"
+// @Failure 416 "Requested Range Not Satisfiable"
+// @Failure 503 {object} gin.H "Storage unavailable"
+// @Router /media/{id}/content [get]
+func (mc *MediaController) GetMediaContent(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid media id"})
+		return
+	}
+
+	media, err := mc.MediaService.GetMedia(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching media %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch media"})
+		return
+	}
+
+	if media.External {
+		c.Redirect(http.StatusFound, media.ExternalURL)
+		return
+	}
+
+	key := media.StorageKey
+	reader, ok := mc.open(c, media.StorageProvider, key, "Media content not found", "failed to open stored file of media "+id.String())
+	if !ok {
+		return
+	}
+	defer reader.Close()
+
+	filename := media.OriginalFilename
+	if filename == "" {
+		filename = key
+	}
+	serveContent(c, reader, media.ContentType, filename, media.ContentHash, media.CreatedAt)
+}
+
+// GetMediaThumbnail godoc
+// @Summary Download a media thumbnail
+// @Description Stream a thumbnail generated for an image, in one of the configured sizes. Supports Range requests and conditional GETs via ETag and Last-Modified
+// @Tags media
+// @Produce image/jpeg
+// @Produce image/png
+// @Param id path string true "Media ID"
+// @Param size query string true "Thumbnail size, e.g. small"
+// @Success 200 {file} file "Thumbnail"
+// @Success 304 "Not Modified"
+// @Failure 400 {object} gin.H "Bad Request"
+// @Failure 404 {object} gin.H "Not Found"
+// @Failure 503 {object} gin.H "Storage unavailable"
+// @Router /media/{id}/thumbnail [get]
+func (mc *MediaController) GetMediaThumbnail(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid media id"})
+		return
+	}
+	size := c.Query("size")
+	if size == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Thumbnail size is required"})
+		return
+	}
+
+	media, err := mc.MediaService.GetMedia(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching media %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch media"})
+		return
+	}
+	rendition := media.Rendition(size)
+	if rendition == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Thumbnail not found"})
+		return
+	}
+
+	reader, ok := mc.open(c, rendition.StorageProvider, rendition.StorageKey, "Thumbnail not found", "failed to open thumbnail "+size+" of media "+id.String())
+	if !ok {
+		return
+	}
+	defer reader.Close()
+
+	// The thumbnail of "photo.heic" in size small is "photo-small.jpg".
+	name := media.OriginalFilename
+	if name == "" {
+		name = media.ID.String()
+	}
+	filename := strings.TrimSuffix(name, filepath.Ext(name)) + "-" + size + filepath.Ext(rendition.StorageKey)
+	serveContent(c, reader, rendition.ContentType, filename, rendition.ContentHash, rendition.CreatedAt)
+}
+
+// open opens the blob under key, answering the request with an error and
+// returning false if that fails.
+func (mc *MediaController) open(c *gin.Context, provider string, key string, notFound string, description string) (storage.ObjectReader, bool) {
+	reader, err := storage.InstanceNamed(mc.Storage, provider).Open(c.Request.Context(), key)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+		return nil, false
+	}
+	if errors.Is(err, storage.ErrUnavailable) {
+		log.Printf("%s: %v", description, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage is unavailable, try again later"})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("%s: %v", description, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read media content"})
+		return nil, false
+	}
+	return reader, true
+}
+
+// serveContent streams a blob, letting http.ServeContent handle Range,
+// If-Range, If-None-Match and If-Modified-Since. Blobs are content addressed,
+// so the content hash is a strong ETag. Only images, video and audio are
+// displayed inline; other uploads could carry scripts and are downloaded.
+func serveContent(c *gin.Context, reader io.ReadSeeker, contentType string, filename string, contentHash string, modTime time.Time) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	disposition := "inline"
+	if !storage.DisplayInline(contentType) {
+		disposition = "attachment"
+		header.Set("Content-Security-Policy", "sandbox")
+	}
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	if contentHash != "" {
+		header.Set("ETag", `"`+contentHash+`"`)
+	}
+
+	http.ServeContent(c.Writer, c.Request, filename, modTime, reader)
+}
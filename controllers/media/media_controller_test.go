@@ -2,56 +2,263 @@ package media
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
 
 	"media-indexer/models"
+	"media-indexer/phash"
+	mediaRepo "media-indexer/repositories/media"
+	"media-indexer/services/ingest"
+	"media-indexer/services/link"
 	"media-indexer/services/media"
+	"media-indexer/services/quota"
+	"media-indexer/services/staging"
+	"media-indexer/services/thumbnail"
 	"media-indexer/storage"
 )
 
-type MockMediaService struct{}
+var existingMediaID = uuid.MustParse("7d9e6a5c-2f41-4b8e-9c3d-1a2b3c4d5e6f")
 
-func (m *MockMediaService) CreateMedia(name string, filePath string, _tagNames []string) (*models.Media, []models.Tag, error) {
-	media := &models.Media{Name: name, Link: filePath}
+type MockMediaService struct {
+	// Created holds the media created and not deleted since.
+	Created map[uuid.UUID]*models.Media
+	// Filter is the filter of the last search.
+	Filter mediaRepo.SearchFilter
+	// MaxDistance is the distance of the last lookup of similar media.
+	MaxDistance int
+}
+
+func (m *MockMediaService) CreateMedia(media *models.Media, _tagNames []string) (*models.Media, []models.Tag, error) {
+	if m.Created == nil {
+		m.Created = make(map[uuid.UUID]*models.Media)
+	}
+	m.Created[media.ID] = media
 	tags := []models.Tag{{Name: "tag1"}, {Name: "tag2"}}
 	return media, tags, nil
 }
 
-func (m *MockMediaService) SearchMediaByTags(_tagNames []string, page int, pageSize int) ([]models.Media, int64, error) {
+func (m *MockMediaService) GetMedia(id uuid.UUID) (*models.Media, error) {
+	if media, ok := m.Created[id]; ok {
+		return media, nil
+	}
+	if id != existingMediaID {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &models.Media{
+		Model:            gorm.Model{CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+		ID:               id,
+		Name:             "Arsenal",
+		StorageKey:       "media_1.jpg",
+		ContentHash:      "abc123",
+		ContentType:      "video/mp4",
+		OriginalFilename: "penalty.mp4",
+	}, nil
+}
+
+func (m *MockMediaService) DeleteMedia(id uuid.UUID) (*models.Media, error) {
+	if media, ok := m.Created[id]; ok {
+		delete(m.Created, id)
+		return media, nil
+	}
+	return m.GetMedia(id)
+}
+
+func (m *MockMediaService) SearchMediaByTags(_tagNames []string, filter mediaRepo.SearchFilter, page int, pageSize int) ([]models.Media, int64, error) {
+	m.Filter = filter
+	iso, latitude, longitude := 800, 51.555, -0.108
+	capturedAt := time.Date(2024, 5, 1, 17, 30, 15, 0, time.UTC)
 	media := []models.Media{
-		{Name: "Arsenal", Link: "https://s3.amazonaws.com/bucket/media_1.jpg", Tags: []models.Tag{{Name: "arsenal-mu"}, {Name: "penalty"}}},
-		{Name: "MU", Link: "https://s3.amazonaws.com/bucket/media_2.jpg", Tags: []models.Tag{{Name: "arsenal-mu"}, {Name: "goal"}}},
+		{Name: "Arsenal", StorageKey: "media_1.jpg", Tags: []models.Tag{{Name: "arsenal-mu"}, {Name: "penalty"}}, Exif: models.Exif{
+			Make: "Canon", Model: "Canon EOS R5", ISO: &iso, CapturedAt: &capturedAt, CaptureOffset: "+01:00",
+			Latitude: &latitude, Longitude: &longitude,
+		}, Width: 1920, Height: 1080, AspectRatio: 1920.0 / 1080, Orientation: models.OrientationLandscape, Renditions: []models.Rendition{
+			{Name: "large", Width: 1280, Height: 720, StorageKey: "thumb_large.jpg"},
+			{Name: "small", Width: 160, Height: 90, StorageKey: "thumb_small.jpg"},
+		}},
+		{Name: "MU", StorageKey: "media_2.jpg", Tags: []models.Tag{{Name: "arsenal-mu"}, {Name: "goal"}}},
 	}
 	totalItems := int64(len(media))
 	return media, totalItems, nil
 }
 
-func (m *MockMediaService) FetchOrCreateTagsAndAssociate(mediaID uuid.UUID, tagNames []string) ([]models.Tag, error) {
-	tags := []models.Tag{{Name: "tag1"}, {Name: "tag2"}}
-	return tags, nil
+// FindSimilarMedia compares the created media with that of id, like the
+// repository but without paging.
+func (m *MockMediaService) FindSimilarMedia(id uuid.UUID, maxDistance int, page int, pageSize int) ([]media.SimilarMedia, int64, error) {
+	m.MaxDistance = maxDistance
+	target, err := m.GetMedia(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if target.PerceptualHash == nil {
+		return nil, 0, media.ErrNoPerceptualHash
+	}
+	var similar []media.SimilarMedia
+	for _, created := range m.Created {
+		if created.ID == id || created.PerceptualHash == nil {
+			continue
+		}
+		distance := phash.Distance(uint64(target.PerceptualHash.Hash), uint64(created.PerceptualHash.Hash))
+		if distance <= maxDistance {
+			similar = append(similar, media.SimilarMedia{Media: *created, Distance: distance})
+		}
+	}
+	sort.Slice(similar, func(i, j int) bool { return similar[i].Distance < similar[j].Distance })
+	return similar, int64(len(similar)), nil
+}
+
+type MockStorageProvider struct {
+	Objects  map[string]string
+	Released []string
+	// Unsigned makes SignedURL fail like storage that cannot issue links.
+	Unsigned bool
+	// Err makes uploads and reads fail, like a backend that is down.
+	Err error
+}
+
+type nopCloseReader struct {
+	*strings.Reader
+}
+
+func (nopCloseReader) Close() error { return nil }
+
+func (m *MockStorageProvider) UploadFile(_ctx context.Context, file io.Reader, filename string) (*storage.Object, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	contentType, _ := storage.DetectContentType(content)
+	return &storage.Object{
+		Key:         filename,
+		URL:         "http://example.com/" + filename,
+		ContentHash: fmt.Sprintf("%x", sha256.Sum256(content)),
+		ContentType: contentType,
+		Size:        int64(len(content)),
+	}, nil
+}
+
+func (m *MockStorageProvider) Release(_ctx context.Context, key string) error {
+	m.Released = append(m.Released, key)
+	return nil
+}
+
+func (m *MockStorageProvider) Open(_ctx context.Context, key string) (storage.ObjectReader, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	content, ok := m.Objects[key]
+	if !ok {
+		return nil, storage.ErrObjectNotFound
+	}
+	return nopCloseReader{strings.NewReader(content)}, nil
+}
+
+func (m *MockStorageProvider) Stat(_ctx context.Context, key string) (*storage.ObjectInfo, error) {
+	return nil, storage.ErrObjectNotFound
+}
+
+func (m *MockStorageProvider) Delete(_ctx context.Context, key string) error {
+	return nil
+}
+
+func (m *MockStorageProvider) Exists(_ctx context.Context, key string) (bool, error) {
+	return false, nil
+}
+
+func (m *MockStorageProvider) SignedURL(_ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if m.Unsigned {
+		return "", storage.ErrSignedURLUnsupported
+	}
+	return fmt.Sprintf("https://signed.example.com/%s?expires=%d", key, int(expiry.Seconds())), nil
+}
+
+// MockMediaRepository reports how many bytes each owner already stores.
+type MockMediaRepository struct {
+	mediaRepo.MediaRepository
+	Used map[string]int64
+}
+
+func (m *MockMediaRepository) SumSizeByOwner(owner string) (int64, error) {
+	return m.Used[owner], nil
+}
+
+func (m *MockMediaRepository) SavePerceptualHash(hash *models.PerceptualHash) error {
+	return nil
+}
+
+func (m *MockMediaRepository) UpdateLocation(id uuid.UUID, provider string, key string, contentHash string) error {
+	return nil
+}
+
+// stagingDir is shared by the tests, which all leave it empty.
+var stagingDir string
+
+func newStagingService(mediaService media.MediaService, storageProvider storage.StorageProvider) staging.StagingService {
+	stagingService, err := staging.NewStagingService(stagingDir, mediaService, &MockMediaRepository{}, storageProvider, thumbnail.NewThumbnailService(&MockMediaRepository{}, storageProvider, thumbnail.Config{}))
+	if err != nil {
+		panic(err)
+	}
+	return stagingService
 }
 
-type MockStorageProvider struct{}
+func stagedFiles(t *testing.T) []os.DirEntry {
+	entries, err := os.ReadDir(stagingDir)
+	assert.NoError(t, err)
+	return entries
+}
 
-func (m *MockStorageProvider) UploadFile(fileHeader *multipart.FileHeader, filename string) (string, error) {
-	return "http://example.com/" + filename, nil
+// MockIngestService serves Sources by URL and fails with Err for others.
+type MockIngestService struct {
+	Sources map[string]string
+	Err     error
+}
+
+func (m *MockIngestService) Fetch(_ctx context.Context, rawURL string) (*ingest.Download, error) {
+	content, ok := m.Sources[rawURL]
+	if !ok {
+		return nil, m.Err
+	}
+	return &ingest.Download{Body: io.NopCloser(strings.NewReader(content)), URL: rawURL, FileName: "fetched.txt"}, nil
 }
 
 func SetupMediaTestRouter(mediaService media.MediaService, storageProvider storage.StorageProvider) *gin.Engine {
+	quotaService, _ := quota.NewQuotaService(&MockMediaRepository{}, quota.Config{})
+	return setupMediaTestRouterWithQuota(mediaService, storageProvider, quotaService)
+}
+
+func setupMediaTestRouterWithQuota(mediaService media.MediaService, storageProvider storage.StorageProvider, quotaService quota.QuotaService) *gin.Engine {
 	router := gin.Default()
-	mediaController := &MediaController{MediaService: mediaService, Storage: storageProvider}
+	linkService, _ := link.NewLinkService(storageProvider, link.Config{Default: link.Rule{Mode: link.ModeSign}, Expiry: time.Minute})
+	ingestService := &MockIngestService{
+		Sources: map[string]string{"https://cdn.example.com/notes.txt": "fetched content"},
+		Err:     fmt.Errorf("%w: cdn.example.com", ingest.ErrSourceUnreachable),
+	}
+	mediaController := NewMediaController(mediaService, storageProvider, linkService, quotaService, ingestService, newStagingService(mediaService, storageProvider))
 	router.POST("/media", mediaController.CreateMedia)
 	router.GET("/media", mediaController.SearchMediaByTag)
+	router.DELETE("/media/:id", mediaController.DeleteMedia)
+	router.GET("/media/:id/content", mediaController.GetMediaContent)
+	router.GET("/media/:id/thumbnail", mediaController.GetMediaThumbnail)
+	router.GET("/media/:id/similar", mediaController.GetSimilarMedia)
 	return router
 }
 
@@ -63,7 +270,14 @@ func SetupMockServices() (media.MediaService, storage.StorageProvider) {
 
 func TestMain(m *testing.M) {
 	gin.SetMode(gin.TestMode)
-	os.Exit(m.Run())
+	dir, err := os.MkdirTemp("", "staging-")
+	if err != nil {
+		panic(err)
+	}
+	stagingDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
 }
 
 func TestCreateMedia(t *testing.T) {
@@ -92,7 +306,10 @@ func TestCreateMedia(t *testing.T) {
 	json.Unmarshal(bodyBytes, &response)
 
 	assert.Equal(t, "test media", response.Name)
-	assert.Equal(t, "http://example.com/testfile.txt", response.Link)
+	assert.Equal(t, "https://signed.example.com/testfile.txt?expires=60", response.Link)
+	assert.Equal(t, "text/plain", response.ContentType)
+	assert.Equal(t, int64(len("file content")), response.Size)
+	assert.Equal(t, "testfile.txt", response.OriginalFilename)
 	assert.ElementsMatch(t, []string{"tag1", "tag2"}, response.Tags)
 }
 
@@ -149,6 +366,193 @@ func TestCreateMedia_NoTagsProvided(t *testing.T) {
 	assert.Contains(t, response, "error")
 }
 
+func createMediaRequest(fields map[string]string, content string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for name, value := range fields {
+		writer.WriteField(name, value)
+	}
+	part, _ := writer.CreateFormFile("file", "testfile.txt")
+	part.Write([]byte(content))
+	writer.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, "/media", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestCreateMedia_TooLargeForContentType(t *testing.T) {
+	storageProvider := &MockStorageProvider{}
+	quotaService, _ := quota.NewQuotaService(&MockMediaRepository{}, quota.Config{
+		MaxSize:  1 << 20,
+		MaxSizes: []quota.SizeLimit{{ContentType: "text/*", MaxSize: 8}},
+	})
+	router := setupMediaTestRouterWithQuota(&MockMediaService{}, storageProvider, quotaService)
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, createMediaRequest(map[string]string{"name": "notes", "tags": "tag1"}, "file content"))
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+	assert.Contains(t, resp.Body.String(), "text/plain files may not exceed 8 bytes")
+}
+
+func TestCreateMedia_StorageUnavailable(t *testing.T) {
+	mediaService := &MockMediaService{}
+	storageProvider := &MockStorageProvider{Err: fmt.Errorf("upload: %w", storage.ErrUnavailable)}
+	router := SetupMediaTestRouter(mediaService, storageProvider)
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, createMediaRequest(map[string]string{"name": "notes", "tags": "tag1"}, "file content"))
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Empty(t, mediaService.Created, "media whose file could not be stored is deleted again")
+	assert.Empty(t, stagedFiles(t))
+}
+
+func createMediaFromURLRequest(body string) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "/media", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestCreateMedia_FromSourceURL(t *testing.T) {
+	router := SetupMediaTestRouter(&MockMediaService{}, &MockStorageProvider{})
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, createMediaFromURLRequest(`{"name":"notes","tags":["tag1"],"sourceUrl":"https://cdn.example.com/notes.txt"}`))
+
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var response MediaResponse
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &response))
+	assert.Equal(t, "https://cdn.example.com/notes.txt", response.SourceURL)
+	assert.Equal(t, "fetched.txt", response.OriginalFilename)
+	assert.Equal(t, int64(len("fetched content")), response.Size)
+}
+
+func TestCreateMedia_FromSourceURLErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		body   string
+		err    error
+		status int
+	}{
+		{"invalid json", `{"name":`, nil, http.StatusBadRequest},
+		{"missing source", `{"name":"notes","tags":["tag1"]}`, nil, http.StatusBadRequest},
+		{"invalid url", "", ingest.ErrInvalidURL, http.StatusBadRequest},
+		{"host not allowed", "", ingest.ErrHostNotAllowed, http.StatusForbidden},
+		{"private address", "", ingest.ErrAddressNotAllowed, http.StatusForbidden},
+		{"too large", "", ingest.ErrSourceTooLarge, http.StatusRequestEntityTooLarge},
+		{"unreachable", "", ingest.ErrSourceUnreachable, http.StatusBadGateway},
+		{"too many redirects", "", ingest.ErrTooManyRedirects, http.StatusBadGateway},
+		{"timeout", "", ingest.ErrSourceTimeout, http.StatusGatewayTimeout},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			router := gin.New()
+			quotaService, _ := quota.NewQuotaService(&MockMediaRepository{}, quota.Config{})
+			mediaService, storageProvider := SetupMockServices()
+			mediaController := NewMediaController(mediaService, storageProvider, nil, quotaService, &MockIngestService{Err: tc.err}, newStagingService(mediaService, storageProvider))
+			router.POST("/media", mediaController.CreateMedia)
+
+			body := tc.body
+			if body == "" {
+				body = `{"name":"notes","tags":["tag1"],"sourceUrl":"http://10.0.0.1/notes.txt"}`
+			}
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, createMediaFromURLRequest(body))
+
+			assert.Equal(t, tc.status, resp.Code)
+		})
+	}
+}
+
+func TestCreateMedia_External(t *testing.T) {
+	mediaService := &MockMediaService{}
+	storageProvider := &MockStorageProvider{Err: storage.ErrUnavailable}
+	router := SetupMediaTestRouter(mediaService, storageProvider)
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, createMediaFromURLRequest(`{"name":"Highlights","tags":["goal"],"externalUrl":"https://www.youtube.com/watch?v=abc"}`))
+
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var response MediaResponse
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &response))
+	assert.True(t, response.External)
+	assert.Equal(t, "https://www.youtube.com/watch?v=abc", response.Link)
+	assert.Empty(t, stagedFiles(t))
+	for _, media := range mediaService.Created {
+		assert.True(t, media.External)
+		assert.Empty(t, media.StorageKey)
+	}
+}
+
+func TestCreateMedia_ExternalInvalid(t *testing.T) {
+	router := SetupMediaTestRouter(&MockMediaService{}, &MockStorageProvider{})
+
+	for _, body := range []string{
+		`{"name":"Highlights","tags":["goal"],"externalUrl":"ftp://example.com/video"}`,
+		`{"name":"Highlights","tags":["goal"],"externalUrl":"/relative"}`,
+		`{"name":"Highlights","tags":["goal"],"externalUrl":"https://example.com/a","sourceUrl":"https://cdn.example.com/notes.txt"}`,
+	} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, createMediaFromURLRequest(body))
+		assert.Equal(t, http.StatusBadRequest, resp.Code, body)
+	}
+}
+
+func TestGetMediaContent_ExternalRedirects(t *testing.T) {
+	id := uuid.New()
+	mediaService := &MockMediaService{Created: map[uuid.UUID]*models.Media{
+		id: {ID: id, External: true, ExternalURL: "https://cdn.partner.com/clip.mp4"},
+	}}
+	router := SetupMediaTestRouter(mediaService, &MockStorageProvider{})
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/media/"+id.String()+"/content", nil))
+
+	assert.Equal(t, http.StatusFound, resp.Code)
+	assert.Equal(t, "https://cdn.partner.com/clip.mp4", resp.Header().Get("Location"))
+}
+
+func TestCreateMedia_QuotaExceeded(t *testing.T) {
+	repo := &MockMediaRepository{Used: map[string]int64{"alice": 15}}
+	quotaService, _ := quota.NewQuotaService(repo, quota.Config{
+		Quota:   20,
+		APIKeys: map[string]quota.APIKey{"alice-key": {Owner: "alice"}, "bob-key": {Owner: "bob"}},
+	})
+	router := setupMediaTestRouterWithQuota(&MockMediaService{}, &MockStorageProvider{}, quotaService)
+	fields := map[string]string{"name": "notes", "tags": "tag1"}
+
+	req := createMediaRequest(fields, "file content")
+	req.Header.Set("X-API-Key", "alice-key")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusInsufficientStorage, resp.Code)
+
+	req = createMediaRequest(fields, "file content")
+	req.Header.Set("X-API-Key", "bob-key")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, createMediaRequest(fields, "file content"))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+func TestCreateMedia_DiscardsFileOfInvalidForm(t *testing.T) {
+	storageProvider := &MockStorageProvider{}
+	router := SetupMediaTestRouter(&MockMediaService{}, storageProvider)
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, createMediaRequest(map[string]string{"tags": "tag1"}, "file content"))
+
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), "name is required")
+	assert.Empty(t, stagedFiles(t))
+	assert.Empty(t, storageProvider.Released)
+}
+
 func TestSearchMediaByTag(t *testing.T) {
 	mediaService, storageProvider := SetupMockServices()
 	router := SetupMediaTestRouter(mediaService, storageProvider)
@@ -164,13 +568,40 @@ func TestSearchMediaByTag(t *testing.T) {
 
 	assert.Len(t, responseBody.Media, 2)
 	assert.Equal(t, "Arsenal", responseBody.Media[0].Name)
-	assert.Equal(t, "https://s3.amazonaws.com/bucket/media_1.jpg", responseBody.Media[0].FileURL)
+	assert.Equal(t, "https://signed.example.com/media_1.jpg?expires=60", responseBody.Media[0].FileURL)
 	assert.ElementsMatch(t, []string{"arsenal-mu", "penalty"}, responseBody.Media[0].Tags)
 	assert.Equal(t, 1, responseBody.Page)
 	assert.Equal(t, 1, responseBody.PageSize)
 	assert.Equal(t, int64(2), responseBody.TotalItems)
 	assert.Equal(t, 2, responseBody.TotalPages)
 
+	exif := responseBody.Media[0].Exif
+	require.NotNil(t, exif)
+	assert.Equal(t, "Canon EOS R5", exif.Model)
+	assert.Equal(t, 800, *exif.ISO)
+	assert.Equal(t, "2024-05-01T18:30:15+01:00", exif.CapturedAt)
+	assert.Equal(t, &LocationResponse{Latitude: 51.555, Longitude: -0.108}, exif.Location)
+	assert.Nil(t, responseBody.Media[1].Exif)
+
+	assert.Equal(t, []ThumbnailResponse{
+		{Size: "small", Width: 160, Height: 90, URL: "https://signed.example.com/thumb_small.jpg?expires=60"},
+		{Size: "large", Width: 1280, Height: 720, URL: "https://signed.example.com/thumb_large.jpg?expires=60"},
+	}, responseBody.Media[0].Thumbnails)
+	assert.Empty(t, responseBody.Media[1].Thumbnails)
+}
+
+func TestSearchMediaByTag_LinksToContentWithoutSignedURLs(t *testing.T) {
+	mediaService, _ := SetupMockServices()
+	router := SetupMediaTestRouter(mediaService, &MockStorageProvider{Unsigned: true})
+
+	req, _ := http.NewRequest(http.MethodGet, "/media?tag=arsenal", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var responseBody PaginatedMediaResponse
+	json.Unmarshal(resp.Body.Bytes(), &responseBody)
+	assert.Equal(t, "/media/"+responseBody.Media[0].ID.String()+"/content", responseBody.Media[0].FileURL)
 }
 
 func TestSearchMediaByTag_NoTagProvided(t *testing.T) {
@@ -204,3 +635,316 @@ func TestSearchMediaByTag_InvalidPageNumber(t *testing.T) {
 
 	assert.Equal(t, "Invalid page number or page size", responseBody["error"])
 }
+
+func TestSearchMediaByTag_BrokenFilter(t *testing.T) {
+	mediaService := &MockMediaService{}
+	router := SetupMediaTestRouter(mediaService, &MockStorageProvider{})
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/media?tag=arsenal&broken=false", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	if assert.NotNil(t, mediaService.Filter.Broken) {
+		assert.False(t, *mediaService.Filter.Broken)
+	}
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/media?tag=arsenal", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Nil(t, mediaService.Filter.Broken)
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/media?tag=arsenal&broken=maybe", nil))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestSearchMediaByTag_ExifFilters(t *testing.T) {
+	mediaService := &MockMediaService{}
+	router := SetupMediaTestRouter(mediaService, &MockStorageProvider{})
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/media?tag=arsenal&cameraMake=canon&lensModel=RF50mm&minIso=100&maxIso=3200"+
+		"&capturedAfter=2024-05-01T00:00:00%2B02:00&hasLocation=true&bbox=-0.5,51.3,0.3,51.7", nil))
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	filter := mediaService.Filter
+	assert.Equal(t, "canon", filter.CameraMake)
+	assert.Equal(t, "RF50mm", filter.LensModel)
+	assert.Empty(t, filter.CameraModel)
+	assert.Equal(t, 100, *filter.MinISO)
+	assert.Equal(t, 3200, *filter.MaxISO)
+	assert.True(t, filter.CapturedAfter.Equal(time.Date(2024, 4, 30, 22, 0, 0, 0, time.UTC)))
+	assert.Nil(t, filter.CapturedBefore)
+	assert.True(t, *filter.HasLocation)
+	assert.Equal(t, &mediaRepo.BoundingBox{MinLongitude: -0.5, MinLatitude: 51.3, MaxLongitude: 0.3, MaxLatitude: 51.7}, filter.Within)
+
+	for _, query := range []string{"minIso=-1", "maxIso=high", "capturedBefore=yesterday", "hasLocation=maybe", "bbox=1,2,3", "bbox=0.3,51.3,-0.5,51.7", "bbox=0,-91,1,1"} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/media?tag=arsenal&"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, resp.Code, query)
+	}
+}
+
+func TestSearchMediaByTag_DimensionFilters(t *testing.T) {
+	mediaService := &MockMediaService{}
+	router := SetupMediaTestRouter(mediaService, &MockStorageProvider{})
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/media?tag=arsenal&minWidth=1920&orientation=landscape", nil))
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	filter := mediaService.Filter
+	assert.Equal(t, 1920, *filter.MinWidth)
+	assert.Nil(t, filter.MinHeight)
+	assert.Equal(t, models.OrientationLandscape, filter.Orientation)
+
+	var response PaginatedMediaResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &response))
+	assert.Equal(t, 1920, response.Media[0].Width)
+	assert.Equal(t, 1080, response.Media[0].Height)
+	assert.Equal(t, "landscape", response.Media[0].Orientation)
+	assert.Empty(t, response.Media[1].Orientation)
+
+	for _, query := range []string{"minWidth=-1", "minHeight=tall", "orientation=upright"} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/media?tag=arsenal&"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, resp.Code, query)
+	}
+}
+
+func TestDeleteMedia(t *testing.T) {
+	mediaService := &MockMediaService{}
+	storageProvider := &MockStorageProvider{}
+	router := SetupMediaTestRouter(mediaService, storageProvider)
+
+	req, _ := http.NewRequest(http.MethodDelete, "/media/"+existingMediaID.String(), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, []string{"media_1.jpg"}, storageProvider.Released)
+}
+
+func TestDeleteMedia_NotFound(t *testing.T) {
+	mediaService := &MockMediaService{}
+	storageProvider := &MockStorageProvider{}
+	router := SetupMediaTestRouter(mediaService, storageProvider)
+
+	req, _ := http.NewRequest(http.MethodDelete, "/media/"+uuid.New().String(), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Empty(t, storageProvider.Released)
+}
+
+func TestDeleteMedia_InvalidID(t *testing.T) {
+	mediaService, storageProvider := SetupMockServices()
+	router := SetupMediaTestRouter(mediaService, storageProvider)
+
+	req, _ := http.NewRequest(http.MethodDelete, "/media/not-a-uuid", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestGetMediaContent(t *testing.T) {
+	storageProvider := &MockStorageProvider{Objects: map[string]string{"media_1.jpg": "0123456789"}}
+	router := SetupMediaTestRouter(&MockMediaService{}, storageProvider)
+
+	req, _ := http.NewRequest(http.MethodGet, "/media/"+existingMediaID.String()+"/content", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "0123456789", resp.Body.String())
+	assert.Equal(t, "video/mp4", resp.Header().Get("Content-Type"))
+	assert.Equal(t, `"abc123"`, resp.Header().Get("ETag"))
+	assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", resp.Header().Get("Last-Modified"))
+	assert.Equal(t, `inline; filename=penalty.mp4`, resp.Header().Get("Content-Disposition"))
+	assert.Equal(t, "nosniff", resp.Header().Get("X-Content-Type-Options"))
+	assert.Empty(t, resp.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "bytes", resp.Header().Get("Accept-Ranges"))
+}
+
+func TestGetMediaContent_ScriptableTypesAreDownloaded(t *testing.T) {
+	for _, contentType := range []string{"text/html", "image/svg+xml", "application/pdf"} {
+		page := &models.Media{ID: uuid.New(), StorageKey: "page", ContentType: contentType, OriginalFilename: "page"}
+		mediaService := &MockMediaService{Created: map[uuid.UUID]*models.Media{page.ID: page}}
+		router := SetupMediaTestRouter(mediaService, &MockStorageProvider{Objects: map[string]string{"page": "<script>alert(1)</script>"}})
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/media/"+page.ID.String()+"/content", nil))
+
+		assert.Equal(t, http.StatusOK, resp.Code, contentType)
+		assert.Equal(t, `attachment; filename=page`, resp.Header().Get("Content-Disposition"), contentType)
+		assert.Equal(t, "sandbox", resp.Header().Get("Content-Security-Policy"), contentType)
+		assert.Equal(t, "nosniff", resp.Header().Get("X-Content-Type-Options"), contentType)
+	}
+}
+
+// photoWithThumbnail returns media with a small thumbnail, as created from
+// an uploaded photo.
+func photoWithThumbnail(mediaService *MockMediaService) *models.Media {
+	photo := &models.Media{
+		ID:               uuid.New(),
+		StorageKey:       "photo.heic",
+		ContentType:      "image/heic",
+		OriginalFilename: "IMG_0042.HEIC",
+		Renditions: []models.Rendition{{
+			Name: "small", Width: 160, Height: 120, StorageKey: "thumb_small.jpg", ContentHash: "def456", ContentType: "image/jpeg",
+			CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		}},
+	}
+	mediaService.Created = map[uuid.UUID]*models.Media{photo.ID: photo}
+	return photo
+}
+
+func TestGetMediaThumbnail(t *testing.T) {
+	mediaService := &MockMediaService{}
+	photo := photoWithThumbnail(mediaService)
+	router := SetupMediaTestRouter(mediaService, &MockStorageProvider{Objects: map[string]string{"thumb_small.jpg": "thumbnail"}})
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/media/"+photo.ID.String()+"/thumbnail?size=small", nil))
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "thumbnail", resp.Body.String())
+	assert.Equal(t, "image/jpeg", resp.Header().Get("Content-Type"))
+	assert.Equal(t, `"def456"`, resp.Header().Get("ETag"))
+	assert.Equal(t, `inline; filename=IMG_0042-small.jpg`, resp.Header().Get("Content-Disposition"))
+}
+
+func TestGetMediaThumbnail_Errors(t *testing.T) {
+	mediaService := &MockMediaService{}
+	photo := photoWithThumbnail(mediaService)
+	router := SetupMediaTestRouter(mediaService, &MockStorageProvider{})
+
+	for path, status := range map[string]int{
+		"/media/" + photo.ID.String() + "/thumbnail":              http.StatusBadRequest,
+		"/media/not-a-uuid/thumbnail?size=small":                  http.StatusBadRequest,
+		"/media/" + uuid.New().String() + "/thumbnail?size=small": http.StatusNotFound,
+		"/media/" + photo.ID.String() + "/thumbnail?size=huge":    http.StatusNotFound,
+		// The blob of the thumbnail is missing.
+		"/media/" + photo.ID.String() + "/thumbnail?size=small": http.StatusNotFound,
+	} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, status, resp.Code, path)
+	}
+}
+
+func TestDeleteMedia_ReleasesThumbnails(t *testing.T) {
+	mediaService := &MockMediaService{}
+	photo := photoWithThumbnail(mediaService)
+	storageProvider := &MockStorageProvider{}
+	router := SetupMediaTestRouter(mediaService, storageProvider)
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodDelete, "/media/"+photo.ID.String(), nil))
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, []string{"photo.heic", "thumb_small.jpg"}, storageProvider.Released)
+}
+
+func TestGetSimilarMedia(t *testing.T) {
+	mediaService := &MockMediaService{}
+	photo := photoWithThumbnail(mediaService)
+	photo.PerceptualHash = models.NewPerceptualHash(photo.ID, 0xf0f0f0f0f0f0f0f0)
+	for name, hash := range map[string]uint64{"recompressed": 0xf0f0f0f0f0f0f0f1, "cropped": 0xf0f0f0f0f0f0ff00, "other": 0x0f0f0f0f0f0f0f0f} {
+		m := &models.Media{ID: uuid.New(), Name: name, StorageKey: name + ".jpg", ContentType: "image/jpeg"}
+		m.PerceptualHash = models.NewPerceptualHash(m.ID, hash)
+		mediaService.Created[m.ID] = m
+	}
+	router := SetupMediaTestRouter(mediaService, &MockStorageProvider{})
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/media/"+photo.ID.String()+"/similar", nil))
+
+	require.Equal(t, http.StatusOK, resp.Code)
+	var result PaginatedSimilarMediaResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &result))
+	assert.Equal(t, defaultSimilarDistance, mediaService.MaxDistance)
+	assert.Equal(t, int64(2), result.TotalItems)
+	require.Len(t, result.Media, 2)
+	assert.Equal(t, "recompressed", result.Media[0].Name)
+	assert.Equal(t, 1, result.Media[0].Distance)
+	assert.NotEmpty(t, result.Media[0].FileURL)
+	assert.Equal(t, "cropped", result.Media[1].Name)
+	assert.Equal(t, 8, result.Media[1].Distance)
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/media/"+photo.ID.String()+"/similar?maxDistance=0", nil))
+
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `{"media": [], "page": 1, "pageSize": 10, "totalItems": 0, "totalPages": 0}`, resp.Body.String())
+}
+
+func TestGetSimilarMedia_Errors(t *testing.T) {
+	mediaService := &MockMediaService{}
+	photo := photoWithThumbnail(mediaService)
+	router := SetupMediaTestRouter(mediaService, &MockStorageProvider{})
+
+	for path, status := range map[string]int{
+		"/media/not-a-uuid/similar":                               http.StatusBadRequest,
+		"/media/" + photo.ID.String() + "/similar?maxDistance=16": http.StatusBadRequest,
+		"/media/" + photo.ID.String() + "/similar?maxDistance=-1": http.StatusBadRequest,
+		"/media/" + photo.ID.String() + "/similar?page=0":         http.StatusBadRequest,
+		"/media/" + uuid.New().String() + "/similar":              http.StatusNotFound,
+		// The HEIC photo could not be decoded, so it has no hash.
+		"/media/" + photo.ID.String() + "/similar": http.StatusUnprocessableEntity,
+	} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, status, resp.Code, path)
+	}
+}
+
+func TestGetMediaContent_Range(t *testing.T) {
+	storageProvider := &MockStorageProvider{Objects: map[string]string{"media_1.jpg": "0123456789"}}
+	router := SetupMediaTestRouter(&MockMediaService{}, storageProvider)
+
+	req, _ := http.NewRequest(http.MethodGet, "/media/"+existingMediaID.String()+"/content", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "2345", resp.Body.String())
+	assert.Equal(t, "bytes 2-5/10", resp.Header().Get("Content-Range"))
+}
+
+func TestGetMediaContent_NotModified(t *testing.T) {
+	storageProvider := &MockStorageProvider{Objects: map[string]string{"media_1.jpg": "0123456789"}}
+	router := SetupMediaTestRouter(&MockMediaService{}, storageProvider)
+
+	req, _ := http.NewRequest(http.MethodGet, "/media/"+existingMediaID.String()+"/content", nil)
+	req.Header.Set("If-None-Match", `"abc123"`)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNotModified, resp.Code)
+	assert.Empty(t, resp.Body.String())
+}
+
+func TestGetMediaContent_BlobMissing(t *testing.T) {
+	mediaService, storageProvider := SetupMockServices()
+	router := SetupMediaTestRouter(mediaService, storageProvider)
+
+	req, _ := http.NewRequest(http.MethodGet, "/media/"+existingMediaID.String()+"/content", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestGetMediaContent_StorageUnavailable(t *testing.T) {
+	storageProvider := &MockStorageProvider{Err: fmt.Errorf("open: %w", storage.ErrUnavailable)}
+	router := SetupMediaTestRouter(&MockMediaService{}, storageProvider)
+
+	req, _ := http.NewRequest(http.MethodGet, "/media/"+existingMediaID.String()+"/content", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"media-indexer/services/scrub"
+)
+
+type MetricsController struct {
+	ScrubService scrub.ScrubService
+}
+
+func NewMetricsController(scrubService scrub.ScrubService) *MetricsController {
+	return &MetricsController{ScrubService: scrubService}
+}
+
+// Metrics godoc
+// @Summary Prometheus metrics
+// @Description Expose the number of media flagged corrupt and the outcomes of the scrub job in the Prometheus text format
+// @Tags metrics
+// @Produce plain
+// @Success 200 {string} string "Metrics"
+// @Failure 500 {object} map[string]interface{} "Metrics unavailable"
+// @Router /metrics [get]
+func (mc *MetricsController) Metrics(c *gin.Context) {
+	stats, err := mc.ScrubService.Stats()
+	if err != nil {
+		log.Printf("Error reading scrub stats: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read metrics"})
+		return
+	}
+
+	var b strings.Builder
+	writeMetric(&b, "media_indexer_corrupt_media", "gauge", "Media whose stored file is missing or does not match its content hash.")
+	fmt.Fprintf(&b, "media_indexer_corrupt_media %d\n", stats.CorruptMedia)
+
+	writeMetric(&b, "media_indexer_scrubbed_media_total", "counter", "Stored files read back by the scrub job, by result.")
+	fmt.Fprintf(&b, "media_indexer_scrubbed_media_total{result=%q} %d\n", scrub.ResultIntact, stats.Intact)
+	fmt.Fprintf(&b, "media_indexer_scrubbed_media_total{result=%q} %d\n", scrub.ResultCorrupt, stats.Corrupt)
+	fmt.Fprintf(&b, "media_indexer_scrubbed_media_total{result=%q} %d\n", scrub.ResultError, stats.Errors)
+
+	writeMetric(&b, "media_indexer_scrub_last_batch_timestamp_seconds", "gauge", "Unix time the last scrub batch finished, zero if none has yet.")
+	var lastBatch int64
+	if !stats.LastBatchAt.IsZero() {
+		lastBatch = stats.LastBatchAt.Unix()
+	}
+	fmt.Fprintf(&b, "media_indexer_scrub_last_batch_timestamp_seconds %d\n", lastBatch)
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
+
+func writeMetric(b *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"media-indexer/services/scrub"
+)
+
+type MockScrubService struct {
+	scrub.ScrubService
+	stats scrub.Stats
+}
+
+func (m *MockScrubService) Stats() (*scrub.Stats, error) {
+	stats := m.stats
+	return &stats, nil
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+func TestMetrics(t *testing.T) {
+	service := &MockScrubService{stats: scrub.Stats{
+		Intact:       40,
+		Corrupt:      2,
+		Errors:       1,
+		LastBatchAt:  time.Unix(1700000000, 0),
+		CorruptMedia: 3,
+	}}
+	router := gin.Default()
+	router.GET("/metrics", NewMetricsController(service).Metrics)
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Header().Get("Content-Type"), "text/plain")
+	body := resp.Body.String()
+	assert.Contains(t, body, "# TYPE media_indexer_corrupt_media gauge\nmedia_indexer_corrupt_media 3\n")
+	assert.Contains(t, body, `media_indexer_scrubbed_media_total{result="intact"} 40`)
+	assert.Contains(t, body, `media_indexer_scrubbed_media_total{result="corrupt"} 2`)
+	assert.Contains(t, body, `media_indexer_scrubbed_media_total{result="error"} 1`)
+	assert.Contains(t, body, "media_indexer_scrub_last_batch_timestamp_seconds 1700000000\n")
+}
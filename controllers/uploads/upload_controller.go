@@ -0,0 +1,388 @@
+package uploads
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"media-indexer/models"
+	"media-indexer/services/quota"
+	"media-indexer/services/staging"
+	"media-indexer/services/upload"
+	"media-indexer/storage"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	// ownerMetadata is the metadata key the owner of an upload is kept
+	// under. It is always set by the server.
+	ownerMetadata = "owner"
+)
+
+// UploadController implements the tus 1.0 resumable upload protocol with the
+// creation and termination extensions. Once the last chunk arrives the
+// assembled file goes through the same storage and create-media flow as a
+// multipart upload.
+type UploadController struct {
+	UploadService  upload.UploadService
+	StagingService staging.StagingService
+	QuotaService   quota.QuotaService
+	// MaxSize limits Upload-Length; zero means unlimited.
+	MaxSize int64
+}
+
+func NewUploadController(uploadService upload.UploadService, stagingService staging.StagingService, quotaService quota.QuotaService, maxSize int64) *UploadController {
+	return &UploadController{
+		UploadService:  uploadService,
+		StagingService: stagingService,
+		QuotaService:   quotaService,
+		MaxSize:        maxSize,
+	}
+}
+
+// Options godoc
+// @Summary Describe tus upload support
+// @Description Report the tus version, extensions and maximum upload size supported by the server
+// @Tags uploads
+// @Success 204 "Supported tus features in Tus-Version, Tus-Extension and Tus-Max-Size headers"
+// @Router /uploads [options]
+func (uc *UploadController) Options(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	if uc.MaxSize > 0 {
+		c.Header("Tus-Max-Size", strconv.FormatInt(uc.MaxSize, 10))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// CreateUpload godoc
+// @Summary Create a resumable upload
+// @Description Start a tus upload. Upload-Metadata must carry the base64 encoded "name" and comma separated "tags" of the media, and may carry "filename"
+// @Tags uploads
+// @Param Tus-Resumable header string true "tus protocol version" default(1.0.0)
+// @Param X-API-Key header string false "API key the upload is charged to, required when API keys are configured"
+// @Param Upload-Length header int true "Size of the file in bytes"
+// @Param Upload-Metadata header string true "tus metadata: name, tags and filename"
+// @Success 201 "Upload created, its URL is in the Location header"
+// @Failure 400 {object} gin.H "Bad Request"
+// @Failure 401 {object} gin.H "Invalid API key"
+// @Failure 412 {object} gin.H "Unsupported tus version"
+// @Failure 413 {object} gin.H "Upload too large"
+// @Failure 507 {object} gin.H "Storage quota exceeded"
+// @Router /uploads [post]
+func (uc *UploadController) CreateUpload(c *gin.Context) {
+	if !checkTusResumable(c) {
+		return
+	}
+	owner, err := uc.QuotaService.Owner(c.GetHeader("X-API-Key"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Length"})
+		return
+	}
+	if uc.MaxSize > 0 && length > uc.MaxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Upload exceeds Tus-Max-Size"})
+		return
+	}
+
+	metadata, err := parseMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Metadata"})
+		return
+	}
+	if metadata["name"] == "" || len(metadataTags(metadata)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Metadata must contain name and tags"})
+		return
+	}
+
+	// Fail early when the owner has no room left; the upload is charged
+	// when it is stored.
+	charge, err := uc.QuotaService.Begin(owner)
+	if errors.Is(err, quota.ErrQuotaExceeded) {
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Storage quota exceeded"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking the storage quota of %q: %v", owner, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+	charge.Done()
+	metadata[ownerMetadata] = owner
+
+	created, err := uc.UploadService.CreateUpload(length, metadata)
+	if err != nil {
+		log.Printf("Error creating upload: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+
+	c.Header("Location", strings.TrimRight(c.Request.URL.Path, "/")+"/"+created.ID)
+	c.Header("Upload-Offset", "0")
+	c.Status(http.StatusCreated)
+}
+
+// GetUploadOffset godoc
+// @Summary Get upload offset
+// @Description Report how many bytes of a tus upload the server has received
+// @Tags uploads
+// @Param id path string true "Upload ID"
+// @Param Tus-Resumable header string true "tus protocol version" default(1.0.0)
+// @Success 200 "Offset in the Upload-Offset header"
+// @Failure 404 "Not Found"
+// @Router /uploads/{id} [head]
+func (uc *UploadController) GetUploadOffset(c *gin.Context) {
+	if !checkTusResumable(c) {
+		return
+	}
+
+	current, err := uc.UploadService.GetUpload(c.Param("id"))
+	if errors.Is(err, upload.ErrUploadNotFound) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching upload: %v", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	setUploadHeaders(c, current)
+	c.Status(http.StatusOK)
+}
+
+// PatchUpload godoc
+// @Summary Upload a chunk
+// @Description Append a chunk to a tus upload at Upload-Offset. When the upload is complete the media is created and its ID returned in the Media-Id header
+// @Tags uploads
+// @Accept application/offset+octet-stream
+// @Param id path string true "Upload ID"
+// @Param Tus-Resumable header string true "tus protocol version" default(1.0.0)
+// @Param Upload-Offset header int true "Offset the chunk starts at"
+// @Success 204 "Chunk accepted, new offset in the Upload-Offset header"
+// @Failure 400 {object} gin.H "Bad Request"
+// @Failure 404 {object} gin.H "Not Found"
+// @Failure 409 {object} gin.H "Offset mismatch"
+// @Failure 413 {object} gin.H "Chunk exceeds Upload-Length, or the file is too large for its content type"
+// @Failure 415 {object} gin.H "Unsupported Media Type"
+// @Failure 423 {object} gin.H "Upload is being finished by another request"
+// @Failure 503 {object} gin.H "Storage unavailable"
+// @Failure 507 {object} gin.H "Storage quota exceeded"
+// @Router /uploads/{id} [patch]
+func (uc *UploadController) PatchUpload(c *gin.Context) {
+	if !checkTusResumable(c) {
+		return
+	}
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Offset"})
+		return
+	}
+
+	current, err := uc.UploadService.WriteChunk(c.Param("id"), offset, c.Request.Body)
+	switch {
+	case errors.Is(err, upload.ErrUploadNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	case errors.Is(err, upload.ErrOffsetMismatch):
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload-Offset does not match the current offset"})
+		return
+	case errors.Is(err, upload.ErrUploadTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Chunk exceeds Upload-Length"})
+		return
+	case errors.Is(err, upload.ErrUploadFinishing):
+		c.JSON(http.StatusLocked, gin.H{"error": "Upload is being finished"})
+		return
+	case err != nil:
+		log.Printf("Error writing upload chunk: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write upload chunk"})
+		return
+	}
+
+	// WriteChunk leaves a complete upload claimed by this request alone, so
+	// only one request creates media from it.
+	if current.Complete() && !current.Finished() {
+		current, err = uc.finishUpload(c, current)
+		if errors.Is(err, quota.ErrFileTooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, quota.ErrQuotaExceeded) {
+			c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Storage quota exceeded"})
+			return
+		}
+		if errors.Is(err, storage.ErrUnavailable) {
+			// The upload stays complete; patching it again with no data
+			// retries handing it to storage.
+			log.Printf("Error finishing upload %s: %v", c.Param("id"), err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage is unavailable, try again later"})
+			return
+		}
+		if err != nil {
+			log.Printf("Error finishing upload %s: %v", c.Param("id"), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create media"})
+			return
+		}
+	}
+
+	setUploadHeaders(c, current)
+	c.Status(http.StatusNoContent)
+}
+
+// TerminateUpload godoc
+// @Summary Terminate an upload
+// @Description Cancel a tus upload and discard the data received so far
+// @Tags uploads
+// @Param id path string true "Upload ID"
+// @Param Tus-Resumable header string true "tus protocol version" default(1.0.0)
+// @Success 204 "Terminated"
+// @Failure 404 {object} gin.H "Not Found"
+// @Failure 423 {object} gin.H "Upload is being finished"
+// @Router /uploads/{id} [delete]
+func (uc *UploadController) TerminateUpload(c *gin.Context) {
+	if !checkTusResumable(c) {
+		return
+	}
+
+	err := uc.UploadService.TerminateUpload(c.Param("id"))
+	if errors.Is(err, upload.ErrUploadNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+	if errors.Is(err, upload.ErrUploadFinishing) {
+		c.JSON(http.StatusLocked, gin.H{"error": "Upload is being finished"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error terminating upload: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to terminate upload"})
+		return
+	}
+
+	c.Header("Tus-Resumable", tusVersion)
+	c.Status(http.StatusNoContent)
+}
+
+// finishUpload stages the assembled file and commits the media with the name
+// and tags given when the upload was created, which moves the file to
+// storage. The file is checked against the size limit of its content type
+// and charged to the quota of the owner on the way. The claim on the upload
+// is released if no media was created, so the client can retry; once the
+// media exists it is kept, so a retry only records the media.
+func (uc *UploadController) finishUpload(c *gin.Context, current *upload.Upload) (_ *upload.Upload, err error) {
+	committed := false
+	defer func() {
+		if err != nil && !committed {
+			uc.UploadService.ReleaseUpload(current.ID)
+		}
+	}()
+
+	owner := current.Metadata[ownerMetadata]
+	charge, err := uc.QuotaService.Begin(owner)
+	if err != nil {
+		return nil, err
+	}
+	defer charge.Done()
+
+	data, err := uc.UploadService.OpenData(current.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	contentType, file, err := storage.SniffContentType(data)
+	if err != nil {
+		return nil, err
+	}
+	maxSize := uc.QuotaService.MaxSize(contentType)
+
+	ctx := c.Request.Context()
+	fileName := current.Metadata["filename"]
+	if fileName != "" {
+		fileName = filepath.Base(fileName)
+	}
+	staged, err := uc.StagingService.Stage(quota.NewMeter(file, maxSize, charge), fileName)
+	if errors.Is(err, quota.ErrFileTooLarge) {
+		return nil, fmt.Errorf("%w: %s files may not exceed %d bytes", quota.ErrFileTooLarge, contentType, maxSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	created, _, err := uc.StagingService.Commit(ctx, staged, &models.Media{
+		Name:  current.Metadata["name"],
+		Owner: owner,
+	}, metadataTags(current.Metadata))
+	if err != nil {
+		return nil, err
+	}
+	committed = true
+
+	return uc.UploadService.MarkFinished(current.ID, created.ID.String())
+}
+
+func checkTusResumable(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Unsupported tus version"})
+		return false
+	}
+	return true
+}
+
+func setUploadHeaders(c *gin.Context, current *upload.Upload) {
+	c.Header("Upload-Offset", strconv.FormatInt(current.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(current.Length, 10))
+	if current.Finished() {
+		c.Header("Media-Id", current.MediaID)
+	}
+}
+
+// parseMetadata decodes a tus Upload-Metadata header: comma separated pairs
+// of a key and an optional base64 encoded value.
+func parseMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func metadataTags(metadata map[string]string) []string {
+	var tags []string
+	for _, tag := range strings.Split(metadata["tags"], ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
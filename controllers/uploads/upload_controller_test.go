@@ -0,0 +1,300 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"media-indexer/models"
+	mediaRepo "media-indexer/repositories/media"
+	"media-indexer/services/media"
+	"media-indexer/services/quota"
+	"media-indexer/services/staging"
+	"media-indexer/services/thumbnail"
+	"media-indexer/services/upload"
+	"media-indexer/storage"
+)
+
+type MockMediaService struct {
+	mu       sync.Mutex
+	Calls    int
+	Created  *models.Media
+	TagNames []string
+}
+
+func (m *MockMediaService) CreateMedia(media *models.Media, tagNames []string) (*models.Media, []models.Tag, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Calls++
+	m.Created = media
+	m.TagNames = tagNames
+	return media, nil, nil
+}
+
+func (m *MockMediaService) GetMedia(id uuid.UUID) (*models.Media, error) {
+	return nil, nil
+}
+
+func (m *MockMediaService) DeleteMedia(id uuid.UUID) (*models.Media, error) {
+	return nil, nil
+}
+
+func (m *MockMediaService) SearchMediaByTags(tagNames []string, filter mediaRepo.SearchFilter, page int, pageSize int) ([]models.Media, int64, error) {
+	return nil, 0, nil
+}
+
+func (m *MockMediaService) FindSimilarMedia(id uuid.UUID, maxDistance int, page int, pageSize int) ([]media.SimilarMedia, int64, error) {
+	return nil, 0, nil
+}
+
+func SetupUploadTestRouter(t *testing.T) (*gin.Engine, *MockMediaService, *storage.LocalStorage) {
+	return setupUploadTestRouterWithLimits(t, quota.Config{})
+}
+
+func setupUploadTestRouterWithLimits(t *testing.T, limits quota.Config) (*gin.Engine, *MockMediaService, *storage.LocalStorage) {
+	uploadService, err := upload.NewUploadService(t.TempDir())
+	require.NoError(t, err)
+	localStorage, err := storage.NewLocalStorage(storage.LocalConfig{RootDir: t.TempDir(), SigningKey: "test"})
+	require.NoError(t, err)
+	mediaService := &MockMediaService{}
+	stagingService, err := staging.NewStagingService(t.TempDir(), mediaService, nil, localStorage, thumbnail.NewThumbnailService(nil, localStorage, thumbnail.Config{}))
+	require.NoError(t, err)
+	quotaService, err := quota.NewQuotaService(nil, limits)
+	require.NoError(t, err)
+
+	router := gin.Default()
+	uploadController := NewUploadController(uploadService, stagingService, quotaService, 1024)
+	router.OPTIONS("/uploads", uploadController.Options)
+	router.POST("/uploads", uploadController.CreateUpload)
+	router.HEAD("/uploads/:id", uploadController.GetUploadOffset)
+	router.PATCH("/uploads/:id", uploadController.PatchUpload)
+	router.DELETE("/uploads/:id", uploadController.TerminateUpload)
+	return router, mediaService, localStorage
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+func tusRequest(method string, path string, body []byte) *http.Request {
+	req, _ := http.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+	}
+	return req
+}
+
+func createUpload(t *testing.T, router *gin.Engine, length int) string {
+	req := tusRequest(http.MethodPost, "/uploads", nil)
+	req.Header.Set("Upload-Length", fmt.Sprint(length))
+	req.Header.Set("Upload-Metadata", "name "+base64.StdEncoding.EncodeToString([]byte("Final"))+
+		",tags "+base64.StdEncoding.EncodeToString([]byte("worldcup, final"))+
+		",filename "+base64.StdEncoding.EncodeToString([]byte("final.txt")))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	require.Equal(t, http.StatusCreated, resp.Code)
+	return resp.Header().Get("Location")
+}
+
+func TestOptions(t *testing.T) {
+	router, _, _ := SetupUploadTestRouter(t)
+
+	req, _ := http.NewRequest(http.MethodOptions, "/uploads", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "1.0.0", resp.Header().Get("Tus-Version"))
+	assert.Equal(t, "creation,termination", resp.Header().Get("Tus-Extension"))
+	assert.Equal(t, "1024", resp.Header().Get("Tus-Max-Size"))
+}
+
+func TestResumableUpload(t *testing.T) {
+	router, mediaService, localStorage := SetupUploadTestRouter(t)
+	content := []byte("the whole file, sent in two chunks")
+
+	location := createUpload(t, router, len(content))
+	assert.Regexp(t, `^/uploads/[0-9a-f-]{36}$`, location)
+
+	req := tusRequest(http.MethodPatch, location, content[:10])
+	req.Header.Set("Upload-Offset", "0")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "10", resp.Header().Get("Upload-Offset"))
+	assert.Nil(t, mediaService.Created)
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, tusRequest(http.MethodHead, location, nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "10", resp.Header().Get("Upload-Offset"))
+	assert.Equal(t, fmt.Sprint(len(content)), resp.Header().Get("Upload-Length"))
+
+	req = tusRequest(http.MethodPatch, location, content[10:])
+	req.Header.Set("Upload-Offset", "10")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, fmt.Sprint(len(content)), resp.Header().Get("Upload-Offset"))
+
+	require.NotNil(t, mediaService.Created)
+	assert.Equal(t, mediaService.Created.ID.String(), resp.Header().Get("Media-Id"))
+	assert.Equal(t, "Final", mediaService.Created.Name)
+	assert.Equal(t, "final.txt", mediaService.Created.OriginalFilename)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(content)), mediaService.Created.ContentHash)
+	assert.Equal(t, []string{"worldcup", "final"}, mediaService.TagNames)
+
+	exists, err := localStorage.Exists(context.Background(), mediaService.Created.ContentHash+".txt")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestPatchUpload_ConcurrentLastChunk(t *testing.T) {
+	router, mediaService, _ := SetupUploadTestRouter(t)
+	content := []byte("the whole file, sent in two chunks")
+	location := createUpload(t, router, len(content))
+
+	req := tusRequest(http.MethodPatch, location, content[:10])
+	req.Header.Set("Upload-Offset", "0")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusNoContent, resp.Code)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 8)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := tusRequest(http.MethodPatch, location, content[10:])
+			req.Header.Set("Upload-Offset", "10")
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+			codes[i] = resp.Code
+		}(i)
+	}
+	wg.Wait()
+
+	finished := 0
+	for _, code := range codes {
+		if code == http.StatusNoContent {
+			finished++
+		} else {
+			assert.Contains(t, []int{http.StatusConflict, http.StatusLocked}, code)
+		}
+	}
+	assert.Equal(t, 1, finished)
+	assert.Equal(t, 1, mediaService.Calls)
+}
+
+func TestResumableUpload_TooLargeForContentType(t *testing.T) {
+	router, mediaService, _ := setupUploadTestRouterWithLimits(t, quota.Config{MaxSizes: []quota.SizeLimit{{ContentType: "text/*", MaxSize: 8}}})
+	content := []byte("more than eight bytes of text")
+
+	location := createUpload(t, router, len(content))
+	req := tusRequest(http.MethodPatch, location, content)
+	req.Header.Set("Upload-Offset", "0")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+	assert.Contains(t, resp.Body.String(), "text/plain files may not exceed 8 bytes")
+	assert.Nil(t, mediaService.Created)
+}
+
+func TestCreateUpload_UnknownAPIKey(t *testing.T) {
+	router, _, _ := setupUploadTestRouterWithLimits(t, quota.Config{APIKeys: map[string]quota.APIKey{"secret": {Owner: "alice"}}})
+
+	req := tusRequest(http.MethodPost, "/uploads", nil)
+	req.Header.Set("Upload-Length", "10")
+	req.Header.Set("X-API-Key", "guess")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+func TestPatchUpload_OffsetMismatch(t *testing.T) {
+	router, _, _ := SetupUploadTestRouter(t)
+	location := createUpload(t, router, 20)
+
+	req := tusRequest(http.MethodPatch, location, []byte("data"))
+	req.Header.Set("Upload-Offset", "5")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusConflict, resp.Code)
+}
+
+func TestPatchUpload_ExceedsLength(t *testing.T) {
+	router, _, _ := SetupUploadTestRouter(t)
+	location := createUpload(t, router, 4)
+
+	req := tusRequest(http.MethodPatch, location, []byte("too much data"))
+	req.Header.Set("Upload-Offset", "0")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+}
+
+func TestCreateUpload_MissingTusResumable(t *testing.T) {
+	router, _, _ := SetupUploadTestRouter(t)
+
+	req, _ := http.NewRequest(http.MethodPost, "/uploads", nil)
+	req.Header.Set("Upload-Length", "10")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusPreconditionFailed, resp.Code)
+}
+
+func TestCreateUpload_MissingMetadata(t *testing.T) {
+	router, _, _ := SetupUploadTestRouter(t)
+
+	req := tusRequest(http.MethodPost, "/uploads", nil)
+	req.Header.Set("Upload-Length", "10")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestCreateUpload_TooLarge(t *testing.T) {
+	router, _, _ := SetupUploadTestRouter(t)
+
+	req := tusRequest(http.MethodPost, "/uploads", nil)
+	req.Header.Set("Upload-Length", "2048")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+}
+
+func TestTerminateUpload(t *testing.T) {
+	router, _, _ := SetupUploadTestRouter(t)
+	location := createUpload(t, router, 20)
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, tusRequest(http.MethodDelete, location, nil))
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, tusRequest(http.MethodHead, location, nil))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
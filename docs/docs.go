@@ -15,115 +15,135 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
-        "/media": {
+        "/admin/fsck": {
             "get": {
-                "description": "Search for media items by tag name",
-                "consumes": [
-                    "application/json"
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
                 ],
+                "description": "Report blobs no media points at, media whose blob is missing and, with verify, blobs whose checksum does not match their media. Nothing is changed.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "media"
+                    "admin"
                 ],
-                "summary": "Search media by tag",
+                "summary": "Check storage consistency",
                 "parameters": [
                     {
-                        "type": "array",
-                        "items": {
-                            "type": "string"
-                        },
-                        "collectionFormat": "csv",
-                        "description": "Tag name(s) to search for",
-                        "name": "tag",
-                        "in": "query",
-                        "required": true
-                    },
-                    {
-                        "type": "integer",
-                        "description": "Page number",
-                        "name": "page",
-                        "in": "query"
-                    },
-                    {
-                        "type": "integer",
-                        "description": "Number of media items per page",
-                        "name": "pageSize",
+                        "type": "boolean",
+                        "description": "Hash every referenced blob",
+                        "name": "verify",
                         "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "Search results",
+                        "description": "Consistency report",
+                        "schema": {
+                            "$ref": "#/definitions/fsck.Report"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid admin token",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "409": {
+                        "description": "A check is already running",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "500": {
+                        "description": "Check failed",
                         "schema": {
-                            "$ref": "#/definitions/controllers.PaginatedMediaResponse"
+                            "$ref": "#/definitions/gin.H"
                         }
                     }
                 }
-            },
+            }
+        },
+        "/admin/fsck/gc": {
             "post": {
-                "description": "Create a new media item with associated tags",
-                "consumes": [
-                    "multipart/form-data"
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
                 ],
+                "description": "Run a consistency check and delete blobs no media points at that are older than the grace period. Missing blobs and checksum mismatches are only reported.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "media"
+                    "admin"
                 ],
-                "summary": "Create media",
+                "summary": "Delete orphaned blobs",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Name of the media",
-                        "name": "name",
-                        "in": "formData",
-                        "required": true
-                    },
-                    {
-                        "type": "array",
-                        "items": {
-                            "type": "string"
-                        },
-                        "collectionFormat": "csv",
-                        "description": "Tags associated with the media",
-                        "name": "tags",
-                        "in": "formData",
-                        "required": true
+                        "description": "Minimum age of collected blobs, e.g. 48h (default 24h)",
+                        "name": "gracePeriod",
+                        "in": "query"
                     },
                     {
-                        "type": "file",
-                        "description": "File to upload",
-                        "name": "file",
-                        "in": "formData",
-                        "required": true
+                        "type": "boolean",
+                        "description": "Hash every referenced blob",
+                        "name": "verify",
+                        "in": "query"
                     }
                 ],
                 "responses": {
-                    "201": {
-                        "description": "Created media",
+                    "200": {
+                        "description": "Consistency report, collected blobs are flagged",
                         "schema": {
-                            "$ref": "#/definitions/controllers.MediaResponse"
+                            "$ref": "#/definitions/fsck.Report"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid grace period",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid admin token",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "409": {
+                        "description": "A check is already running",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "500": {
+                        "description": "Check failed",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
                         }
                     }
                 }
             }
         },
-        "/tags": {
+        "/admin/scrub/corrupt": {
             "get": {
-                "description": "Retrieve a list of all tags with pagination",
-                "consumes": [
-                    "application/json"
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
                 ],
+                "description": "List the media whose stored file the scrub job found missing or no longer matching the content hash saved at upload time, those corrupt longest first",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "tags"
+                    "admin"
                 ],
-                "summary": "List all tags",
+                "summary": "List corrupt media",
                 "parameters": [
                     {
                         "type": "integer",
@@ -133,183 +153,1573 @@ const docTemplate = `{
                     },
                     {
                         "type": "integer",
-                        "description": "Number of tags per page",
+                        "description": "Number of media per page",
                         "name": "pageSize",
                         "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "List of tags with pagination",
+                        "description": "Corrupt media",
+                        "schema": {
+                            "$ref": "#/definitions/admin.PaginatedScrubbedMedia"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid page number or page size",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid admin token",
                         "schema": {
-                            "$ref": "#/definitions/controllers.PaginatedTagsResponse"
+                            "$ref": "#/definitions/gin.H"
                         }
                     },
                     "500": {
-                        "description": "Failed to retrieve tags",
+                        "description": "Listing failed",
                         "schema": {
-                            "$ref": "#/definitions/controllers.ErrorResponse"
+                            "$ref": "#/definitions/gin.H"
                         }
                     }
                 }
-            },
+            }
+        },
+        "/admin/scrub/media/{id}": {
             "post": {
-                "description": "Create a new tag with the given name",
-                "consumes": [
-                    "application/json"
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
                 ],
+                "description": "Read the stored file of a media back right away and compare it with the content hash saved at upload time, e.g. after restoring it from a backup. An intact file clears the corrupt flag.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "tags"
+                    "admin"
                 ],
-                "summary": "Create a new tag",
+                "summary": "Scrub a media",
                 "parameters": [
                     {
-                        "description": "Tag name",
-                        "name": "tag",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "type": "object"
-                        }
+                        "type": "string",
+                        "description": "Media ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     }
                 ],
                 "responses": {
-                    "201": {
-                        "description": "Created tag",
+                    "200": {
+                        "description": "Scrub result",
                         "schema": {
-                            "$ref": "#/definitions/controllers.TagResponse"
+                            "$ref": "#/definitions/admin.ScrubResponse"
                         }
                     },
                     "400": {
-                        "description": "Invalid request",
+                        "description": "Invalid media id or external media",
                         "schema": {
-                            "$ref": "#/definitions/controllers.ErrorResponse"
+                            "$ref": "#/definitions/gin.H"
                         }
                     },
-                    "409": {
-                        "description": "Tag already exists",
+                    "401": {
+                        "description": "Invalid admin token",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "404": {
+                        "description": "Media not found",
                         "schema": {
-                            "$ref": "#/definitions/controllers.TagResponse"
+                            "$ref": "#/definitions/gin.H"
                         }
                     },
                     "500": {
-                        "description": "Failed to create tag",
+                        "description": "Scrub failed",
                         "schema": {
-                            "$ref": "#/definitions/controllers.ErrorResponse"
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "503": {
+                        "description": "Stored file could not be read",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
                         }
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "controllers.ErrorResponse": {
-            "type": "object",
-            "properties": {
-                "error": {
-                    "type": "string"
-                }
-            }
-        },
-        "controllers.MediaResponse": {
-            "type": "object",
-            "properties": {
-                "id": {
-                    "type": "integer"
-                },
-                "link": {
-                    "type": "string"
-                },
-                "name": {
-                    "type": "string"
-                },
-                "tags": {
-                    "type": "array",
-                    "items": {
-                        "type": "string"
-                    }
-                }
-            }
-        },
-        "controllers.PaginatedMediaResponse": {
-            "type": "object",
-            "properties": {
-                "media": {
-                    "type": "array",
-                    "items": {
-                        "$ref": "#/definitions/controllers.SearchMediaResponse"
-                    }
-                },
-                "page": {
-                    "type": "integer"
-                },
-                "pageSize": {
-                    "type": "integer"
-                },
-                "totalItems": {
-                    "type": "integer"
-                },
-                "totalPages": {
-                    "type": "integer"
-                }
-            }
         },
-        "controllers.PaginatedTagsResponse": {
-            "type": "object",
-            "properties": {
-                "page": {
-                    "type": "integer"
-                },
-                "pageSize": {
-                    "type": "integer"
-                },
-                "tags": {
-                    "type": "array",
-                    "items": {
-                        "$ref": "#/definitions/controllers.TagResponse"
+        "/files/{path}": {
+            "get": {
+                "description": "Serve a stored file through a signed, expiring URL issued by the storage provider",
+                "produces": [
+                    "application/octet-stream"
+                ],
+                "tags": [
+                    "files"
+                ],
+                "summary": "Download a stored file",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Path of the stored file",
+                        "name": "path",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Unix time the URL expires at",
+                        "name": "expires",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "URL signature",
+                        "name": "signature",
+                        "in": "query",
+                        "required": true
                     }
-                },
-                "totalItems": {
-                    "type": "integer"
-                },
-                "totalPages": {
-                    "type": "integer"
-                }
-            }
-        },
-        "controllers.SearchMediaResponse": {
-            "type": "object",
-            "properties": {
-                "fileUrl": {
-                    "type": "string"
-                },
-                "id": {
-                    "type": "integer"
-                },
-                "name": {
-                    "type": "string"
-                },
-                "tags": {
-                    "type": "array",
-                    "items": {
-                        "type": "string"
+                ],
+                "responses": {
+                    "200": {
+                        "description": "File content",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "503": {
+                        "description": "Storage unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
                     }
                 }
             }
         },
-        "controllers.TagResponse": {
-            "type": "object",
-            "properties": {
-                "id": {
-                    "type": "integer"
-                },
-                "name": {
-                    "type": "string"
-                }
-            }
+        "/media": {
+            "get": {
+                "description": "Search for media items by tag name",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "media"
+                ],
+                "summary": "Search media by tag",
+                "parameters": [
+                    {
+                        "type": "array",
+                        "description": "Tag name(s) to search for",
+                        "name": "tag",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page number",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of media items per page",
+                        "name": "pageSize",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Only return external media whose link check failed when true, leave them out when false",
+                        "name": "broken",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Camera make recorded in the EXIF metadata, ignoring case",
+                        "name": "cameraMake",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Camera model recorded in the EXIF metadata, ignoring case",
+                        "name": "cameraModel",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Lens model recorded in the EXIF metadata, ignoring case",
+                        "name": "lensModel",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Minimum ISO speed",
+                        "name": "minIso",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Maximum ISO speed",
+                        "name": "maxIso",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only images taken at or after this RFC 3339 time",
+                        "name": "capturedAfter",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only images taken at or before this RFC 3339 time",
+                        "name": "capturedBefore",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Only images with GPS coordinates when true, only those without when false",
+                        "name": "hasLocation",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only images taken inside minLongitude,minLatitude,maxLongitude,maxLatitude",
+                        "name": "bbox",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Minimum displayed width of images in pixels",
+                        "name": "minWidth",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Minimum displayed height of images in pixels",
+                        "name": "minHeight",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "landscape",
+                            "portrait",
+                            "square"
+                        ],
+                        "type": "string",
+                        "description": "Only images of this orientation",
+                        "name": "orientation",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Search results",
+                        "schema": {
+                            "$ref": "#/definitions/media.PaginatedMediaResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Create a new media item with associated tags. The file is streamed to a staging area as it arrives, so it should be the last part of the form, and only moved to storage once the media and its tags have been committed. Instead of a form, a JSON body with a sourceUrl makes the server fetch the file from an allowed host, and one with an externalUrl creates external media that only link to content hosted elsewhere. Uploads are limited in size by content type and charged to the quota of the API key",
+                "consumes": [
+                    "multipart/form-data",
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "media"
+                ],
+                "summary": "Create media",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API key the upload is charged to, required when API keys are configured",
+                        "name": "X-API-Key",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the media",
+                        "name": "name",
+                        "in": "formData"
+                    },
+                    {
+                        "type": "array",
+                        "description": "Tags associated with the media",
+                        "name": "tags",
+                        "in": "formData"
+                    },
+                    {
+                        "type": "file",
+                        "description": "File to upload",
+                        "name": "file",
+                        "in": "formData"
+                    },
+                    {
+                        "description": "Media to fetch from or link to a URL, sent as JSON instead of a form",
+                        "name": "media",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/media.CreateMediaFromURLRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created media",
+                        "schema": {
+                            "$ref": "#/definitions/media.MediaResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid API key",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "403": {
+                        "description": "Source host or address not allowed",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "413": {
+                        "description": "File too large for its content type",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "502": {
+                        "description": "Source could not be fetched",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "503": {
+                        "description": "Storage unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "504": {
+                        "description": "Fetching the source timed out",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "507": {
+                        "description": "Storage quota exceeded",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    }
+                }
+            }
+        },
+        "/media/{id}": {
+            "delete": {
+                "description": "Delete a media item and release its stored file, if it has one, and its thumbnails",
+                "tags": [
+                    "media"
+                ],
+                "summary": "Delete media",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Media ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Deleted"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    }
+                }
+            }
+        },
+        "/media/{id}/content": {
+            "get": {
+                "description": "Stream the stored file of a media item. Supports Range requests and conditional GETs via ETag and Last-Modified. External media redirect to their URL",
+                "produces": [
+                    "application/octet-stream"
+                ],
+                "tags": [
+                    "media"
+                ],
+                "summary": "Download media content",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Media ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Byte range to return, e.g. bytes=0-1023",
+                        "name": "Range",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of a cached copy",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Media content",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "206": {
+                        "description": "Partial media content",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "302": {
+                        "description": "Redirect to the URL of external media"
+                    },
+                    "304": {
+                        "description": "Not Modified"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "416": {
+                        "description": "Requested Range Not Satisfiable"
+                    },
+                    "503": {
+                        "description": "Storage unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    }
+                }
+            }
+        },
+        "/media/{id}/similar": {
+            "get": {
+                "description": "Find the images that look like an image: near-duplicates with a different size, compression or a slightly different crop. Images are compared by the Hamming distance between their perceptual hashes, out of 64 bits; mirrored or rotated copies are not found",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "media"
+                ],
+                "summary": "Find similar media",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Media ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "default": 10,
+                        "description": "Maximum number of bits the perceptual hashes may differ in, from 0 to 15",
+                        "name": "maxDistance",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page number",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of media items per page",
+                        "name": "pageSize",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Similar media, closest first",
+                        "schema": {
+                            "$ref": "#/definitions/media.PaginatedSimilarMediaResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "422": {
+                        "description": "Media is not an image that could be decoded",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    }
+                }
+            }
+        },
+        "/media/{id}/thumbnail": {
+            "get": {
+                "description": "Stream a thumbnail generated for an image, in one of the configured sizes. Supports Range requests and conditional GETs via ETag and Last-Modified",
+                "produces": [
+                    "image/jpeg",
+                    "image/png"
+                ],
+                "tags": [
+                    "media"
+                ],
+                "summary": "Download a media thumbnail",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Media ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Thumbnail size, e.g. small",
+                        "name": "size",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Thumbnail",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "304": {
+                        "description": "Not Modified"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "503": {
+                        "description": "Storage unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    }
+                }
+            }
+        },
+        "/metrics": {
+            "get": {
+                "description": "Expose the number of media flagged corrupt and the outcomes of the scrub job in the Prometheus text format",
+                "produces": [
+                    "text/plain"
+                ],
+                "tags": [
+                    "metrics"
+                ],
+                "summary": "Prometheus metrics",
+                "responses": {
+                    "200": {
+                        "description": "Metrics",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Metrics unavailable",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/tags": {
+            "get": {
+                "description": "Retrieve a list of all tags with pagination",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "tags"
+                ],
+                "summary": "List all tags",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Page number",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of tags per page",
+                        "name": "pageSize",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "List of tags with pagination",
+                        "schema": {
+                            "$ref": "#/definitions/tags.PaginatedTagsResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to retrieve tags",
+                        "schema": {
+                            "$ref": "#/definitions/tags.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Create a new tag with the given name",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "tags"
+                ],
+                "summary": "Create a new tag",
+                "parameters": [
+                    {
+                        "description": "Tag name",
+                        "name": "tag",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created tag",
+                        "schema": {
+                            "$ref": "#/definitions/tags.TagResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/tags.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Tag already exists",
+                        "schema": {
+                            "$ref": "#/definitions/tags.TagResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to create tag",
+                        "schema": {
+                            "$ref": "#/definitions/tags.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/uploads": {
+            "post": {
+                "description": "Start a tus upload. Upload-Metadata must carry the base64 encoded \"name\" and comma separated \"tags\" of the media, and may carry \"filename\"",
+                "tags": [
+                    "uploads"
+                ],
+                "summary": "Create a resumable upload",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "default": "1.0.0",
+                        "description": "tus protocol version",
+                        "name": "Tus-Resumable",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "API key the upload is charged to, required when API keys are configured",
+                        "name": "X-API-Key",
+                        "in": "header"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Size of the file in bytes",
+                        "name": "Upload-Length",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "tus metadata: name, tags and filename",
+                        "name": "Upload-Metadata",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Upload created, its URL is in the Location header"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid API key",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "412": {
+                        "description": "Unsupported tus version",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "413": {
+                        "description": "Upload too large",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "507": {
+                        "description": "Storage quota exceeded",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    }
+                }
+            },
+            "options": {
+                "description": "Report the tus version, extensions and maximum upload size supported by the server",
+                "tags": [
+                    "uploads"
+                ],
+                "summary": "Describe tus upload support",
+                "responses": {
+                    "204": {
+                        "description": "Supported tus features in Tus-Version, Tus-Extension and Tus-Max-Size headers"
+                    }
+                }
+            }
+        },
+        "/uploads/{id}": {
+            "delete": {
+                "description": "Cancel a tus upload and discard the data received so far",
+                "tags": [
+                    "uploads"
+                ],
+                "summary": "Terminate an upload",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Upload ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "default": "1.0.0",
+                        "description": "tus protocol version",
+                        "name": "Tus-Resumable",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Terminated"
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "423": {
+                        "description": "Upload is being finished",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    }
+                }
+            },
+            "head": {
+                "description": "Report how many bytes of a tus upload the server has received",
+                "tags": [
+                    "uploads"
+                ],
+                "summary": "Get upload offset",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Upload ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "default": "1.0.0",
+                        "description": "tus protocol version",
+                        "name": "Tus-Resumable",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Offset in the Upload-Offset header"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    }
+                }
+            },
+            "patch": {
+                "description": "Append a chunk to a tus upload at Upload-Offset. When the upload is complete the media is created and its ID returned in the Media-Id header",
+                "consumes": [
+                    "application/offset+octet-stream"
+                ],
+                "tags": [
+                    "uploads"
+                ],
+                "summary": "Upload a chunk",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Upload ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "default": "1.0.0",
+                        "description": "tus protocol version",
+                        "name": "Tus-Resumable",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Offset the chunk starts at",
+                        "name": "Upload-Offset",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Chunk accepted, new offset in the Upload-Offset header"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "409": {
+                        "description": "Offset mismatch",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "413": {
+                        "description": "Chunk exceeds Upload-Length, or the file is too large for its content type",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "415": {
+                        "description": "Unsupported Media Type",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "423": {
+                        "description": "Upload is being finished by another request",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "503": {
+                        "description": "Storage unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    },
+                    "507": {
+                        "description": "Storage quota exceeded",
+                        "schema": {
+                            "$ref": "#/definitions/gin.H"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "admin.PaginatedScrubbedMedia": {
+            "type": "object",
+            "properties": {
+                "media": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/admin.ScrubbedMedia"
+                    }
+                },
+                "page": {
+                    "type": "integer"
+                },
+                "pageSize": {
+                    "type": "integer"
+                },
+                "totalItems": {
+                    "type": "integer"
+                },
+                "totalPages": {
+                    "type": "integer"
+                }
+            }
+        },
+        "admin.ScrubResponse": {
+            "type": "object",
+            "properties": {
+                "contentHash": {
+                    "type": "string"
+                },
+                "corruptAt": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "result": {
+                    "$ref": "#/definitions/scrub.Result"
+                },
+                "scrubbedAt": {
+                    "type": "string"
+                },
+                "storageKey": {
+                    "type": "string"
+                },
+                "storageProvider": {
+                    "type": "string"
+                },
+                "verifiedAt": {
+                    "type": "string"
+                }
+            }
+        },
+        "admin.ScrubbedMedia": {
+            "type": "object",
+            "properties": {
+                "contentHash": {
+                    "type": "string"
+                },
+                "corruptAt": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "scrubbedAt": {
+                    "type": "string"
+                },
+                "storageKey": {
+                    "type": "string"
+                },
+                "storageProvider": {
+                    "type": "string"
+                },
+                "verifiedAt": {
+                    "type": "string"
+                }
+            }
+        },
+        "fsck.ChecksumMismatch": {
+            "type": "object",
+            "properties": {
+                "actual": {
+                    "type": "string"
+                },
+                "expected": {
+                    "type": "string"
+                },
+                "key": {
+                    "type": "string"
+                },
+                "mediaId": {
+                    "type": "string"
+                }
+            }
+        },
+        "fsck.MediaBlob": {
+            "type": "object",
+            "properties": {
+                "key": {
+                    "type": "string"
+                },
+                "mediaId": {
+                    "type": "string"
+                }
+            }
+        },
+        "fsck.OrphanBlob": {
+            "type": "object",
+            "properties": {
+                "collected": {
+                    "type": "boolean"
+                },
+                "key": {
+                    "type": "string"
+                },
+                "lastModified": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer"
+                }
+            }
+        },
+        "fsck.Report": {
+            "type": "object",
+            "properties": {
+                "checkedBlobs": {
+                    "type": "integer"
+                },
+                "checkedMedia": {
+                    "type": "integer"
+                },
+                "checksumMismatches": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/fsck.ChecksumMismatch"
+                    }
+                },
+                "duration": {
+                    "type": "string"
+                },
+                "errors": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "missingBlobs": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/fsck.MediaBlob"
+                    }
+                },
+                "orphans": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/fsck.OrphanBlob"
+                    }
+                },
+                "startedAt": {
+                    "type": "string"
+                }
+            }
+        },
+        "gin.H": {
+            "type": "object",
+            "additionalProperties": {}
+        },
+        "media.CreateMediaFromURLRequest": {
+            "type": "object",
+            "properties": {
+                "externalUrl": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "sourceUrl": {
+                    "type": "string"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "media.ExifResponse": {
+            "type": "object",
+            "properties": {
+                "capturedAt": {
+                    "type": "string"
+                },
+                "exposureTime": {
+                    "description": "ExposureTime is in seconds, FocalLength in millimetres.",
+                    "type": "number"
+                },
+                "fNumber": {
+                    "type": "number"
+                },
+                "focalLength": {
+                    "type": "number"
+                },
+                "iso": {
+                    "type": "integer"
+                },
+                "lensModel": {
+                    "type": "string"
+                },
+                "location": {
+                    "$ref": "#/definitions/media.LocationResponse"
+                },
+                "make": {
+                    "type": "string"
+                },
+                "model": {
+                    "type": "string"
+                },
+                "orientation": {
+                    "type": "integer"
+                }
+            }
+        },
+        "media.LocationResponse": {
+            "type": "object",
+            "properties": {
+                "altitude": {
+                    "type": "number"
+                },
+                "latitude": {
+                    "type": "number"
+                },
+                "longitude": {
+                    "type": "number"
+                }
+            }
+        },
+        "media.MediaResponse": {
+            "type": "object",
+            "properties": {
+                "aspectRatio": {
+                    "type": "number"
+                },
+                "contentType": {
+                    "type": "string"
+                },
+                "exif": {
+                    "$ref": "#/definitions/media.ExifResponse"
+                },
+                "external": {
+                    "type": "boolean"
+                },
+                "height": {
+                    "type": "integer"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "link": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "orientation": {
+                    "type": "string"
+                },
+                "originalFilename": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer"
+                },
+                "sourceUrl": {
+                    "type": "string"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "thumbnails": {
+                    "description": "Thumbnails lists the renditions generated for images, if any.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/media.ThumbnailResponse"
+                    }
+                },
+                "width": {
+                    "type": "integer"
+                }
+            }
+        },
+        "media.PaginatedMediaResponse": {
+            "type": "object",
+            "properties": {
+                "media": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/media.SearchMediaResponse"
+                    }
+                },
+                "page": {
+                    "type": "integer"
+                },
+                "pageSize": {
+                    "type": "integer"
+                },
+                "totalItems": {
+                    "type": "integer"
+                },
+                "totalPages": {
+                    "type": "integer"
+                }
+            }
+        },
+        "media.PaginatedSimilarMediaResponse": {
+            "type": "object",
+            "properties": {
+                "media": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/media.SimilarMediaResponse"
+                    }
+                },
+                "page": {
+                    "type": "integer"
+                },
+                "pageSize": {
+                    "type": "integer"
+                },
+                "totalItems": {
+                    "type": "integer"
+                },
+                "totalPages": {
+                    "type": "integer"
+                }
+            }
+        },
+        "media.SearchMediaResponse": {
+            "type": "object",
+            "properties": {
+                "aspectRatio": {
+                    "type": "number"
+                },
+                "contentType": {
+                    "type": "string"
+                },
+                "exif": {
+                    "$ref": "#/definitions/media.ExifResponse"
+                },
+                "external": {
+                    "type": "boolean"
+                },
+                "fileUrl": {
+                    "type": "string"
+                },
+                "height": {
+                    "type": "integer"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "linkBroken": {
+                    "type": "boolean"
+                },
+                "linkCheckedAt": {
+                    "type": "string"
+                },
+                "linkStatus": {
+                    "description": "LinkStatus, LinkCheckedAt and LinkBroken report the last check of\nthe link of external media.",
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "orientation": {
+                    "type": "string"
+                },
+                "originalFilename": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer"
+                },
+                "sourceUrl": {
+                    "type": "string"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "thumbnails": {
+                    "description": "Thumbnails lists the renditions generated for images, if any.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/media.ThumbnailResponse"
+                    }
+                },
+                "width": {
+                    "type": "integer"
+                }
+            }
+        },
+        "media.SimilarMediaResponse": {
+            "type": "object",
+            "properties": {
+                "aspectRatio": {
+                    "type": "number"
+                },
+                "contentType": {
+                    "type": "string"
+                },
+                "distance": {
+                    "type": "integer"
+                },
+                "exif": {
+                    "$ref": "#/definitions/media.ExifResponse"
+                },
+                "external": {
+                    "type": "boolean"
+                },
+                "fileUrl": {
+                    "type": "string"
+                },
+                "height": {
+                    "type": "integer"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "linkBroken": {
+                    "type": "boolean"
+                },
+                "linkCheckedAt": {
+                    "type": "string"
+                },
+                "linkStatus": {
+                    "description": "LinkStatus, LinkCheckedAt and LinkBroken report the last check of\nthe link of external media.",
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "orientation": {
+                    "type": "string"
+                },
+                "originalFilename": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer"
+                },
+                "sourceUrl": {
+                    "type": "string"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "thumbnails": {
+                    "description": "Thumbnails lists the renditions generated for images, if any.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/media.ThumbnailResponse"
+                    }
+                },
+                "width": {
+                    "type": "integer"
+                }
+            }
+        },
+        "media.ThumbnailResponse": {
+            "type": "object",
+            "properties": {
+                "height": {
+                    "type": "integer"
+                },
+                "size": {
+                    "type": "string"
+                },
+                "url": {
+                    "type": "string"
+                },
+                "width": {
+                    "type": "integer"
+                }
+            }
+        },
+        "scrub.Result": {
+            "type": "string",
+            "enum": [
+                "intact",
+                "corrupt",
+                "error"
+            ],
+            "x-enum-varnames": [
+                "ResultIntact",
+                "ResultCorrupt",
+                "ResultError"
+            ]
+        },
+        "tags.ErrorResponse": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                }
+            }
+        },
+        "tags.PaginatedTagsResponse": {
+            "type": "object",
+            "properties": {
+                "page": {
+                    "type": "integer"
+                },
+                "pageSize": {
+                    "type": "integer"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/tags.TagResponse"
+                    }
+                },
+                "totalItems": {
+                    "type": "integer"
+                },
+                "totalPages": {
+                    "type": "integer"
+                }
+            }
+        },
+        "tags.TagResponse": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                }
+            }
+        }
+    },
+    "securityDefinitions": {
+        "AdminToken": {
+            "description": "\"Bearer \" followed by the ADMIN_TOKEN of the server",
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
         }
     }
 }`
@@ -0,0 +1,128 @@
+// Package exif reads the EXIF metadata cameras record in JPEG, TIFF and
+// HEIC images.
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrNoExif is returned for images that carry no EXIF metadata and for
+	// content types that cannot carry it.
+	ErrNoExif = errors.New("exif: no EXIF metadata")
+	// ErrMalformed is returned when the metadata cannot be parsed.
+	ErrMalformed = errors.New("exif: malformed metadata")
+)
+
+// maxSegmentSize bounds how much EXIF data is read into memory; a JPEG APP1
+// segment cannot be larger than 64KiB anyway.
+const maxSegmentSize = 1 << 20
+
+// Metadata is the EXIF metadata of an image. Fields the image does not
+// record are zero or nil.
+type Metadata struct {
+	Make      string
+	Model     string
+	LensModel string
+	// ExposureTime is in seconds.
+	ExposureTime *float64
+	FNumber      *float64
+	ISO          *int
+	// FocalLength is in millimetres.
+	FocalLength *float64
+	// Orientation is the EXIF orientation, 1 to 8.
+	Orientation int
+	// CapturedAt is when the image was taken. When the camera recorded
+	// its UTC offset, CaptureOffset holds it ("+02:00") and CapturedAt is in
+	// that zone; otherwise CaptureOffset is empty and CapturedAt is the
+	// camera's wall clock time, in UTC.
+	CapturedAt    *time.Time
+	CaptureOffset string
+	// Latitude and Longitude are in decimal degrees, negative south and
+	// west. Altitude is in metres, negative below sea level.
+	Latitude  *float64
+	Longitude *float64
+	Altitude  *float64
+}
+
+// Supported reports whether images of contentType can be decoded.
+func Supported(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/tiff", "image/heic", "image/heif":
+		return true
+	}
+	return false
+}
+
+// Decode reads the EXIF metadata of the image of contentType in r, which is
+// size bytes long.
+func Decode(r io.ReaderAt, size int64, contentType string) (*Metadata, error) {
+	switch contentType {
+	case "image/jpeg":
+		tiff, err := jpegExif(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return nil, err
+		}
+		return decodeTIFF(bytes.NewReader(tiff), int64(len(tiff)))
+	case "image/tiff":
+		return decodeTIFF(r, size)
+	case "image/heic", "image/heif":
+		tiff, err := heifExif(r, size)
+		if err != nil {
+			return nil, err
+		}
+		return decodeTIFF(bytes.NewReader(tiff), int64(len(tiff)))
+	}
+	return nil, ErrNoExif
+}
+
+// jpegExif returns the TIFF structure held in the "Exif" APP1 segment of a
+// JPEG, walking the segments up to the start of the image data.
+func jpegExif(r io.Reader) ([]byte, error) {
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xFF, 0xD8} {
+		return nil, ErrMalformed
+	}
+
+	for {
+		if _, err := io.ReadFull(r, marker[:1]); err != nil {
+			return nil, ErrNoExif
+		}
+		if marker[0] != 0xFF {
+			return nil, ErrMalformed
+		}
+		// Markers may be preceded by any number of 0xFF fill bytes.
+		for marker[0] == 0xFF {
+			if _, err := io.ReadFull(r, marker[:1]); err != nil {
+				return nil, ErrNoExif
+			}
+		}
+
+		switch code := marker[0]; {
+		case code == 0xD9 || code == 0xDA:
+			// End of image, or start of scan: no metadata follows.
+			return nil, ErrNoExif
+		case code == 0x01 || (code >= 0xD0 && code <= 0xD7):
+			// Standalone markers have no length.
+			continue
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return nil, ErrMalformed
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, ErrMalformed
+		}
+		if marker[0] == 0xE1 {
+			if tiff, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00")); ok {
+				return tiff, nil
+			}
+		}
+	}
+}
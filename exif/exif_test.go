@@ -0,0 +1,283 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+type entry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func ascii(tag uint16, value string) entry {
+	return entry{tag: tag, typ: typeASCII, count: uint32(len(value) + 1), value: append([]byte(value), 0)}
+}
+
+func short(order byteOrder, tag uint16, value uint16) entry {
+	return entry{tag: tag, typ: typeShort, count: 1, value: order.AppendUint16(nil, value)}
+}
+
+func rationals(order byteOrder, tag uint16, values ...uint32) entry {
+	var value []byte
+	for _, v := range values {
+		value = order.AppendUint32(value, v)
+	}
+	return entry{tag: tag, typ: typeRational, count: uint32(len(values) / 2), value: value}
+}
+
+// buildTIFF lays out a TIFF structure: the header, IFD0, the Exif and GPS
+// IFDs if given, then the values that do not fit in their entries.
+func buildTIFF(order byteOrder, ifd0 []entry, exifIFD []entry, gpsIFD []entry) []byte {
+	ifdSize := func(entries []entry) int {
+		if len(entries) == 0 {
+			return 0
+		}
+		return 2 + 12*len(entries) + 4
+	}
+	if len(exifIFD) > 0 {
+		ifd0 = append(ifd0, entry{tag: tagExifIFD, typ: typeLong, count: 1})
+	}
+	if len(gpsIFD) > 0 {
+		ifd0 = append(ifd0, entry{tag: tagGPSIFD, typ: typeLong, count: 1})
+	}
+	exifOffset := 8 + ifdSize(ifd0)
+	gpsOffset := exifOffset + ifdSize(exifIFD)
+	dataOffset := gpsOffset + ifdSize(gpsIFD)
+	for i := range ifd0 {
+		switch ifd0[i].tag {
+		case tagExifIFD:
+			ifd0[i].value = order.AppendUint32(nil, uint32(exifOffset))
+		case tagGPSIFD:
+			ifd0[i].value = order.AppendUint32(nil, uint32(gpsOffset))
+		}
+	}
+
+	var out, data []byte
+	if order == binary.LittleEndian {
+		out = append(out, "II*\x00"...)
+	} else {
+		out = append(out, "MM\x00*"...)
+	}
+	out = order.AppendUint32(out, 8)
+	for _, entries := range [][]entry{ifd0, exifIFD, gpsIFD} {
+		if len(entries) == 0 {
+			continue
+		}
+		out = order.AppendUint16(out, uint16(len(entries)))
+		for _, e := range entries {
+			out = order.AppendUint16(out, e.tag)
+			out = order.AppendUint16(out, e.typ)
+			out = order.AppendUint32(out, e.count)
+			if len(e.value) <= 4 {
+				out = append(out, append(e.value, make([]byte, 4-len(e.value))...)...)
+			} else {
+				out = order.AppendUint32(out, uint32(dataOffset+len(data)))
+				data = append(data, e.value...)
+			}
+		}
+		out = order.AppendUint32(out, 0)
+	}
+	return append(out, data...)
+}
+
+func sampleTIFF(order byteOrder) []byte {
+	return buildTIFF(order,
+		[]entry{
+			ascii(tagMake, "Canon"),
+			ascii(tagModel, "Canon EOS R5"),
+			short(order, tagOrientation, 6),
+			ascii(tagDateTime, "2024:05:02 10:00:00"),
+		},
+		[]entry{
+			rationals(order, tagExposureTime, 1, 250),
+			rationals(order, tagFNumber, 28, 10),
+			short(order, tagISO, 400),
+			ascii(tagDateTimeOriginal, "2024:05:01 18:30:15"),
+			ascii(tagOffsetOriginal, "+02:00"),
+			rationals(order, tagFocalLength, 50, 1),
+			ascii(tagLensModel, "RF50mm F1.8 STM"),
+		},
+		[]entry{
+			ascii(tagGPSLatitudeRef, "N"),
+			rationals(order, tagGPSLatitude, 48, 1, 51, 1, 2940, 100),
+			ascii(tagGPSLongitudeRef, "W"),
+			rationals(order, tagGPSLongitude, 2, 1, 17, 1, 4000, 100),
+			{tag: tagGPSAltitudeRef, typ: typeByte, count: 1, value: []byte{1}},
+			rationals(order, tagGPSAltitude, 15, 2),
+		},
+	)
+}
+
+func jpegWithExif(tiff []byte) []byte {
+	out := []byte{0xFF, 0xD8}
+	jfif := []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	out = append(out, 0xFF, 0xE0)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(jfif)+2))
+	out = append(out, jfif...)
+	if tiff != nil {
+		payload := append([]byte("Exif\x00\x00"), tiff...)
+		out = append(out, 0xFF, 0xE1)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+		out = append(out, payload...)
+	}
+	return append(out, 0xFF, 0xDA, 0x00, 0x02, 0xFF, 0xD9)
+}
+
+func isoBox(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(out, typ...), body...)
+}
+
+// heicWithExif lays out a HEIC file whose item 2 is the Exif item, stored in
+// the mdat box.
+func heicWithExif(tiff []byte) []byte {
+	exifItem := append(binary.BigEndian.AppendUint32(nil, 6), "Exif\x00\x00"...)
+	exifItem = append(exifItem, tiff...)
+
+	infe := func(id uint16, itemType string) []byte {
+		payload := []byte{2, 0, 0, 0}
+		payload = binary.BigEndian.AppendUint16(payload, id)
+		payload = append(payload, 0, 0)
+		payload = append(payload, itemType...)
+		return isoBox("infe", payload, []byte{0})
+	}
+	iinf := isoBox("iinf", []byte{0, 0, 0, 0, 0, 2}, infe(1, "hvc1"), infe(2, "Exif"))
+	iloc := func(exifOffset uint32) []byte {
+		payload := []byte{0, 0, 0, 0, 0x44, 0x00}
+		payload = binary.BigEndian.AppendUint16(payload, 2)
+		for _, item := range []struct {
+			id             uint16
+			offset, length uint32
+		}{{1, 0, 0}, {2, exifOffset, uint32(len(exifItem))}} {
+			payload = binary.BigEndian.AppendUint16(payload, item.id)
+			payload = binary.BigEndian.AppendUint16(payload, 0)
+			payload = binary.BigEndian.AppendUint16(payload, 1)
+			payload = binary.BigEndian.AppendUint32(payload, item.offset)
+			payload = binary.BigEndian.AppendUint32(payload, item.length)
+		}
+		return isoBox("iloc", payload)
+	}
+
+	ftyp := isoBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	meta := func(exifOffset uint32) []byte {
+		return isoBox("meta", []byte{0, 0, 0, 0}, isoBox("hdlr", make([]byte, 24)), iinf, iloc(exifOffset))
+	}
+	// The Exif item is the payload of mdat, right after meta.
+	exifOffset := uint32(len(ftyp) + len(meta(0)) + 8)
+	return bytes.Join([][]byte{ftyp, meta(exifOffset), isoBox("mdat", exifItem)}, nil)
+}
+
+func decode(t *testing.T, data []byte, contentType string) (*Metadata, error) {
+	t.Helper()
+	return Decode(bytes.NewReader(data), int64(len(data)), contentType)
+}
+
+func assertSample(t *testing.T, m *Metadata) {
+	t.Helper()
+	assert.Equal(t, "Canon", m.Make)
+	assert.Equal(t, "Canon EOS R5", m.Model)
+	assert.Equal(t, "RF50mm F1.8 STM", m.LensModel)
+	require.NotNil(t, m.ExposureTime)
+	assert.InDelta(t, 0.004, *m.ExposureTime, 1e-9)
+	require.NotNil(t, m.FNumber)
+	assert.InDelta(t, 2.8, *m.FNumber, 1e-9)
+	require.NotNil(t, m.ISO)
+	assert.Equal(t, 400, *m.ISO)
+	require.NotNil(t, m.FocalLength)
+	assert.InDelta(t, 50, *m.FocalLength, 1e-9)
+	assert.Equal(t, 6, m.Orientation)
+
+	require.NotNil(t, m.CapturedAt)
+	assert.Equal(t, "+02:00", m.CaptureOffset)
+	assert.Equal(t, "2024-05-01T18:30:15+02:00", m.CapturedAt.Format(time.RFC3339))
+
+	require.NotNil(t, m.Latitude)
+	assert.InDelta(t, 48.858167, *m.Latitude, 1e-6)
+	require.NotNil(t, m.Longitude)
+	assert.InDelta(t, -2.294444, *m.Longitude, 1e-6)
+	require.NotNil(t, m.Altitude)
+	assert.InDelta(t, -7.5, *m.Altitude, 1e-9)
+}
+
+func TestDecode_JPEG(t *testing.T) {
+	m, err := decode(t, jpegWithExif(sampleTIFF(binary.LittleEndian)), "image/jpeg")
+	require.NoError(t, err)
+	assertSample(t, m)
+}
+
+func TestDecode_TIFF(t *testing.T) {
+	m, err := decode(t, sampleTIFF(binary.BigEndian), "image/tiff")
+	require.NoError(t, err)
+	assertSample(t, m)
+}
+
+func TestDecode_HEIC(t *testing.T) {
+	m, err := decode(t, heicWithExif(sampleTIFF(binary.BigEndian)), "image/heic")
+	require.NoError(t, err)
+	assertSample(t, m)
+}
+
+func TestDecode_CaptureTimeWithoutOffset(t *testing.T) {
+	order := binary.LittleEndian
+	tiff := buildTIFF(order, []entry{ascii(tagDateTime, "2023:12:24 09:15:00")}, nil, nil)
+
+	m, err := decode(t, tiff, "image/tiff")
+	require.NoError(t, err)
+
+	require.NotNil(t, m.CapturedAt)
+	assert.Empty(t, m.CaptureOffset)
+	assert.Equal(t, time.Date(2023, 12, 24, 9, 15, 0, 0, time.UTC), *m.CapturedAt)
+	assert.Nil(t, m.ISO)
+	assert.Nil(t, m.Latitude)
+}
+
+func TestDecode_UnsetClock(t *testing.T) {
+	tiff := buildTIFF(binary.LittleEndian, nil, []entry{ascii(tagDateTimeOriginal, "0000:00:00 00:00:00")}, nil)
+
+	m, err := decode(t, tiff, "image/tiff")
+	require.NoError(t, err)
+	assert.Nil(t, m.CapturedAt)
+}
+
+func TestDecode_NoExif(t *testing.T) {
+	_, err := decode(t, jpegWithExif(nil), "image/jpeg")
+	assert.ErrorIs(t, err, ErrNoExif)
+
+	_, err = decode(t, []byte("\x89PNG\r\n\x1a\n"), "image/png")
+	assert.ErrorIs(t, err, ErrNoExif)
+	assert.False(t, Supported("image/png"))
+}
+
+func TestDecode_Truncated(t *testing.T) {
+	for _, tc := range []struct {
+		contentType string
+		data        []byte
+	}{
+		{"image/jpeg", jpegWithExif(sampleTIFF(binary.LittleEndian))},
+		{"image/tiff", sampleTIFF(binary.BigEndian)},
+		{"image/heic", heicWithExif(sampleTIFF(binary.BigEndian))},
+	} {
+		// Every prefix decodes to an error or partial metadata, without
+		// panicking.
+		for n := 0; n < len(tc.data); n++ {
+			_, _ = decode(t, tc.data[:n], tc.contentType)
+		}
+	}
+
+	_, err := decode(t, []byte("II*\x00\xff\xff\xff\x00"), "image/tiff")
+	assert.ErrorIs(t, err, ErrMalformed)
+}
@@ -0,0 +1,163 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"media-indexer/isobmff"
+)
+
+// heifExif returns the TIFF structure held in the "Exif" item of a HEIF
+// (HEIC) image. Items are described in the top-level "meta" box: "iinf" gives
+// their types and "iloc" where their data lies.
+func heifExif(r io.ReaderAt, size int64) ([]byte, error) {
+	meta, ok, err := isobmff.FindMeta(r, size)
+	if err != nil || !ok {
+		return nil, orMalformed(err, ErrNoExif)
+	}
+	iinf, ok, err := isobmff.FindChild(r, meta, "iinf")
+	if err != nil || !ok {
+		return nil, orMalformed(err, ErrNoExif)
+	}
+	itemID, ok, err := exifItemID(r, iinf)
+	if err != nil || !ok {
+		return nil, orMalformed(err, ErrNoExif)
+	}
+	iloc, ok, err := isobmff.FindChild(r, meta, "iloc")
+	if err != nil || !ok {
+		return nil, ErrMalformed
+	}
+	data, err := itemData(r, size, iloc, itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The item starts with the offset of the TIFF header past that field,
+	// usually skipping an "Exif\0\0" prefix.
+	if len(data) < 4 {
+		return nil, ErrMalformed
+	}
+	headerOffset := binary.BigEndian.Uint32(data)
+	if uint64(headerOffset) > uint64(len(data)-4) {
+		return nil, ErrMalformed
+	}
+	return data[4+headerOffset:], nil
+}
+
+func orMalformed(err error, fallback error) error {
+	if err != nil {
+		return ErrMalformed
+	}
+	return fallback
+}
+
+// exifItemID returns the ID of the item of type "Exif" listed in iinf.
+func exifItemID(r io.ReaderAt, iinf isobmff.Box) (uint32, bool, error) {
+	payload, err := isobmff.ReadPayload(r, iinf, maxSegmentSize)
+	if err != nil {
+		return 0, false, err
+	}
+	p := &isobmff.Parser{Data: payload}
+	if version, _ := p.FullBox(); version == 0 {
+		p.Uint(2)
+	} else {
+		p.Uint(4)
+	}
+
+	// The item info entries ("infe" boxes) follow the entry count.
+	entries := bytes.NewReader(payload[min(p.Pos, len(payload)):])
+	for offset := int64(0); !p.Failed; {
+		infe, ok, err := isobmff.Find(entries, offset, entries.Size()-offset, "infe")
+		if err != nil || !ok {
+			return 0, false, err
+		}
+		offset = infe.Offset + infe.Size
+
+		entry := &isobmff.Parser{Data: payload[p.Pos+int(infe.Offset) : p.Pos+int(infe.Offset+infe.Size)]}
+		entryVersion, _ := entry.FullBox()
+		if entryVersion < 2 {
+			// Version 0 and 1 entries have no item type.
+			continue
+		}
+		var id uint32
+		if entryVersion == 2 {
+			id = entry.Uint(2)
+		} else {
+			id = entry.Uint(4)
+		}
+		entry.Skip(2)
+		itemType := entry.Bytes(4)
+		if !entry.Failed && string(itemType) == "Exif" {
+			return id, true, nil
+		}
+	}
+	return 0, false, ErrMalformed
+}
+
+// itemData reads the data of item id from the extents iloc lists for it.
+func itemData(r io.ReaderAt, size int64, iloc isobmff.Box, id uint32) ([]byte, error) {
+	payload, err := isobmff.ReadPayload(r, iloc, maxSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	p := &isobmff.Parser{Data: payload}
+	version, _ := p.FullBox()
+	sizes := p.Uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0x0F)
+	sizes = p.Uint(1)
+	baseOffsetSize, indexSize := int(sizes>>4), 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0x0F)
+	}
+	var itemCount uint32
+	if version < 2 {
+		itemCount = p.Uint(2)
+	} else {
+		itemCount = p.Uint(4)
+	}
+
+	for i := uint32(0); i < itemCount && !p.Failed; i++ {
+		var itemID uint32
+		if version < 2 {
+			itemID = p.Uint(2)
+		} else {
+			itemID = p.Uint(4)
+		}
+		constructionMethod := uint32(0)
+		if version == 1 || version == 2 {
+			constructionMethod = p.Uint(2) & 0x0F
+		}
+		p.Skip(2) // data reference index
+		baseOffset := p.Uint64(baseOffsetSize)
+		extentCount := p.Uint(2)
+
+		var data []byte
+		for j := uint32(0); j < extentCount && !p.Failed; j++ {
+			p.Skip(indexSize)
+			extentOffset, extentLength := p.Uint64(offsetSize), p.Uint64(lengthSize)
+			if itemID != id {
+				continue
+			}
+			// Only items stored in the file itself are supported, not ones
+			// stored in the "idat" box or referring to other items.
+			if constructionMethod != 0 {
+				return nil, ErrMalformed
+			}
+			start := baseOffset + extentOffset
+			if extentLength == 0 || start > uint64(size) || extentLength > uint64(size)-start ||
+				uint64(len(data))+extentLength > maxSegmentSize {
+				return nil, ErrMalformed
+			}
+			extent := make([]byte, extentLength)
+			if _, err := r.ReadAt(extent, int64(start)); err != nil {
+				return nil, ErrMalformed
+			}
+			data = append(data, extent...)
+		}
+		if itemID == id && !p.Failed {
+			return data, nil
+		}
+	}
+	return nil, ErrMalformed
+}
@@ -0,0 +1,268 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// TIFF tags read from IFD0, the Exif IFD and the GPS IFD.
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagOffsetTime       = 0x9010
+	tagOffsetOriginal   = 0x9011
+	tagFocalLength      = 0x920A
+	tagLensModel        = 0xA434
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+	tagGPSAltitudeRef   = 0x0005
+	tagGPSAltitude      = 0x0006
+)
+
+// TIFF field types and their sizes in bytes.
+const (
+	typeByte      = 1
+	typeASCII     = 2
+	typeShort     = 3
+	typeLong      = 4
+	typeRational  = 5
+	typeUndefined = 7
+	typeSLong     = 9
+	typeSRational = 10
+)
+
+var typeSizes = map[uint16]uint32{
+	typeByte: 1, typeASCII: 1, typeShort: 2, typeLong: 4, typeRational: 8,
+	typeUndefined: 1, typeSLong: 4, typeSRational: 8,
+}
+
+const (
+	// maxEntries bounds the entries read from a single IFD.
+	maxEntries = 1024
+	// maxValueSize bounds the value of a single field.
+	maxValueSize = 64 << 10
+)
+
+// field is an IFD entry whose value has been read.
+type field struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+type tiffReader struct {
+	r     io.ReaderAt
+	size  int64
+	order binary.ByteOrder
+}
+
+// decodeTIFF reads the metadata from a TIFF structure: an 8-byte header
+// followed by IFDs that offsets are relative to.
+func decodeTIFF(r io.ReaderAt, size int64) (*Metadata, error) {
+	var header [8]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return nil, ErrMalformed
+	}
+	t := &tiffReader{r: r, size: size}
+	switch string(header[:4]) {
+	case "II*\x00":
+		t.order = binary.LittleEndian
+	case "MM\x00*":
+		t.order = binary.BigEndian
+	default:
+		return nil, ErrMalformed
+	}
+
+	ifd0, err := t.readIFD(t.order.Uint32(header[4:]))
+	if err != nil {
+		return nil, err
+	}
+	// A broken Exif or GPS IFD only loses the fields it holds.
+	var exifIFD, gpsIFD map[uint16]field
+	if offset, ok := t.uint(ifd0, tagExifIFD); ok {
+		exifIFD, _ = t.readIFD(offset)
+	}
+	if offset, ok := t.uint(ifd0, tagGPSIFD); ok {
+		gpsIFD, _ = t.readIFD(offset)
+	}
+
+	m := &Metadata{
+		Make:         t.string(ifd0, tagMake),
+		Model:        t.string(ifd0, tagModel),
+		LensModel:    t.string(exifIFD, tagLensModel),
+		ExposureTime: t.rational(exifIFD, tagExposureTime, 0),
+		FNumber:      t.rational(exifIFD, tagFNumber, 0),
+		FocalLength:  t.rational(exifIFD, tagFocalLength, 0),
+	}
+	if iso, ok := t.uint(exifIFD, tagISO); ok && iso > 0 {
+		iso := int(iso)
+		m.ISO = &iso
+	}
+	if orientation, ok := t.uint(ifd0, tagOrientation); ok && orientation >= 1 && orientation <= 8 {
+		m.Orientation = int(orientation)
+	}
+
+	capturedAt := t.string(exifIFD, tagDateTimeOriginal)
+	offset := t.string(exifIFD, tagOffsetOriginal)
+	if capturedAt == "" {
+		capturedAt, offset = t.string(ifd0, tagDateTime), t.string(exifIFD, tagOffsetTime)
+	}
+	m.CapturedAt, m.CaptureOffset = parseDateTime(capturedAt, offset)
+
+	m.Latitude = t.coordinate(gpsIFD, tagGPSLatitude, tagGPSLatitudeRef, "S", 90)
+	m.Longitude = t.coordinate(gpsIFD, tagGPSLongitude, tagGPSLongitudeRef, "W", 180)
+	if altitude := t.rational(gpsIFD, tagGPSAltitude, 0); altitude != nil {
+		if ref, ok := gpsIFD[tagGPSAltitudeRef]; ok && len(ref.value) > 0 && ref.value[0] == 1 {
+			*altitude = -*altitude
+		}
+		m.Altitude = altitude
+	}
+	return m, nil
+}
+
+// readIFD reads the entries of the IFD at offset, keyed by tag.
+func (t *tiffReader) readIFD(offset uint32) (map[uint16]field, error) {
+	var count [2]byte
+	if _, err := t.r.ReadAt(count[:], int64(offset)); err != nil {
+		return nil, ErrMalformed
+	}
+	n := int(t.order.Uint16(count[:]))
+	if n > maxEntries {
+		return nil, ErrMalformed
+	}
+	entries := make([]byte, 12*n)
+	if _, err := t.r.ReadAt(entries, int64(offset)+2); err != nil {
+		return nil, ErrMalformed
+	}
+
+	fields := make(map[uint16]field, n)
+	for i := 0; i < n; i++ {
+		entry := entries[12*i : 12*(i+1)]
+		f := field{typ: t.order.Uint16(entry[2:]), count: t.order.Uint32(entry[4:])}
+		size, ok := typeSizes[f.typ]
+		if !ok || f.count == 0 || uint64(size)*uint64(f.count) > maxValueSize {
+			// Unknown types and oversized values are not needed.
+			continue
+		}
+		total := size * f.count
+		if total <= 4 {
+			f.value = entry[8 : 8+total]
+		} else {
+			valueOffset := int64(t.order.Uint32(entry[8:]))
+			if valueOffset+int64(total) > t.size {
+				continue
+			}
+			f.value = make([]byte, total)
+			if _, err := t.r.ReadAt(f.value, valueOffset); err != nil {
+				continue
+			}
+		}
+		fields[t.order.Uint16(entry)] = f
+	}
+	return fields, nil
+}
+
+func (t *tiffReader) string(fields map[uint16]field, tag uint16) string {
+	f, ok := fields[tag]
+	if !ok || (f.typ != typeASCII && f.typ != typeUndefined) {
+		return ""
+	}
+	value, _, _ := bytes.Cut(f.value, []byte{0})
+	return strings.TrimSpace(strings.ToValidUTF8(string(value), ""))
+}
+
+// uint returns the first value of an unsigned integer field.
+func (t *tiffReader) uint(fields map[uint16]field, tag uint16) (uint32, bool) {
+	f, ok := fields[tag]
+	if !ok {
+		return 0, false
+	}
+	switch f.typ {
+	case typeByte:
+		return uint32(f.value[0]), true
+	case typeShort:
+		return uint32(t.order.Uint16(f.value)), true
+	case typeLong:
+		return t.order.Uint32(f.value), true
+	}
+	return 0, false
+}
+
+// rational returns the i-th value of a rational field, or nil if the field
+// is missing or its denominator is zero.
+func (t *tiffReader) rational(fields map[uint16]field, tag uint16, i uint32) *float64 {
+	f, ok := fields[tag]
+	if !ok || (f.typ != typeRational && f.typ != typeSRational) || i >= f.count {
+		return nil
+	}
+	numerator, denominator := t.order.Uint32(f.value[8*i:]), t.order.Uint32(f.value[8*i+4:])
+	if denominator == 0 {
+		return nil
+	}
+	var value float64
+	if f.typ == typeSRational {
+		value = float64(int32(numerator)) / float64(int32(denominator))
+	} else {
+		value = float64(numerator) / float64(denominator)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	return &value
+}
+
+// coordinate returns a GPS latitude or longitude, recorded as degrees,
+// minutes and seconds, in decimal degrees. It is negative when the
+// reference field is negativeRef.
+func (t *tiffReader) coordinate(fields map[uint16]field, tag uint16, refTag uint16, negativeRef string, limit float64) *float64 {
+	var parts [3]float64
+	for i := range parts {
+		part := t.rational(fields, tag, uint32(i))
+		if part == nil {
+			return nil
+		}
+		parts[i] = *part
+	}
+	value := parts[0] + parts[1]/60 + parts[2]/3600
+	if value > limit {
+		return nil
+	}
+	if strings.EqualFold(t.string(fields, refTag), negativeRef) {
+		value = -value
+	}
+	return &value
+}
+
+// parseDateTime parses an EXIF date ("2006:01:02 15:04:05") and its UTC
+// offset ("+02:00"). Cameras without a clock set record blanks or zeros.
+func parseDateTime(value string, offset string) (*time.Time, string) {
+	if value == "" {
+		return nil, ""
+	}
+	location := time.UTC
+	if zone, err := time.Parse("-07:00", offset); err == nil {
+		_, seconds := zone.Zone()
+		location = time.FixedZone(offset, seconds)
+	} else {
+		offset = ""
+	}
+	parsed, err := time.ParseInLocation("2006:01:02 15:04:05", value, location)
+	if err != nil {
+		return nil, ""
+	}
+	return &parsed, offset
+}
@@ -0,0 +1,139 @@
+package imageinfo
+
+import (
+	"bytes"
+	"io"
+
+	"media-indexer/isobmff"
+)
+
+// maxPropertiesSize bounds the item properties read into memory.
+const maxPropertiesSize = 1 << 20
+
+// decodeHEIF reads the size of the primary item of a HEIF (HEIC or AVIF)
+// image: "pitm" names the item, "ipma" associates it with properties stored
+// in "ipco", among them its size ("ispe") and rotation ("irot").
+func decodeHEIF(r io.ReaderAt, size int64) (*Info, error) {
+	meta, ok, err := isobmff.FindMeta(r, size)
+	if err != nil || !ok {
+		return nil, ErrMalformed
+	}
+	pitm, ok, err := isobmff.FindChild(r, meta, "pitm")
+	if err != nil || !ok {
+		return nil, ErrMalformed
+	}
+	payload, err := isobmff.ReadPayload(r, pitm, 16)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	p := &isobmff.Parser{Data: payload}
+	var primary uint32
+	if version, _ := p.FullBox(); version == 0 {
+		primary = p.Uint(2)
+	} else {
+		primary = p.Uint(4)
+	}
+	if p.Failed {
+		return nil, ErrMalformed
+	}
+
+	iprp, ok, err := isobmff.FindChild(r, meta, "iprp")
+	if err != nil || !ok {
+		return nil, ErrMalformed
+	}
+	properties, err := isobmff.ReadPayload(r, iprp, maxPropertiesSize)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	container := bytes.NewReader(properties)
+	ipco, ok, err := isobmff.Find(container, 0, container.Size(), "ipco")
+	if err != nil || !ok {
+		return nil, ErrMalformed
+	}
+	ipma, ok, err := isobmff.Find(container, 0, container.Size(), "ipma")
+	if err != nil || !ok {
+		return nil, ErrMalformed
+	}
+
+	info := &Info{}
+	for _, index := range associatedProperties(properties[ipma.Offset:ipma.Offset+ipma.Size], primary) {
+		property, ok := nthBox(properties[ipco.Offset:ipco.Offset+ipco.Size], index)
+		if !ok {
+			continue
+		}
+		p := &isobmff.Parser{Data: property.payload}
+		switch property.typ {
+		case "ispe":
+			p.FullBox()
+			width, height := p.Uint(4), p.Uint(4)
+			if !p.Failed {
+				info.Width, info.Height = int(width), int(height)
+			}
+		case "irot":
+			// The image is turned anticlockwise by quarters; as an EXIF
+			// orientation that is 8 for one quarter and 6 for three.
+			switch p.Uint(1) & 0x03 {
+			case 1:
+				info.Orientation = 8
+			case 2:
+				info.Orientation = 3
+			case 3:
+				info.Orientation = 6
+			default:
+				info.Orientation = 1
+			}
+		}
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		return nil, ErrMalformed
+	}
+	if info.Orientation == 0 {
+		info.Orientation = 1
+	}
+	return info, nil
+}
+
+// associatedProperties returns the 1-based indexes into ipco of the
+// properties ipma associates with item.
+func associatedProperties(ipma []byte, item uint32) []int {
+	p := &isobmff.Parser{Data: ipma}
+	version, flags := p.FullBox()
+	entries := p.Uint(4)
+	for i := uint32(0); i < entries && !p.Failed; i++ {
+		var id uint32
+		if version < 1 {
+			id = p.Uint(2)
+		} else {
+			id = p.Uint(4)
+		}
+		count := int(p.Uint(1))
+		indexes := make([]int, 0, count)
+		for j := 0; j < count && !p.Failed; j++ {
+			// The top bit marks essential properties.
+			if flags&1 != 0 {
+				indexes = append(indexes, int(p.Uint(2)&0x7FFF))
+			} else {
+				indexes = append(indexes, int(p.Uint(1)&0x7F))
+			}
+		}
+		if id == item && !p.Failed {
+			return indexes
+		}
+	}
+	return nil
+}
+
+type property struct {
+	typ     string
+	payload []byte
+}
+
+// nthBox returns the index-th box in ipco, counting from 1.
+func nthBox(ipco []byte, index int) (property, bool) {
+	boxes, err := isobmff.List(bytes.NewReader(ipco), 0, int64(len(ipco)))
+	if err != nil || index < 1 || index > len(boxes) {
+		return property{}, false
+	}
+	b := boxes[index-1]
+	return property{typ: b.Type, payload: ipco[b.Offset : b.Offset+b.Size]}, true
+}
@@ -0,0 +1,72 @@
+// Package imageinfo reads the dimensions of images from their headers,
+// without decoding the pixels.
+package imageinfo
+
+import (
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	// ErrUnsupported is returned for content types that are not images
+	// whose header can be read.
+	ErrUnsupported = errors.New("imageinfo: unsupported image format")
+	// ErrMalformed is returned when the header cannot be parsed.
+	ErrMalformed = errors.New("imageinfo: malformed image header")
+)
+
+// Info describes the pixels of an image as stored.
+type Info struct {
+	Width  int
+	Height int
+	// Orientation is the rotation recorded by the container, as an EXIF
+	// orientation (1 to 8), or zero when only the EXIF metadata, if any,
+	// records it. HEIF images record their rotation in the container and
+	// their EXIF orientation is to be ignored.
+	Orientation int
+}
+
+// Supported reports whether the header of images of contentType can be read.
+func Supported(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp", "image/tiff",
+		"image/avif", "image/heic", "image/heif":
+		return true
+	}
+	return false
+}
+
+// Decode reads the header of the image of contentType in r, which is size
+// bytes long.
+func Decode(r io.ReaderAt, size int64, contentType string) (*Info, error) {
+	if !Supported(contentType) {
+		return nil, ErrUnsupported
+	}
+	switch contentType {
+	case "image/avif", "image/heic", "image/heif":
+		return decodeHEIF(r, size)
+	}
+
+	config, _, err := image.DecodeConfig(io.NewSectionReader(r, 0, size))
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrMalformed
+	}
+	return &Info{Width: config.Width, Height: config.Height}, nil
+}
+
+// Displayed returns the size of an image once rotated as its orientation
+// says: orientations 5 to 8 turn it by a quarter.
+func Displayed(width int, height int, orientation int) (int, int) {
+	if orientation >= 5 && orientation <= 8 {
+		return height, width
+	}
+	return width, height
+}
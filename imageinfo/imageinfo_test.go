@@ -0,0 +1,126 @@
+package imageinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decode(t *testing.T, data []byte, contentType string) (*Info, error) {
+	t.Helper()
+	return Decode(bytes.NewReader(data), int64(len(data)), contentType)
+}
+
+func TestDecode_StandardFormats(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	var jpegData, pngData, gifData bytes.Buffer
+	require.NoError(t, jpeg.Encode(&jpegData, img, nil))
+	require.NoError(t, png.Encode(&pngData, img))
+	require.NoError(t, gif.Encode(&gifData, img, nil))
+
+	for contentType, data := range map[string][]byte{
+		"image/jpeg": jpegData.Bytes(),
+		"image/png":  pngData.Bytes(),
+		"image/gif":  gifData.Bytes(),
+		"image/webp": webpLossless(640, 480),
+	} {
+		info, err := decode(t, data, contentType)
+		require.NoError(t, err, contentType)
+		if contentType == "image/webp" {
+			assert.Equal(t, &Info{Width: 640, Height: 480}, info)
+		} else {
+			assert.Equal(t, &Info{Width: 64, Height: 48}, info, contentType)
+		}
+	}
+}
+
+// webpLossless returns the header of a lossless WebP image, which is all
+// DecodeConfig reads.
+func webpLossless(width uint32, height uint32) []byte {
+	header := []byte{0x2f}
+	header = binary.LittleEndian.AppendUint32(header, (width-1)|(height-1)<<14)
+	chunk := append([]byte("VP8L"), binary.LittleEndian.AppendUint32(nil, uint32(len(header)))...)
+	chunk = append(chunk, header...)
+	if len(chunk)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	out := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(4+len(chunk)))...)
+	out = append(out, "WEBP"...)
+	return append(out, chunk...)
+}
+
+func isoBox(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(out, typ...), body...)
+}
+
+// heif lays out a HEIF file whose primary item 2 is associated with ispe
+// and, unless rotation is negative, irot properties. Item 1 has its own,
+// smaller ispe.
+func heif(brand string, width uint32, height uint32, rotation int) []byte {
+	ispe := func(width, height uint32) []byte {
+		payload := binary.BigEndian.AppendUint32([]byte{0, 0, 0, 0}, width)
+		return isoBox("ispe", binary.BigEndian.AppendUint32(payload, height))
+	}
+	properties := [][]byte{ispe(320, 240), ispe(width, height)}
+	// Entries are an item ID, a count and property indexes, essential ones
+	// with the top bit set.
+	associations := []byte{0, 1, 1, 1, 0, 2, 1, 2}
+	if rotation >= 0 {
+		properties = append(properties, isoBox("irot", []byte{byte(rotation)}))
+		associations = []byte{0, 1, 1, 1, 0, 2, 2, 2, 0x83}
+	}
+	ipma := isoBox("ipma", []byte{0, 0, 0, 0, 0, 0, 0, 2}, associations)
+	iprp := isoBox("iprp", isoBox("ipco", properties...), ipma)
+
+	ftyp := isoBox("ftyp", []byte(brand+"\x00\x00\x00\x00mif1"+brand))
+	pitm := isoBox("pitm", []byte{0, 0, 0, 0, 0, 2})
+	meta := isoBox("meta", []byte{0, 0, 0, 0}, isoBox("hdlr", make([]byte, 24)), pitm, iprp)
+	return bytes.Join([][]byte{ftyp, meta, isoBox("mdat")}, nil)
+}
+
+func TestDecode_HEIF(t *testing.T) {
+	info, err := decode(t, heif("heic", 4032, 3024, 3), "image/heic")
+	require.NoError(t, err)
+	assert.Equal(t, &Info{Width: 4032, Height: 3024, Orientation: 6}, info)
+	assert.Equal(t, []int{3024, 4032}, pair(Displayed(info.Width, info.Height, info.Orientation)))
+
+	info, err = decode(t, heif("avif", 1920, 1080, -1), "image/avif")
+	require.NoError(t, err)
+	assert.Equal(t, &Info{Width: 1920, Height: 1080, Orientation: 1}, info)
+}
+
+func pair(a int, b int) []int {
+	return []int{a, b}
+}
+
+func TestDecode_Unsupported(t *testing.T) {
+	_, err := decode(t, []byte("%PDF-1.7"), "application/pdf")
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
+
+func TestDecode_Malformed(t *testing.T) {
+	_, err := decode(t, []byte("\x89PNG\r\n\x1a\n"), "image/png")
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	data := heif("heic", 4032, 3024, 1)
+	// Every prefix fails cleanly, without panicking.
+	for n := 0; n < len(data)-8; n++ {
+		_, err := decode(t, data[:n], "image/heic")
+		assert.Error(t, err)
+	}
+}
+
+func TestDisplayed(t *testing.T) {
+	assert.Equal(t, []int{600, 800}, pair(Displayed(800, 600, 6)))
+	assert.Equal(t, []int{800, 600}, pair(Displayed(800, 600, 3)))
+	assert.Equal(t, []int{800, 600}, pair(Displayed(800, 600, 0)))
+}
@@ -0,0 +1,157 @@
+// Package isobmff walks the boxes of ISO base media files, the container of
+// HEIF (HEIC) and AVIF images.
+package isobmff
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrMalformed is returned for boxes that do not fit their parent.
+var ErrMalformed = errors.New("isobmff: malformed box")
+
+// maxBoxes bounds the boxes walked at each level.
+const maxBoxes = 4096
+
+// Box is a box: its type and where its payload lies.
+type Box struct {
+	Type   string
+	Offset int64
+	Size   int64
+}
+
+// Find returns the first box of type typ among the boxes in the size bytes
+// at offset.
+func Find(r io.ReaderAt, offset int64, size int64, typ string) (Box, bool, error) {
+	var found Box
+	err := walk(r, offset, size, func(b Box) bool {
+		if b.Type == typ {
+			found = b
+			return false
+		}
+		return true
+	})
+	return found, found.Type != "", err
+}
+
+// List returns the boxes in the size bytes at offset, in order.
+func List(r io.ReaderAt, offset int64, size int64) ([]Box, error) {
+	var boxes []Box
+	err := walk(r, offset, size, func(b Box) bool {
+		boxes = append(boxes, b)
+		return true
+	})
+	return boxes, err
+}
+
+// walk calls visit with the boxes in the size bytes at offset until it
+// returns false.
+func walk(r io.ReaderAt, offset int64, size int64, visit func(Box) bool) error {
+	end := offset + size
+	for i := 0; i < maxBoxes && offset+8 <= end; i++ {
+		var header [16]byte
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return err
+		}
+		b := Box{Type: string(header[4:8]), Offset: offset + 8, Size: int64(binary.BigEndian.Uint32(header[:4])) - 8}
+		switch b.Size + 8 {
+		case 0:
+			// The box extends to the end of its parent.
+			b.Size = end - b.Offset
+		case 1:
+			// A 64-bit size follows the type.
+			if _, err := r.ReadAt(header[8:], offset+8); err != nil {
+				return err
+			}
+			b.Offset += 8
+			b.Size = int64(binary.BigEndian.Uint64(header[8:])) - 16
+		}
+		if b.Size < 0 || b.Offset+b.Size > end {
+			return ErrMalformed
+		}
+		if !visit(b) {
+			return nil
+		}
+		offset = b.Offset + b.Size
+	}
+	return nil
+}
+
+// FindMeta returns the top-level "meta" box of a file of size bytes, which
+// describes the items of HEIF images. Its children follow a version and
+// flags, so they start at Offset+4.
+func FindMeta(r io.ReaderAt, size int64) (Box, bool, error) {
+	meta, ok, err := Find(r, 0, size, "meta")
+	if err != nil || !ok {
+		return Box{}, false, err
+	}
+	if meta.Size < 4 {
+		return Box{}, false, ErrMalformed
+	}
+	return meta, true, nil
+}
+
+// FindChild returns the first child of type typ of the full box b, one
+// whose children follow a version and flags, like "meta".
+func FindChild(r io.ReaderAt, b Box, typ string) (Box, bool, error) {
+	return Find(r, b.Offset+4, b.Size-4, typ)
+}
+
+// ReadPayload reads the payload of b into memory, refusing payloads larger
+// than limit.
+func ReadPayload(r io.ReaderAt, b Box, limit int64) ([]byte, error) {
+	if b.Size > limit {
+		return nil, ErrMalformed
+	}
+	payload := make([]byte, b.Size)
+	if _, err := r.ReadAt(payload, b.Offset); err != nil {
+		return nil, ErrMalformed
+	}
+	return payload, nil
+}
+
+// Parser reads big-endian fields from a box payload. Reading past the end
+// sets Failed and returns zeros.
+type Parser struct {
+	Data   []byte
+	Pos    int
+	Failed bool
+}
+
+// FullBox reads the version and flags that start the payload of a full box.
+func (p *Parser) FullBox() (version uint8, flags uint32) {
+	header := p.Uint(4)
+	return uint8(header >> 24), header & 0xFFFFFF
+}
+
+// Bytes reads the next n bytes.
+func (p *Parser) Bytes(n int) []byte {
+	if p.Failed || n < 0 || n > len(p.Data)-p.Pos {
+		p.Failed = true
+		return nil
+	}
+	b := p.Data[p.Pos : p.Pos+n]
+	p.Pos += n
+	return b
+}
+
+// Skip skips the next n bytes.
+func (p *Parser) Skip(n int) {
+	p.Bytes(n)
+}
+
+// Uint reads an n-byte unsigned integer of at most 4 bytes.
+func (p *Parser) Uint(n int) uint32 {
+	return uint32(p.Uint64(n))
+}
+
+// Uint64 reads an n-byte unsigned integer; iloc uses sizes of 0, 4 and 8
+// bytes.
+func (p *Parser) Uint64(n int) uint64 {
+	var value uint64
+	for _, b := range p.Bytes(n) {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
@@ -15,19 +15,48 @@ import (
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 	"media-indexer/config"
+	"media-indexer/controllers/admin"
+	"media-indexer/controllers/files"
 	"media-indexer/controllers/media"
+	"media-indexer/controllers/metrics"
 	"media-indexer/controllers/tags"
+	"media-indexer/controllers/uploads"
 	"media-indexer/docs"
 	mediaRepo "media-indexer/repositories/media"
 	tagRepo "media-indexer/repositories/tag"
+	"media-indexer/services/fsck"
+	"media-indexer/services/ingest"
+	"media-indexer/services/link"
+	"media-indexer/services/linkcheck"
 	mediaService "media-indexer/services/media"
+	"media-indexer/services/quota"
+	"media-indexer/services/scrub"
+	"media-indexer/services/staging"
 	"media-indexer/services/tag"
+	"media-indexer/services/thumbnail"
+	"media-indexer/services/upload"
+	"media-indexer/storage"
 )
 
 func setupApp(r *gin.Engine) {
+	storageProvider, err := storage.NewStorageFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	// Storage instances guarded by a circuit breaker report its state; the
+	// check fails while any of them is open.
 	r.GET("/health-check", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
+		status := http.StatusOK
+		health := storage.InstanceHealth(storageProvider)
+		for _, instance := range health {
+			if instance.State == storage.CircuitOpen {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		c.JSON(status, gin.H{
 			"message": "healthys",
+			"storage": health,
 		})
 	})
 	docs.SwaggerInfo.BasePath = "/api/v1"
@@ -37,10 +66,77 @@ func setupApp(r *gin.Engine) {
 	mediaRepo := mediaRepo.NewMediaRepository(config.DB)
 
 	tagService := tag.NewTagService(tagRepo)
-	mediaService := mediaService.NewMediaService(mediaRepo, tagRepo)
+	mediaService := mediaService.NewMediaService(mediaRepo)
+
+	linkConfig, err := link.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to read media link config: %v", err)
+	}
+	linkService, err := link.NewLinkService(storageProvider, linkConfig)
+	if err != nil {
+		log.Fatalf("Failed to initialize media links: %v", err)
+	}
+
+	uploadConfig, err := upload.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to read upload config: %v", err)
+	}
+	uploadService, err := upload.NewUploadService(uploadConfig.Dir)
+	if err != nil {
+		log.Fatalf("Failed to initialize upload service: %v", err)
+	}
+	go upload.RunSweeper(context.Background(), uploadService, uploadConfig.SweepInterval, uploadConfig.MaxAge)
+	quotaConfig, err := quota.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to read upload limits: %v", err)
+	}
+	quotaService, err := quota.NewQuotaService(mediaRepo, quotaConfig)
+	if err != nil {
+		log.Fatalf("Failed to initialize upload quotas: %v", err)
+	}
+
+	ingestConfig, err := ingest.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to read ingest config: %v", err)
+	}
+	ingestService := ingest.NewIngestService(ingestConfig)
+
+	stagingConfig, err := staging.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to read staging config: %v", err)
+	}
+	thumbnailConfig, err := thumbnail.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to read thumbnail config: %v", err)
+	}
+	thumbnailService := thumbnail.NewThumbnailService(mediaRepo, storageProvider, thumbnailConfig)
+	stagingService, err := staging.NewStagingService(stagingConfig.Dir, mediaService, mediaRepo, storageProvider, thumbnailService)
+	if err != nil {
+		log.Fatalf("Failed to initialize staging area: %v", err)
+	}
+	go staging.RunSweeper(context.Background(), stagingService, stagingConfig.SweepInterval, stagingConfig.MaxAge)
+
+	linkCheckConfig, err := linkcheck.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to read link check config: %v", err)
+	}
+	go linkcheck.RunChecker(context.Background(), linkcheck.NewLinkCheckService(mediaRepo, linkCheckConfig), linkCheckConfig.Interval)
+
+	scrubConfig, err := scrub.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to read scrub config: %v", err)
+	}
+	scrubService := scrub.NewScrubService(mediaRepo, storageProvider, scrubConfig)
+	go scrub.RunScrubber(context.Background(), scrubService, scrubConfig.Interval)
 
 	tagController := tags.NewTagController(tagService)
-	mediaController := media.NewMediaController(mediaService)
+	mediaController := media.NewMediaController(mediaService, storageProvider, linkService, quotaService, ingestService, stagingService)
+	fileController := files.NewFileController(storageProvider)
+	uploadController := uploads.NewUploadController(uploadService, stagingService, quotaService, quotaConfig.MaxSize)
+	metricsController := metrics.NewMetricsController(scrubService)
+
+	r.GET("/files/*path", fileController.ServeFile)
+	r.GET("/metrics", metricsController.Metrics)
 
 	v1 := r.Group("/api/v1")
 	{
@@ -48,8 +144,33 @@ func setupApp(r *gin.Engine) {
 		v1.GET("/tags", tagController.ListTags)
 		v1.POST("/media", mediaController.CreateMedia)
 		v1.GET("/media", mediaController.SearchMediaByTag)
+		v1.DELETE("/media/:id", mediaController.DeleteMedia)
+		v1.GET("/media/:id/content", mediaController.GetMediaContent)
+		v1.GET("/media/:id/thumbnail", mediaController.GetMediaThumbnail)
+		v1.GET("/media/:id/similar", mediaController.GetSimilarMedia)
+		v1.OPTIONS("/uploads", uploadController.Options)
+		v1.POST("/uploads", uploadController.CreateUpload)
+		v1.HEAD("/uploads/:id", uploadController.GetUploadOffset)
+		v1.PATCH("/uploads/:id", uploadController.PatchUpload)
+		v1.DELETE("/uploads/:id", uploadController.TerminateUpload)
+	}
+
+	// Admin endpoints are only served when a token is configured.
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		adminController := admin.NewAdminController(fsck.NewFsckService(mediaRepo, storageProvider), scrubService)
+
+		adminRoutes := v1.Group("/admin", admin.RequireToken(adminToken))
+		adminRoutes.GET("/fsck", adminController.CheckStorage)
+		adminRoutes.POST("/fsck/gc", adminController.CollectGarbage)
+		adminRoutes.GET("/scrub/corrupt", adminController.ListCorruptMedia)
+		adminRoutes.POST("/scrub/media/:id", adminController.ScrubMedia)
 	}
 }
+
+// @securityDefinitions.apikey AdminToken
+// @in header
+// @name Authorization
+// @description "Bearer " followed by the ADMIN_TOKEN of the server
 func main() {
 	fmt.Println("Initializing the application...")
 
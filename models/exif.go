@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// Exif is the EXIF metadata read from an uploaded image, stored in the
+// exif_* columns of its media. Fields the image does not record are zero or
+// nil. It has the fields of exif.Metadata, so one converts to the other.
+type Exif struct {
+	Make      string `gorm:"size:255;index"`
+	Model     string `gorm:"size:255;index"`
+	LensModel string `gorm:"size:255"`
+	// ExposureTime is in seconds, FocalLength in millimetres.
+	ExposureTime *float64
+	FNumber      *float64
+	ISO          *int `gorm:"index"`
+	FocalLength  *float64
+	Orientation  int
+	// CapturedAt is when the image was taken. CaptureOffset is the UTC
+	// offset the camera recorded ("+02:00"); when it is empty CapturedAt is
+	// the camera's wall clock time, stored as UTC.
+	CapturedAt    *time.Time `gorm:"index"`
+	CaptureOffset string     `gorm:"size:6"`
+	// Latitude and Longitude are in decimal degrees, Altitude in metres.
+	Latitude  *float64 `gorm:"index"`
+	Longitude *float64
+	Altitude  *float64
+}
@@ -1,19 +1,111 @@
 package models
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
 type Media struct {
 	gorm.Model
-	ID   uuid.UUID `gorm:"type:uuid;primary_key;"`
-	Name string    `gorm:"not null"`
-	Link string    `gorm:"not null"`
-	Tags []Tag     `gorm:"many2many:media_tags;"`
+	ID               uuid.UUID `gorm:"type:uuid;primary_key;"`
+	Name             string    `gorm:"not null"`
+	StorageProvider  string    `gorm:"size:64"`
+	StorageKey       string    `gorm:"size:255;index"`
+	ContentHash      string    `gorm:"size:64;index"`
+	ContentType      string    `gorm:"size:255"`
+	Size             int64
+	OriginalFilename string
+	// SourceURL is where the file was fetched from when the media was
+	// ingested from a URL rather than uploaded.
+	SourceURL string `gorm:"size:2048"`
+	// External media only point at content hosted elsewhere, at
+	// ExternalURL; nothing is stored for them.
+	External    bool   `gorm:"index"`
+	ExternalURL string `gorm:"size:2048"`
+	// LinkStatus is the HTTP status the external URL answered the last
+	// check with, or zero if it could not be reached. LinkCheckedAt is nil
+	// until the first check.
+	LinkStatus    int
+	LinkCheckedAt *time.Time
+	// ScrubbedAt is when the scrub job last tried to read the stored file
+	// back, VerifiedAt when it last matched ContentHash. CorruptAt is set while
+	// the file is missing or does not match, since the first scrub that
+	// found it so.
+	ScrubbedAt *time.Time `gorm:"index"`
+	VerifiedAt *time.Time
+	CorruptAt  *time.Time `gorm:"index"`
+	// Exif is the EXIF metadata of images.
+	Exif Exif `gorm:"embedded;embeddedPrefix:exif_"`
+	// Width and Height are the size of images as displayed, after any
+	// rotation their metadata asks for; they are zero for other media.
+	// AspectRatio is Width / Height.
+	Width       int `gorm:"index"`
+	Height      int `gorm:"index"`
+	AspectRatio float64
+	Orientation Orientation `gorm:"size:16;index"`
+	// Renditions are the thumbnails generated for images.
+	Renditions []Rendition `gorm:"foreignKey:MediaID"`
+	// PerceptualHash is nil for media that are not images, or images that
+	// could not be decoded.
+	PerceptualHash *PerceptualHash `gorm:"foreignKey:MediaID"`
+	// Owner is who the upload is charged to: the owner of its API key, or
+	// empty when API keys are not configured.
+	Owner string `gorm:"size:255;index"`
+	Tags  []Tag  `gorm:"many2many:media_tags;"`
+
+	// Link is the storage URL saved before StorageProvider and StorageKey
+	// existed. It is only read to backfill them; links are resolved at
+	// read time now.
+	Link string
+}
+
+// Orientation is whether an image is wider than it is tall or the other way
+// around.
+type Orientation string
+
+const (
+	OrientationLandscape Orientation = "landscape"
+	OrientationPortrait  Orientation = "portrait"
+	OrientationSquare    Orientation = "square"
+)
+
+// SetDimensions records the displayed size of an image along with its
+// aspect ratio and orientation.
+func (media *Media) SetDimensions(width int, height int) {
+	media.Width, media.Height = width, height
+	media.AspectRatio = float64(width) / float64(height)
+	switch {
+	case width > height:
+		media.Orientation = OrientationLandscape
+	case width < height:
+		media.Orientation = OrientationPortrait
+	default:
+		media.Orientation = OrientationSquare
+	}
+}
+
+// Rendition returns the rendition of media called name, or nil if there is
+// none.
+func (media *Media) Rendition(name string) *Rendition {
+	for i := range media.Renditions {
+		if media.Renditions[i].Name == name {
+			return &media.Renditions[i]
+		}
+	}
+	return nil
+}
+
+// LinkBroken reports whether the last check of an external link failed.
+func (media *Media) LinkBroken() bool {
+	return media.External && media.LinkCheckedAt != nil && (media.LinkStatus == 0 || media.LinkStatus >= 400)
 }
 
+// BeforeCreate assigns an ID unless the caller picked one up front.
 func (media *Media) BeforeCreate(_tx *gorm.DB) (err error) {
-	media.ID = uuid.New()
+	if media.ID == uuid.Nil {
+		media.ID = uuid.New()
+	}
 	return
 }
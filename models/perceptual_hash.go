@@ -0,0 +1,37 @@
+package models
+
+import (
+	"github.com/google/uuid"
+
+	"media-indexer/phash"
+)
+
+// PerceptualHash is the dHash of an image, which near-duplicates share all
+// or most bits of. Only images have one.
+//
+// Similar images are looked up by multi-index hashing: Chunk0 to Chunk3
+// hold the four 16-bit chunks of Hash, each indexed, and media whose hash is
+// within distance d of a query share at least one chunk within d/4 bits of
+// the query's.
+type PerceptualHash struct {
+	MediaID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	// Hash holds the 64 bits of the hash; Postgres has no unsigned
+	// integers.
+	Hash   int64
+	Chunk0 int32 `gorm:"index"`
+	Chunk1 int32 `gorm:"index"`
+	Chunk2 int32 `gorm:"index"`
+	Chunk3 int32 `gorm:"index"`
+}
+
+func NewPerceptualHash(mediaID uuid.UUID, hash uint64) *PerceptualHash {
+	chunks := phash.Chunks(hash)
+	return &PerceptualHash{
+		MediaID: mediaID,
+		Hash:    int64(hash),
+		Chunk0:  int32(chunks[0]),
+		Chunk1:  int32(chunks[1]),
+		Chunk2:  int32(chunks[2]),
+		Chunk3:  int32(chunks[3]),
+	}
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Rendition is a scaled-down copy of an image, such as a thumbnail, stored
+// next to the original under its own content-addressed key.
+type Rendition struct {
+	MediaID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	// Name is the configured size the rendition was made for, e.g. "small".
+	Name            string `gorm:"primaryKey;size:32"`
+	Width           int
+	Height          int
+	StorageProvider string `gorm:"size:64"`
+	StorageKey      string `gorm:"size:255;index"`
+	ContentHash     string `gorm:"size:64"`
+	ContentType     string `gorm:"size:255"`
+	Size            int64
+	CreatedAt       time.Time
+}
@@ -0,0 +1,68 @@
+// Package phash computes perceptual hashes of images: hashes that stay the
+// same, or nearly, when an image is resized, recompressed or slightly
+// edited, so near-duplicates are found by comparing bits.
+package phash
+
+import (
+	"image"
+	"math/bits"
+
+	"golang.org/x/image/draw"
+)
+
+// DHash returns the difference hash of img. The image is shrunk to 9x8 grey
+// pixels and each of the 64 bits, from the most significant, tells whether
+// a pixel is brighter than its right neighbour.
+func DHash(img image.Image) uint64 {
+	grey := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.BiLinear.Scale(grey, grey.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if grey.GrayAt(x, y).Y > grey.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// Distance returns the number of bits a and b differ in, their Hamming
+// distance.
+func Distance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Chunks splits hash into four 16-bit chunks, the most significant first.
+// Two hashes within distance d of each other have at least one chunk within
+// d/4 of each other, so similar hashes are found by looking up the chunks
+// close to those of the query, rather than comparing every hash.
+func Chunks(hash uint64) [4]uint16 {
+	return [4]uint16{uint16(hash >> 48), uint16(hash >> 32), uint16(hash >> 16), uint16(hash)}
+}
+
+// Neighbors returns the chunks within radius bits of chunk, chunk included.
+func Neighbors(chunk uint16, radius int) []uint16 {
+	neighbors := []uint16{chunk}
+	// Each round flips one more bit, above the highest one flipped so far,
+	// so every neighbour is produced once.
+	type neighbor struct {
+		value   uint16
+		nextBit int
+	}
+	round := []neighbor{{value: chunk}}
+	for r := 0; r < radius; r++ {
+		var next []neighbor
+		for _, n := range round {
+			for bit := n.nextBit; bit < 16; bit++ {
+				flipped := neighbor{value: n.value ^ 1<<bit, nextBit: bit + 1}
+				next = append(next, flipped)
+				neighbors = append(neighbors, flipped.value)
+			}
+		}
+		round = next
+	}
+	return neighbors
+}
@@ -0,0 +1,72 @@
+package phash
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/draw"
+)
+
+// gradient returns an image with some structure: brightness rises to the
+// right and falls down, with a dark square in the middle.
+func gradient(width int, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8((x*255/width + (height-y)*255/height) / 2)
+			if x > width/3 && x < width/2 && y > height/3 && y < height/2 {
+				v = 10
+			}
+			img.Set(x, y, color.RGBA{R: v, G: v / 2, B: 255 - v, A: 255})
+		}
+	}
+	return img
+}
+
+func TestDHash_NearDuplicates(t *testing.T) {
+	original := gradient(640, 480)
+	hash := DHash(original)
+
+	resized := image.NewRGBA(image.Rect(0, 0, 200, 150))
+	draw.BiLinear.Scale(resized, resized.Bounds(), original, original.Bounds(), draw.Src, nil)
+	assert.LessOrEqual(t, Distance(hash, DHash(resized)), 2)
+
+	// Cropping a few percent off the edges keeps the hash close.
+	cropped := original.SubImage(image.Rect(12, 10, 628, 470))
+	assert.LessOrEqual(t, Distance(hash, DHash(cropped)), 10)
+
+	mirrored := image.NewRGBA(original.Bounds())
+	for y := 0; y < 480; y++ {
+		for x := 0; x < 640; x++ {
+			mirrored.Set(639-x, y, original.At(x, y))
+		}
+	}
+	assert.Greater(t, Distance(hash, DHash(mirrored)), 20)
+}
+
+func TestDistance(t *testing.T) {
+	assert.Equal(t, 0, Distance(0xdeadbeef, 0xdeadbeef))
+	assert.Equal(t, 64, Distance(0, ^uint64(0)))
+	assert.Equal(t, 2, Distance(0b1010, 0b0000))
+}
+
+func TestChunks(t *testing.T) {
+	assert.Equal(t, [4]uint16{0x0123, 0x4567, 0x89ab, 0xcdef}, Chunks(0x0123456789abcdef))
+}
+
+func TestNeighbors(t *testing.T) {
+	assert.Equal(t, []uint16{0xff00}, Neighbors(0xff00, 0))
+
+	for radius, count := range map[int]int{1: 1 + 16, 2: 1 + 16 + 120, 3: 1 + 16 + 120 + 560} {
+		neighbors := Neighbors(0xff00, radius)
+		assert.Len(t, neighbors, count)
+		seen := map[uint16]bool{}
+		for _, n := range neighbors {
+			assert.False(t, seen[n], "%04x is listed twice", n)
+			seen[n] = true
+			assert.LessOrEqual(t, Distance(uint64(n), 0xff00), radius)
+		}
+	}
+}
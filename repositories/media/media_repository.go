@@ -1,13 +1,73 @@
 package media
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 
 	"media-indexer/models"
 )
 
+// SearchFilter narrows down a search beyond its tags. Nil fields do not
+// filter.
+type SearchFilter struct {
+	// Broken keeps only external media whose last link check failed when
+	// true, and drops them when false.
+	Broken *bool
+	// CameraMake, CameraModel and LensModel match the EXIF metadata of
+	// images, ignoring case. Empty strings do not filter.
+	CameraMake  string
+	CameraModel string
+	LensModel   string
+	// MinISO and MaxISO bound the ISO speed, inclusively.
+	MinISO *int
+	MaxISO *int
+	// CapturedAfter and CapturedBefore bound when images were taken,
+	// inclusively.
+	CapturedAfter  *time.Time
+	CapturedBefore *time.Time
+	// HasLocation keeps only images with GPS coordinates when true, and
+	// only those without when false.
+	HasLocation *bool
+	// Within keeps only images taken inside the area.
+	Within *BoundingBox
+	// MinWidth and MinHeight bound the displayed size of images in pixels,
+	// inclusively.
+	MinWidth  *int
+	MinHeight *int
+	// Orientation keeps only images of that orientation. An empty
+	// orientation does not filter.
+	Orientation models.Orientation
+}
+
+// BoundingBox is an area between two latitudes and two longitudes, in
+// decimal degrees. It does not wrap around the antimeridian.
+type BoundingBox struct {
+	MinLatitude  float64
+	MinLongitude float64
+	MaxLatitude  float64
+	MaxLongitude float64
+}
+
 type MediaRepository interface {
 	Create(media *models.Media) error
-	FindByTagNames(tagNames []string, page int, pageSize int) ([]models.Media, int64, error)
-	AssociateMediaWithTag(mediaID uuid.UUID, tagID uuid.UUID, tagName string) error
+	CreateWithTags(media *models.Media, tagNames []string) ([]models.Tag, error)
+	FindByID(id uuid.UUID) (*models.Media, error)
+	Delete(media *models.Media) error
+	FindBatch(afterID uuid.UUID, limit int) ([]models.Media, error)
+	CountByContentHash(contentHash string) (int64, error)
+	SumSizeByOwner(owner string) (int64, error)
+	UpdateLocation(id uuid.UUID, provider string, key string, contentHash string) error
+	CreateRenditions(renditions []models.Rendition) error
+	UpdateRenditionLocation(mediaID uuid.UUID, name string, provider string, key string, contentHash string) error
+	SavePerceptualHash(hash *models.PerceptualHash) error
+	FindSimilar(hash uint64, maxDistance int, excludeID uuid.UUID, page int, pageSize int) ([]models.Media, int64, error)
+	FindByTagNames(tagNames []string, filter SearchFilter, page int, pageSize int) ([]models.Media, int64, error)
+	FindExternalBatch(afterID uuid.UUID, limit int) ([]models.Media, error)
+	UpdateLinkStatus(id uuid.UUID, status int, checkedAt time.Time) error
+	FindScrubBatch(scrubbedBefore time.Time, limit int) ([]models.Media, error)
+	UpdateScrubResult(id uuid.UUID, scrubbedAt time.Time, intact bool) error
+	UpdateScrubAttempt(id uuid.UUID, scrubbedAt time.Time) error
+	FindCorrupt(page int, pageSize int) ([]models.Media, int64, error)
+	CountCorrupt() (int64, error)
 }
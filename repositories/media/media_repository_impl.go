@@ -1,10 +1,14 @@
 package media
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"media-indexer/models"
+	"media-indexer/phash"
 )
 
 type MediaRepositoryImpl struct {
@@ -19,12 +23,293 @@ func (r *MediaRepositoryImpl) Create(media *models.Media) error {
 	return r.DB.Create(media).Error
 }
 
-func (r *MediaRepositoryImpl) FindByTagNames(tagNames []string, page int, pageSize int) ([]models.Media, int64, error) {
+// CreateWithTags creates the media along with its tags and associations in
+// one transaction, so a failure leaves nothing behind. Missing tags are
+// created.
+func (r *MediaRepositoryImpl) CreateWithTags(media *models.Media, tagNames []string) ([]models.Tag, error) {
+	var tags []models.Tag
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(media).Error; err != nil {
+			return err
+		}
+		tags = make([]models.Tag, 0, len(tagNames))
+		for _, tagName := range tagNames {
+			var tag models.Tag
+			if err := tx.Where(models.Tag{Name: tagName}).FirstOrCreate(&tag).Error; err != nil {
+				return err
+			}
+			mediaTag := models.MediaTag{MediaID: media.ID, TagID: tag.ID, TagName: tag.Name}
+			if err := tx.Create(&mediaTag).Error; err != nil {
+				return err
+			}
+			tags = append(tags, tag)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (r *MediaRepositoryImpl) FindByID(id uuid.UUID) (*models.Media, error) {
+	var media models.Media
+	err := r.DB.Preload("Tags").Preload("Renditions").Preload("PerceptualHash").Where("id = ?", id).First(&media).Error
+	if err != nil {
+		return nil, err
+	}
+	return &media, nil
+}
+
+// Delete removes the media, its tag associations, renditions and perceptual
+// hash permanently. The row is not soft deleted because its blobs are released
+// along with it.
+func (r *MediaRepositoryImpl) Delete(media *models.Media) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("media_id = ?", media.ID).Delete(&models.MediaTag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("media_id = ?", media.ID).Delete(&models.Rendition{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("media_id = ?", media.ID).Delete(&models.PerceptualHash{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(media).Error
+	})
+}
+
+// FindBatch returns up to limit media with a stored file ordered by ID,
+// along with their renditions and perceptual hashes, starting after afterID.
+// Pass uuid.Nil to start from the beginning.
+func (r *MediaRepositoryImpl) FindBatch(afterID uuid.UUID, limit int) ([]models.Media, error) {
+	var mediaList []models.Media
+	err := r.DB.Preload("Renditions").Preload("PerceptualHash").Where("id > ? AND NOT external", afterID).Order("id").Limit(limit).Find(&mediaList).Error
+	if err != nil {
+		return nil, err
+	}
+	return mediaList, nil
+}
+
+// FindExternalBatch returns up to limit external media ordered by ID,
+// starting after afterID.
+func (r *MediaRepositoryImpl) FindExternalBatch(afterID uuid.UUID, limit int) ([]models.Media, error) {
+	var mediaList []models.Media
+	err := r.DB.Where("id > ? AND external", afterID).Order("id").Limit(limit).Find(&mediaList).Error
+	if err != nil {
+		return nil, err
+	}
+	return mediaList, nil
+}
+
+// UpdateLinkStatus records the outcome of checking the link of external
+// media.
+func (r *MediaRepositoryImpl) UpdateLinkStatus(id uuid.UUID, status int, checkedAt time.Time) error {
+	return r.DB.Model(&models.Media{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"link_status": status, "link_checked_at": checkedAt}).Error
+}
+
+// FindScrubBatch returns up to limit media with a stored file that have not
+// been scrubbed since scrubbedBefore, those never scrubbed or scrubbed
+// longest ago first.
+func (r *MediaRepositoryImpl) FindScrubBatch(scrubbedBefore time.Time, limit int) ([]models.Media, error) {
+	var mediaList []models.Media
+	err := r.DB.Where("NOT external AND (scrubbed_at IS NULL OR scrubbed_at < ?)", scrubbedBefore).
+		Order("scrubbed_at NULLS FIRST, id").Limit(limit).Find(&mediaList).Error
+	if err != nil {
+		return nil, err
+	}
+	return mediaList, nil
+}
+
+// UpdateScrubResult records a scrub of the stored file of the media. A
+// corrupt file keeps the time it was first found corrupt.
+func (r *MediaRepositoryImpl) UpdateScrubResult(id uuid.UUID, scrubbedAt time.Time, intact bool) error {
+	updates := map[string]interface{}{"scrubbed_at": scrubbedAt}
+	if intact {
+		updates["verified_at"] = scrubbedAt
+		updates["corrupt_at"] = nil
+	} else {
+		updates["corrupt_at"] = gorm.Expr("COALESCE(corrupt_at, ?)", scrubbedAt)
+	}
+	return r.DB.Model(&models.Media{}).Where("id = ?", id).Updates(updates).Error
+}
+
+// UpdateScrubAttempt records a scrub that could not read the stored file of
+// the media, leaving its verified and corrupt times alone.
+func (r *MediaRepositoryImpl) UpdateScrubAttempt(id uuid.UUID, scrubbedAt time.Time) error {
+	return r.DB.Model(&models.Media{}).Where("id = ?", id).Update("scrubbed_at", scrubbedAt).Error
+}
+
+// FindCorrupt returns a page of the media flagged corrupt, the longest
+// corrupt first.
+func (r *MediaRepositoryImpl) FindCorrupt(page int, pageSize int) ([]models.Media, int64, error) {
+	totalItems, err := r.CountCorrupt()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var mediaList []models.Media
+	err = r.DB.Where("corrupt_at IS NOT NULL").Order("corrupt_at, id").
+		Offset((page - 1) * pageSize).Limit(pageSize).Find(&mediaList).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return mediaList, totalItems, nil
+}
+
+func (r *MediaRepositoryImpl) CountCorrupt() (int64, error) {
+	var count int64
+	err := r.DB.Model(&models.Media{}).Where("corrupt_at IS NOT NULL").Count(&count).Error
+	return count, err
+}
+
+func (r *MediaRepositoryImpl) CountByContentHash(contentHash string) (int64, error) {
+	var count int64
+	err := r.DB.Model(&models.Media{}).Where("content_hash = ?", contentHash).Count(&count).Error
+	return count, err
+}
+
+// SumSizeByOwner returns how many bytes the media of owner take up.
+func (r *MediaRepositoryImpl) SumSizeByOwner(owner string) (int64, error) {
+	var total int64
+	err := r.DB.Model(&models.Media{}).Where("owner = ?", owner).Select("COALESCE(SUM(size), 0)").Scan(&total).Error
+	return total, err
+}
+
+// UpdateLocation points the media at a copy of its file stored elsewhere.
+func (r *MediaRepositoryImpl) UpdateLocation(id uuid.UUID, provider string, key string, contentHash string) error {
+	return r.DB.Model(&models.Media{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"storage_provider": provider, "storage_key": key, "content_hash": contentHash}).Error
+}
+
+// CreateRenditions saves renditions generated for media.
+func (r *MediaRepositoryImpl) CreateRenditions(renditions []models.Rendition) error {
+	return r.DB.Create(&renditions).Error
+}
+
+// UpdateRenditionLocation records where a rendition of the media is stored,
+// after it was moved to another instance.
+func (r *MediaRepositoryImpl) UpdateRenditionLocation(mediaID uuid.UUID, name string, provider string, key string, contentHash string) error {
+	return r.DB.Model(&models.Rendition{}).Where("media_id = ? AND name = ?", mediaID, name).
+		Updates(map[string]interface{}{"storage_provider": provider, "storage_key": key, "content_hash": contentHash}).Error
+}
+
+// SavePerceptualHash saves the perceptual hash of media, replacing the one
+// it had.
+func (r *MediaRepositoryImpl) SavePerceptualHash(hash *models.PerceptualHash) error {
+	return r.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(hash).Error
+}
+
+// hammingDistance is the number of bits perceptual_hashes.hash differs in
+// from a hash.
+const hammingDistance = "bit_count((perceptual_hashes.hash # ?)::bit(64))"
+
+// FindSimilar returns a page of the media whose perceptual hash is within
+// maxDistance bits of hash, closest first, leaving out excludeID. Only
+// media sharing a chunk within maxDistance/4 bits of those of hash are
+// compared; see models.PerceptualHash.
+func (r *MediaRepositoryImpl) FindSimilar(hash uint64, maxDistance int, excludeID uuid.UUID, page int, pageSize int) ([]models.Media, int64, error) {
+	var neighbors [4][]int32
+	for i, chunk := range phash.Chunks(hash) {
+		for _, neighbor := range phash.Neighbors(chunk, maxDistance/4) {
+			neighbors[i] = append(neighbors[i], int32(neighbor))
+		}
+	}
+	query := func() *gorm.DB {
+		return r.DB.Model(&models.Media{}).
+			Joins("JOIN perceptual_hashes ON perceptual_hashes.media_id = media.id").
+			Where("(perceptual_hashes.chunk0 IN ? OR perceptual_hashes.chunk1 IN ? OR perceptual_hashes.chunk2 IN ? OR perceptual_hashes.chunk3 IN ?)",
+				neighbors[0], neighbors[1], neighbors[2], neighbors[3]).
+			Where(hammingDistance+" <= ?", int64(hash), maxDistance).
+			Where("media.id <> ?", excludeID)
+	}
+
+	var totalItems int64
+	if err := query().Count(&totalItems).Error; err != nil {
+		return nil, 0, err
+	}
+	if totalItems == 0 {
+		return []models.Media{}, 0, nil
+	}
+
+	var mediaList []models.Media
+	err := query().
+		Order(clause.OrderBy{Expression: clause.Expr{SQL: hammingDistance + ", media.id", Vars: []interface{}{int64(hash)}}}).
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Preload("Tags").
+		Preload("Renditions").
+		Preload("PerceptualHash").
+		Find(&mediaList).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return mediaList, totalItems, nil
+}
+
+// brokenLink matches external media whose last link check failed; it mirrors
+// models.Media.LinkBroken.
+const brokenLink = "media.external AND media.link_checked_at IS NOT NULL AND (media.link_status = 0 OR media.link_status >= 400)"
+
+func applySearchFilter(query *gorm.DB, filter SearchFilter) *gorm.DB {
+	if filter.Broken != nil {
+		if *filter.Broken {
+			query = query.Where(brokenLink)
+		} else {
+			query = query.Where("NOT (" + brokenLink + ")")
+		}
+	}
+	if filter.CameraMake != "" {
+		query = query.Where("LOWER(media.exif_make) = LOWER(?)", filter.CameraMake)
+	}
+	if filter.CameraModel != "" {
+		query = query.Where("LOWER(media.exif_model) = LOWER(?)", filter.CameraModel)
+	}
+	if filter.LensModel != "" {
+		query = query.Where("LOWER(media.exif_lens_model) = LOWER(?)", filter.LensModel)
+	}
+	if filter.MinISO != nil {
+		query = query.Where("media.exif_iso >= ?", *filter.MinISO)
+	}
+	if filter.MaxISO != nil {
+		query = query.Where("media.exif_iso <= ?", *filter.MaxISO)
+	}
+	if filter.CapturedAfter != nil {
+		query = query.Where("media.exif_captured_at >= ?", *filter.CapturedAfter)
+	}
+	if filter.CapturedBefore != nil {
+		query = query.Where("media.exif_captured_at <= ?", *filter.CapturedBefore)
+	}
+	if filter.HasLocation != nil {
+		if *filter.HasLocation {
+			query = query.Where("media.exif_latitude IS NOT NULL AND media.exif_longitude IS NOT NULL")
+		} else {
+			query = query.Where("(media.exif_latitude IS NULL OR media.exif_longitude IS NULL)")
+		}
+	}
+	if box := filter.Within; box != nil {
+		query = query.Where("media.exif_latitude BETWEEN ? AND ? AND media.exif_longitude BETWEEN ? AND ?",
+			box.MinLatitude, box.MaxLatitude, box.MinLongitude, box.MaxLongitude)
+	}
+	if filter.MinWidth != nil {
+		query = query.Where("media.width >= ?", *filter.MinWidth)
+	}
+	if filter.MinHeight != nil {
+		query = query.Where("media.height >= ?", *filter.MinHeight)
+	}
+	if filter.Orientation != "" {
+		query = query.Where("media.orientation = ?", filter.Orientation)
+	}
+	return query
+}
+
+func (r *MediaRepositoryImpl) FindByTagNames(tagNames []string, filter SearchFilter, page int, pageSize int) ([]models.Media, int64, error) {
 	var mediaList []models.Media
 	offset := (page - 1) * pageSize
 
 	var totalItems int64
-	countQuery := r.DB.Model(&models.Media{}).
+	countQuery := applySearchFilter(r.DB.Model(&models.Media{}), filter).
 		Joins("JOIN media_tags ON media_tags.media_id::uuid = media.id::uuid").
 		Where("media_tags.tag_name::text IN ?", tagNames).
 		Group("media.id").
@@ -39,13 +324,14 @@ func (r *MediaRepositoryImpl) FindByTagNames(tagNames []string, page int, pageSi
 		return []models.Media{}, 0, nil
 	}
 
-	err := r.DB.Model(&models.Media{}).
+	err := applySearchFilter(r.DB.Model(&models.Media{}), filter).
 		Joins("JOIN media_tags ON media_tags.media_id::uuid = media.id::uuid").
 		Where("media_tags.tag_name::text IN ?", tagNames).
 		Group("media.id").
 		Offset(offset).
 		Limit(pageSize).
 		Preload("Tags").
+		Preload("Renditions").
 		Find(&mediaList).Error
 
 	if err != nil {
@@ -54,12 +340,3 @@ func (r *MediaRepositoryImpl) FindByTagNames(tagNames []string, page int, pageSi
 
 	return mediaList, totalItems, nil
 }
-
-func (r *MediaRepositoryImpl) AssociateMediaWithTag(mediaID uuid.UUID, tagID uuid.UUID, tagName string) error {
-	mediaTag := models.MediaTag{
-		MediaID: mediaID,
-		TagID:   tagID,
-		TagName: tagName,
-	}
-	return r.DB.Create(&mediaTag).Error
-}
@@ -0,0 +1,60 @@
+package fsck
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type FsckService interface {
+	Check(ctx context.Context, options Options) (*Report, error)
+}
+
+type Options struct {
+	// Verify reads every referenced blob and compares its SHA-256 with the
+	// content hash of the media pointing at it.
+	Verify bool
+	// Repair deletes orphaned blobs last modified more than GracePeriod ago.
+	// Younger orphans are only reported, since they may belong to an upload
+	// whose media row has not been written yet.
+	Repair      bool
+	GracePeriod time.Duration
+}
+
+type Report struct {
+	StartedAt          time.Time          `json:"startedAt"`
+	Duration           string             `json:"duration"`
+	CheckedMedia       int                `json:"checkedMedia"`
+	CheckedBlobs       int                `json:"checkedBlobs"`
+	Orphans            []OrphanBlob       `json:"orphans"`
+	MissingBlobs       []MediaBlob        `json:"missingBlobs"`
+	ChecksumMismatches []ChecksumMismatch `json:"checksumMismatches"`
+	Errors             []string           `json:"errors"`
+}
+
+// OrphanBlob is a stored blob no media points at.
+type OrphanBlob struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	Collected    bool      `json:"collected"`
+}
+
+// MediaBlob is a media row together with the key of its blob.
+type MediaBlob struct {
+	MediaID uuid.UUID `json:"mediaId"`
+	Key     string    `json:"key"`
+}
+
+type ChecksumMismatch struct {
+	MediaID  uuid.UUID `json:"mediaId"`
+	Key      string    `json:"key"`
+	Expected string    `json:"expected"`
+	Actual   string    `json:"actual"`
+}
+
+// Clean reports whether the check found no inconsistencies.
+func (r *Report) Clean() bool {
+	return len(r.Orphans) == 0 && len(r.MissingBlobs) == 0 && len(r.ChecksumMismatches) == 0 && len(r.Errors) == 0
+}
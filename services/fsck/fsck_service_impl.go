@@ -0,0 +1,192 @@
+package fsck
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"media-indexer/models"
+	"media-indexer/repositories/media"
+	"media-indexer/storage"
+)
+
+const (
+	DefaultGracePeriod = 24 * time.Hour
+	mediaBatchSize     = 1000
+)
+
+type FsckServiceImpl struct {
+	MediaRepo media.MediaRepository
+	Storage   storage.StorageProvider
+}
+
+func NewFsckService(mediaRepo media.MediaRepository, storageProvider storage.StorageProvider) FsckService {
+	return &FsckServiceImpl{MediaRepo: mediaRepo, Storage: storageProvider}
+}
+
+// Check compares the blobs held by storage with the media rows of the
+// database. Blobs are listed before media are loaded, so a blob uploaded
+// during the check is never mistaken for a missing one; the grace period
+// protects it from being collected as an orphan.
+func (s *FsckServiceImpl) Check(ctx context.Context, options Options) (*Report, error) {
+	if options.GracePeriod <= 0 {
+		options.GracePeriod = DefaultGracePeriod
+	}
+
+	report := &Report{
+		StartedAt:          time.Now(),
+		Orphans:            []OrphanBlob{},
+		MissingBlobs:       []MediaBlob{},
+		ChecksumMismatches: []ChecksumMismatch{},
+		Errors:             []string{},
+	}
+
+	blobs := make(map[string]storage.ObjectInfo)
+	err := storage.ListObjects(ctx, s.Storage, func(info storage.ObjectInfo) error {
+		blobs[info.Key] = info
+		return nil
+	})
+	if errors.Is(err, storage.ErrListUnsupported) {
+		report.Errors = append(report.Errors, "orphan detection skipped: storage provider cannot list objects")
+	} else if err != nil {
+		return nil, fmt.Errorf("list blobs: %w", err)
+	}
+	report.CheckedBlobs = len(blobs)
+
+	referenced := make(map[string]bool)
+	err = s.eachMedia(ctx, func(m models.Media) error {
+		report.CheckedMedia++
+		key := m.StorageKey
+		referenced[key] = true
+		// Thumbnails are not checked, only kept from being collected; they
+		// can be rendered again from the original.
+		for _, rendition := range m.Renditions {
+			referenced[rendition.StorageKey] = true
+		}
+
+		found, err := s.blobExists(ctx, blobs, m, key)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("media %s: %v", m.ID, err))
+			return nil
+		}
+		if !found {
+			report.MissingBlobs = append(report.MissingBlobs, MediaBlob{MediaID: m.ID, Key: key})
+			return nil
+		}
+
+		if options.Verify {
+			if mismatch, err := s.verify(ctx, m, key); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("media %s: %v", m.ID, err))
+			} else if mismatch != nil {
+				report.ChecksumMismatches = append(report.ChecksumMismatches, *mismatch)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-options.GracePeriod)
+	for key, info := range blobs {
+		if referenced[key] {
+			continue
+		}
+		orphan := OrphanBlob{Key: key, Size: info.Size, LastModified: info.LastModified}
+		if options.Repair && info.LastModified.Before(cutoff) {
+			if err := s.collect(ctx, key); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("collect %s: %v", key, err))
+			} else {
+				orphan.Collected = true
+			}
+		}
+		report.Orphans = append(report.Orphans, orphan)
+	}
+
+	report.Duration = time.Since(report.StartedAt).Round(time.Millisecond).String()
+	return report, nil
+}
+
+func (s *FsckServiceImpl) eachMedia(ctx context.Context, fn func(models.Media) error) error {
+	afterID := uuid.Nil
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch, err := s.MediaRepo.FindBatch(afterID, mediaBatchSize)
+		if err != nil {
+			return fmt.Errorf("load media: %w", err)
+		}
+		for _, m := range batch {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		if len(batch) < mediaBatchSize {
+			return nil
+		}
+		afterID = batch[len(batch)-1].ID
+	}
+}
+
+func (s *FsckServiceImpl) blobExists(ctx context.Context, blobs map[string]storage.ObjectInfo, m models.Media, key string) (bool, error) {
+	if _, ok := blobs[key]; ok {
+		return true, nil
+	}
+	// The blob may have been written after the listing, or the provider
+	// cannot list at all, so ask for it directly.
+	return storage.InstanceNamed(s.Storage, m.StorageProvider).Exists(ctx, key)
+}
+
+// verify hashes the blob of m and returns a mismatch if it differs from the
+// hash the media was stored with.
+func (s *FsckServiceImpl) verify(ctx context.Context, m models.Media, key string) (*ChecksumMismatch, error) {
+	reader, err := storage.InstanceNamed(s.Storage, m.StorageProvider).Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return nil, err
+	}
+
+	expected := m.ContentHash
+	if expected == "" {
+		expected = contentHashFromKey(key)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return &ChecksumMismatch{MediaID: m.ID, Key: key, Expected: expected, Actual: actual}, nil
+	}
+	return nil, nil
+}
+
+// collect deletes an orphaned blob, unless a media row pointing at it was
+// created since the media were loaded.
+func (s *FsckServiceImpl) collect(ctx context.Context, key string) error {
+	count, err := s.MediaRepo.CountByContentHash(contentHashFromKey(key))
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("blob is referenced again")
+	}
+	log.Printf("fsck: deleting orphaned blob %s", key)
+	return s.Storage.Delete(ctx, key)
+}
+
+// contentHashFromKey strips the extension from a content-addressed key.
+func contentHashFromKey(key string) string {
+	if len(key) < sha256.Size*2 {
+		return key
+	}
+	return key[:sha256.Size*2]
+}
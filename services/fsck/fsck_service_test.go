@@ -0,0 +1,147 @@
+package fsck
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"media-indexer/models"
+	"media-indexer/repositories/media"
+	"media-indexer/storage"
+)
+
+// fakeMediaRepository keeps media in memory. Only the methods used by fsck
+// are implemented.
+type fakeMediaRepository struct {
+	media.MediaRepository
+	media []models.Media
+}
+
+func (r *fakeMediaRepository) FindBatch(afterID uuid.UUID, limit int) ([]models.Media, error) {
+	var batch []models.Media
+	for _, m := range r.media {
+		if m.ID.String() > afterID.String() && len(batch) < limit {
+			batch = append(batch, m)
+		}
+	}
+	return batch, nil
+}
+
+func (r *fakeMediaRepository) CountByContentHash(contentHash string) (int64, error) {
+	var count int64
+	for _, m := range r.media {
+		if m.ContentHash == contentHash {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *fakeMediaRepository) add(object *storage.Object, renditions ...models.Rendition) models.Media {
+	m := models.Media{ID: uuid.New(), StorageKey: object.Key, ContentHash: object.ContentHash, Renditions: renditions}
+	r.media = append(r.media, m)
+	sort.Slice(r.media, func(i, j int) bool { return r.media[i].ID.String() < r.media[j].ID.String() })
+	return m
+}
+
+type fixture struct {
+	service *FsckServiceImpl
+	storage *storage.LocalStorage
+	repo    *fakeMediaRepository
+
+	healthy, missing, corrupt models.Media
+	orphan, thumbnail         *storage.Object
+}
+
+func setup(t *testing.T) *fixture {
+	t.Helper()
+	ctx := context.Background()
+
+	s, err := storage.NewLocalStorage(storage.LocalConfig{RootDir: t.TempDir(), BaseURL: "http://localhost/files", SigningKey: "test"})
+	require.NoError(t, err)
+	repo := &fakeMediaRepository{}
+	f := &fixture{service: NewFsckService(repo, s).(*FsckServiceImpl), storage: s, repo: repo}
+
+	upload := func(content string) *storage.Object {
+		object, err := s.UploadFile(ctx, strings.NewReader(content), "notes.txt")
+		require.NoError(t, err)
+		return object
+	}
+
+	f.thumbnail = upload("thumbnail")
+	f.healthy = repo.add(upload("healthy"), models.Rendition{Name: "small", StorageKey: f.thumbnail.Key})
+
+	missing := upload("missing")
+	f.missing = repo.add(missing)
+	require.NoError(t, s.Delete(ctx, missing.Key))
+
+	corrupt := upload("corrupt")
+	corrupt.ContentHash = strings.Repeat("0", 64)
+	f.corrupt = repo.add(corrupt)
+
+	f.orphan = upload("orphan")
+	return f
+}
+
+func TestCheck(t *testing.T) {
+	f := setup(t)
+
+	report, err := f.service.Check(context.Background(), Options{})
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, report.CheckedMedia)
+	assert.Equal(t, 4, report.CheckedBlobs)
+	require.Len(t, report.Orphans, 1)
+	assert.Equal(t, f.orphan.Key, report.Orphans[0].Key)
+	assert.False(t, report.Orphans[0].Collected)
+	assert.Equal(t, []MediaBlob{{MediaID: f.missing.ID, Key: f.missing.StorageKey}}, report.MissingBlobs)
+	assert.Empty(t, report.ChecksumMismatches)
+	assert.False(t, report.Clean())
+
+	exists, err := f.storage.Exists(context.Background(), f.orphan.Key)
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestCheck_Verify(t *testing.T) {
+	f := setup(t)
+
+	report, err := f.service.Check(context.Background(), Options{Verify: true})
+	require.NoError(t, err)
+
+	require.Len(t, report.ChecksumMismatches, 1)
+	mismatch := report.ChecksumMismatches[0]
+	assert.Equal(t, f.corrupt.ID, mismatch.MediaID)
+	assert.Equal(t, f.corrupt.ContentHash, mismatch.Expected)
+	assert.Equal(t, mismatch.Actual, f.corrupt.StorageKey[:64])
+}
+
+func TestCheck_RepairRespectsGracePeriod(t *testing.T) {
+	f := setup(t)
+	ctx := context.Background()
+
+	report, err := f.service.Check(ctx, Options{Repair: true, GracePeriod: time.Hour})
+	require.NoError(t, err)
+	require.Len(t, report.Orphans, 1)
+	assert.False(t, report.Orphans[0].Collected)
+
+	report, err = f.service.Check(ctx, Options{Repair: true, GracePeriod: time.Nanosecond})
+	require.NoError(t, err)
+	require.Len(t, report.Orphans, 1)
+	assert.True(t, report.Orphans[0].Collected)
+
+	exists, err := f.storage.Exists(ctx, f.orphan.Key)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	for _, key := range []string{f.healthy.StorageKey, f.thumbnail.Key} {
+		exists, err = f.storage.Exists(ctx, key)
+		require.NoError(t, err)
+		assert.True(t, exists, key)
+	}
+}
@@ -0,0 +1,94 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidURL        = errors.New("source url must be an absolute http or https url")
+	ErrHostNotAllowed    = errors.New("source host is not allowed")
+	ErrAddressNotAllowed = errors.New("source resolves to a private or reserved address")
+	ErrTooManyRedirects  = errors.New("source redirected too often")
+	ErrSourceTooLarge    = errors.New("source exceeds the maximum size")
+	ErrSourceTimeout     = errors.New("fetching the source timed out")
+	ErrSourceUnreachable = errors.New("source could not be fetched")
+)
+
+const (
+	defaultTimeout      = 30 * time.Second
+	defaultMaxSize      = 100 << 20
+	defaultMaxRedirects = 5
+)
+
+type IngestService interface {
+	// Fetch starts downloading rawURL. The source must be on an allowed host
+	// and resolve to a public address, also after redirects. Reading the body
+	// fails with ErrSourceTooLarge past the size limit and ErrSourceTimeout
+	// once the time limit has passed; the caller must close it.
+	Fetch(ctx context.Context, rawURL string) (*Download, error)
+}
+
+// Download is a source being fetched.
+type Download struct {
+	Body io.ReadCloser
+	// URL is where the body came from, after redirects.
+	URL string
+	// FileName is taken from Content-Disposition or the last path segment of
+	// URL, and may be empty.
+	FileName string
+}
+
+type Config struct {
+	// AllowedHosts lists the hosts media may be fetched from, e.g.
+	// "cdn.partner.com", or "*.partner.com" for every subdomain. Fetching is
+	// disabled while it is empty.
+	AllowedHosts []string
+	// MaxSize limits the bytes fetched from a source, on top of the upload
+	// limits of its content type.
+	MaxSize int64
+	// Timeout bounds a whole fetch, including reading the body.
+	Timeout      time.Duration
+	MaxRedirects int
+}
+
+// ConfigFromEnv reads INGEST_ALLOWED_HOSTS as a comma separated list,
+// INGEST_MAX_SIZE in bytes, INGEST_TIMEOUT as a duration such as "30s" and
+// INGEST_MAX_REDIRECTS.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{MaxSize: defaultMaxSize, Timeout: defaultTimeout, MaxRedirects: defaultMaxRedirects}
+
+	for _, host := range strings.Split(os.Getenv("INGEST_ALLOWED_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			cfg.AllowedHosts = append(cfg.AllowedHosts, strings.ToLower(host))
+		}
+	}
+	if value := os.Getenv("INGEST_MAX_SIZE"); value != "" {
+		maxSize, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxSize <= 0 {
+			return Config{}, fmt.Errorf("parse INGEST_MAX_SIZE: %q is not a size in bytes", value)
+		}
+		cfg.MaxSize = maxSize
+	}
+	if value := os.Getenv("INGEST_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return Config{}, fmt.Errorf("parse INGEST_TIMEOUT: %q is not a duration", value)
+		}
+		cfg.Timeout = timeout
+	}
+	if value := os.Getenv("INGEST_MAX_REDIRECTS"); value != "" {
+		maxRedirects, err := strconv.Atoi(value)
+		if err != nil || maxRedirects < 0 {
+			return Config{}, fmt.Errorf("parse INGEST_MAX_REDIRECTS: %q is not a number", value)
+		}
+		cfg.MaxRedirects = maxRedirects
+	}
+	return cfg, nil
+}
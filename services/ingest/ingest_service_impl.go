@@ -0,0 +1,224 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// reservedPrefixes are ranges outside the loopback, private, link-local and
+// multicast ones netip knows about that must not be reachable either.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+type IngestServiceImpl struct {
+	Config Config
+
+	client *http.Client
+	// allowAddress decides which resolved addresses may be dialed.
+	allowAddress func(netip.Addr) bool
+}
+
+func NewIngestService(cfg Config) IngestService {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = defaultMaxSize
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	s := &IngestServiceImpl{Config: cfg, allowAddress: PublicAddress}
+	s.client = &http.Client{
+		Transport: NewRestrictedTransport(cfg.Timeout, func(addr netip.Addr) bool { return s.allowAddress(addr) }),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > s.Config.MaxRedirects {
+				return ErrTooManyRedirects
+			}
+			return s.checkURL(req.URL)
+		},
+	}
+	return s
+}
+
+func (s *IngestServiceImpl) Fetch(ctx context.Context, rawURL string) (*Download, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, ErrInvalidURL
+	}
+	if err := s.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.Config.Timeout)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, ErrInvalidURL
+	}
+	req.Header.Set("User-Agent", "media-indexer")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, classify(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("%w: %s answered %d", ErrSourceUnreachable, resp.Request.URL.Host, resp.StatusCode)
+	}
+	if resp.ContentLength > s.Config.MaxSize {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("%w of %d bytes", ErrSourceTooLarge, s.Config.MaxSize)
+	}
+
+	return &Download{
+		Body:     &body{body: resp.Body, remaining: s.Config.MaxSize, maxSize: s.Config.MaxSize, cancel: cancel},
+		URL:      resp.Request.URL.String(),
+		FileName: fileName(resp),
+	}, nil
+}
+
+// checkURL accepts absolute http and https URLs on an allowed host.
+func (s *IngestServiceImpl) checkURL(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+		return ErrInvalidURL
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	for _, allowed := range s.Config.AllowedHosts {
+		if host == allowed {
+			return nil
+		}
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok && strings.HasSuffix(host, "."+suffix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrHostNotAllowed, host)
+}
+
+// NewRestrictedTransport returns a transport that only connects to addresses
+// allow accepts, failing with ErrAddressNotAllowed otherwise. Pass
+// PublicAddress to keep requests made on behalf of users away from internal
+// services.
+func NewRestrictedTransport(timeout time.Duration, allow func(netip.Addr) bool) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		// The address is checked after name resolution, right before
+		// connecting, so a host cannot pass the check with one address and
+		// then resolve to another.
+		Control: func(_network, address string, _conn syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !allow(addrPort.Addr().Unmap()) {
+				return fmt.Errorf("%w: %s", ErrAddressNotAllowed, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+	return &http.Transport{
+		// A proxy would connect on our behalf, past the address check.
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+// PublicAddress reports whether addr is a globally routable unicast address.
+func PublicAddress(addr netip.Addr) bool {
+	if !addr.IsValid() || !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() ||
+		addr.IsLinkLocalUnicast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// classify maps an error of a fetch to the errors of this package, keeping
+// the ones it already returned.
+func classify(err error) error {
+	for _, known := range []error{ErrInvalidURL, ErrHostNotAllowed, ErrAddressNotAllowed, ErrTooManyRedirects, ErrSourceTooLarge} {
+		if errors.Is(err, known) {
+			return err
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", ErrSourceTimeout, err)
+	}
+	return fmt.Errorf("%w: %v", ErrSourceUnreachable, err)
+}
+
+func fileName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(strings.ReplaceAll(params["filename"], "\\", "/"))
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return ""
+}
+
+// body limits the bytes read from a source and ends the fetch when closed.
+type body struct {
+	body      io.ReadCloser
+	remaining int64
+	maxSize   int64
+	cancel    context.CancelFunc
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, fmt.Errorf("%w of %d bytes", ErrSourceTooLarge, b.maxSize)
+	}
+	// Read one byte past the limit to tell a source of exactly the maximum
+	// size from a larger one.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n - 1, fmt.Errorf("%w of %d bytes", ErrSourceTooLarge, b.maxSize)
+	}
+	if err != nil && err != io.EOF {
+		err = classify(err)
+	}
+	return n, err
+}
+
+func (b *body) Close() error {
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
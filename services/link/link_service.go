@@ -0,0 +1,90 @@
+package link
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"media-indexer/models"
+	"media-indexer/utils"
+)
+
+// Modes a Rule can use to turn a stored object into a link.
+const (
+	// ModeSign asks the storage instance for a short-lived signed URL and
+	// falls back to ModeProxy when it cannot issue one.
+	ModeSign = "sign"
+	// ModeCDN prepends BaseURL to the object key.
+	ModeCDN = "cdn"
+	// ModeProxy links to the content endpoint of the API.
+	ModeProxy = "proxy"
+)
+
+const defaultExpiry = 15 * time.Minute
+
+type LinkService interface {
+	// Resolve returns the link clients use to fetch the file of media.
+	Resolve(ctx context.Context, media *models.Media) (string, error)
+	// ResolveRendition returns the link clients use to fetch a rendition of
+	// media, such as a thumbnail.
+	ResolveRendition(ctx context.Context, media *models.Media, rendition *models.Rendition) (string, error)
+}
+
+type Config struct {
+	// Default applies to instances without a rule of their own.
+	Default Rule
+	// Providers holds rules by storage instance name.
+	Providers map[string]Rule
+	// Expiry is how long signed links stay valid.
+	Expiry time.Duration
+	// ProxyBaseURL is prepended to /media/:id/content and
+	// /media/:id/thumbnail in proxied links.
+	ProxyBaseURL string
+}
+
+type Rule struct {
+	Mode    string `json:"mode"`
+	BaseURL string `json:"baseUrl"`
+}
+
+func (r Rule) validate() error {
+	switch r.Mode {
+	case ModeSign, ModeProxy:
+		return nil
+	case ModeCDN:
+		if r.BaseURL == "" {
+			return fmt.Errorf("mode %q requires a baseUrl", ModeCDN)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %q", r.Mode)
+	}
+}
+
+// ConfigFromEnv reads MEDIA_URL_MODE and MEDIA_CDN_BASE_URL for the default
+// rule, MEDIA_URL_PROVIDERS for per instance rules as a JSON object such as
+// {"videos": {"mode": "cdn", "baseUrl": "https://cdn.example.com"}},
+// SIGNED_URL_EXPIRY and MEDIA_PROXY_BASE_URL.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Default:      Rule{Mode: utils.GetEnv("MEDIA_URL_MODE", ModeSign), BaseURL: os.Getenv("MEDIA_CDN_BASE_URL")},
+		ProxyBaseURL: utils.GetEnv("MEDIA_PROXY_BASE_URL", "/api/v1"),
+	}
+
+	if providers := os.Getenv("MEDIA_URL_PROVIDERS"); providers != "" {
+		if err := json.Unmarshal([]byte(providers), &cfg.Providers); err != nil {
+			return Config{}, fmt.Errorf("parse MEDIA_URL_PROVIDERS: %w", err)
+		}
+	}
+
+	if expiry := os.Getenv("SIGNED_URL_EXPIRY"); expiry != "" {
+		parsed, err := time.ParseDuration(expiry)
+		if err != nil {
+			return Config{}, fmt.Errorf("parse SIGNED_URL_EXPIRY: %w", err)
+		}
+		cfg.Expiry = parsed
+	}
+	return cfg, nil
+}
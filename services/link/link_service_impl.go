@@ -0,0 +1,82 @@
+package link
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"media-indexer/models"
+	"media-indexer/storage"
+)
+
+type LinkServiceImpl struct {
+	Storage storage.StorageProvider
+	Config  Config
+}
+
+func NewLinkService(storageProvider storage.StorageProvider, cfg Config) (LinkService, error) {
+	if err := cfg.Default.validate(); err != nil {
+		return nil, fmt.Errorf("media links: %w", err)
+	}
+	names := make([]string, 0, len(cfg.Providers))
+	for name := range cfg.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := cfg.Providers[name].validate(); err != nil {
+			return nil, fmt.Errorf("media links of instance %q: %w", name, err)
+		}
+	}
+	if cfg.Expiry <= 0 {
+		cfg.Expiry = defaultExpiry
+	}
+	cfg.ProxyBaseURL = strings.TrimRight(cfg.ProxyBaseURL, "/")
+
+	return &LinkServiceImpl{Storage: storageProvider, Config: cfg}, nil
+}
+
+// Resolve builds the link from the instance name and key saved on the media,
+// so moving a bucket or putting a CDN in front of it only takes a config
+// change. External media link to their external URL.
+func (s *LinkServiceImpl) Resolve(ctx context.Context, media *models.Media) (string, error) {
+	if media.External {
+		return media.ExternalURL, nil
+	}
+	return s.resolve(ctx, media.StorageProvider, media.StorageKey, s.proxyURL(media))
+}
+
+// ResolveRendition links to renditions the same way as to the files they
+// were made from, following the rule of the instance holding them.
+func (s *LinkServiceImpl) ResolveRendition(ctx context.Context, media *models.Media, rendition *models.Rendition) (string, error) {
+	proxyURL := s.Config.ProxyBaseURL + "/media/" + media.ID.String() + "/thumbnail?size=" + url.QueryEscape(rendition.Name)
+	return s.resolve(ctx, rendition.StorageProvider, rendition.StorageKey, proxyURL)
+}
+
+func (s *LinkServiceImpl) resolve(ctx context.Context, provider string, key string, proxyURL string) (string, error) {
+	rule, ok := s.Config.Providers[provider]
+	if !ok {
+		rule = s.Config.Default
+	}
+
+	switch rule.Mode {
+	case ModeCDN:
+		return strings.TrimRight(rule.BaseURL, "/") + "/" + key, nil
+	case ModeProxy:
+		return proxyURL, nil
+	default:
+		instance := storage.InstanceNamed(s.Storage, provider)
+		link, err := instance.SignedURL(ctx, key, s.Config.Expiry)
+		if errors.Is(err, storage.ErrSignedURLUnsupported) {
+			return proxyURL, nil
+		}
+		return link, err
+	}
+}
+
+func (s *LinkServiceImpl) proxyURL(media *models.Media) string {
+	return s.Config.ProxyBaseURL + "/media/" + media.ID.String() + "/content"
+}
@@ -0,0 +1,138 @@
+package link
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"media-indexer/models"
+	"media-indexer/storage"
+)
+
+// unsignedStorage cannot issue links, like encrypted storage over S3.
+type unsignedStorage struct {
+	storage.StorageProvider
+}
+
+func (unsignedStorage) SignedURL(_ctx context.Context, _key string, _expiry time.Duration) (string, error) {
+	return "", storage.ErrSignedURLUnsupported
+}
+
+func newTestStorage(t *testing.T) storage.StorageProvider {
+	t.Helper()
+
+	local := func(baseURL string) storage.StorageProvider {
+		s, err := storage.NewLocalStorage(storage.LocalConfig{RootDir: t.TempDir(), BaseURL: baseURL, SigningKey: "test"})
+		require.NoError(t, err)
+		return s
+	}
+	return storage.NewRouter(map[string]storage.StorageProvider{
+		"media":     local("http://media.example.com/files"),
+		"archive":   local("http://archive.example.com/files"),
+		"encrypted": unsignedStorage{local("http://encrypted.example.com/files")},
+	}, "media", nil)
+}
+
+func testMedia(provider string) *models.Media {
+	return &models.Media{ID: uuid.New(), StorageProvider: provider, StorageKey: strings.Repeat("a", 64) + ".jpg"}
+}
+
+func TestResolve_Sign(t *testing.T) {
+	service, err := NewLinkService(newTestStorage(t), Config{Default: Rule{Mode: ModeSign}, Expiry: time.Minute})
+	require.NoError(t, err)
+
+	link, err := service.Resolve(context.Background(), testMedia("archive"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(link, "http://archive.example.com/files/aa/aa/"), link)
+	assert.Contains(t, link, "signature=")
+}
+
+func TestResolve_SignFallsBackToProxy(t *testing.T) {
+	service, err := NewLinkService(newTestStorage(t), Config{Default: Rule{Mode: ModeSign}, ProxyBaseURL: "https://api.example.com/api/v1/"})
+	require.NoError(t, err)
+	media := testMedia("encrypted")
+
+	link, err := service.Resolve(context.Background(), media)
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.example.com/api/v1/media/"+media.ID.String()+"/content", link)
+}
+
+func TestResolve_ProviderRules(t *testing.T) {
+	service, err := NewLinkService(newTestStorage(t), Config{
+		Default: Rule{Mode: ModeSign},
+		Providers: map[string]Rule{
+			"media":   {Mode: ModeCDN, BaseURL: "https://cdn.example.com/media/"},
+			"archive": {Mode: ModeProxy},
+		},
+		ProxyBaseURL: "/api/v1",
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	media := testMedia("media")
+	link, err := service.Resolve(ctx, media)
+	require.NoError(t, err)
+	assert.Equal(t, "https://cdn.example.com/media/"+media.StorageKey, link)
+
+	archived := testMedia("archive")
+	link, err = service.Resolve(ctx, archived)
+	require.NoError(t, err)
+	assert.Equal(t, "/api/v1/media/"+archived.ID.String()+"/content", link)
+}
+
+func TestResolveRendition(t *testing.T) {
+	service, err := NewLinkService(newTestStorage(t), Config{
+		Default:      Rule{Mode: ModeSign},
+		Providers:    map[string]Rule{"media": {Mode: ModeCDN, BaseURL: "https://cdn.example.com/media"}},
+		ProxyBaseURL: "/api/v1",
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+	media := testMedia("media")
+	rendition := &models.Rendition{Name: "small", StorageProvider: "media", StorageKey: strings.Repeat("b", 64) + ".jpg"}
+
+	link, err := service.ResolveRendition(ctx, media, rendition)
+	require.NoError(t, err)
+	assert.Equal(t, "https://cdn.example.com/media/"+rendition.StorageKey, link)
+
+	// Renditions follow the rule of their own instance.
+	rendition.StorageProvider = "encrypted"
+	link, err = service.ResolveRendition(ctx, media, rendition)
+	require.NoError(t, err)
+	assert.Equal(t, "/api/v1/media/"+media.ID.String()+"/thumbnail?size=small", link)
+}
+
+func TestNewLinkService_InvalidConfig(t *testing.T) {
+	_, err := NewLinkService(newTestStorage(t), Config{Default: Rule{Mode: "presign"}})
+	assert.ErrorContains(t, err, `unknown mode "presign"`)
+
+	_, err = NewLinkService(newTestStorage(t), Config{
+		Default:   Rule{Mode: ModeSign},
+		Providers: map[string]Rule{"videos": {Mode: ModeCDN}},
+	})
+	assert.ErrorContains(t, err, `instance "videos": mode "cdn" requires a baseUrl`)
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("MEDIA_URL_MODE", "")
+	t.Setenv("MEDIA_CDN_BASE_URL", "")
+	t.Setenv("MEDIA_PROXY_BASE_URL", "")
+	t.Setenv("MEDIA_URL_PROVIDERS", `{"videos": {"mode": "cdn", "baseUrl": "https://cdn.example.com"}}`)
+	t.Setenv("SIGNED_URL_EXPIRY", "1h")
+
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, Rule{Mode: ModeSign}, cfg.Default)
+	assert.Equal(t, map[string]Rule{"videos": {Mode: ModeCDN, BaseURL: "https://cdn.example.com"}}, cfg.Providers)
+	assert.Equal(t, time.Hour, cfg.Expiry)
+	assert.Equal(t, "/api/v1", cfg.ProxyBaseURL)
+
+	t.Setenv("MEDIA_URL_PROVIDERS", `{"videos": "cdn"}`)
+	_, err = ConfigFromEnv()
+	assert.ErrorContains(t, err, "MEDIA_URL_PROVIDERS")
+}
@@ -0,0 +1,49 @@
+package linkcheck
+
+import (
+	"context"
+	"time"
+
+	"media-indexer/models"
+	"media-indexer/utils"
+)
+
+const (
+	defaultInterval = 6 * time.Hour
+	defaultTimeout  = 10 * time.Second
+)
+
+// CheckResult counts the links a pass of the checker went through.
+type CheckResult struct {
+	Checked int `json:"checked"`
+	Broken  int `json:"broken"`
+}
+
+type LinkCheckService interface {
+	// Check requests the external URL of media and records the HTTP status
+	// it answered with, or zero if it could not be reached.
+	Check(ctx context.Context, media *models.Media) error
+	// CheckAll checks the links of all external media.
+	CheckAll(ctx context.Context) (*CheckResult, error)
+}
+
+type Config struct {
+	// Interval is how often all links are checked.
+	Interval time.Duration
+	// Timeout bounds a single check.
+	Timeout time.Duration
+}
+
+// ConfigFromEnv reads LINK_CHECK_INTERVAL and LINK_CHECK_TIMEOUT.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{Interval: defaultInterval, Timeout: defaultTimeout}
+
+	var err error
+	if cfg.Interval, err = utils.GetEnvDuration("LINK_CHECK_INTERVAL", cfg.Interval); err != nil {
+		return Config{}, err
+	}
+	if cfg.Timeout, err = utils.GetEnvDuration("LINK_CHECK_TIMEOUT", cfg.Timeout); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
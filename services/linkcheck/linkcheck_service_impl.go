@@ -0,0 +1,128 @@
+package linkcheck
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/google/uuid"
+
+	"media-indexer/models"
+	"media-indexer/repositories/media"
+	"media-indexer/services/ingest"
+)
+
+const checkBatchSize = 100
+
+type LinkCheckServiceImpl struct {
+	MediaRepo media.MediaRepository
+	Config    Config
+
+	client *http.Client
+	// allowAddress decides which resolved addresses may be requested.
+	allowAddress func(netip.Addr) bool
+}
+
+func NewLinkCheckService(mediaRepo media.MediaRepository, cfg Config) LinkCheckService {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	s := &LinkCheckServiceImpl{MediaRepo: mediaRepo, Config: cfg, allowAddress: ingest.PublicAddress}
+	// External URLs are given by users, so they may not point the checker
+	// at internal services either.
+	s.client = &http.Client{
+		Transport: ingest.NewRestrictedTransport(cfg.Timeout, func(addr netip.Addr) bool { return s.allowAddress(addr) }),
+		Timeout:   cfg.Timeout,
+	}
+	return s
+}
+
+func (s *LinkCheckServiceImpl) Check(ctx context.Context, m *models.Media) error {
+	status := s.status(ctx, m.ExternalURL)
+	checkedAt := time.Now()
+	if err := s.MediaRepo.UpdateLinkStatus(m.ID, status, checkedAt); err != nil {
+		return err
+	}
+	m.LinkStatus, m.LinkCheckedAt = status, &checkedAt
+	return nil
+}
+
+// status sends a HEAD request to rawURL, following redirects, and returns
+// the final status code. Servers that do not support HEAD are asked with a
+// GET whose body is not read. Zero means no response was received.
+func (s *LinkCheckServiceImpl) status(ctx context.Context, rawURL string) int {
+	status := s.request(ctx, http.MethodHead, rawURL)
+	if status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented {
+		status = s.request(ctx, http.MethodGet, rawURL)
+	}
+	return status
+}
+
+func (s *LinkCheckServiceImpl) request(ctx context.Context, method string, rawURL string) int {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return 0
+	}
+	req.Header.Set("User-Agent", "media-indexer")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (s *LinkCheckServiceImpl) CheckAll(ctx context.Context) (*CheckResult, error) {
+	result := &CheckResult{}
+	afterID := uuid.Nil
+	for {
+		batch, err := s.MediaRepo.FindExternalBatch(afterID, checkBatchSize)
+		if err != nil {
+			return result, err
+		}
+		for i := range batch {
+			if err := ctx.Err(); err != nil {
+				return result, err
+			}
+			if err := s.Check(ctx, &batch[i]); err != nil {
+				return result, err
+			}
+			result.Checked++
+			if batch[i].LinkBroken() {
+				result.Broken++
+			}
+		}
+		if len(batch) < checkBatchSize {
+			return result, nil
+		}
+		afterID = batch[len(batch)-1].ID
+	}
+}
+
+// RunChecker checks all links right away and then every interval until ctx
+// is done.
+func RunChecker(ctx context.Context, service LinkCheckService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		result, err := service.CheckAll(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("failed to check external links: %v", err)
+		} else if result != nil && result.Checked > 0 {
+			log.Printf("checked %d external links, %d broken", result.Checked, result.Broken)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
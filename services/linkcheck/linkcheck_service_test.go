@@ -0,0 +1,131 @@
+package linkcheck
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"media-indexer/models"
+	"media-indexer/repositories/media"
+)
+
+// fakeMediaRepository keeps media in memory. Only the methods used by the
+// checker are implemented.
+type fakeMediaRepository struct {
+	media.MediaRepository
+	media []*models.Media
+}
+
+func (r *fakeMediaRepository) add(externalURL string) *models.Media {
+	m := &models.Media{ID: uuid.New(), External: true, ExternalURL: externalURL}
+	r.media = append(r.media, m)
+	sort.Slice(r.media, func(i, j int) bool { return r.media[i].ID.String() < r.media[j].ID.String() })
+	return m
+}
+
+func (r *fakeMediaRepository) FindExternalBatch(afterID uuid.UUID, limit int) ([]models.Media, error) {
+	var batch []models.Media
+	for _, m := range r.media {
+		if m.ID.String() > afterID.String() && len(batch) < limit {
+			batch = append(batch, *m)
+		}
+	}
+	return batch, nil
+}
+
+func (r *fakeMediaRepository) UpdateLinkStatus(id uuid.UUID, status int, checkedAt time.Time) error {
+	for _, m := range r.media {
+		if m.ID == id {
+			m.LinkStatus, m.LinkCheckedAt = status, &checkedAt
+		}
+	}
+	return nil
+}
+
+func newTestService(t *testing.T, repo *fakeMediaRepository) *LinkCheckServiceImpl {
+	t.Helper()
+	s := NewLinkCheckService(repo, Config{Timeout: time.Second}).(*LinkCheckServiceImpl)
+	// httptest servers listen on loopback.
+	s.allowAddress = func(addr netip.Addr) bool { return addr.IsLoopback() }
+	return s
+}
+
+func TestCheckAll(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/ok":
+		case "/moved":
+			http.Redirect(w, r, "/ok", http.StatusMovedPermanently)
+		case "/no-head":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	repo := &fakeMediaRepository{}
+	ok := repo.add(server.URL + "/ok")
+	moved := repo.add(server.URL + "/moved")
+	noHead := repo.add(server.URL + "/no-head")
+	gone := repo.add(server.URL + "/gone")
+	down := repo.add("http://127.0.0.1:1/unreachable")
+
+	result, err := newTestService(t, repo).CheckAll(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, &CheckResult{Checked: 5, Broken: 2}, result)
+	assert.Equal(t, http.StatusOK, ok.LinkStatus)
+	assert.Equal(t, http.StatusOK, moved.LinkStatus)
+	assert.Equal(t, http.StatusOK, noHead.LinkStatus)
+	assert.Equal(t, http.StatusNotFound, gone.LinkStatus)
+	assert.Equal(t, 0, down.LinkStatus)
+	for _, m := range repo.media {
+		assert.NotNil(t, m.LinkCheckedAt)
+	}
+	assert.Contains(t, methods, "GET /no-head")
+	assert.NotContains(t, methods, "GET /ok")
+}
+
+func TestCheck_RefusesPrivateAddresses(t *testing.T) {
+	requested := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer server.Close()
+
+	repo := &fakeMediaRepository{}
+	m := repo.add(server.URL)
+	s := NewLinkCheckService(repo, Config{Timeout: time.Second})
+
+	require.NoError(t, s.Check(context.Background(), m))
+
+	assert.False(t, requested)
+	assert.Equal(t, 0, m.LinkStatus)
+	assert.True(t, m.LinkBroken())
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("LINK_CHECK_INTERVAL", "30m")
+	t.Setenv("LINK_CHECK_TIMEOUT", "")
+
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, Config{Interval: 30 * time.Minute, Timeout: 10 * time.Second}, cfg)
+
+	t.Setenv("LINK_CHECK_TIMEOUT", "-1s")
+	_, err = ConfigFromEnv()
+	assert.Error(t, err)
+}
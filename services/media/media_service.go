@@ -1,13 +1,32 @@
 package media
 
 import (
+	"errors"
+
 	"github.com/google/uuid"
 
 	"media-indexer/models"
+	"media-indexer/repositories/media"
 )
 
+// ErrNoPerceptualHash is returned when looking for media similar to media
+// that have no perceptual hash, not being a decodable image.
+var ErrNoPerceptualHash = errors.New("media has no perceptual hash")
+
+// SimilarMedia is media found similar to another, Distance bits apart.
+type SimilarMedia struct {
+	Media    models.Media
+	Distance int
+}
+
 type MediaService interface {
-	CreateMedia(name string, filePath string, tagNames []string) (*models.Media, []models.Tag, error)
-	SearchMediaByTags(tagNames []string, page int, pageSize int) ([]models.Media, int64, error)
-	FetchOrCreateTagsAndAssociate(mediaID uuid.UUID, tagNames []string) ([]models.Tag, error)
+	// CreateMedia creates the media and associates it with its tags in one
+	// transaction.
+	CreateMedia(media *models.Media, tagNames []string) (*models.Media, []models.Tag, error)
+	GetMedia(id uuid.UUID) (*models.Media, error)
+	DeleteMedia(id uuid.UUID) (*models.Media, error)
+	SearchMediaByTags(tagNames []string, filter media.SearchFilter, page int, pageSize int) ([]models.Media, int64, error)
+	// FindSimilarMedia returns a page of the images whose perceptual hash is
+	// within maxDistance bits of that of the media id, closest first.
+	FindSimilarMedia(id uuid.UUID, maxDistance int, page int, pageSize int) ([]SimilarMedia, int64, error)
 }
@@ -4,65 +4,78 @@ import (
 	"github.com/google/uuid"
 
 	"media-indexer/models"
+	"media-indexer/phash"
 	"media-indexer/repositories/media"
-	"media-indexer/repositories/tag"
 	"media-indexer/utils"
 )
 
 type MediaServiceImpl struct {
 	MediaRepo media.MediaRepository
-	TagRepo   tag.TagRepository
 }
 
-func NewMediaService(mediaRepo media.MediaRepository, tagRepo tag.TagRepository) MediaService {
-	return &MediaServiceImpl{MediaRepo: mediaRepo, TagRepo: tagRepo}
+func NewMediaService(mediaRepo media.MediaRepository) MediaService {
+	return &MediaServiceImpl{MediaRepo: mediaRepo}
 }
 
-func (s *MediaServiceImpl) CreateMedia(name string, fileName string, tagNames []string) (*models.Media, []models.Tag, error) {
-	normalizedTagNames := make([]string, len(tagNames))
-	for i, tagName := range tagNames {
-		normalizedTagNames[i] = utils.NormalizeTag(tagName)
-	}
-
-	media := models.Media{
-		Name: name,
-		Link: fileName,
+func (s *MediaServiceImpl) CreateMedia(media *models.Media, tagNames []string) (*models.Media, []models.Tag, error) {
+	normalizedTagNames := make([]string, 0, len(tagNames))
+	seen := make(map[string]bool, len(tagNames))
+	for _, tagName := range tagNames {
+		normalized := utils.NormalizeTag(tagName)
+		if !seen[normalized] {
+			seen[normalized] = true
+			normalizedTagNames = append(normalizedTagNames, normalized)
+		}
 	}
 
-	if err := s.MediaRepo.Create(&media); err != nil {
+	tags, err := s.MediaRepo.CreateWithTags(media, normalizedTagNames)
+	if err != nil {
 		return nil, nil, err
 	}
 
-	tags, err := s.FetchOrCreateTagsAndAssociate(media.ID, normalizedTagNames)
+	return media, tags, nil
+}
+
+func (s *MediaServiceImpl) GetMedia(id uuid.UUID) (*models.Media, error) {
+	return s.MediaRepo.FindByID(id)
+}
+
+func (s *MediaServiceImpl) DeleteMedia(id uuid.UUID) (*models.Media, error) {
+	media, err := s.MediaRepo.FindByID(id)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-
-	return &media, tags, nil
+	if err := s.MediaRepo.Delete(media); err != nil {
+		return nil, err
+	}
+	return media, nil
 }
 
-func (s *MediaServiceImpl) SearchMediaByTags(tagNames []string, page int, pageSize int) ([]models.Media, int64, error) {
+func (s *MediaServiceImpl) SearchMediaByTags(tagNames []string, filter media.SearchFilter, page int, pageSize int) ([]models.Media, int64, error) {
 	normalizedTagNames := make([]string, len(tagNames))
 	for i, tagName := range tagNames {
 		normalizedTagNames[i] = utils.NormalizeTag(tagName)
 	}
-	return s.MediaRepo.FindByTagNames(normalizedTagNames, page, pageSize)
+	return s.MediaRepo.FindByTagNames(normalizedTagNames, filter, page, pageSize)
 }
 
-func (s *MediaServiceImpl) FetchOrCreateTagsAndAssociate(mediaID uuid.UUID, tagNames []string) ([]models.Tag, error) {
-	var tags []models.Tag
-	for _, tagName := range tagNames {
-		tag, err := s.TagRepo.FindOrCreateTagByName(tagName)
-		if err != nil {
-			return nil, err
-		}
-
-		if err := s.MediaRepo.AssociateMediaWithTag(mediaID, tag.ID, tag.Name); err != nil {
-			return nil, err
-		}
-
-		tags = append(tags, *tag)
+func (s *MediaServiceImpl) FindSimilarMedia(id uuid.UUID, maxDistance int, page int, pageSize int) ([]SimilarMedia, int64, error) {
+	target, err := s.MediaRepo.FindByID(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if target.PerceptualHash == nil {
+		return nil, 0, ErrNoPerceptualHash
 	}
 
-	return tags, nil
+	hash := uint64(target.PerceptualHash.Hash)
+	mediaList, totalItems, err := s.MediaRepo.FindSimilar(hash, maxDistance, id, page, pageSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	similar := make([]SimilarMedia, len(mediaList))
+	for i, m := range mediaList {
+		similar[i] = SimilarMedia{Media: m, Distance: phash.Distance(hash, uint64(m.PerceptualHash.Hash))}
+	}
+	return similar, totalItems, nil
 }
@@ -0,0 +1,38 @@
+package migration
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type MigrationService interface {
+	Migrate(ctx context.Context, options Options) (*Report, error)
+}
+
+type Options struct {
+	// Workers is the number of media copied concurrently.
+	Workers int
+	// BatchSize is the number of media records loaded per query.
+	BatchSize int
+	// DryRun only checks that every source object exists and reports what
+	// would be copied. Nothing is written.
+	DryRun bool
+	// Progress, if set, is called with a snapshot of the report every
+	// ProgressInterval while the migration runs.
+	Progress         func(Report)
+	ProgressInterval time.Duration
+}
+
+type Report struct {
+	// Total counts the media of both the source and destination instances.
+	// Those already on the destination, e.g. from an interrupted run, are
+	// Skipped.
+	Total    int
+	Migrated int
+	Skipped  int
+	Bytes    int64
+	Failed   map[uuid.UUID]error
+	Duration time.Duration
+}
@@ -0,0 +1,315 @@
+package migration
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"media-indexer/models"
+	"media-indexer/repositories/media"
+	"media-indexer/storage"
+)
+
+const (
+	defaultWorkers          = 4
+	defaultBatchSize        = 500
+	defaultProgressInterval = 10 * time.Second
+)
+
+// MigrationServiceImpl moves media between two storage instances, identified
+// by the names saved as Media.StorageProvider.
+type MigrationServiceImpl struct {
+	MediaRepo       media.MediaRepository
+	SourceName      string
+	Source          storage.StorageProvider
+	DestinationName string
+	Destination     storage.StorageProvider
+}
+
+func NewMigrationService(mediaRepo media.MediaRepository, sourceName string, source storage.StorageProvider, destinationName string, destination storage.StorageProvider) MigrationService {
+	return &MigrationServiceImpl{
+		MediaRepo:       mediaRepo,
+		SourceName:      sourceName,
+		Source:          source,
+		DestinationName: destinationName,
+		Destination:     destination,
+	}
+}
+
+// Migrate copies the file and the renditions of every media record stored in
+// Source to Destination and points the records at the copies. Each copy is
+// read back and its SHA-256 compared with the content hash before the record
+// is updated. Source objects are left in place. Since records only move to
+// Destination once copied, an interrupted migration resumes where it
+// stopped.
+func (s *MigrationServiceImpl) Migrate(ctx context.Context, options Options) (*Report, error) {
+	if options.Workers <= 0 {
+		options.Workers = defaultWorkers
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultBatchSize
+	}
+	if options.ProgressInterval <= 0 {
+		options.ProgressInterval = defaultProgressInterval
+	}
+
+	run := &migrationRun{
+		service: s,
+		options: options,
+		report:  Report{Failed: make(map[uuid.UUID]error)},
+	}
+	started := time.Now()
+
+	stopProgress := run.reportProgress()
+	defer stopProgress()
+
+	jobs := make(chan models.Media)
+	var workers sync.WaitGroup
+	for i := 0; i < options.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for m := range jobs {
+				run.migrate(ctx, m)
+			}
+		}()
+	}
+
+	err := s.eachMedia(ctx, options.BatchSize, func(m models.Media) {
+		pending := s.storedIn(m, s.SourceName)
+		if !pending && !s.storedIn(m, s.DestinationName) {
+			return
+		}
+
+		run.mu.Lock()
+		run.report.Total++
+		skip := !pending
+		if skip {
+			run.report.Skipped++
+		}
+		run.mu.Unlock()
+
+		if !skip {
+			jobs <- m
+		}
+	})
+	close(jobs)
+	workers.Wait()
+
+	report := run.snapshot()
+	report.Duration = time.Since(started)
+	return &report, err
+}
+
+// storedIn reports whether the file or a rendition of m is stored in the
+// instance called name.
+func (s *MigrationServiceImpl) storedIn(m models.Media, name string) bool {
+	if m.StorageProvider == name {
+		return true
+	}
+	for _, rendition := range m.Renditions {
+		if rendition.StorageProvider == name {
+			return true
+		}
+	}
+	return false
+}
+
+// eachMedia walks all media records in ID order, one batch at a time. It
+// stops early when ctx is cancelled.
+func (s *MigrationServiceImpl) eachMedia(ctx context.Context, batchSize int, fn func(models.Media)) error {
+	afterID := uuid.Nil
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch, err := s.MediaRepo.FindBatch(afterID, batchSize)
+		if err != nil {
+			return fmt.Errorf("load media: %w", err)
+		}
+		for _, m := range batch {
+			fn(m)
+		}
+		if len(batch) < batchSize {
+			return nil
+		}
+		afterID = batch[len(batch)-1].ID
+	}
+}
+
+type migrationRun struct {
+	service *MigrationServiceImpl
+	options Options
+
+	mu     sync.Mutex
+	report Report
+}
+
+func (r *migrationRun) migrate(ctx context.Context, m models.Media) {
+	var size int64
+	var err error
+	if r.options.DryRun {
+		size, err = r.check(ctx, m)
+	} else {
+		size, err = r.copy(ctx, m)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.report.Failed[m.ID] = err
+		return
+	}
+	r.report.Migrated++
+	r.report.Bytes += size
+}
+
+func (r *migrationRun) check(ctx context.Context, m models.Media) (int64, error) {
+	var size int64
+	for _, rendition := range m.Renditions {
+		if rendition.StorageProvider != r.service.SourceName {
+			continue
+		}
+		info, err := r.service.Source.Stat(ctx, rendition.StorageKey)
+		if err != nil {
+			return 0, fmt.Errorf("rendition %s: %w", rendition.Name, err)
+		}
+		size += info.Size
+	}
+	if m.StorageProvider != r.service.SourceName {
+		return size, nil
+	}
+	info, err := r.service.Source.Stat(ctx, m.StorageKey)
+	if err != nil {
+		return 0, err
+	}
+	return size + info.Size, nil
+}
+
+// copy moves the renditions of m before its file, so media whose file was
+// moved by an interrupted run still have theirs picked up.
+func (r *migrationRun) copy(ctx context.Context, m models.Media) (int64, error) {
+	destination := r.service.Destination
+
+	var size int64
+	for _, rendition := range m.Renditions {
+		if rendition.StorageProvider != r.service.SourceName {
+			continue
+		}
+		object, err := r.copyObject(ctx, rendition.StorageKey, rendition.Name+path.Ext(rendition.StorageKey), rendition.ContentHash)
+		if err != nil {
+			return 0, fmt.Errorf("rendition %s: %w", rendition.Name, err)
+		}
+		if err := r.service.MediaRepo.UpdateRenditionLocation(m.ID, rendition.Name, r.service.DestinationName, object.Key, object.ContentHash); err != nil {
+			destination.Release(ctx, object.Key)
+			return 0, fmt.Errorf("update rendition %s: %w", rendition.Name, err)
+		}
+		size += object.Size
+	}
+	if m.StorageProvider != r.service.SourceName {
+		return size, nil
+	}
+
+	object, err := r.copyObject(ctx, m.StorageKey, m.OriginalFilename, m.ContentHash)
+	if err != nil {
+		return 0, err
+	}
+	if err := r.service.MediaRepo.UpdateLocation(m.ID, r.service.DestinationName, object.Key, object.ContentHash); err != nil {
+		destination.Release(ctx, object.Key)
+		return 0, fmt.Errorf("update media: %w", err)
+	}
+	return size + object.Size, nil
+}
+
+// copyObject copies the source object key to the destination and verifies
+// the copy. The copy is released again if it does not check out.
+func (r *migrationRun) copyObject(ctx context.Context, key string, filename string, contentHash string) (*storage.Object, error) {
+	destination := r.service.Destination
+
+	reader, err := r.service.Source.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	object, err := destination.UploadFile(ctx, reader, filename)
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.verify(ctx, contentHash, object); err != nil {
+		destination.Release(ctx, object.Key)
+		return nil, err
+	}
+	return object, nil
+}
+
+// verify reads the copy back from the destination and checks it against the
+// hash the object was stored with.
+func (r *migrationRun) verify(ctx context.Context, contentHash string, object *storage.Object) error {
+	if contentHash != "" && contentHash != object.ContentHash {
+		return fmt.Errorf("checksum mismatch: record has %s, source object hashes to %s", contentHash, object.ContentHash)
+	}
+
+	reader, err := r.service.Destination.Open(ctx, object.Key)
+	if err != nil {
+		return fmt.Errorf("read back copy: %w", err)
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return fmt.Errorf("read back copy: %w", err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != object.ContentHash {
+		return fmt.Errorf("checksum mismatch: copy hashes to %s, expected %s", sum, object.ContentHash)
+	}
+	return nil
+}
+
+func (r *migrationRun) snapshot() Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := r.report
+	report.Failed = make(map[uuid.UUID]error, len(r.report.Failed))
+	for id, err := range r.report.Failed {
+		report.Failed[id] = err
+	}
+	return report
+}
+
+// reportProgress calls the Progress callback periodically until the returned
+// function is called.
+func (r *migrationRun) reportProgress() func() {
+	if r.options.Progress == nil {
+		return func() {}
+	}
+
+	ticker := time.NewTicker(r.options.ProgressInterval)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				r.options.Progress(r.snapshot())
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(stop)
+		<-stopped
+	}
+}
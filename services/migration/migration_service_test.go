@@ -0,0 +1,244 @@
+package migration
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"media-indexer/models"
+	"media-indexer/repositories/media"
+	"media-indexer/storage"
+)
+
+// fakeMediaRepository keeps media in memory. Only the methods used by the
+// migration are implemented.
+type fakeMediaRepository struct {
+	media.MediaRepository
+
+	mu    sync.Mutex
+	media map[uuid.UUID]*models.Media
+}
+
+func (r *fakeMediaRepository) FindBatch(afterID uuid.UUID, limit int) ([]models.Media, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var all []models.Media
+	for _, m := range r.media {
+		if strings.Compare(m.ID.String(), afterID.String()) > 0 {
+			all = append(all, *m)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID.String() < all[j].ID.String() })
+	if len(all) > limit {
+		all = all[:limit]
+	}
+	return all, nil
+}
+
+func (r *fakeMediaRepository) UpdateLocation(id uuid.UUID, provider string, key string, contentHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.media[id].StorageProvider = provider
+	r.media[id].StorageKey = key
+	r.media[id].ContentHash = contentHash
+	return nil
+}
+
+func (r *fakeMediaRepository) UpdateRenditionLocation(mediaID uuid.UUID, name string, provider string, key string, contentHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	renditions := r.media[mediaID].Renditions
+	for i := range renditions {
+		if renditions[i].Name == name {
+			renditions[i].StorageProvider = provider
+			renditions[i].StorageKey = key
+			renditions[i].ContentHash = contentHash
+		}
+	}
+	return nil
+}
+
+// countingStorage counts uploads and can fail them on demand.
+type countingStorage struct {
+	storage.StorageProvider
+	mu      sync.Mutex
+	uploads int
+	fail    bool
+}
+
+func (s *countingStorage) UploadFile(ctx context.Context, file io.Reader, filename string) (*storage.Object, error) {
+	s.mu.Lock()
+	s.uploads++
+	fail := s.fail
+	s.mu.Unlock()
+	if fail {
+		return nil, errors.New("destination unavailable")
+	}
+	return s.StorageProvider.UploadFile(ctx, file, filename)
+}
+
+func newTestLocalStorage(t *testing.T, baseURL string) *storage.LocalStorage {
+	t.Helper()
+
+	s, err := storage.NewLocalStorage(storage.LocalConfig{RootDir: t.TempDir(), BaseURL: baseURL, SigningKey: "test"})
+	require.NoError(t, err)
+	return s
+}
+
+func setupMigration(t *testing.T, contents ...string) (*MigrationServiceImpl, *fakeMediaRepository, *countingStorage) {
+	t.Helper()
+
+	source := newTestLocalStorage(t, "http://old.example.com/files")
+	destination := &countingStorage{StorageProvider: newTestLocalStorage(t, "http://new.example.com/files")}
+	repo := &fakeMediaRepository{media: make(map[uuid.UUID]*models.Media)}
+
+	for _, content := range contents {
+		object, err := source.UploadFile(context.Background(), strings.NewReader(content), "notes.txt")
+		require.NoError(t, err)
+		id := uuid.New()
+		repo.media[id] = &models.Media{ID: id, StorageProvider: "old", StorageKey: object.Key, ContentHash: object.ContentHash, OriginalFilename: "notes.txt"}
+	}
+
+	// Media of other instances are left alone.
+	other := uuid.New()
+	repo.media[other] = &models.Media{ID: other, StorageProvider: "other", StorageKey: "elsewhere.txt"}
+
+	service := NewMigrationService(repo, "old", source, "new", destination).(*MigrationServiceImpl)
+	return service, repo, destination
+}
+
+func TestMigrate(t *testing.T) {
+	service, repo, destination := setupMigration(t, "first", "second", "third")
+
+	report, err := service.Migrate(context.Background(), Options{Workers: 2, BatchSize: 2})
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, report.Total)
+	assert.Equal(t, 3, report.Migrated)
+	assert.Empty(t, report.Failed)
+	assert.Equal(t, int64(len("first")+len("second")+len("third")), report.Bytes)
+
+	for _, m := range repo.media {
+		if m.StorageProvider == "other" {
+			continue
+		}
+		assert.Equal(t, "new", m.StorageProvider)
+		reader, err := destination.Open(context.Background(), m.StorageKey)
+		require.NoError(t, err)
+		content, _ := io.ReadAll(reader)
+		reader.Close()
+		sum := sha256.Sum256(content)
+		assert.Equal(t, m.ContentHash, hex.EncodeToString(sum[:]))
+	}
+}
+
+func TestMigrate_DryRun(t *testing.T) {
+	service, repo, destination := setupMigration(t, "first", "second")
+	links := map[uuid.UUID]string{}
+	for id, m := range repo.media {
+		links[id] = m.StorageProvider
+	}
+
+	report, err := service.Migrate(context.Background(), Options{DryRun: true})
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, report.Migrated)
+	assert.Equal(t, int64(len("first")+len("second")), report.Bytes)
+	assert.Zero(t, destination.uploads)
+	for id, m := range repo.media {
+		assert.Equal(t, links[id], m.StorageProvider)
+	}
+}
+
+func TestMigrate_ChecksumMismatch(t *testing.T) {
+	service, repo, _ := setupMigration(t, "content")
+	var id uuid.UUID
+	for candidate, m := range repo.media {
+		if m.StorageProvider == "old" {
+			id = candidate
+			m.ContentHash = strings.Repeat("0", 64)
+		}
+	}
+
+	report, err := service.Migrate(context.Background(), Options{})
+	require.NoError(t, err)
+
+	require.Contains(t, report.Failed, id)
+	assert.ErrorContains(t, report.Failed[id], "checksum mismatch")
+	assert.Equal(t, "old", repo.media[id].StorageProvider)
+}
+
+func TestMigrate_Resumes(t *testing.T) {
+	service, _, destination := setupMigration(t, "first", "second")
+
+	destination.fail = true
+	report, err := service.Migrate(context.Background(), Options{})
+	require.NoError(t, err)
+	assert.Len(t, report.Failed, 2)
+
+	destination.fail = false
+	report, err = service.Migrate(context.Background(), Options{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Migrated)
+
+	uploads := destination.uploads
+	report, err = service.Migrate(context.Background(), Options{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Total)
+	assert.Equal(t, 2, report.Skipped)
+	assert.Zero(t, report.Migrated)
+	assert.Equal(t, uploads, destination.uploads)
+}
+
+func TestMigrate_Renditions(t *testing.T) {
+	service, repo, destination := setupMigration(t, "photo")
+	ctx := context.Background()
+	var photo *models.Media
+	for _, m := range repo.media {
+		if m.StorageProvider == "old" {
+			photo = m
+		}
+	}
+	for _, name := range []string{"small", "large"} {
+		object, err := service.Source.UploadFile(ctx, strings.NewReader(name+" thumbnail"), name+".txt")
+		require.NoError(t, err)
+		photo.Renditions = append(photo.Renditions, models.Rendition{
+			MediaID: photo.ID, Name: name, StorageProvider: "old", StorageKey: object.Key, ContentHash: object.ContentHash,
+		})
+	}
+
+	report, err := service.Migrate(ctx, Options{})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, report.Migrated)
+	assert.Empty(t, report.Failed)
+	assert.Equal(t, int64(len("photo")+len("small thumbnail")+len("large thumbnail")), report.Bytes)
+	assert.Equal(t, "new", photo.StorageProvider)
+	for _, rendition := range photo.Renditions {
+		assert.Equal(t, "new", rendition.StorageProvider)
+		exists, err := destination.Exists(ctx, rendition.StorageKey)
+		require.NoError(t, err)
+		assert.True(t, exists, rendition.Name)
+	}
+
+	// A media moved before its renditions were is picked up again for them.
+	photo.Renditions[0].StorageProvider = "old"
+	report, err = service.Migrate(ctx, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Migrated)
+	assert.Equal(t, int64(len("small thumbnail")), report.Bytes)
+	assert.Equal(t, "new", photo.Renditions[0].StorageProvider)
+}
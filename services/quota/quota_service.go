@@ -0,0 +1,87 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+var (
+	ErrUnknownAPIKey = errors.New("unknown API key")
+	ErrFileTooLarge  = errors.New("file exceeds the maximum size for its content type")
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+type QuotaService interface {
+	// Owner returns who uploads made with apiKey are charged to. Without
+	// configured API keys every upload is anonymous and charged to "".
+	Owner(apiKey string) (string, error)
+	// MaxSize returns the largest file of contentType that may be uploaded,
+	// or zero when there is no limit.
+	MaxSize(contentType string) int64
+	// Begin starts charging an upload to owner. It fails with
+	// ErrQuotaExceeded when the owner has no room left at all.
+	Begin(owner string) (*Charge, error)
+}
+
+type Config struct {
+	// MaxSize limits files no entry of MaxSizes matches; zero means unlimited.
+	MaxSize int64
+	// MaxSizes limit files by detected content type. The first match wins.
+	MaxSizes []SizeLimit
+	// Quota is how many bytes an owner may store, unless their API key sets
+	// its own; zero means unlimited.
+	Quota int64
+	// APIKeys maps API keys, sent in the X-API-Key header, to their owner.
+	APIKeys map[string]APIKey
+}
+
+type SizeLimit struct {
+	ContentType string `json:"contentType"`
+	MaxSize     int64  `json:"maxSize"`
+}
+
+type APIKey struct {
+	Owner string `json:"owner"`
+	Quota int64  `json:"quota"`
+}
+
+// ConfigFromEnv reads UPLOAD_MAX_SIZE, UPLOAD_MAX_SIZES as a JSON list such
+// as [{"contentType": "image/*", "maxSize": 10485760}], UPLOAD_QUOTA and
+// API_KEYS as a JSON object such as {"secret": {"owner": "alice"}}.
+func ConfigFromEnv() (Config, error) {
+	var cfg Config
+	var err error
+
+	if cfg.MaxSize, err = parseSize("UPLOAD_MAX_SIZE"); err != nil {
+		return Config{}, err
+	}
+	if cfg.Quota, err = parseSize("UPLOAD_QUOTA"); err != nil {
+		return Config{}, err
+	}
+	if maxSizes := os.Getenv("UPLOAD_MAX_SIZES"); maxSizes != "" {
+		if err := json.Unmarshal([]byte(maxSizes), &cfg.MaxSizes); err != nil {
+			return Config{}, fmt.Errorf("parse UPLOAD_MAX_SIZES: %w", err)
+		}
+	}
+	if apiKeys := os.Getenv("API_KEYS"); apiKeys != "" {
+		if err := json.Unmarshal([]byte(apiKeys), &cfg.APIKeys); err != nil {
+			return Config{}, fmt.Errorf("parse API_KEYS: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+func parseSize(name string) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("parse %s: %q is not a size in bytes", name, value)
+	}
+	return size, nil
+}
@@ -0,0 +1,210 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"media-indexer/repositories/media"
+	"media-indexer/storage"
+)
+
+type QuotaServiceImpl struct {
+	MediaRepo media.MediaRepository
+	Config    Config
+
+	mu sync.Mutex
+	// usage tracks the uploads of owners with a charge open, so concurrent
+	// uploads cannot overrun a quota together.
+	usage  map[string]*usage
+	quotas map[string]int64
+}
+
+// usage counts the bytes of the uploads of an owner that the sum of their
+// stored media, read when a charge began, may not include yet.
+type usage struct {
+	// inflight is the bytes of uploads that are still streaming.
+	inflight int64
+	// finished is the bytes of every upload finished while a charge of the
+	// owner was open. A charge counts those finished after its sum was read.
+	finished int64
+	charges  int
+}
+
+func NewQuotaService(mediaRepo media.MediaRepository, cfg Config) (QuotaService, error) {
+	quotas := make(map[string]int64)
+	for _, key := range cfg.APIKeys {
+		if key.Owner == "" {
+			return nil, errors.New("upload quota: every API key needs an owner")
+		}
+		if key.Quota < 0 {
+			return nil, fmt.Errorf("upload quota: negative quota for %q", key.Owner)
+		}
+		if key.Quota > 0 {
+			quotas[key.Owner] = key.Quota
+		}
+	}
+
+	return &QuotaServiceImpl{MediaRepo: mediaRepo, Config: cfg, usage: make(map[string]*usage), quotas: quotas}, nil
+}
+
+func (s *QuotaServiceImpl) Owner(apiKey string) (string, error) {
+	if len(s.Config.APIKeys) == 0 {
+		return "", nil
+	}
+	key, ok := s.Config.APIKeys[apiKey]
+	if !ok || apiKey == "" {
+		return "", ErrUnknownAPIKey
+	}
+	return key.Owner, nil
+}
+
+func (s *QuotaServiceImpl) MaxSize(contentType string) int64 {
+	for _, limit := range s.Config.MaxSizes {
+		if storage.MatchContentType(limit.ContentType, contentType) {
+			return limit.MaxSize
+		}
+	}
+	return s.Config.MaxSize
+}
+
+func (s *QuotaServiceImpl) Begin(owner string) (*Charge, error) {
+	limit, ok := s.quotas[owner]
+	if !ok {
+		limit = s.Config.Quota
+	}
+	charge := &Charge{service: s, owner: owner, limit: limit}
+	if limit <= 0 {
+		return charge, nil
+	}
+
+	s.mu.Lock()
+	u := s.usage[owner]
+	if u == nil {
+		u = &usage{}
+		s.usage[owner] = u
+	}
+	u.charges++
+	s.mu.Unlock()
+	charge.usage = u
+
+	if err := charge.refresh(); err != nil {
+		charge.Done()
+		return nil, err
+	}
+	if charge.used >= limit {
+		charge.Done()
+		return nil, ErrQuotaExceeded
+	}
+	return charge, nil
+}
+
+// Charge tracks the bytes of one upload against the quota of its owner. Done
+// must be called once the upload has been stored and its media created, or
+// has failed.
+type Charge struct {
+	service *QuotaServiceImpl
+	owner   string
+	limit   int64
+	usage   *usage
+	// used is what the owner's media took up when it was last read, and
+	// finished the usage.finished of the owner just before.
+	used     int64
+	finished int64
+	charged  int64
+}
+
+// refresh reads what the owner's media take up. Uploads finished in the
+// meantime may be counted twice until the next refresh, never missed.
+func (c *Charge) refresh() error {
+	c.service.mu.Lock()
+	finished := c.usage.finished
+	c.service.mu.Unlock()
+
+	used, err := c.service.MediaRepo.SumSizeByOwner(c.owner)
+	if err != nil {
+		return fmt.Errorf("sum storage used by %q: %w", c.owner, err)
+	}
+	c.used, c.finished = used, finished
+	return nil
+}
+
+// Add charges n more bytes, failing with ErrQuotaExceeded if they do not fit.
+// Uploads that finished since the owner's media were summed count in full;
+// only when n does not fit are the media summed again, which leaves out those
+// that failed.
+func (c *Charge) Add(n int64) error {
+	if c.limit <= 0 {
+		return nil
+	}
+	if c.add(n) {
+		return nil
+	}
+	if err := c.refresh(); err != nil {
+		return err
+	}
+	if c.add(n) {
+		return nil
+	}
+	return ErrQuotaExceeded
+}
+
+func (c *Charge) add(n int64) bool {
+	c.service.mu.Lock()
+	defer c.service.mu.Unlock()
+	if c.used+c.usage.inflight+c.usage.finished-c.finished+n > c.limit {
+		return false
+	}
+	c.usage.inflight += n
+	c.charged += n
+	return true
+}
+
+// Done ends the charge. Its bytes keep counting against the quota for the
+// other uploads of the owner until they sum the owner's media again.
+func (c *Charge) Done() {
+	if c.usage == nil {
+		return
+	}
+
+	c.service.mu.Lock()
+	defer c.service.mu.Unlock()
+	c.usage.inflight -= c.charged
+	c.usage.finished += c.charged
+	c.usage.charges--
+	if c.usage.charges == 0 {
+		delete(c.service.usage, c.owner)
+	}
+	c.charged = 0
+	c.usage = nil
+}
+
+// Meter counts the bytes of an upload while they stream to storage. The read
+// that takes the upload past maxSize fails with ErrFileTooLarge, the one that
+// takes it past the owner's quota with ErrQuotaExceeded, so the storage
+// provider aborts the upload before storing anything.
+type Meter struct {
+	reader  io.Reader
+	charge  *Charge
+	maxSize int64
+	size    int64
+}
+
+func NewMeter(r io.Reader, maxSize int64, charge *Charge) *Meter {
+	return &Meter{reader: r, charge: charge, maxSize: maxSize}
+}
+
+func (m *Meter) Read(p []byte) (int, error) {
+	n, err := m.reader.Read(p)
+	if n > 0 {
+		m.size += int64(n)
+		if m.maxSize > 0 && m.size > m.maxSize {
+			return 0, ErrFileTooLarge
+		}
+		if chargeErr := m.charge.Add(int64(n)); chargeErr != nil {
+			return 0, chargeErr
+		}
+	}
+	return n, err
+}
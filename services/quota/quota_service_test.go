@@ -0,0 +1,154 @@
+package quota
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"media-indexer/repositories/media"
+)
+
+// fakeMediaRepository reports how many bytes each owner already stores.
+type fakeMediaRepository struct {
+	media.MediaRepository
+	used map[string]int64
+}
+
+func (r *fakeMediaRepository) SumSizeByOwner(owner string) (int64, error) {
+	return r.used[owner], nil
+}
+
+func newTestQuotaService(t *testing.T, used map[string]int64, cfg Config) *QuotaServiceImpl {
+	t.Helper()
+
+	service, err := NewQuotaService(&fakeMediaRepository{used: used}, cfg)
+	require.NoError(t, err)
+	return service.(*QuotaServiceImpl)
+}
+
+func TestOwner(t *testing.T) {
+	service := newTestQuotaService(t, nil, Config{})
+	owner, err := service.Owner("")
+	require.NoError(t, err)
+	assert.Empty(t, owner)
+
+	service = newTestQuotaService(t, nil, Config{APIKeys: map[string]APIKey{"secret": {Owner: "alice"}}})
+	owner, err = service.Owner("secret")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", owner)
+
+	_, err = service.Owner("")
+	assert.ErrorIs(t, err, ErrUnknownAPIKey)
+	_, err = service.Owner("guess")
+	assert.ErrorIs(t, err, ErrUnknownAPIKey)
+}
+
+func TestMaxSize(t *testing.T) {
+	service := newTestQuotaService(t, nil, Config{
+		MaxSize:  100,
+		MaxSizes: []SizeLimit{{ContentType: "image/png", MaxSize: 10}, {ContentType: "image/*", MaxSize: 20}},
+	})
+
+	assert.Equal(t, int64(10), service.MaxSize("image/png"))
+	assert.Equal(t, int64(20), service.MaxSize("image/jpeg"))
+	assert.Equal(t, int64(100), service.MaxSize("video/mp4"))
+}
+
+func TestCharge(t *testing.T) {
+	service := newTestQuotaService(t, map[string]int64{"alice": 60, "bob": 100}, Config{
+		Quota:   100,
+		APIKeys: map[string]APIKey{"alice-key": {Owner: "alice"}, "bob-key": {Owner: "bob", Quota: 200}},
+	})
+
+	first, err := service.Begin("alice")
+	require.NoError(t, err)
+	second, err := service.Begin("alice")
+	require.NoError(t, err)
+
+	require.NoError(t, first.Add(30))
+	assert.ErrorIs(t, second.Add(20), ErrQuotaExceeded, "in-flight bytes of concurrent uploads count")
+	require.NoError(t, second.Add(10))
+
+	first.Done()
+	second.Done()
+	assert.Empty(t, service.usage)
+
+	bob, err := service.Begin("bob")
+	require.NoError(t, err)
+	assert.NoError(t, bob.Add(100), "API keys can raise the quota of their owner")
+	bob.Done()
+
+	service = newTestQuotaService(t, map[string]int64{"alice": 100}, Config{Quota: 100})
+	_, err = service.Begin("alice")
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+}
+
+func TestCharge_UploadsFinishingConcurrently(t *testing.T) {
+	repo := &fakeMediaRepository{used: map[string]int64{"alice": 0}}
+	service, err := NewQuotaService(repo, Config{Quota: 100})
+	require.NoError(t, err)
+
+	first, err := service.Begin("alice")
+	require.NoError(t, err)
+	second, err := service.Begin("alice")
+	require.NoError(t, err)
+
+	// The first upload is stored and its media created in the middle of the
+	// second one's stream, whose sum of stored media predates it.
+	require.NoError(t, first.Add(60))
+	repo.used["alice"] = 60
+	first.Done()
+	require.NoError(t, second.Add(30))
+	assert.ErrorIs(t, second.Add(20), ErrQuotaExceeded, "finished uploads still count")
+	require.NoError(t, second.Add(10))
+	second.Done()
+
+	// A failed upload does not count once the media are summed again.
+	first, err = service.Begin("alice")
+	require.NoError(t, err)
+	second, err = service.Begin("alice")
+	require.NoError(t, err)
+	require.NoError(t, first.Add(30))
+	first.Done()
+	assert.NoError(t, second.Add(40))
+	second.Done()
+}
+
+func TestMeter(t *testing.T) {
+	service := newTestQuotaService(t, map[string]int64{"alice": 0}, Config{Quota: 10})
+
+	charge, err := service.Begin("alice")
+	require.NoError(t, err)
+	content, err := io.ReadAll(NewMeter(strings.NewReader("12345"), 8, charge))
+	require.NoError(t, err)
+	assert.Equal(t, "12345", string(content))
+
+	_, err = io.ReadAll(NewMeter(strings.NewReader("123456789"), 8, charge))
+	assert.ErrorIs(t, err, ErrFileTooLarge)
+
+	_, err = io.ReadAll(NewMeter(strings.NewReader("123456"), 0, charge))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	charge.Done()
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("UPLOAD_MAX_SIZE", "1048576")
+	t.Setenv("UPLOAD_MAX_SIZES", `[{"contentType": "video/*", "maxSize": 2147483648}]`)
+	t.Setenv("UPLOAD_QUOTA", "")
+	t.Setenv("API_KEYS", `{"secret": {"owner": "alice", "quota": 5}}`)
+
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, Config{
+		MaxSize:  1048576,
+		MaxSizes: []SizeLimit{{ContentType: "video/*", MaxSize: 2147483648}},
+		APIKeys:  map[string]APIKey{"secret": {Owner: "alice", Quota: 5}},
+	}, cfg)
+
+	t.Setenv("UPLOAD_QUOTA", "10GB")
+	_, err = ConfigFromEnv()
+	assert.ErrorContains(t, err, "UPLOAD_QUOTA")
+}
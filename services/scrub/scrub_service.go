@@ -0,0 +1,113 @@
+package scrub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"media-indexer/models"
+	"media-indexer/utils"
+)
+
+const (
+	defaultBatchSize = 100
+	defaultInterval  = time.Minute
+	defaultPeriod    = 30 * 24 * time.Hour
+	defaultRate      = 10 << 20
+)
+
+// ErrExternalMedia is returned when asked to scrub media that only link to
+// content hosted elsewhere.
+var ErrExternalMedia = errors.New("external media have no stored file")
+
+// Result is the outcome of scrubbing the stored file of one media.
+type Result string
+
+const (
+	// ResultIntact means the file hashed to the content hash saved at
+	// upload time.
+	ResultIntact Result = "intact"
+	// ResultCorrupt means the file is missing or its hash differs.
+	ResultCorrupt Result = "corrupt"
+	// ResultError means the file could not be read, e.g. because storage
+	// was unavailable. Only the attempt is recorded, so a file that keeps
+	// failing does not hold up the batches, and the media is scrubbed again
+	// once the period has passed.
+	ResultError Result = "error"
+)
+
+// BatchResult counts the outcomes of a scrub batch.
+type BatchResult struct {
+	Intact  int `json:"intact"`
+	Corrupt int `json:"corrupt"`
+	Errors  int `json:"errors"`
+}
+
+// Stats describe the scrub job since the server started, along with how many
+// media are currently flagged corrupt.
+type Stats struct {
+	Intact       int64
+	Corrupt      int64
+	Errors       int64
+	LastBatchAt  time.Time
+	CorruptMedia int64
+}
+
+type ScrubService interface {
+	// ScrubBatch verifies the stored files of the media due for a scrub,
+	// those never scrubbed or scrubbed longest ago first.
+	ScrubBatch(ctx context.Context) (*BatchResult, error)
+	// ScrubMedia verifies the stored file of a single media right away,
+	// e.g. after it was restored from a backup.
+	ScrubMedia(ctx context.Context, id uuid.UUID) (*models.Media, Result, error)
+	// ListCorrupt returns a page of the media flagged corrupt.
+	ListCorrupt(page int, pageSize int) ([]models.Media, int64, error)
+	Stats() (*Stats, error)
+}
+
+type Config struct {
+	// BatchSize is how many media are verified per batch.
+	BatchSize int
+	// Interval is the pause between batches.
+	Interval time.Duration
+	// Period is how long a verified file is trusted before it is read
+	// again.
+	Period time.Duration
+	// Rate limits how many bytes per second are read from storage; zero
+	// means unlimited.
+	Rate int64
+}
+
+// ConfigFromEnv reads SCRUB_BATCH_SIZE, SCRUB_INTERVAL, SCRUB_PERIOD and
+// SCRUB_RATE, in bytes per second.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{BatchSize: defaultBatchSize, Interval: defaultInterval, Period: defaultPeriod, Rate: defaultRate}
+
+	if value := os.Getenv("SCRUB_BATCH_SIZE"); value != "" {
+		batchSize, err := strconv.Atoi(value)
+		if err != nil || batchSize <= 0 {
+			return Config{}, fmt.Errorf("parse SCRUB_BATCH_SIZE: %q is not a positive number", value)
+		}
+		cfg.BatchSize = batchSize
+	}
+	var err error
+	if cfg.Interval, err = utils.GetEnvDuration("SCRUB_INTERVAL", cfg.Interval); err != nil {
+		return Config{}, err
+	}
+	if cfg.Period, err = utils.GetEnvDuration("SCRUB_PERIOD", cfg.Period); err != nil {
+		return Config{}, err
+	}
+	if value := os.Getenv("SCRUB_RATE"); value != "" {
+		rate, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || rate < 0 {
+			return Config{}, fmt.Errorf("parse SCRUB_RATE: %q is not a number of bytes per second", value)
+		}
+		cfg.Rate = rate
+	}
+	return cfg, nil
+}
@@ -0,0 +1,232 @@
+package scrub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"media-indexer/models"
+	"media-indexer/repositories/media"
+	"media-indexer/storage"
+	"media-indexer/utils"
+)
+
+type ScrubServiceImpl struct {
+	MediaRepo media.MediaRepository
+	Storage   storage.StorageProvider
+	Config    Config
+
+	mu    sync.Mutex
+	stats Stats
+	// sleep waits for d or until ctx is done; tests replace it.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func NewScrubService(mediaRepo media.MediaRepository, storageProvider storage.StorageProvider, cfg Config) ScrubService {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+	if cfg.Period <= 0 {
+		cfg.Period = defaultPeriod
+	}
+	return &ScrubServiceImpl{MediaRepo: mediaRepo, Storage: storageProvider, Config: cfg, sleep: utils.Sleep}
+}
+
+func (s *ScrubServiceImpl) ScrubBatch(ctx context.Context) (*BatchResult, error) {
+	batch, err := s.MediaRepo.FindScrubBatch(time.Now().Add(-s.Config.Period), s.Config.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BatchResult{}
+	for i := range batch {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		outcome, err := s.scrub(ctx, &batch[i])
+		if err != nil {
+			return result, err
+		}
+		switch outcome {
+		case ResultIntact:
+			result.Intact++
+		case ResultCorrupt:
+			result.Corrupt++
+		case ResultError:
+			result.Errors++
+		}
+	}
+
+	s.mu.Lock()
+	s.stats.LastBatchAt = time.Now()
+	s.mu.Unlock()
+	return result, nil
+}
+
+func (s *ScrubServiceImpl) ScrubMedia(ctx context.Context, id uuid.UUID) (*models.Media, Result, error) {
+	m, err := s.MediaRepo.FindByID(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if m.External {
+		return nil, "", ErrExternalMedia
+	}
+	outcome, err := s.scrub(ctx, m)
+	if err != nil {
+		return nil, "", err
+	}
+	return m, outcome, nil
+}
+
+func (s *ScrubServiceImpl) ListCorrupt(page int, pageSize int) ([]models.Media, int64, error) {
+	return s.MediaRepo.FindCorrupt(page, pageSize)
+}
+
+func (s *ScrubServiceImpl) Stats() (*Stats, error) {
+	corrupt, err := s.MediaRepo.CountCorrupt()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	stats := s.stats
+	s.mu.Unlock()
+	stats.CorruptMedia = corrupt
+	return &stats, nil
+}
+
+// scrub reads the stored file of m back, compares it with the content hash
+// saved at upload time and records the outcome on m. Only a failure to
+// record it is returned as an error.
+func (s *ScrubServiceImpl) scrub(ctx context.Context, m *models.Media) (Result, error) {
+	intact, err := s.verify(ctx, m)
+	scrubbedAt := time.Now()
+	if err != nil {
+		log.Printf("scrub: failed to read stored file of media %s: %v", m.ID, err)
+		if err := s.MediaRepo.UpdateScrubAttempt(m.ID, scrubbedAt); err != nil {
+			return "", err
+		}
+		m.ScrubbedAt = &scrubbedAt
+		s.count(ResultError)
+		return ResultError, nil
+	}
+
+	if err := s.MediaRepo.UpdateScrubResult(m.ID, scrubbedAt, intact); err != nil {
+		return "", err
+	}
+	m.ScrubbedAt = &scrubbedAt
+	if intact {
+		m.VerifiedAt, m.CorruptAt = &scrubbedAt, nil
+		s.count(ResultIntact)
+		return ResultIntact, nil
+	}
+	if m.CorruptAt == nil {
+		m.CorruptAt = &scrubbedAt
+	}
+	log.Printf("scrub: stored file %s of media %s is corrupt", m.StorageKey, m.ID)
+	s.count(ResultCorrupt)
+	return ResultCorrupt, nil
+}
+
+// verify reports whether the stored file of m hashes to its content hash. A
+// missing file counts as corrupt.
+func (s *ScrubServiceImpl) verify(ctx context.Context, m *models.Media) (bool, error) {
+	reader, err := storage.InstanceNamed(s.Storage, m.StorageProvider).Open(ctx, m.StorageKey)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, s.throttle(ctx, reader)); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == expectedHash(m), nil
+}
+
+func (s *ScrubServiceImpl) count(result Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch result {
+	case ResultIntact:
+		s.stats.Intact++
+	case ResultCorrupt:
+		s.stats.Corrupt++
+	case ResultError:
+		s.stats.Errors++
+	}
+}
+
+// expectedHash returns the content hash of m, falling back to the hash its
+// content-addressed key starts with for media stored before hashes were
+// saved.
+func expectedHash(m *models.Media) string {
+	if m.ContentHash != "" {
+		return m.ContentHash
+	}
+	if len(m.StorageKey) < sha256.Size*2 {
+		return m.StorageKey
+	}
+	return m.StorageKey[:sha256.Size*2]
+}
+
+// throttle limits reads from r to the configured rate, so scrubbing does not
+// compete with serving media.
+func (s *ScrubServiceImpl) throttle(ctx context.Context, r io.Reader) io.Reader {
+	if s.Config.Rate <= 0 {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, rate: s.Config.Rate, sleep: s.sleep}
+}
+
+// throttledReader pauses after every read for as long as reading that many
+// bytes should take at rate. The time spent reading is not deducted, so the
+// actual rate stays somewhat below it.
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if sleepErr := t.sleep(t.ctx, time.Duration(n)*time.Second/time.Duration(t.rate)); sleepErr != nil {
+			return n, sleepErr
+		}
+	}
+	return n, err
+}
+
+// RunScrubber scrubs batch after batch, pausing for interval between them,
+// until ctx is done.
+func RunScrubber(ctx context.Context, service ScrubService, interval time.Duration) {
+	for {
+		result, err := service.ScrubBatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("scrub: batch failed: %v", err)
+		} else if result != nil && result.Corrupt > 0 {
+			log.Printf("scrub: found %d corrupt files in a batch of %d", result.Corrupt, result.Intact+result.Corrupt+result.Errors)
+		}
+
+		if utils.Sleep(ctx, interval) != nil {
+			return
+		}
+	}
+}
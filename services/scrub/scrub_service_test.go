@@ -0,0 +1,246 @@
+package scrub
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"media-indexer/models"
+	"media-indexer/repositories/media"
+	"media-indexer/storage"
+)
+
+// fakeMediaRepository keeps media in memory. Only the methods used by the
+// scrubber are implemented.
+type fakeMediaRepository struct {
+	media.MediaRepository
+	media []*models.Media
+}
+
+func (r *fakeMediaRepository) add(m *models.Media) *models.Media {
+	m.ID = uuid.New()
+	r.media = append(r.media, m)
+	sort.Slice(r.media, func(i, j int) bool { return r.media[i].ID.String() < r.media[j].ID.String() })
+	return m
+}
+
+func (r *fakeMediaRepository) FindByID(id uuid.UUID) (*models.Media, error) {
+	for _, m := range r.media {
+		if m.ID == id {
+			found := *m
+			return &found, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func (r *fakeMediaRepository) FindScrubBatch(scrubbedBefore time.Time, limit int) ([]models.Media, error) {
+	var batch []models.Media
+	for _, m := range r.media {
+		if !m.External && (m.ScrubbedAt == nil || m.ScrubbedAt.Before(scrubbedBefore)) && len(batch) < limit {
+			batch = append(batch, *m)
+		}
+	}
+	return batch, nil
+}
+
+func (r *fakeMediaRepository) UpdateScrubResult(id uuid.UUID, scrubbedAt time.Time, intact bool) error {
+	for _, m := range r.media {
+		if m.ID != id {
+			continue
+		}
+		m.ScrubbedAt = &scrubbedAt
+		if intact {
+			m.VerifiedAt, m.CorruptAt = &scrubbedAt, nil
+		} else if m.CorruptAt == nil {
+			m.CorruptAt = &scrubbedAt
+		}
+	}
+	return nil
+}
+
+func (r *fakeMediaRepository) UpdateScrubAttempt(id uuid.UUID, scrubbedAt time.Time) error {
+	for _, m := range r.media {
+		if m.ID == id {
+			m.ScrubbedAt = &scrubbedAt
+		}
+	}
+	return nil
+}
+
+func (r *fakeMediaRepository) CountCorrupt() (int64, error) {
+	var count int64
+	for _, m := range r.media {
+		if m.CorruptAt != nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// unavailableStorage fails to open any object.
+type unavailableStorage struct {
+	storage.StorageProvider
+}
+
+func (unavailableStorage) Open(_ctx context.Context, _key string) (storage.ObjectReader, error) {
+	return nil, storage.ErrUnavailable
+}
+
+type fixture struct {
+	service *ScrubServiceImpl
+	storage *storage.LocalStorage
+	repo    *fakeMediaRepository
+
+	intact, missing, corrupt, external *models.Media
+}
+
+func setup(t *testing.T) *fixture {
+	t.Helper()
+	ctx := context.Background()
+
+	s, err := storage.NewLocalStorage(storage.LocalConfig{RootDir: t.TempDir(), BaseURL: "http://localhost/files", SigningKey: "test"})
+	require.NoError(t, err)
+	repo := &fakeMediaRepository{}
+	f := &fixture{service: NewScrubService(repo, s, Config{}).(*ScrubServiceImpl), storage: s, repo: repo}
+
+	upload := func(content string) *models.Media {
+		object, err := s.UploadFile(ctx, strings.NewReader(content), "notes.txt")
+		require.NoError(t, err)
+		return repo.add(&models.Media{StorageKey: object.Key, ContentHash: object.ContentHash})
+	}
+
+	f.intact = upload("intact")
+	f.missing = upload("missing")
+	require.NoError(t, s.Delete(ctx, f.missing.StorageKey))
+	f.corrupt = upload("corrupt")
+	f.corrupt.ContentHash = strings.Repeat("0", 64)
+	f.external = repo.add(&models.Media{External: true, ExternalURL: "https://example.com/a.jpg"})
+	return f
+}
+
+func TestScrubBatch(t *testing.T) {
+	f := setup(t)
+
+	result, err := f.service.ScrubBatch(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, &BatchResult{Intact: 1, Corrupt: 2}, result)
+	assert.NotNil(t, f.intact.VerifiedAt)
+	assert.Nil(t, f.intact.CorruptAt)
+	assert.NotNil(t, f.missing.CorruptAt)
+	assert.NotNil(t, f.corrupt.CorruptAt)
+	assert.Nil(t, f.corrupt.VerifiedAt)
+	assert.Nil(t, f.external.ScrubbedAt)
+
+	stats, err := f.service.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Intact)
+	assert.Equal(t, int64(2), stats.Corrupt)
+	assert.Equal(t, int64(2), stats.CorruptMedia)
+	assert.False(t, stats.LastBatchAt.IsZero())
+
+	// Everything was scrubbed within the period, so nothing is due.
+	result, err = f.service.ScrubBatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &BatchResult{}, result)
+}
+
+func TestScrubBatch_KeepsFirstCorruptTime(t *testing.T) {
+	f := setup(t)
+	f.service.Config.Period = time.Nanosecond
+
+	_, err := f.service.ScrubBatch(context.Background())
+	require.NoError(t, err)
+	corruptAt := *f.corrupt.CorruptAt
+
+	_, err = f.service.ScrubBatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, corruptAt, *f.corrupt.CorruptAt)
+	assert.True(t, f.corrupt.ScrubbedAt.After(corruptAt))
+}
+
+func TestScrubBatch_StorageUnavailable(t *testing.T) {
+	f := setup(t)
+	f.service.Storage = unavailableStorage{}
+
+	result, err := f.service.ScrubBatch(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, &BatchResult{Errors: 3}, result)
+	for _, m := range f.repo.media {
+		if !m.External {
+			assert.NotNil(t, m.ScrubbedAt)
+		}
+		assert.Nil(t, m.VerifiedAt)
+		assert.Nil(t, m.CorruptAt)
+	}
+
+	// Media that failed are not picked again before the period has passed,
+	// so they do not block the others.
+	result, err = f.service.ScrubBatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &BatchResult{}, result)
+}
+
+func TestScrubMedia_ClearsCorruptOnceRestored(t *testing.T) {
+	f := setup(t)
+	_, err := f.service.ScrubBatch(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, f.missing.CorruptAt)
+
+	// Restore the missing file, e.g. from a backup.
+	_, err = f.storage.UploadFile(context.Background(), strings.NewReader("missing"), "notes.txt")
+	require.NoError(t, err)
+
+	m, result, err := f.service.ScrubMedia(context.Background(), f.missing.ID)
+	require.NoError(t, err)
+	assert.Equal(t, ResultIntact, result)
+	assert.Nil(t, m.CorruptAt)
+	assert.Nil(t, f.missing.CorruptAt)
+}
+
+func TestScrubMedia_External(t *testing.T) {
+	f := setup(t)
+
+	_, _, err := f.service.ScrubMedia(context.Background(), f.external.ID)
+	assert.ErrorIs(t, err, ErrExternalMedia)
+}
+
+func TestThrottle(t *testing.T) {
+	var slept time.Duration
+	s := &ScrubServiceImpl{Config: Config{Rate: 1000}, sleep: func(_ctx context.Context, d time.Duration) error {
+		slept += d
+		return nil
+	}}
+
+	n, err := io.Copy(io.Discard, s.throttle(context.Background(), strings.NewReader(strings.Repeat("x", 3000))))
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(3000), n)
+	// Reading 3000 bytes at 1000 bytes per second takes 3 seconds.
+	assert.Equal(t, 3*time.Second, slept)
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("SCRUB_BATCH_SIZE", "20")
+	t.Setenv("SCRUB_INTERVAL", "")
+	t.Setenv("SCRUB_PERIOD", "168h")
+	t.Setenv("SCRUB_RATE", "0")
+
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, Config{BatchSize: 20, Interval: time.Minute, Period: 7 * 24 * time.Hour, Rate: 0}, cfg)
+
+	t.Setenv("SCRUB_RATE", "fast")
+	_, err = ConfigFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+package staging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+
+	"media-indexer/models"
+	"media-indexer/storage"
+	"media-indexer/utils"
+)
+
+const (
+	defaultDir           = "./data/staging"
+	defaultMaxAge        = time.Hour
+	defaultSweepInterval = 10 * time.Minute
+)
+
+// ErrClaimed is returned by Commit when the sweeper is already handling the
+// staged file.
+var ErrClaimed = errors.New("staged file is claimed by the sweeper")
+
+// StagedFile is an upload held in the staging area until the media created
+// from it has been committed. The file is only written to storage then, so a
+// failed upload or database write never leaves a blob behind.
+type StagedFile struct {
+	ID          string `json:"id"`
+	FileName    string `json:"fileName"`
+	ContentHash string `json:"contentHash"`
+	ContentType string `json:"contentType"`
+	Extension   string `json:"extension"`
+	Size        int64  `json:"size"`
+	// MediaID is the media being created from the file. It is recorded
+	// before the media is written, so the sweeper can finish the promotion
+	// if the server stops in between.
+	MediaID   uuid.UUID `json:"mediaId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Key returns the key the file will be stored under once promoted.
+func (f *StagedFile) Key() string {
+	return storage.ObjectKey(f.ContentHash, f.Extension)
+}
+
+// SweepResult counts what a sweep of the staging area did.
+type SweepResult struct {
+	// Promoted is the number of files whose media had been committed and
+	// which were stored now.
+	Promoted int `json:"promoted"`
+	// Removed is the number of abandoned files deleted.
+	Removed int `json:"removed"`
+}
+
+type StagingService interface {
+	// Stage copies file into the staging area.
+	Stage(file io.Reader, fileName string) (*StagedFile, error)
+	// Commit creates media from a staged file. The media and its tags are
+	// written in one transaction, pointing at the instance the file is meant
+	// for, and the file is promoted to storage once that has committed,
+	// along with the thumbnails of images; if the promotion fails the media
+	// is deleted again.
+	// The staged file is gone once Commit returns.
+	Commit(ctx context.Context, staged *StagedFile, media *models.Media, tagNames []string) (*models.Media, []models.Tag, error)
+	// Discard drops a staged file that will not be committed.
+	Discard(staged *StagedFile)
+	// Sweep cleans up files left in the staging area for longer than maxAge
+	// by requests that never finished. Files whose media was committed are
+	// promoted, the others are removed.
+	Sweep(ctx context.Context, maxAge time.Duration) (*SweepResult, error)
+}
+
+type Config struct {
+	Dir string
+	// MaxAge is how long a staged file may go untouched before the sweeper
+	// considers it abandoned.
+	MaxAge        time.Duration
+	SweepInterval time.Duration
+}
+
+// ConfigFromEnv reads STAGING_DIR, STAGING_MAX_AGE and
+// STAGING_SWEEP_INTERVAL.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{Dir: defaultDir, MaxAge: defaultMaxAge, SweepInterval: defaultSweepInterval}
+
+	if dir := os.Getenv("STAGING_DIR"); dir != "" {
+		cfg.Dir = dir
+	}
+	var err error
+	if cfg.MaxAge, err = utils.GetEnvDuration("STAGING_MAX_AGE", cfg.MaxAge); err != nil {
+		return Config{}, err
+	}
+	if cfg.SweepInterval, err = utils.GetEnvDuration("STAGING_SWEEP_INTERVAL", cfg.SweepInterval); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
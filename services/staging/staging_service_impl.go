@@ -0,0 +1,399 @@
+package staging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"media-indexer/exif"
+	"media-indexer/imageinfo"
+	"media-indexer/models"
+	mediaRepo "media-indexer/repositories/media"
+	"media-indexer/services/media"
+	"media-indexer/services/thumbnail"
+	"media-indexer/storage"
+)
+
+// StagingServiceImpl keeps each staged file as "<id>.bin" (the bytes) and
+// "<id>.info" (JSON StagedFile) in Dir. "<id>.lock" is created by whoever
+// promotes the file, Commit or Sweep, so only one of them stores it.
+type StagingServiceImpl struct {
+	Dir          string
+	MediaService media.MediaService
+	MediaRepo    mediaRepo.MediaRepository
+	Storage      storage.StorageProvider
+	Thumbnails   thumbnail.ThumbnailService
+
+	// startedAt tells the lock files of this process from those left
+	// behind by one that stopped.
+	startedAt time.Time
+}
+
+func NewStagingService(dir string, mediaService media.MediaService, mediaRepository mediaRepo.MediaRepository, storageProvider storage.StorageProvider, thumbnailService thumbnail.ThumbnailService) (StagingService, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create staging directory: %w", err)
+	}
+	return &StagingServiceImpl{
+		Dir:          dir,
+		MediaService: mediaService,
+		MediaRepo:    mediaRepository,
+		Storage:      storageProvider,
+		Thumbnails:   thumbnailService,
+		// File times may be truncated to the second.
+		startedAt: time.Now().Truncate(time.Second),
+	}, nil
+}
+
+func (s *StagingServiceImpl) Stage(file io.Reader, fileName string) (_ *StagedFile, err error) {
+	staged := &StagedFile{ID: uuid.New().String(), FileName: fileName, CreatedAt: time.Now()}
+	defer func() {
+		if err != nil {
+			s.Discard(staged)
+		}
+	}()
+
+	data, err := os.OpenFile(s.dataPath(staged.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	hw := storage.NewHashingWriter()
+	if _, err = io.Copy(io.MultiWriter(data, hw), file); err != nil {
+		data.Close()
+		return nil, err
+	}
+	if err = data.Sync(); err != nil {
+		data.Close()
+		return nil, err
+	}
+	if err = data.Close(); err != nil {
+		return nil, err
+	}
+
+	staged.ContentHash = hw.Digest()
+	staged.ContentType, staged.Extension = hw.ContentType()
+	staged.Size = hw.Size()
+	if err = s.writeInfo(staged); err != nil {
+		return nil, err
+	}
+	return staged, nil
+}
+
+func (s *StagingServiceImpl) Commit(ctx context.Context, staged *StagedFile, media *models.Media, tagNames []string) (*models.Media, []models.Tag, error) {
+	claimed, err := s.claim(staged.ID)
+	if err != nil {
+		s.Discard(staged)
+		return nil, nil, err
+	}
+	if !claimed {
+		return nil, nil, ErrClaimed
+	}
+
+	if media.ID == uuid.Nil {
+		media.ID = uuid.New()
+	}
+	media.StorageProvider = storage.InstanceFor(s.Storage, staged.ContentType)
+	media.StorageKey = staged.Key()
+	media.ContentHash = staged.ContentHash
+	media.ContentType = staged.ContentType
+	media.Size = staged.Size
+	media.OriginalFilename = staged.FileName
+	s.describe(staged, media)
+
+	staged.MediaID = media.ID
+	if err := s.writeInfo(staged); err != nil {
+		s.Discard(staged)
+		return nil, nil, err
+	}
+
+	created, tags, err := s.MediaService.CreateMedia(media, tagNames)
+	if err != nil {
+		s.Discard(staged)
+		return nil, nil, err
+	}
+
+	if err := s.promote(ctx, staged, created); err != nil {
+		if _, deleteErr := s.MediaService.DeleteMedia(created.ID); deleteErr != nil {
+			// The staged file is kept so the sweeper can finish the
+			// promotion of the media that could not be deleted.
+			log.Printf("failed to delete media %s after its file could not be stored: %v", created.ID, deleteErr)
+			s.unclaim(staged.ID)
+			return nil, nil, err
+		}
+		s.Discard(staged)
+		return nil, nil, err
+	}
+	return created, tags, nil
+}
+
+// describe fills in the EXIF metadata and dimensions of staged images.
+// Images whose headers cannot be read are still stored, without them.
+func (s *StagingServiceImpl) describe(staged *StagedFile, media *models.Media) {
+	if !exif.Supported(staged.ContentType) && !imageinfo.Supported(staged.ContentType) {
+		return
+	}
+	data, err := os.Open(s.dataPath(staged.ID))
+	if err != nil {
+		log.Printf("failed to open staged file %s: %v", staged.ID, err)
+		return
+	}
+	defer data.Close()
+
+	if exif.Supported(staged.ContentType) {
+		metadata, err := exif.Decode(data, staged.Size, staged.ContentType)
+		if err == nil {
+			media.Exif = models.Exif(*metadata)
+		} else if !errors.Is(err, exif.ErrNoExif) {
+			log.Printf("failed to read EXIF metadata of staged file %s: %v", staged.ID, err)
+		}
+	}
+
+	if imageinfo.Supported(staged.ContentType) {
+		info, err := imageinfo.Decode(data, staged.Size, staged.ContentType)
+		if err != nil {
+			log.Printf("failed to read dimensions of staged file %s: %v", staged.ID, err)
+			return
+		}
+		orientation := info.Orientation
+		if orientation == 0 {
+			orientation = media.Exif.Orientation
+		}
+		media.SetDimensions(imageinfo.Displayed(info.Width, info.Height, orientation))
+	}
+}
+
+// promote stores a staged file for media that has been committed, points the
+// media at where the file ended up, renders its thumbnails and drops the
+// staged copy.
+func (s *StagingServiceImpl) promote(ctx context.Context, staged *StagedFile, media *models.Media) error {
+	data, err := os.Open(s.dataPath(staged.ID))
+	if err != nil {
+		return err
+	}
+	object, err := s.Storage.UploadFile(ctx, data, staged.FileName)
+	data.Close()
+	if err != nil {
+		return err
+	}
+
+	if object.Provider != media.StorageProvider || object.Key != media.StorageKey || object.ContentHash != media.ContentHash {
+		if err := s.MediaRepo.UpdateLocation(media.ID, object.Provider, object.Key, object.ContentHash); err != nil {
+			instance := storage.InstanceNamed(s.Storage, object.Provider)
+			if releaseErr := instance.Release(ctx, object.Key); releaseErr != nil {
+				log.Printf("failed to release stored file %s: %v", object.Key, releaseErr)
+			}
+			return err
+		}
+		media.StorageProvider, media.StorageKey, media.ContentHash = object.Provider, object.Key, object.ContentHash
+	}
+
+	s.renderThumbnails(ctx, staged, media)
+	s.Discard(staged)
+	return nil
+}
+
+// renderThumbnails generates the thumbnails and perceptual hash of staged
+// images. Media whose image cannot be decoded are still stored, without
+// them.
+func (s *StagingServiceImpl) renderThumbnails(ctx context.Context, staged *StagedFile, media *models.Media) {
+	if !thumbnail.Supported(media.ContentType) {
+		return
+	}
+	data, err := os.Open(s.dataPath(staged.ID))
+	if err != nil {
+		log.Printf("failed to open staged file %s: %v", staged.ID, err)
+		return
+	}
+	defer data.Close()
+
+	if _, err := s.Thumbnails.Generate(ctx, media, data, staged.Size); err != nil {
+		log.Printf("failed to render thumbnails of media %s: %v", media.ID, err)
+	}
+}
+
+func (s *StagingServiceImpl) Discard(staged *StagedFile) {
+	for _, path := range []string{s.dataPath(staged.ID), s.infoPath(staged.ID), s.infoPath(staged.ID) + ".tmp", s.lockPath(staged.ID)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("failed to remove staged file %s: %v", path, err)
+		}
+	}
+}
+
+func (s *StagingServiceImpl) Sweep(ctx context.Context, maxAge time.Duration) (*SweepResult, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool)
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".tmp")
+		if id, ok := strings.CutSuffix(name, ".bin"); ok {
+			ids[id] = true
+		} else if id, ok := strings.CutSuffix(name, ".info"); ok {
+			ids[id] = true
+		} else if id, ok := strings.CutSuffix(name, ".lock"); ok {
+			ids[id] = true
+		}
+	}
+
+	result := &SweepResult{}
+	cutoff := time.Now().Add(-maxAge)
+	for id := range ids {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if !s.untouchedSince(id, cutoff) || s.claimHeld(id) {
+			continue
+		}
+		// A lock file still there was left behind by a stopped process.
+		s.unclaim(id)
+		claimed, err := s.claim(id)
+		if err != nil {
+			return result, err
+		}
+		if !claimed {
+			continue
+		}
+
+		staged, err := s.readInfo(id)
+		if err != nil || staged.MediaID == uuid.Nil {
+			s.Discard(&StagedFile{ID: id})
+			result.Removed++
+			continue
+		}
+
+		media, err := s.MediaService.GetMedia(staged.MediaID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			s.Discard(staged)
+			result.Removed++
+			continue
+		}
+		if err != nil {
+			s.unclaim(id)
+			return result, err
+		}
+
+		if err := s.promote(ctx, staged, media); err != nil {
+			log.Printf("failed to promote staged file %s of media %s: %v", id, media.ID, err)
+			s.unclaim(id)
+			continue
+		}
+		result.Promoted++
+	}
+	return result, nil
+}
+
+// RunSweeper sweeps the staging area right away and then every interval
+// until ctx is done.
+func RunSweeper(ctx context.Context, service StagingService, interval time.Duration, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		result, err := service.Sweep(ctx, maxAge)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("failed to sweep the staging area: %v", err)
+		} else if result != nil && result.Promoted+result.Removed > 0 {
+			log.Printf("swept the staging area: promoted %d and removed %d files", result.Promoted, result.Removed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// untouchedSince reports whether neither file of a staged upload has been
+// modified since cutoff. The data file keeps changing while it is received,
+// so long uploads are not mistaken for abandoned ones.
+func (s *StagingServiceImpl) untouchedSince(id string, cutoff time.Time) bool {
+	for _, path := range []string{s.dataPath(id), s.infoPath(id)} {
+		info, err := os.Stat(path)
+		if err == nil && info.ModTime().After(cutoff) {
+			return false
+		}
+	}
+	return true
+}
+
+// claim creates the lock file of a staged file. It reports false when the
+// file is already claimed.
+func (s *StagingServiceImpl) claim(id string) (bool, error) {
+	lock, err := os.OpenFile(s.lockPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, lock.Close()
+}
+
+// unclaim removes the lock file of a staged file that is kept for a later
+// sweep.
+func (s *StagingServiceImpl) unclaim(id string) {
+	if err := os.Remove(s.lockPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("failed to remove lock of staged file %s: %v", id, err)
+	}
+}
+
+// claimHeld reports whether a staged file was claimed since this process
+// started.
+func (s *StagingServiceImpl) claimHeld(id string) bool {
+	info, err := os.Stat(s.lockPath(id))
+	return err == nil && !info.ModTime().Before(s.startedAt)
+}
+
+func (s *StagingServiceImpl) readInfo(id string) (*StagedFile, error) {
+	data, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var staged StagedFile
+	if err := json.Unmarshal(data, &staged); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(s.dataPath(id)); err != nil {
+		return nil, err
+	}
+	return &staged, nil
+}
+
+// writeInfo replaces the info file atomically, so a crash never leaves a
+// truncated one behind.
+func (s *StagingServiceImpl) writeInfo(staged *StagedFile) error {
+	data, err := json.Marshal(staged)
+	if err != nil {
+		return err
+	}
+	tmp := s.infoPath(staged.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.infoPath(staged.ID))
+}
+
+func (s *StagingServiceImpl) dataPath(id string) string {
+	return filepath.Join(s.Dir, id+".bin")
+}
+
+func (s *StagingServiceImpl) infoPath(id string) string {
+	return filepath.Join(s.Dir, id+".info")
+}
+
+func (s *StagingServiceImpl) lockPath(id string) string {
+	return filepath.Join(s.Dir, id+".lock")
+}
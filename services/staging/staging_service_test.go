@@ -0,0 +1,380 @@
+package staging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"media-indexer/models"
+	mediaRepo "media-indexer/repositories/media"
+	"media-indexer/services/media"
+	"media-indexer/services/thumbnail"
+	"media-indexer/storage"
+)
+
+// fakeMediaService keeps media in memory. Only the methods used by staging
+// are implemented.
+type fakeMediaService struct {
+	media.MediaService
+	media     map[uuid.UUID]*models.Media
+	createErr error
+	// inserted holds copies of the media as they were inserted.
+	inserted []models.Media
+}
+
+func (s *fakeMediaService) CreateMedia(m *models.Media, tagNames []string) (*models.Media, []models.Tag, error) {
+	if s.createErr != nil {
+		return nil, nil, s.createErr
+	}
+	s.media[m.ID] = m
+	s.inserted = append(s.inserted, *m)
+	tags := make([]models.Tag, len(tagNames))
+	for i, name := range tagNames {
+		tags[i] = models.Tag{Name: name}
+	}
+	return m, tags, nil
+}
+
+func (s *fakeMediaService) GetMedia(id uuid.UUID) (*models.Media, error) {
+	m, ok := s.media[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return m, nil
+}
+
+func (s *fakeMediaService) DeleteMedia(id uuid.UUID) (*models.Media, error) {
+	m, err := s.GetMedia(id)
+	if err != nil {
+		return nil, err
+	}
+	delete(s.media, id)
+	return m, nil
+}
+
+type fakeMediaRepository struct {
+	mediaRepo.MediaRepository
+	service *fakeMediaService
+}
+
+func (r *fakeMediaRepository) UpdateLocation(id uuid.UUID, provider string, key string, contentHash string) error {
+	m := r.service.media[id]
+	m.StorageProvider, m.StorageKey, m.ContentHash = provider, key, contentHash
+	return nil
+}
+
+func (r *fakeMediaRepository) CreateRenditions(renditions []models.Rendition) error {
+	return nil
+}
+
+func (r *fakeMediaRepository) SavePerceptualHash(hash *models.PerceptualHash) error {
+	return nil
+}
+
+// failingStorage fails uploads, like a backend that is down.
+type failingStorage struct {
+	storage.StorageProvider
+}
+
+func (failingStorage) UploadFile(ctx context.Context, file io.Reader, filename string) (*storage.Object, error) {
+	return nil, storage.ErrUnavailable
+}
+
+type fixture struct {
+	service *StagingServiceImpl
+	media   *fakeMediaService
+	storage *storage.LocalStorage
+}
+
+func setup(t *testing.T) *fixture {
+	t.Helper()
+	s, err := storage.NewLocalStorage(storage.LocalConfig{RootDir: t.TempDir(), BaseURL: "http://localhost/files", SigningKey: "test"})
+	require.NoError(t, err)
+	mediaService := &fakeMediaService{media: make(map[uuid.UUID]*models.Media)}
+	repository := &fakeMediaRepository{service: mediaService}
+	thumbnails := thumbnail.NewThumbnailService(repository, s, thumbnail.Config{Sizes: []thumbnail.Size{{Name: "small", MaxEdge: 16}}})
+	service, err := NewStagingService(t.TempDir(), mediaService, repository, s, thumbnails)
+	require.NoError(t, err)
+	return &fixture{service: service.(*StagingServiceImpl), media: mediaService, storage: s}
+}
+
+func (f *fixture) stagedFiles(t *testing.T) []string {
+	t.Helper()
+	entries, err := os.ReadDir(f.service.Dir)
+	require.NoError(t, err)
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names
+}
+
+func (f *fixture) stored(t *testing.T, key string) bool {
+	t.Helper()
+	exists, err := f.storage.Exists(context.Background(), key)
+	require.NoError(t, err)
+	return exists
+}
+
+// age makes a staged file look untouched for d.
+func (f *fixture) age(t *testing.T, staged *StagedFile, d time.Duration) {
+	t.Helper()
+	past := time.Now().Add(-d)
+	require.NoError(t, os.Chtimes(f.service.dataPath(staged.ID), past, past))
+	require.NoError(t, os.Chtimes(f.service.infoPath(staged.ID), past, past))
+}
+
+func TestStage(t *testing.T) {
+	f := setup(t)
+
+	staged, err := f.service.Stage(strings.NewReader("hello world"), "notes.txt")
+	require.NoError(t, err)
+
+	assert.Equal(t, "notes.txt", staged.FileName)
+	assert.Equal(t, "text/plain", staged.ContentType)
+	assert.Equal(t, int64(11), staged.Size)
+	assert.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9.txt", staged.Key())
+	assert.ElementsMatch(t, []string{staged.ID + ".bin", staged.ID + ".info"}, f.stagedFiles(t))
+	assert.False(t, f.stored(t, staged.Key()), "nothing is stored before the media is committed")
+}
+
+func TestStage_DiscardsPartialFile(t *testing.T) {
+	f := setup(t)
+	failure := errors.New("connection reset")
+
+	_, err := f.service.Stage(io.MultiReader(strings.NewReader("partial"), &errorReader{failure}), "notes.txt")
+
+	assert.ErrorIs(t, err, failure)
+	assert.Empty(t, f.stagedFiles(t))
+}
+
+type errorReader struct{ err error }
+
+func (r *errorReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestCommit(t *testing.T) {
+	f := setup(t)
+	staged, err := f.service.Stage(strings.NewReader("hello world"), "notes.txt")
+	require.NoError(t, err)
+
+	created, tags, err := f.service.Commit(context.Background(), staged, &models.Media{Name: "Notes", Owner: "alice"}, []string{"a", "b"})
+	require.NoError(t, err)
+
+	assert.NotEqual(t, uuid.Nil, created.ID)
+	assert.Equal(t, "Notes", created.Name)
+	assert.Equal(t, staged.Key(), created.StorageKey)
+	assert.Equal(t, staged.ContentHash, created.ContentHash)
+	assert.Equal(t, "text/plain", created.ContentType)
+	assert.Equal(t, int64(11), created.Size)
+	assert.Equal(t, "notes.txt", created.OriginalFilename)
+	assert.Len(t, tags, 2)
+	assert.True(t, f.stored(t, created.StorageKey))
+	assert.Empty(t, f.stagedFiles(t))
+}
+
+func TestCommit_InsertsMediaWithItsInstance(t *testing.T) {
+	f := setup(t)
+	f.service.Storage = storage.NewRouter(map[string]storage.StorageProvider{"media": f.storage}, "media", nil)
+	staged, err := f.service.Stage(strings.NewReader("hello world"), "notes.txt")
+	require.NoError(t, err)
+
+	created, _, err := f.service.Commit(context.Background(), staged, &models.Media{Name: "Notes"}, nil)
+	require.NoError(t, err)
+
+	require.Len(t, f.media.inserted, 1)
+	assert.Equal(t, "media", f.media.inserted[0].StorageProvider)
+	assert.Equal(t, staged.Key(), f.media.inserted[0].StorageKey)
+	assert.Equal(t, "media", created.StorageProvider)
+}
+
+func TestCommit_ClaimedBySweeper(t *testing.T) {
+	f := setup(t)
+	staged, err := f.service.Stage(strings.NewReader("hello world"), "notes.txt")
+	require.NoError(t, err)
+	claimed, err := f.service.claim(staged.ID)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	_, _, err = f.service.Commit(context.Background(), staged, &models.Media{Name: "Notes"}, nil)
+
+	assert.ErrorIs(t, err, ErrClaimed)
+	assert.Empty(t, f.media.media)
+	assert.False(t, f.stored(t, staged.Key()))
+}
+
+func TestCommit_ReadsExif(t *testing.T) {
+	f := setup(t)
+	// A JPEG whose APP1 segment holds a big-endian TIFF structure with one
+	// IFD entry, Make = "Canon", followed by the start of the image data.
+	tiff := "MM\x00*\x00\x00\x00\x08" +
+		"\x00\x01" + "\x01\x0f\x00\x02\x00\x00\x00\x06\x00\x00\x00\x1a" + "\x00\x00\x00\x00" +
+		"Canon\x00"
+	app1 := "Exif\x00\x00" + tiff
+	jpeg := "\xff\xd8\xff\xe1" + string([]byte{0, byte(len(app1) + 2)}) + app1 + "\xff\xda\x00\x02\xff\xd9"
+	staged, err := f.service.Stage(strings.NewReader(jpeg), "photo.jpg")
+	require.NoError(t, err)
+	require.Equal(t, "image/jpeg", staged.ContentType)
+
+	created, _, err := f.service.Commit(context.Background(), staged, &models.Media{Name: "Photo"}, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Canon", created.Exif.Make)
+	assert.Nil(t, created.Exif.CapturedAt)
+}
+
+func TestCommit_ReadsDimensionsAndRendersThumbnails(t *testing.T) {
+	f := setup(t)
+	var data bytes.Buffer
+	require.NoError(t, png.Encode(&data, image.NewGray(image.Rect(0, 0, 30, 40))))
+	staged, err := f.service.Stage(&data, "scan.png")
+	require.NoError(t, err)
+
+	created, _, err := f.service.Commit(context.Background(), staged, &models.Media{Name: "Scan"}, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, 30, created.Width)
+	assert.Equal(t, 40, created.Height)
+	assert.Equal(t, 0.75, created.AspectRatio)
+	assert.Equal(t, models.OrientationPortrait, created.Orientation)
+
+	require.Len(t, created.Renditions, 1)
+	small := created.Renditions[0]
+	assert.Equal(t, "small", small.Name)
+	assert.Equal(t, 12, small.Width)
+	assert.Equal(t, 16, small.Height)
+	assert.True(t, f.stored(t, small.StorageKey))
+	assert.NotNil(t, created.PerceptualHash)
+}
+
+func TestCommit_MediaNotCreated(t *testing.T) {
+	f := setup(t)
+	f.media.createErr = errors.New("duplicate key")
+	staged, err := f.service.Stage(strings.NewReader("hello world"), "notes.txt")
+	require.NoError(t, err)
+
+	_, _, err = f.service.Commit(context.Background(), staged, &models.Media{Name: "Notes"}, []string{"a"})
+
+	assert.ErrorIs(t, err, f.media.createErr)
+	assert.False(t, f.stored(t, staged.Key()))
+	assert.Empty(t, f.stagedFiles(t))
+}
+
+func TestCommit_PromotionFails(t *testing.T) {
+	f := setup(t)
+	f.service.Storage = failingStorage{f.storage}
+	staged, err := f.service.Stage(strings.NewReader("hello world"), "notes.txt")
+	require.NoError(t, err)
+
+	_, _, err = f.service.Commit(context.Background(), staged, &models.Media{Name: "Notes"}, []string{"a"})
+
+	assert.ErrorIs(t, err, storage.ErrUnavailable)
+	assert.Empty(t, f.media.media, "media whose file could not be stored is deleted")
+	assert.Empty(t, f.stagedFiles(t))
+}
+
+func TestSweep(t *testing.T) {
+	f := setup(t)
+	ctx := context.Background()
+	stage := func(content string) *StagedFile {
+		staged, err := f.service.Stage(strings.NewReader(content), "notes.txt")
+		require.NoError(t, err)
+		return staged
+	}
+
+	abandoned := stage("abandoned before commit")
+	f.age(t, abandoned, 2*time.Hour)
+
+	rolledBack := stage("media rolled back")
+	rolledBack.MediaID = uuid.New()
+	require.NoError(t, f.service.writeInfo(rolledBack))
+	f.age(t, rolledBack, 2*time.Hour)
+
+	committed := stage("media committed, server stopped before promotion")
+	m := &models.Media{ID: uuid.New(), StorageKey: committed.Key(), ContentHash: committed.ContentHash}
+	f.media.media[m.ID] = m
+	committed.MediaID = m.ID
+	require.NoError(t, f.service.writeInfo(committed))
+	f.age(t, committed, 2*time.Hour)
+
+	fresh := stage("still being committed")
+
+	result, err := f.service.Sweep(ctx, time.Hour)
+	require.NoError(t, err)
+
+	assert.Equal(t, &SweepResult{Promoted: 1, Removed: 2}, result)
+	assert.True(t, f.stored(t, committed.Key()))
+	assert.False(t, f.stored(t, abandoned.Key()))
+	assert.False(t, f.stored(t, rolledBack.Key()))
+	assert.ElementsMatch(t, []string{fresh.ID + ".bin", fresh.ID + ".info"}, f.stagedFiles(t))
+}
+
+func TestSweep_SkipsClaimedFile(t *testing.T) {
+	f := setup(t)
+	staged, err := f.service.Stage(strings.NewReader("media committed, promotion running"), "notes.txt")
+	require.NoError(t, err)
+	m := &models.Media{ID: uuid.New(), StorageKey: staged.Key(), ContentHash: staged.ContentHash}
+	f.media.media[m.ID] = m
+	staged.MediaID = m.ID
+	require.NoError(t, f.service.writeInfo(staged))
+	f.age(t, staged, 2*time.Hour)
+	claimed, err := f.service.claim(staged.ID)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	result, err := f.service.Sweep(context.Background(), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, &SweepResult{}, result)
+	assert.False(t, f.stored(t, staged.Key()))
+
+	// A lock file older than the service was left behind by a stopped
+	// process, so the sweeper takes over.
+	past := f.service.startedAt.Add(-time.Minute)
+	require.NoError(t, os.Chtimes(f.service.lockPath(staged.ID), past, past))
+
+	result, err = f.service.Sweep(context.Background(), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, &SweepResult{Promoted: 1}, result)
+	assert.True(t, f.stored(t, staged.Key()))
+	assert.Empty(t, f.stagedFiles(t))
+}
+
+func TestSweep_RemovesFileWithoutInfo(t *testing.T) {
+	f := setup(t)
+	path := filepath.Join(f.service.Dir, uuid.New().String()+".bin")
+	require.NoError(t, os.WriteFile(path, []byte("interrupted"), 0o644))
+	past := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(path, past, past))
+
+	result, err := f.service.Sweep(context.Background(), time.Hour)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, result.Removed)
+	assert.Empty(t, f.stagedFiles(t))
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("STAGING_DIR", "/var/staging")
+	t.Setenv("STAGING_MAX_AGE", "2h")
+	t.Setenv("STAGING_SWEEP_INTERVAL", "")
+
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, Config{Dir: "/var/staging", MaxAge: 2 * time.Hour, SweepInterval: 10 * time.Minute}, cfg)
+
+	t.Setenv("STAGING_MAX_AGE", "soon")
+	_, err = ConfigFromEnv()
+	assert.Error(t, err)
+}
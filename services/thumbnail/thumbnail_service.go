@@ -0,0 +1,117 @@
+package thumbnail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"media-indexer/models"
+)
+
+const (
+	defaultSizes       = "small=160,medium=480,large=1280"
+	defaultQuality     = 85
+	defaultMaxPixels   = 50_000_000
+	defaultConcurrency = 2
+)
+
+// ErrTooLarge is returned for images with more pixels than Config.MaxPixels,
+// which are not decoded.
+var ErrTooLarge = errors.New("image is too large to render thumbnails")
+
+// Size is a thumbnail size: images are scaled down, keeping their aspect
+// ratio, until their longest edge is at most MaxEdge pixels. Images already
+// that small are only re-encoded.
+type Size struct {
+	Name    string
+	MaxEdge int
+}
+
+type ThumbnailService interface {
+	// Generate renders the configured thumbnails of the image of media, read
+	// from the size bytes of r, stores them and saves them as renditions of
+	// media, skipping sizes media already has. The perceptual hash of the
+	// image is computed and saved along the way, so it is decoded once.
+	// Media whose format cannot be decoded get neither.
+	Generate(ctx context.Context, media *models.Media, r io.ReaderAt, size int64) ([]models.Rendition, error)
+}
+
+type Config struct {
+	// Sizes are the thumbnails rendered for every image; none when empty.
+	Sizes []Size
+	// Quality is the JPEG quality of thumbnails, from 1 to 100. Images with
+	// transparency get PNG thumbnails instead.
+	Quality int
+	// MaxPixels bounds the images decoded, as decoding takes 4 bytes of
+	// memory per pixel.
+	MaxPixels int64
+	// Concurrency is how many images are rendered at once; uploads beyond
+	// that wait for their turn.
+	Concurrency int
+}
+
+var sizeName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// ConfigFromEnv reads THUMBNAIL_SIZES as comma separated name=maxEdge pairs
+// such as "small=160,large=1280", or "none" to render no thumbnails,
+// THUMBNAIL_QUALITY, THUMBNAIL_MAX_PIXELS and THUMBNAIL_CONCURRENCY.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{Quality: defaultQuality, MaxPixels: defaultMaxPixels, Concurrency: defaultConcurrency}
+
+	sizes := os.Getenv("THUMBNAIL_SIZES")
+	if sizes == "" {
+		sizes = defaultSizes
+	}
+	var err error
+	if cfg.Sizes, err = parseSizes(sizes); err != nil {
+		return Config{}, err
+	}
+	if value := os.Getenv("THUMBNAIL_QUALITY"); value != "" {
+		quality, err := strconv.Atoi(value)
+		if err != nil || quality < 1 || quality > 100 {
+			return Config{}, fmt.Errorf("parse THUMBNAIL_QUALITY: %q is not a number from 1 to 100", value)
+		}
+		cfg.Quality = quality
+	}
+	if value := os.Getenv("THUMBNAIL_MAX_PIXELS"); value != "" {
+		maxPixels, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxPixels <= 0 {
+			return Config{}, fmt.Errorf("parse THUMBNAIL_MAX_PIXELS: %q is not a positive number", value)
+		}
+		cfg.MaxPixels = maxPixels
+	}
+	if value := os.Getenv("THUMBNAIL_CONCURRENCY"); value != "" {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil || concurrency <= 0 {
+			return Config{}, fmt.Errorf("parse THUMBNAIL_CONCURRENCY: %q is not a positive number", value)
+		}
+		cfg.Concurrency = concurrency
+	}
+	return cfg, nil
+}
+
+func parseSizes(value string) ([]Size, error) {
+	if value == "none" {
+		return nil, nil
+	}
+	var sizes []Size
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(value, ",") {
+		name, edge, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		maxEdge, err := strconv.Atoi(edge)
+		if !ok || err != nil || maxEdge <= 0 || !sizeName.MatchString(name) {
+			return nil, fmt.Errorf("parse THUMBNAIL_SIZES: %q is not a name=maxEdge pair", pair)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("parse THUMBNAIL_SIZES: size %q is listed twice", name)
+		}
+		seen[name] = true
+		sizes = append(sizes, Size{Name: name, MaxEdge: maxEdge})
+	}
+	return sizes, nil
+}
@@ -0,0 +1,227 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"sort"
+
+	"golang.org/x/image/draw"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+
+	"media-indexer/models"
+	"media-indexer/phash"
+	"media-indexer/repositories/media"
+	"media-indexer/storage"
+)
+
+// hashSourceEdge is the size images are scaled down to, upright, before
+// their perceptual hash is computed.
+const hashSourceEdge = 64
+
+type ThumbnailServiceImpl struct {
+	MediaRepo media.MediaRepository
+	Storage   storage.StorageProvider
+	Config    Config
+
+	// slots bounds how many images are rendered at once.
+	slots chan struct{}
+}
+
+func NewThumbnailService(mediaRepo media.MediaRepository, storageProvider storage.StorageProvider, cfg Config) ThumbnailService {
+	if cfg.Quality <= 0 || cfg.Quality > 100 {
+		cfg.Quality = defaultQuality
+	}
+	if cfg.MaxPixels <= 0 {
+		cfg.MaxPixels = defaultMaxPixels
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = defaultConcurrency
+	}
+	return &ThumbnailServiceImpl{MediaRepo: mediaRepo, Storage: storageProvider, Config: cfg, slots: make(chan struct{}, cfg.Concurrency)}
+}
+
+// Supported reports whether thumbnails can be rendered for images of
+// contentType. AVIF and HEIC images cannot be decoded in pure Go.
+func Supported(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp", "image/tiff":
+		return true
+	}
+	return false
+}
+
+func (s *ThumbnailServiceImpl) Generate(ctx context.Context, m *models.Media, r io.ReaderAt, size int64) ([]models.Rendition, error) {
+	if !Supported(m.ContentType) {
+		return nil, nil
+	}
+	config, _, err := image.DecodeConfig(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > s.Config.MaxPixels {
+		return nil, ErrTooLarge
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	img, _, err := image.Decode(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	// The hash is taken from the upright image, so a copy whose rotation
+	// was applied to the pixels matches the original.
+	hash := models.NewPerceptualHash(m.ID, phash.DHash(render(img, m.Exif.Orientation, hashSourceEdge)))
+	if err := s.MediaRepo.SavePerceptualHash(hash); err != nil {
+		return nil, err
+	}
+	m.PerceptualHash = hash
+
+	encode, extension, contentType := s.encoder(img)
+
+	// Each size is scaled from the next larger one, which is much cheaper
+	// than scaling the original every time and looks the same.
+	sizes := append([]Size(nil), s.Config.Sizes...)
+	sort.SliceStable(sizes, func(i, j int) bool { return sizes[i].MaxEdge > sizes[j].MaxEdge })
+	source, orientation := img, m.Exif.Orientation
+
+	renditions := make([]models.Rendition, 0, len(sizes))
+	for _, size := range sizes {
+		if err := ctx.Err(); err != nil {
+			s.release(ctx, renditions)
+			return nil, err
+		}
+		scaled := render(source, orientation, size.MaxEdge)
+		source, orientation = scaled, 1
+		if m.Rendition(size.Name) != nil {
+			continue
+		}
+
+		var data bytes.Buffer
+		if err := encode(&data, scaled); err != nil {
+			s.release(ctx, renditions)
+			return nil, err
+		}
+		object, err := s.Storage.UploadFile(ctx, bytes.NewReader(data.Bytes()), size.Name+extension)
+		if err != nil {
+			s.release(ctx, renditions)
+			return nil, err
+		}
+		renditions = append(renditions, models.Rendition{
+			MediaID:         m.ID,
+			Name:            size.Name,
+			Width:           scaled.Bounds().Dx(),
+			Height:          scaled.Bounds().Dy(),
+			StorageProvider: object.Provider,
+			StorageKey:      object.Key,
+			ContentHash:     object.ContentHash,
+			ContentType:     contentType,
+			Size:            int64(data.Len()),
+		})
+	}
+
+	if len(renditions) == 0 {
+		return nil, nil
+	}
+	if err := s.MediaRepo.CreateRenditions(renditions); err != nil {
+		s.release(ctx, renditions)
+		return nil, err
+	}
+	m.Renditions = append(m.Renditions, renditions...)
+	return renditions, nil
+}
+
+// encoder picks JPEG for thumbnails of opaque images and PNG for those of
+// images with transparency.
+func (s *ThumbnailServiceImpl) encoder(img image.Image) (func(io.Writer, image.Image) error, string, string) {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+		return png.Encode, ".png", "image/png"
+	}
+	encode := func(w io.Writer, img image.Image) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: s.Config.Quality})
+	}
+	return encode, ".jpg", "image/jpeg"
+}
+
+// release drops the blobs of renditions that will not be saved.
+func (s *ThumbnailServiceImpl) release(ctx context.Context, renditions []models.Rendition) {
+	for _, rendition := range renditions {
+		instance := storage.InstanceNamed(s.Storage, rendition.StorageProvider)
+		if err := instance.Release(context.WithoutCancel(ctx), rendition.StorageKey); err != nil {
+			log.Printf("failed to release thumbnail %s: %v", rendition.StorageKey, err)
+		}
+	}
+}
+
+// render scales img down to fit in maxEdge by maxEdge pixels, then turns it
+// upright as its EXIF orientation says.
+func render(img image.Image, orientation int, maxEdge int) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := fit(bounds.Dx(), bounds.Dy(), maxEdge)
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+	return orient(scaled, orientation)
+}
+
+// fit returns the size of a width by height image scaled down, if needed,
+// so that neither edge exceeds maxEdge.
+func fit(width int, height int, maxEdge int) (int, int) {
+	longest := max(width, height)
+	if longest <= maxEdge {
+		return width, height
+	}
+	scale := float64(maxEdge) / float64(longest)
+	return max(1, int(float64(width)*scale+0.5)), max(1, int(float64(height)*scale+0.5))
+}
+
+// orient applies an EXIF orientation, from 1 (upright) to 8, to img.
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	// source maps a pixel of the upright image to one of img.
+	var source func(x, y int) (int, int)
+	switch orientation {
+	case 2: // mirrored
+		source = func(x, y int) (int, int) { return w - 1 - x, y }
+	case 3: // upside down
+		source = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	case 4: // mirrored upside down
+		source = func(x, y int) (int, int) { return x, h - 1 - y }
+	case 5: // mirrored, turned anticlockwise
+		source = func(x, y int) (int, int) { return y, x }
+	case 6: // turned anticlockwise
+		source = func(x, y int) (int, int) { return y, h - 1 - x }
+	case 7: // mirrored, turned clockwise
+		source = func(x, y int) (int, int) { return w - 1 - y, h - 1 - x }
+	case 8: // turned clockwise
+		source = func(x, y int) (int, int) { return w - 1 - y, x }
+	}
+
+	upright := image.NewRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		upright = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	bounds := upright.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			sx, sy := source(x, y)
+			upright.SetRGBA(x, y, img.RGBAAt(sx, sy))
+		}
+	}
+	return upright
+}
@@ -0,0 +1,250 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"media-indexer/models"
+	mediaRepo "media-indexer/repositories/media"
+	"media-indexer/storage"
+)
+
+type fakeMediaRepository struct {
+	mediaRepo.MediaRepository
+	renditions []models.Rendition
+	hashes     []*models.PerceptualHash
+	err        error
+}
+
+func (r *fakeMediaRepository) SavePerceptualHash(hash *models.PerceptualHash) error {
+	r.hashes = append(r.hashes, hash)
+	return nil
+}
+
+func (r *fakeMediaRepository) CreateRenditions(renditions []models.Rendition) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.renditions = append(r.renditions, renditions...)
+	return nil
+}
+
+type fixture struct {
+	service *ThumbnailServiceImpl
+	repo    *fakeMediaRepository
+	storage *storage.LocalStorage
+}
+
+func setup(t *testing.T, cfg Config) *fixture {
+	t.Helper()
+	s, err := storage.NewLocalStorage(storage.LocalConfig{RootDir: t.TempDir(), BaseURL: "http://localhost/files", SigningKey: "test"})
+	require.NoError(t, err)
+	repo := &fakeMediaRepository{}
+	if cfg.Sizes == nil {
+		cfg.Sizes = []Size{{Name: "small", MaxEdge: 40}, {Name: "large", MaxEdge: 100}}
+	}
+	return &fixture{service: NewThumbnailService(repo, s, cfg).(*ThumbnailServiceImpl), repo: repo, storage: s}
+}
+
+func (f *fixture) generate(t *testing.T, m *models.Media, data []byte) ([]models.Rendition, error) {
+	t.Helper()
+	return f.service.Generate(context.Background(), m, bytes.NewReader(data), int64(len(data)))
+}
+
+func (f *fixture) decode(t *testing.T, rendition models.Rendition) image.Image {
+	t.Helper()
+	reader, err := f.storage.Open(context.Background(), rendition.StorageKey)
+	require.NoError(t, err)
+	defer reader.Close()
+	img, _, err := image.Decode(reader)
+	require.NoError(t, err)
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var data bytes.Buffer
+	require.NoError(t, jpeg.Encode(&data, img, nil))
+	return data.Bytes()
+}
+
+func TestGenerate(t *testing.T) {
+	f := setup(t, Config{})
+	m := &models.Media{ID: uuid.New(), ContentType: "image/jpeg"}
+
+	renditions, err := f.generate(t, m, encodeJPEG(t, image.NewRGBA(image.Rect(0, 0, 400, 300))))
+	require.NoError(t, err)
+
+	require.Len(t, renditions, 2)
+	assert.Equal(t, f.repo.renditions, renditions)
+	assert.Equal(t, renditions, m.Renditions)
+	byName := map[string]models.Rendition{}
+	for _, rendition := range renditions {
+		assert.Equal(t, m.ID, rendition.MediaID)
+		assert.Equal(t, "image/jpeg", rendition.ContentType)
+		byName[rendition.Name] = rendition
+	}
+	assert.Equal(t, [2]int{40, 30}, [2]int{byName["small"].Width, byName["small"].Height})
+	assert.Equal(t, [2]int{100, 75}, [2]int{byName["large"].Width, byName["large"].Height})
+	assert.Equal(t, image.Rect(0, 0, 100, 75), f.decode(t, byName["large"]).Bounds())
+	require.Len(t, f.repo.hashes, 1)
+	assert.Equal(t, m.PerceptualHash, f.repo.hashes[0])
+	assert.Equal(t, m.ID, m.PerceptualHash.MediaID)
+}
+
+func TestGenerate_HashesWithoutSizes(t *testing.T) {
+	f := setup(t, Config{Sizes: []Size{}})
+	m := &models.Media{ID: uuid.New(), ContentType: "image/jpeg"}
+
+	renditions, err := f.generate(t, m, encodeJPEG(t, image.NewRGBA(image.Rect(0, 0, 400, 300))))
+	require.NoError(t, err)
+
+	assert.Empty(t, renditions)
+	assert.Empty(t, f.repo.renditions)
+	assert.NotNil(t, m.PerceptualHash)
+}
+
+func TestGenerate_Orientation(t *testing.T) {
+	f := setup(t, Config{Sizes: []Size{{Name: "small", MaxEdge: 40}}})
+	// A landscape image whose left half is white, stored as the camera saw
+	// it, turned anticlockwise: once upright the white half is at the top.
+	img := image.NewRGBA(image.Rect(0, 0, 80, 60))
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 40; x++ {
+			img.Set(x, y, color.White)
+		}
+	}
+	m := &models.Media{ID: uuid.New(), ContentType: "image/jpeg", Exif: models.Exif{Orientation: 6}}
+
+	renditions, err := f.generate(t, m, encodeJPEG(t, img))
+	require.NoError(t, err)
+
+	require.Len(t, renditions, 1)
+	assert.Equal(t, 30, renditions[0].Width)
+	assert.Equal(t, 40, renditions[0].Height)
+	upright := f.decode(t, renditions[0])
+	top, _, _, _ := upright.At(15, 5).RGBA()
+	bottom, _, _, _ := upright.At(15, 35).RGBA()
+	assert.Greater(t, top, uint32(0xf000))
+	assert.Less(t, bottom, uint32(0x1000))
+}
+
+func TestGenerate_TransparentImagesGetPNG(t *testing.T) {
+	f := setup(t, Config{})
+	var data bytes.Buffer
+	require.NoError(t, png.Encode(&data, image.NewNRGBA(image.Rect(0, 0, 20, 20))))
+
+	renditions, err := f.generate(t, &models.Media{ID: uuid.New(), ContentType: "image/png"}, data.Bytes())
+	require.NoError(t, err)
+
+	require.Len(t, renditions, 2)
+	assert.Equal(t, "image/png", renditions[0].ContentType)
+	// Images smaller than every size get thumbnails of their own size,
+	// which are the same blob.
+	assert.Equal(t, 20, renditions[0].Width)
+	assert.Equal(t, renditions[0].StorageKey, renditions[1].StorageKey)
+}
+
+func TestGenerate_Skipped(t *testing.T) {
+	f := setup(t, Config{MaxPixels: 1000})
+	data := encodeJPEG(t, image.NewRGBA(image.Rect(0, 0, 400, 300)))
+
+	renditions, err := f.generate(t, &models.Media{ID: uuid.New(), ContentType: "image/heic"}, data)
+	require.NoError(t, err)
+	assert.Empty(t, renditions)
+
+	_, err = f.generate(t, &models.Media{ID: uuid.New(), ContentType: "image/jpeg"}, data)
+	assert.ErrorIs(t, err, ErrTooLarge)
+	assert.Empty(t, f.repo.renditions)
+	assert.Empty(t, f.repo.hashes)
+}
+
+func TestGenerate_ReleasesBlobsWhenNotSaved(t *testing.T) {
+	f := setup(t, Config{})
+	f.repo.err = errors.New("database is down")
+	data := encodeJPEG(t, image.NewRGBA(image.Rect(0, 0, 400, 300)))
+
+	_, err := f.generate(t, &models.Media{ID: uuid.New(), ContentType: "image/jpeg"}, data)
+
+	assert.ErrorIs(t, err, f.repo.err)
+	var keys []string
+	require.NoError(t, f.storage.List(context.Background(), func(info storage.ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	}))
+	assert.Empty(t, keys)
+}
+
+func TestOrient(t *testing.T) {
+	// A 3x2 image whose pixels are numbered by their red channel:
+	//   1 2 3
+	//   4 5 6
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		img.SetRGBA(i%3, i/3, color.RGBA{R: uint8(i + 1), A: 255})
+	}
+	rows := func(img *image.RGBA) [][]uint8 {
+		var rows [][]uint8
+		for y := 0; y < img.Bounds().Dy(); y++ {
+			var row []uint8
+			for x := 0; x < img.Bounds().Dx(); x++ {
+				row = append(row, img.RGBAAt(x, y).R)
+			}
+			rows = append(rows, row)
+		}
+		return rows
+	}
+
+	for orientation, want := range map[int][][]uint8{
+		1: {{1, 2, 3}, {4, 5, 6}},
+		2: {{3, 2, 1}, {6, 5, 4}},
+		3: {{6, 5, 4}, {3, 2, 1}},
+		4: {{4, 5, 6}, {1, 2, 3}},
+		5: {{1, 4}, {2, 5}, {3, 6}},
+		6: {{4, 1}, {5, 2}, {6, 3}},
+		7: {{6, 3}, {5, 2}, {4, 1}},
+		8: {{3, 6}, {2, 5}, {1, 4}},
+	} {
+		assert.Equal(t, want, rows(orient(img, orientation)), "orientation %d", orientation)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("THUMBNAIL_SIZES", "")
+	t.Setenv("THUMBNAIL_QUALITY", "")
+	t.Setenv("THUMBNAIL_MAX_PIXELS", "")
+	t.Setenv("THUMBNAIL_CONCURRENCY", "")
+
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, []Size{{Name: "small", MaxEdge: 160}, {Name: "medium", MaxEdge: 480}, {Name: "large", MaxEdge: 1280}}, cfg.Sizes)
+	assert.Equal(t, defaultQuality, cfg.Quality)
+
+	t.Setenv("THUMBNAIL_SIZES", "grid=200, hero=1600")
+	t.Setenv("THUMBNAIL_QUALITY", "70")
+	cfg, err = ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, []Size{{Name: "grid", MaxEdge: 200}, {Name: "hero", MaxEdge: 1600}}, cfg.Sizes)
+	assert.Equal(t, 70, cfg.Quality)
+
+	t.Setenv("THUMBNAIL_SIZES", "none")
+	cfg, err = ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Sizes)
+
+	for _, sizes := range []string{"grid", "grid=0", "Grid=200", "grid=200,grid=400"} {
+		t.Setenv("THUMBNAIL_SIZES", sizes)
+		_, err = ConfigFromEnv()
+		assert.ErrorContains(t, err, "THUMBNAIL_SIZES", sizes)
+	}
+}
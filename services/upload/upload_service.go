@@ -0,0 +1,72 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"media-indexer/utils"
+)
+
+const (
+	defaultDir           = "./data/uploads"
+	defaultMaxAge        = 24 * time.Hour
+	defaultSweepInterval = time.Hour
+)
+
+var (
+	ErrUploadNotFound  = errors.New("upload not found")
+	ErrOffsetMismatch  = errors.New("upload offset mismatch")
+	ErrUploadTooLarge  = errors.New("upload exceeds its declared length")
+	ErrUploadFinishing = errors.New("upload is being finished")
+)
+
+type UploadService interface {
+	CreateUpload(length int64, metadata map[string]string) (*Upload, error)
+	GetUpload(id string) (*Upload, error)
+	// WriteChunk appends r to the upload, which must currently be at offset.
+	// Bytes received before a failure are kept so the client can resume.
+	// When the upload is complete but not finished afterwards, the caller
+	// holds the claim to finish it and must call MarkFinished or
+	// ReleaseUpload. Other requests get ErrUploadFinishing until then.
+	WriteChunk(id string, offset int64, r io.Reader) (*Upload, error)
+	// OpenData opens the assembled file of a complete upload.
+	OpenData(id string) (*os.File, error)
+	// MarkFinished records the media created from the upload and drops its
+	// data, which now lives in storage. If recording fails the upload stays
+	// claimed, and the next WriteChunk tries again instead of letting the
+	// upload be finished a second time.
+	MarkFinished(id string, mediaID string) (*Upload, error)
+	// ReleaseUpload gives up the claim WriteChunk took on a complete upload
+	// that could not be finished, so a later request can retry.
+	ReleaseUpload(id string)
+	TerminateUpload(id string) error
+	// Sweep removes uploads whose files have not been touched for maxAge:
+	// abandoned partial uploads as well as the state of finished ones. It
+	// returns the number of uploads removed.
+	Sweep(ctx context.Context, maxAge time.Duration) (int, error)
+}
+
+type Config struct {
+	Dir string
+	// MaxAge is how long an upload may go untouched before the sweeper
+	// removes it.
+	MaxAge        time.Duration
+	SweepInterval time.Duration
+}
+
+// ConfigFromEnv reads UPLOAD_DIR, UPLOAD_MAX_AGE and UPLOAD_SWEEP_INTERVAL.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{Dir: utils.GetEnv("UPLOAD_DIR", defaultDir), MaxAge: defaultMaxAge, SweepInterval: defaultSweepInterval}
+
+	var err error
+	if cfg.MaxAge, err = utils.GetEnvDuration("UPLOAD_MAX_AGE", cfg.MaxAge); err != nil {
+		return Config{}, err
+	}
+	if cfg.SweepInterval, err = utils.GetEnvDuration("UPLOAD_SWEEP_INTERVAL", cfg.SweepInterval); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
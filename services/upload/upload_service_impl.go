@@ -0,0 +1,402 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Upload is the state of a resumable upload. It is kept next to the partial
+// data on disk, so uploads survive restarts.
+type Upload struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata"`
+	MediaID   string            `json:"mediaId,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	// Offset is the number of bytes received so far. It is derived from the
+	// size of the data file rather than stored.
+	Offset int64 `json:"-"`
+}
+
+func (u *Upload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+func (u *Upload) Finished() bool {
+	return u.MediaID != ""
+}
+
+// UploadServiceImpl stores each upload as "<id>.info" (JSON state) and
+// "<id>.bin" (bytes received so far) in Dir.
+type UploadServiceImpl struct {
+	Dir string
+
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+	// finishing holds the complete uploads claimed by WriteChunk until they
+	// are finished or released, along with the ID of the media created from
+	// them once MarkFinished failed to record it.
+	finishing map[string]string
+}
+
+// uploadLock serializes access to a single upload. It is dropped from locks
+// once no request holds or waits for it.
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+func NewUploadService(dir string) (UploadService, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create upload directory: %w", err)
+	}
+	return &UploadServiceImpl{Dir: dir, locks: make(map[string]*uploadLock), finishing: make(map[string]string)}, nil
+}
+
+func (s *UploadServiceImpl) CreateUpload(length int64, metadata map[string]string) (*Upload, error) {
+	upload := &Upload{
+		ID:        uuid.New().String(),
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: time.Now(),
+	}
+
+	data, err := os.OpenFile(s.dataPath(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	data.Close()
+
+	if err := s.writeInfo(upload); err != nil {
+		os.Remove(s.dataPath(upload.ID))
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (s *UploadServiceImpl) GetUpload(id string) (*Upload, error) {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return s.readUpload(id)
+}
+
+func (s *UploadServiceImpl) WriteChunk(id string, offset int64, r io.Reader) (*Upload, error) {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	upload, err := s.readUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if mediaID, ok := s.claim(id); ok {
+		if mediaID == "" {
+			return upload, ErrUploadFinishing
+		}
+		// The media was created, but recording it failed: try again
+		// rather than letting the upload be finished twice.
+		return s.markFinished(upload, mediaID)
+	}
+	if upload.Offset != offset {
+		return upload, ErrOffsetMismatch
+	}
+	if upload.Finished() {
+		return upload, nil
+	}
+
+	data, err := os.OpenFile(s.dataPath(id), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	remaining := upload.Length - upload.Offset
+	written, copyErr := io.Copy(data, io.LimitReader(r, remaining+1))
+	if written > remaining {
+		// Drop the byte that proved the chunk too long.
+		if err := data.Truncate(upload.Length); err != nil {
+			return nil, err
+		}
+		written = remaining
+		copyErr = ErrUploadTooLarge
+	}
+	if err := data.Sync(); err != nil {
+		return nil, err
+	}
+
+	upload.Offset += written
+	if copyErr == nil && upload.Complete() {
+		s.mu.Lock()
+		s.finishing[id] = ""
+		s.mu.Unlock()
+	}
+	return upload, copyErr
+}
+
+func (s *UploadServiceImpl) OpenData(id string) (*os.File, error) {
+	f, err := os.Open(s.dataPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrUploadNotFound
+	}
+	return f, err
+}
+
+func (s *UploadServiceImpl) MarkFinished(id string, mediaID string) (*Upload, error) {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	upload, err := s.readUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.markFinished(upload, mediaID)
+}
+
+// markFinished records the media created from an upload whose lock is held.
+// The claim on the upload is kept along with mediaID when that fails.
+func (s *UploadServiceImpl) markFinished(upload *Upload, mediaID string) (*Upload, error) {
+	upload.MediaID = mediaID
+	if err := s.writeInfo(upload); err != nil {
+		s.mu.Lock()
+		s.finishing[upload.ID] = mediaID
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.ReleaseUpload(upload.ID)
+
+	// The upload is finished once its info is written; leftover data is
+	// removed by the sweeper.
+	if err := os.Remove(s.dataPath(upload.ID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("failed to remove data of finished upload %s: %v", upload.ID, err)
+	}
+	return upload, nil
+}
+
+func (s *UploadServiceImpl) ReleaseUpload(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.finishing, id)
+}
+
+func (s *UploadServiceImpl) TerminateUpload(id string) error {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := s.readUpload(id); err != nil {
+		return err
+	}
+	if s.isFinishing(id) {
+		return ErrUploadFinishing
+	}
+	if err := os.Remove(s.dataPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Remove(s.infoPath(id))
+}
+
+func (s *UploadServiceImpl) Sweep(ctx context.Context, maxAge time.Duration) (int, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := make(map[string]bool)
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".tmp")
+		if id, ok := strings.CutSuffix(name, ".bin"); ok {
+			ids[id] = true
+		} else if id, ok := strings.CutSuffix(name, ".info"); ok {
+			ids[id] = true
+		}
+	}
+
+	removed := 0
+	cutoff := time.Now().Add(-maxAge)
+	for id := range ids {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		// Skip uploads in progress before waiting for their lock.
+		if !s.untouchedSince(id, cutoff) {
+			continue
+		}
+		ok, err := s.sweepUpload(id, cutoff)
+		if err != nil {
+			log.Printf("failed to remove upload %s: %v", id, err)
+			continue
+		}
+		if ok {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// sweepUpload removes the files of an upload that is not being finished and
+// has not been touched since cutoff.
+func (s *UploadServiceImpl) sweepUpload(id string, cutoff time.Time) (bool, error) {
+	unlock, err := s.lock(id)
+	if err != nil {
+		// Not an upload.
+		return false, nil
+	}
+	defer unlock()
+
+	if s.isFinishing(id) || !s.untouchedSince(id, cutoff) {
+		return false, nil
+	}
+	for _, path := range []string{s.dataPath(id), s.infoPath(id), s.infoPath(id) + ".tmp"} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// RunSweeper sweeps the upload directory right away and then every interval
+// until ctx is done.
+func RunSweeper(ctx context.Context, service UploadService, interval time.Duration, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		removed, err := service.Sweep(ctx, maxAge)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("failed to sweep the upload directory: %v", err)
+		} else if removed > 0 {
+			log.Printf("swept the upload directory: removed %d uploads", removed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lock locks a single upload, so that two PATCH requests for the same upload
+// cannot interleave their writes, and returns the function unlocking it.
+func (s *UploadServiceImpl) lock(id string) (func(), error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrUploadNotFound
+	}
+
+	s.mu.Lock()
+	lock, ok := s.locks[id]
+	if !ok {
+		lock = &uploadLock{}
+		s.locks[id] = lock
+	}
+	lock.refs++
+	s.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if lock.refs--; lock.refs == 0 {
+			delete(s.locks, id)
+		}
+	}, nil
+}
+
+// claim reports whether an upload is claimed, and the ID of the media created
+// from it if that could not be recorded.
+func (s *UploadServiceImpl) claim(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mediaID, ok := s.finishing[id]
+	return mediaID, ok
+}
+
+func (s *UploadServiceImpl) isFinishing(id string) bool {
+	_, ok := s.claim(id)
+	return ok
+}
+
+// untouchedSince reports whether neither file of an upload has been modified
+// since cutoff.
+func (s *UploadServiceImpl) untouchedSince(id string, cutoff time.Time) bool {
+	for _, path := range []string{s.dataPath(id), s.infoPath(id)} {
+		info, err := os.Stat(path)
+		if err == nil && info.ModTime().After(cutoff) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *UploadServiceImpl) readUpload(id string) (*Upload, error) {
+	info, err := os.ReadFile(s.infoPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var upload Upload
+	if err := json.Unmarshal(info, &upload); err != nil {
+		return nil, err
+	}
+
+	if upload.Finished() {
+		upload.Offset = upload.Length
+		return &upload, nil
+	}
+	fi, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return nil, err
+	}
+	upload.Offset = fi.Size()
+	return &upload, nil
+}
+
+func (s *UploadServiceImpl) writeInfo(upload *Upload) error {
+	info, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	tmp := s.infoPath(upload.ID) + ".tmp"
+	if err := os.WriteFile(tmp, info, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.infoPath(upload.ID))
+}
+
+func (s *UploadServiceImpl) dataPath(id string) string {
+	return filepath.Join(s.Dir, id+".bin")
+}
+
+func (s *UploadServiceImpl) infoPath(id string) string {
+	return filepath.Join(s.Dir, id+".info")
+}
@@ -0,0 +1,169 @@
+package upload
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestService(t *testing.T) *UploadServiceImpl {
+	service, err := NewUploadService(t.TempDir())
+	require.NoError(t, err)
+	return service.(*UploadServiceImpl)
+}
+
+func TestWriteChunk_ClaimsCompleteUpload(t *testing.T) {
+	s := newTestService(t)
+	created, err := s.CreateUpload(5, nil)
+	require.NoError(t, err)
+
+	current, err := s.WriteChunk(created.ID, 0, strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.True(t, current.Complete())
+
+	// A retry of the last chunk must not finish the upload a second time.
+	_, err = s.WriteChunk(created.ID, 5, strings.NewReader(""))
+	assert.ErrorIs(t, err, ErrUploadFinishing)
+	assert.ErrorIs(t, s.TerminateUpload(created.ID), ErrUploadFinishing)
+
+	s.ReleaseUpload(created.ID)
+	current, err = s.WriteChunk(created.ID, 5, strings.NewReader(""))
+	require.NoError(t, err)
+	assert.True(t, current.Complete())
+
+	current, err = s.MarkFinished(created.ID, "media")
+	require.NoError(t, err)
+	assert.True(t, current.Finished())
+
+	current, err = s.WriteChunk(created.ID, 5, strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Equal(t, "media", current.MediaID)
+}
+
+func TestMarkFinished_KeepsClaimWhenRecordingFails(t *testing.T) {
+	s := newTestService(t)
+	created, err := s.CreateUpload(5, nil)
+	require.NoError(t, err)
+	_, err = s.WriteChunk(created.ID, 0, strings.NewReader("hello"))
+	require.NoError(t, err)
+
+	// A directory in the way of the temporary info file makes writing it
+	// fail.
+	require.NoError(t, os.Mkdir(s.infoPath(created.ID)+".tmp", 0o755))
+	_, err = s.MarkFinished(created.ID, "media")
+	require.Error(t, err)
+
+	_, err = s.WriteChunk(created.ID, 5, strings.NewReader(""))
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUploadFinishing)
+
+	// The retry records the media instead of handing the upload out again.
+	require.NoError(t, os.Remove(s.infoPath(created.ID)+".tmp"))
+	current, err := s.WriteChunk(created.ID, 5, strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Equal(t, "media", current.MediaID)
+	assert.Empty(t, s.finishing)
+}
+
+func TestWriteChunk_OnlyOneConcurrentRequestClaims(t *testing.T) {
+	s := newTestService(t)
+	created, err := s.CreateUpload(5, nil)
+	require.NoError(t, err)
+	_, err = s.WriteChunk(created.ID, 0, strings.NewReader("hell"))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	results := make([]error, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, results[i] = s.WriteChunk(created.ID, 4, strings.NewReader("o"))
+		}(i)
+	}
+	wg.Wait()
+
+	claimed := 0
+	for _, err := range results {
+		if err == nil {
+			claimed++
+		} else {
+			assert.ErrorIs(t, err, ErrUploadFinishing)
+		}
+	}
+	assert.Equal(t, 1, claimed)
+}
+
+func TestLock_DropsUnusedEntries(t *testing.T) {
+	s := newTestService(t)
+	created, err := s.CreateUpload(5, nil)
+	require.NoError(t, err)
+
+	_, err = s.GetUpload(created.ID)
+	require.NoError(t, err)
+	_, err = s.GetUpload("../../etc/passwd")
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+	_, err = s.GetUpload("3b241101-e2bb-4255-8caf-4136c566a962")
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+
+	assert.Empty(t, s.locks)
+}
+
+func TestSweep(t *testing.T) {
+	s := newTestService(t)
+	abandoned, err := s.CreateUpload(5, nil)
+	require.NoError(t, err)
+	finished, err := s.CreateUpload(5, nil)
+	require.NoError(t, err)
+	_, err = s.WriteChunk(finished.ID, 0, strings.NewReader("hello"))
+	require.NoError(t, err)
+	_, err = s.MarkFinished(finished.ID, "media")
+	require.NoError(t, err)
+	claimed, err := s.CreateUpload(5, nil)
+	require.NoError(t, err)
+	_, err = s.WriteChunk(claimed.ID, 0, strings.NewReader("hello"))
+	require.NoError(t, err)
+	active, err := s.CreateUpload(5, nil)
+	require.NoError(t, err)
+
+	past := time.Now().Add(-2 * time.Hour)
+	for _, id := range []string{abandoned.ID, finished.ID, claimed.ID} {
+		for _, path := range []string{s.dataPath(id), s.infoPath(id)} {
+			if err := os.Chtimes(path, past, past); err != nil {
+				require.ErrorIs(t, err, os.ErrNotExist)
+			}
+		}
+	}
+
+	removed, err := s.Sweep(context.Background(), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+
+	_, err = s.GetUpload(abandoned.ID)
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+	_, err = s.GetUpload(finished.ID)
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+	_, err = s.GetUpload(claimed.ID)
+	assert.NoError(t, err)
+	_, err = s.GetUpload(active.ID)
+	assert.NoError(t, err)
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", "/var/uploads")
+	t.Setenv("UPLOAD_MAX_AGE", "48h")
+
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, Config{Dir: "/var/uploads", MaxAge: 48 * time.Hour, SweepInterval: defaultSweepInterval}, cfg)
+
+	t.Setenv("UPLOAD_SWEEP_INTERVAL", "often")
+	_, err = ConfigFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAzureBlockSize = 16 << 20
+	maxAzureBlockSize     = 4000 << 20
+)
+
+type AzureConfig struct {
+	Account string `json:"account"`
+	// AccountKey is the base64 encoded shared key of the storage account.
+	AccountKey string `json:"accountKey"`
+	Container  string `json:"container"`
+	// Endpoint defaults to https://<account>.blob.core.windows.net.
+	Endpoint string `json:"endpoint"`
+	// PublicBaseURL, when set, replaces the container URL in returned links,
+	// e.g. to serve blobs through a CDN.
+	PublicBaseURL string `json:"publicBaseUrl"`
+	// Files larger than BlockSize are staged as several blocks.
+	BlockSize int64 `json:"blockSize"`
+	// TempDir holds uploads while they are hashed, before they are sent.
+	TempDir string `json:"tempDir"`
+}
+
+func init() {
+	Register("azure", func(cfg AzureConfig) (StorageProvider, error) {
+		s, err := NewAzureStorage(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}, AzureConfigFromEnv)
+}
+
+// AzureStorage stores blobs in an Azure Blob Storage container. Reference
+// counts are kept in a "<key>.refs" blob next to each blob.
+type AzureStorage struct {
+	Config AzureConfig
+
+	client *azureClient
+	mu     sync.Mutex
+}
+
+func NewAzureStorage(cfg AzureConfig) (*AzureStorage, error) {
+	if cfg.Account == "" {
+		return nil, errors.New("azure storage: account is required")
+	}
+	if cfg.Container == "" {
+		return nil, errors.New("azure storage: container is required")
+	}
+	key, err := base64.StdEncoding.DecodeString(cfg.AccountKey)
+	if err != nil || len(key) == 0 {
+		return nil, errors.New("azure storage: account key must be base64 encoded")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", cfg.Account)
+	}
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = defaultAzureBlockSize
+	}
+	if cfg.BlockSize < 0 || cfg.BlockSize > maxAzureBlockSize {
+		return nil, fmt.Errorf("azure storage: block size must be between 1 and %d bytes", int64(maxAzureBlockSize))
+	}
+	if cfg.TempDir == "" {
+		cfg.TempDir = os.TempDir()
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("azure storage: invalid endpoint %q", cfg.Endpoint)
+	}
+
+	return &AzureStorage{
+		Config: cfg,
+		client: &azureClient{
+			Endpoint:   endpoint,
+			Account:    cfg.Account,
+			Key:        key,
+			Container:  cfg.Container,
+			HTTPClient: http.DefaultClient,
+		},
+	}, nil
+}
+
+func (s *AzureStorage) UploadFile(ctx context.Context, file io.Reader, _filename string) (*Object, error) {
+	spooled, err := spoolFile(s.Config.TempDir, file)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spooled.Path)
+
+	return s.store(ctx, spooled.Key(), spooled)
+}
+
+func (s *AzureStorage) UploadFileAs(ctx context.Context, key string, file io.Reader, contentType string) (*Object, error) {
+	spooled, err := spoolFile(s.Config.TempDir, file)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spooled.Path)
+
+	spooled.ContentType = contentType
+	return s.store(ctx, key, spooled)
+}
+
+func (s *AzureStorage) ReplaceFile(ctx context.Context, key string, file io.Reader, contentType string) error {
+	spooled, err := spoolFile(s.Config.TempDir, file)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spooled.Path)
+	spooled.ContentType = contentType
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs(ctx, key)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		return ErrObjectNotFound
+	}
+	return s.putFile(ctx, key, spooled)
+}
+
+// store uploads a spooled file under key, unless the blob is already
+// stored, and adds a reference to it.
+func (s *AzureStorage) store(ctx context.Context, key string, spooled *spooledFile) (*Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if refs == 0 {
+		if err := s.putFile(ctx, key, spooled); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.writeRefs(ctx, key, refs+1); err != nil {
+		return nil, err
+	}
+
+	return &Object{
+		Key:         key,
+		URL:         s.url(key),
+		ContentHash: spooled.ContentHash,
+		ContentType: spooled.ContentType,
+		Size:        spooled.Size,
+	}, nil
+}
+
+func (s *AzureStorage) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs(ctx, key)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		return ErrObjectNotFound
+	}
+	if refs > 1 {
+		return s.writeRefs(ctx, key, refs-1)
+	}
+	return s.remove(ctx, key)
+}
+
+func (s *AzureStorage) References(ctx context.Context, key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readRefs(ctx, key)
+}
+
+func (s *AzureStorage) SetReferences(ctx context.Context, key string, refs int) error {
+	if refs <= 0 {
+		return fmt.Errorf("set references of %s: %d is not a positive count", key, refs)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.readRefs(ctx, key)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return ErrObjectNotFound
+	}
+	return s.writeRefs(ctx, key, refs)
+}
+
+// SignedURL returns a blob URL carrying a read-only service SAS. Like S3
+// presigned URLs they always point at the container, not PublicBaseURL.
+func (s *AzureStorage) SignedURL(_ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return s.client.sasURL(key, "r", time.Now().Add(expiry)).String(), nil
+}
+
+func (s *AzureStorage) Open(ctx context.Context, key string) (ObjectReader, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	fetch := func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		resp, err := s.client.getBlob(ctx, key, http.Header{"X-Ms-Range": {fmt.Sprintf("bytes=%d-", offset)}})
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	return &rangeReader{ctx: ctx, size: info.Size, fetch: fetch}, nil
+}
+
+func (s *AzureStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	resp, err := s.client.getBlobProperties(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &ObjectInfo{
+		Key:          key,
+		Size:         resp.ContentLength,
+		ContentType:  resp.Header.Get("Content-Type"),
+		LastModified: lastModified,
+	}, nil
+}
+
+func (s *AzureStorage) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	return s.client.listBlobs(ctx, func(blob azureListedBlob) error {
+		if strings.HasSuffix(blob.Name, ".refs") {
+			return nil
+		}
+		lastModified, _ := http.ParseTime(blob.Properties.LastModified)
+		return fn(ObjectInfo{Key: blob.Name, Size: blob.Properties.ContentLength, LastModified: lastModified})
+	})
+}
+
+func (s *AzureStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remove(ctx, key)
+}
+
+func (s *AzureStorage) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.getBlobProperties(ctx, key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// remove deletes a blob together with its reference count. The caller must
+// hold s.mu. Unlike S3, the Blob service fails deleting a missing blob, which
+// is not an error here.
+func (s *AzureStorage) remove(ctx context.Context, key string) error {
+	for _, name := range []string{key, key + ".refs"} {
+		if err := s.client.deleteBlob(ctx, name); err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *AzureStorage) url(key string) string {
+	if s.Config.PublicBaseURL != "" {
+		return strings.TrimRight(s.Config.PublicBaseURL, "/") + "/" + key
+	}
+	return s.client.blobURL(key).String()
+}
+
+// putFile uploads a spooled file under key, staging it as several blocks
+// when it does not fit into a single one.
+func (s *AzureStorage) putFile(ctx context.Context, key string, spooled *spooledFile) error {
+	f, err := os.Open(spooled.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size := spooled.Size
+	if size <= s.Config.BlockSize {
+		return s.client.putBlob(ctx, key, f, size, spooled.ContentType)
+	}
+
+	// Uncommitted blocks are discarded by the service after a week, so a
+	// failed upload needs no cleanup.
+	var blockIDs []string
+	for offset, index := int64(0), 0; offset < size; offset, index = offset+s.Config.BlockSize, index+1 {
+		blockSize := min(s.Config.BlockSize, size-offset)
+		blockID := azureBlockID(index)
+		if err := s.client.putBlock(ctx, key, blockID, io.NewSectionReader(f, offset, blockSize), blockSize); err != nil {
+			return err
+		}
+		blockIDs = append(blockIDs, blockID)
+	}
+	return s.client.putBlockList(ctx, key, blockIDs, spooled.ContentType)
+}
+
+func (s *AzureStorage) readRefs(ctx context.Context, key string) (int, error) {
+	resp, err := s.client.getBlob(ctx, key+".refs", nil)
+	if errors.Is(err, ErrObjectNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func (s *AzureStorage) writeRefs(ctx context.Context, key string, refs int) error {
+	data := strconv.Itoa(refs)
+	return s.client.putBlob(ctx, key+".refs", strings.NewReader(data), int64(len(data)), "text/plain")
+}
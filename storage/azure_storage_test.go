@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The well-known development account every Azurite instance accepts.
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// newAzuriteStorage connects to the Azurite blob endpoint in
+// AZURITE_BLOB_ENDPOINT, e.g. http://127.0.0.1:10000/devstoreaccount1, and
+// creates a fresh container for the test. The test is skipped without one.
+func newAzuriteStorage(t *testing.T) *AzureStorage {
+	t.Helper()
+
+	endpoint := os.Getenv("AZURITE_BLOB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("AZURITE_BLOB_ENDPOINT is not set")
+	}
+	s, err := NewAzureStorage(AzureConfig{
+		Account:    azuriteAccount,
+		AccountKey: azuriteKey,
+		Container:  fmt.Sprintf("test-%d", time.Now().UnixNano()),
+		Endpoint:   endpoint,
+		BlockSize:  1024,
+		TempDir:    t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	resp, err := s.client.do(context.Background(), http.MethodPut, "", url.Values{"restype": {"container"}}, nil, nil, 0)
+	require.NoError(t, err)
+	resp.Body.Close()
+	t.Cleanup(func() {
+		if resp, err := s.client.do(context.Background(), http.MethodDelete, "", url.Values{"restype": {"container"}}, nil, nil, 0); err == nil {
+			resp.Body.Close()
+		}
+	})
+	return s
+}
+
+func TestAzureStorageLifecycle(t *testing.T) {
+	s, _ := newTestAzureStorage(t)
+	testProviderLifecycle(t, s)
+}
+
+func TestAzureStorageList(t *testing.T) {
+	s, fake := newTestAzureStorage(t)
+	fake.ListPageSize = 2
+	testProviderList(t, s)
+}
+
+func TestAzureStorageUploadFile(t *testing.T) {
+	s, fake := newTestAzureStorage(t)
+
+	object, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "photo.jpg")
+	require.NoError(t, err)
+
+	assert.Equal(t, s.Config.Endpoint+"/media/"+object.Key, object.URL)
+	stored, ok := fake.Blob(object.Key)
+	require.True(t, ok)
+	assert.Equal(t, "file content", string(stored))
+	refs, _ := fake.Blob(object.Key + ".refs")
+	assert.Equal(t, "1", string(refs))
+}
+
+func TestAzureStorageUploadFile_Blocks(t *testing.T) {
+	s, fake := newTestAzureStorage(t)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), (2*1024+512)/16)
+	object, err := s.UploadFile(context.Background(), bytes.NewReader(content), "video.mp4")
+	require.NoError(t, err)
+
+	stored, ok := fake.Blob(object.Key)
+	require.True(t, ok)
+	assert.Equal(t, content, stored)
+	assert.Contains(t, fake.Requests(), "PUT "+object.Key+" blocklist")
+}
+
+func TestAzureStorageUploadFile_SameContentSharesBlob(t *testing.T) {
+	s, fake := newTestAzureStorage(t)
+
+	first, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "photo.jpg")
+	require.NoError(t, err)
+	second, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "copy.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, first.Key, second.Key)
+
+	blobPuts := 0
+	for _, request := range fake.Requests() {
+		if request == "PUT "+first.Key+" " {
+			blobPuts++
+		}
+	}
+	assert.Equal(t, 1, blobPuts)
+
+	require.NoError(t, s.Release(context.Background(), first.Key))
+	_, ok := fake.Blob(first.Key)
+	assert.True(t, ok)
+
+	require.NoError(t, s.Release(context.Background(), first.Key))
+	_, ok = fake.Blob(first.Key)
+	assert.False(t, ok)
+	_, ok = fake.Blob(first.Key + ".refs")
+	assert.False(t, ok)
+}
+
+func TestAzureStorageSignedURL(t *testing.T) {
+	s, _ := newTestAzureStorage(t)
+	testAzureSignedURL(t, s)
+}
+
+func testAzureSignedURL(t *testing.T, s *AzureStorage) {
+	t.Helper()
+
+	object, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "photo.jpg")
+	require.NoError(t, err)
+
+	signedURL, err := s.SignedURL(context.Background(), object.Key, time.Minute)
+	require.NoError(t, err)
+
+	resp, err := http.Get(signedURL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "file content", string(body))
+
+	tampered := strings.Replace(signedURL, object.Key, strings.Repeat("0", 64)+".txt", 1)
+	resp, err = http.Get(tampered)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestAzureStorageDefaultEndpoint(t *testing.T) {
+	s, err := NewAzureStorage(AzureConfig{Account: "media", AccountKey: base64.StdEncoding.EncodeToString([]byte("key")), Container: "uploads"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "https://media.blob.core.windows.net/uploads/abc.jpg", s.url("abc.jpg"))
+}
+
+func TestNewStorage_Azure(t *testing.T) {
+	_, err := NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": {Type: "azure", Config: json.RawMessage(`{"account": "media", "container": "uploads", "accountKey": "not base64"}`)}},
+	})
+	assert.ErrorContains(t, err, "account key must be base64 encoded")
+
+	provider, err := NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": {Type: "azure", Config: json.RawMessage(`{"account": "media", "container": "uploads", "accountKey": "a2V5"}`)}},
+	})
+	require.NoError(t, err)
+	assert.IsType(t, &AzureStorage{}, InstanceNamed(provider, "media"))
+}
+
+func TestAzuriteLifecycle(t *testing.T) {
+	s := newAzuriteStorage(t)
+	testProviderLifecycle(t, s)
+	testProviderList(t, s)
+}
+
+func TestAzuriteUploadFile_Blocks(t *testing.T) {
+	s := newAzuriteStorage(t)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), (2*1024+512)/16)
+	object, err := s.UploadFile(context.Background(), bytes.NewReader(content), "video.mp4")
+	require.NoError(t, err)
+
+	reader, err := s.Open(context.Background(), object.Key)
+	require.NoError(t, err)
+	defer reader.Close()
+	stored, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, content, stored)
+}
+
+func TestAzuriteSignedURL(t *testing.T) {
+	testAzureSignedURL(t, newAzuriteStorage(t))
+}
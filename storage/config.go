@@ -0,0 +1,348 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"media-indexer/utils"
+)
+
+// Config describes the named storage instances of the application and which
+// of them receives uploads of a given content type.
+//
+//	{
+//	  "default": "media",
+//	  "instances": {
+//	    "media":  {"type": "local", "config": {"rootDir": "/var/lib/media"}},
+//	    "videos": {"type": "s3", "config": {"bucket": "videos"}}
+//	  },
+//	  "routes": [{"contentType": "video/*", "instance": "videos"}]
+//	}
+type Config struct {
+	Default   string                    `json:"default"`
+	Instances map[string]InstanceConfig `json:"instances"`
+	Routes    []RouteConfig             `json:"routes"`
+}
+
+type InstanceConfig struct {
+	Type   string          `json:"type"`
+	Config json.RawMessage `json:"config"`
+}
+
+// RouteConfig sends uploads whose detected content type matches ContentType,
+// e.g. "video/*" or "image/png", to Instance. Routes are tried in order.
+type RouteConfig struct {
+	ContentType string `json:"contentType"`
+	Instance    string `json:"instance"`
+}
+
+// LoadConfigFile reads a JSON storage config. Environment variables such as
+// ${S3_SECRET_ACCESS_KEY} are expanded, so secrets can stay out of the file.
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(os.ExpandEnv(string(data)))))
+	decoder.DisallowUnknownFields()
+	var cfg Config
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parse storage config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// NewStorage builds every configured instance and returns a Router over
+// them, which tags every stored object with the name of its instance.
+func NewStorage(cfg *Config) (StorageProvider, error) {
+	if len(cfg.Instances) == 0 {
+		return nil, errors.New("storage config: no instances defined")
+	}
+	if _, ok := cfg.Instances[cfg.Default]; !ok {
+		return nil, fmt.Errorf("storage config: default instance %q is not defined", cfg.Default)
+	}
+
+	names := make([]string, 0, len(cfg.Instances))
+	for name := range cfg.Instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	instances := make(map[string]StorageProvider, len(cfg.Instances))
+	for _, name := range names {
+		provider, err := NewInstance(cfg.Instances[name])
+		if err != nil {
+			return nil, fmt.Errorf("storage instance %q: %w", name, err)
+		}
+		instances[name] = provider
+	}
+
+	for _, route := range cfg.Routes {
+		if _, ok := instances[route.Instance]; !ok {
+			return nil, fmt.Errorf("storage config: route %q points to undefined instance %q", route.ContentType, route.Instance)
+		}
+	}
+
+	return NewRouter(instances, cfg.Default, cfg.Routes), nil
+}
+
+// NewInstance builds a single provider of a registered type from its config.
+func NewInstance(cfg InstanceConfig) (StorageProvider, error) {
+	reg, err := lookupProvider(cfg.Type)
+	if err != nil {
+		return nil, err
+	}
+	return reg.fromJSON(cfg.Config)
+}
+
+// NewStorageFromEnv builds storage from the file named by STORAGE_CONFIG or,
+// when it is not set, a single instance of type STORAGE_TYPE configured
+// through that provider's environment variables and named after its type.
+func NewStorageFromEnv() (StorageProvider, error) {
+	if path := os.Getenv("STORAGE_CONFIG"); path != "" {
+		cfg, err := LoadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return NewStorage(cfg)
+	}
+
+	name := utils.GetEnv("STORAGE_TYPE", "local")
+	provider, err := newInstanceFromEnv(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewRouter(map[string]StorageProvider{name: provider}, name, nil), nil
+}
+
+// DefaultInstanceName returns the name of the instance NewStorageFromEnv
+// sends uploads to by default.
+func DefaultInstanceName() (string, error) {
+	if path := os.Getenv("STORAGE_CONFIG"); path != "" {
+		cfg, err := LoadConfigFile(path)
+		if err != nil {
+			return "", err
+		}
+		return cfg.Default, nil
+	}
+	return utils.GetEnv("STORAGE_TYPE", "local"), nil
+}
+
+// NewNamedInstanceFromEnv builds one backend for tools that address it
+// directly: the instance called name in the STORAGE_CONFIG file or, when no
+// file is set, a provider of type name configured through its environment
+// variables.
+func NewNamedInstanceFromEnv(name string) (StorageProvider, error) {
+	if path := os.Getenv("STORAGE_CONFIG"); path != "" {
+		cfg, err := LoadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		instance, ok := cfg.Instances[name]
+		if !ok {
+			return nil, fmt.Errorf("storage config: instance %q is not defined", name)
+		}
+		return NewInstance(instance)
+	}
+
+	return newInstanceFromEnv(name)
+}
+
+// newInstanceFromEnv builds a provider of type providerType configured
+// through its environment variables.
+func newInstanceFromEnv(providerType string) (StorageProvider, error) {
+	reg, err := lookupProvider(providerType)
+	if err != nil {
+		return nil, err
+	}
+	return reg.fromEnv()
+}
+
+func LocalConfigFromEnv() (LocalConfig, error) {
+	return LocalConfig{
+		RootDir:    utils.GetEnv("LOCAL_STORAGE_ROOT", "./data/media"),
+		BaseURL:    utils.GetEnv("LOCAL_STORAGE_BASE_URL", "http://localhost:8080/files"),
+		SigningKey: os.Getenv("LOCAL_STORAGE_SIGNING_KEY"),
+	}, nil
+}
+
+func S3ConfigFromEnv() (S3Config, error) {
+	cfg := S3Config{
+		Bucket:          os.Getenv("S3_BUCKET"),
+		Region:          utils.GetEnv("S3_REGION", os.Getenv("AWS_REGION")),
+		Endpoint:        os.Getenv("S3_ENDPOINT"),
+		AccessKeyID:     utils.GetEnv("S3_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID")),
+		SecretAccessKey: utils.GetEnv("S3_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		SessionToken:    utils.GetEnv("S3_SESSION_TOKEN", os.Getenv("AWS_SESSION_TOKEN")),
+		PublicBaseURL:   os.Getenv("S3_PUBLIC_BASE_URL"),
+		TempDir:         os.Getenv("S3_TEMP_DIR"),
+	}
+	var err error
+	if cfg.ForcePathStyle, err = getEnvBool("S3_FORCE_PATH_STYLE"); err != nil {
+		return S3Config{}, err
+	}
+	if cfg.PartSize, err = getEnvSize("S3_PART_SIZE"); err != nil {
+		return S3Config{}, err
+	}
+	return cfg, nil
+}
+
+func AzureConfigFromEnv() (AzureConfig, error) {
+	cfg := AzureConfig{
+		Account:       os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		AccountKey:    os.Getenv("AZURE_STORAGE_KEY"),
+		Container:     os.Getenv("AZURE_STORAGE_CONTAINER"),
+		Endpoint:      os.Getenv("AZURE_STORAGE_ENDPOINT"),
+		PublicBaseURL: os.Getenv("AZURE_STORAGE_PUBLIC_BASE_URL"),
+		TempDir:       os.Getenv("AZURE_STORAGE_TEMP_DIR"),
+	}
+	var err error
+	if cfg.BlockSize, err = getEnvSize("AZURE_STORAGE_BLOCK_SIZE"); err != nil {
+		return AzureConfig{}, err
+	}
+	return cfg, nil
+}
+
+func GCSConfigFromEnv() (GCSConfig, error) {
+	cfg := GCSConfig{
+		Bucket:          os.Getenv("GCS_BUCKET"),
+		CredentialsFile: utils.GetEnv("GCS_CREDENTIALS_FILE", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")),
+		Endpoint:        os.Getenv("GCS_ENDPOINT"),
+		PublicBaseURL:   os.Getenv("GCS_PUBLIC_BASE_URL"),
+		TempDir:         os.Getenv("GCS_TEMP_DIR"),
+	}
+	var err error
+	if cfg.ChunkSize, err = getEnvSize("GCS_CHUNK_SIZE"); err != nil {
+		return GCSConfig{}, err
+	}
+	return cfg, nil
+}
+
+// EncryptedConfigFromEnv wraps a provider of type ENCRYPTION_STORAGE_TYPE,
+// itself configured from the environment. ENCRYPTION_MASTER_KEY sets a single
+// master key with the ID "default"; ENCRYPTION_KEY_FILE points at a key file
+// holding several.
+func EncryptedConfigFromEnv() (EncryptedConfig, error) {
+	cfg := EncryptedConfig{
+		Inner:     InstanceConfig{Type: utils.GetEnv("ENCRYPTION_STORAGE_TYPE", "local")},
+		ActiveKey: os.Getenv("ENCRYPTION_ACTIVE_KEY"),
+		KeyFile:   os.Getenv("ENCRYPTION_KEY_FILE"),
+		TempDir:   os.Getenv("ENCRYPTION_TEMP_DIR"),
+	}
+	if masterKey := os.Getenv("ENCRYPTION_MASTER_KEY"); masterKey != "" {
+		cfg.Keys = map[string]string{"default": masterKey}
+	}
+	return cfg, nil
+}
+
+// ResilientConfigFromEnv wraps a provider of type RESILIENT_STORAGE_TYPE,
+// itself configured from the environment.
+func ResilientConfigFromEnv() (ResilientConfig, error) {
+	cfg := ResilientConfig{
+		Inner:   InstanceConfig{Type: utils.GetEnv("RESILIENT_STORAGE_TYPE", "local")},
+		TempDir: os.Getenv("RESILIENT_TEMP_DIR"),
+	}
+	var err error
+	if cfg.Timeout, err = getEnvDuration("RESILIENT_TIMEOUT"); err != nil {
+		return ResilientConfig{}, err
+	}
+	if cfg.MaxAttempts, err = getEnvCount("RESILIENT_MAX_ATTEMPTS"); err != nil {
+		return ResilientConfig{}, err
+	}
+	if cfg.InitialBackoff, err = getEnvDuration("RESILIENT_INITIAL_BACKOFF"); err != nil {
+		return ResilientConfig{}, err
+	}
+	if cfg.MaxBackoff, err = getEnvDuration("RESILIENT_MAX_BACKOFF"); err != nil {
+		return ResilientConfig{}, err
+	}
+	if cfg.FailureThreshold, err = getEnvCount("RESILIENT_FAILURE_THRESHOLD"); err != nil {
+		return ResilientConfig{}, err
+	}
+	if cfg.OpenTimeout, err = getEnvDuration("RESILIENT_OPEN_TIMEOUT"); err != nil {
+		return ResilientConfig{}, err
+	}
+	if os.Getenv("RESILIENT_UPLOAD_TIMEOUT") != "" {
+		uploadTimeout, err := getEnvDuration("RESILIENT_UPLOAD_TIMEOUT")
+		if err != nil {
+			return ResilientConfig{}, err
+		}
+		cfg.Timeouts = map[string]Duration{opUpload: uploadTimeout}
+	}
+	return cfg, nil
+}
+
+// Duration is a time.Duration written in config files as a string such as
+// "30s" or "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// getEnvDuration parses the environment variable name as a positive
+// duration. Zero, the default of every duration it is used for, is returned
+// when the variable is unset.
+func getEnvDuration(name string) (Duration, error) {
+	d, err := utils.GetEnvDuration(name, 0)
+	return Duration(d), err
+}
+
+func getEnvBool(name string) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("parse %s: %q is not a boolean", name, value)
+	}
+	return b, nil
+}
+
+// getEnvSize parses the environment variable name as a size in bytes, zero
+// when it is unset.
+func getEnvSize(name string) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("parse %s: %q is not a size in bytes", name, value)
+	}
+	return size, nil
+}
+
+// getEnvCount parses the environment variable name as a non-negative
+// number, zero when it is unset.
+func getEnvCount(name string) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("parse %s: %q is not a number", name, value)
+	}
+	return n, nil
+}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func localInstance(t *testing.T) InstanceConfig {
+	t.Helper()
+
+	raw, err := json.Marshal(LocalConfig{RootDir: t.TempDir(), BaseURL: "http://localhost:8080/files", SigningKey: "test"})
+	require.NoError(t, err)
+	return InstanceConfig{Type: "local", Config: raw}
+}
+
+func TestNewStorage_SingleInstance(t *testing.T) {
+	provider, err := NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": localInstance(t)},
+	})
+	require.NoError(t, err)
+
+	require.IsType(t, &Router{}, provider)
+	assert.IsType(t, &LocalStorage{}, InstanceNamed(provider, "media"))
+
+	object, err := provider.UploadFile(context.Background(), strings.NewReader("plain text"), "notes.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "media", object.Provider)
+}
+
+func TestNewStorage_UnknownType(t *testing.T) {
+	_, err := NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": {Type: "S3"}},
+	})
+
+	assert.ErrorContains(t, err, `unknown storage type "S3"`)
+}
+
+func TestNewStorage_Misconfigured(t *testing.T) {
+	_, err := NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": {Type: "s3", Config: json.RawMessage(`{"bucket": "media", "regoin": "eu-west-1"}`)}},
+	})
+	assert.ErrorContains(t, err, "regoin")
+
+	_, err = NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": {Type: "s3", Config: json.RawMessage(`{}`)}},
+	})
+	assert.ErrorContains(t, err, "bucket is required")
+
+	_, err = NewStorage(&Config{
+		Default:   "missing",
+		Instances: map[string]InstanceConfig{"media": localInstance(t)},
+	})
+	assert.ErrorContains(t, err, `default instance "missing"`)
+
+	_, err = NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": localInstance(t)},
+		Routes:    []RouteConfig{{ContentType: "video/*", Instance: "videos"}},
+	})
+	assert.ErrorContains(t, err, `undefined instance "videos"`)
+}
+
+func TestNewStorageFromEnv_UnknownType(t *testing.T) {
+	t.Setenv("STORAGE_CONFIG", "")
+	t.Setenv("STORAGE_TYPE", "S3")
+
+	_, err := NewStorageFromEnv()
+	assert.ErrorContains(t, err, `unknown storage type "S3"`)
+}
+
+func TestNewStorageFromEnv_Misconfigured(t *testing.T) {
+	t.Setenv("STORAGE_CONFIG", "")
+	for name, env := range map[string]map[string]string{
+		"S3_FORCE_PATH_STYLE":      {"STORAGE_TYPE": "s3", "S3_FORCE_PATH_STYLE": "yes please"},
+		"S3_PART_SIZE":             {"STORAGE_TYPE": "s3", "S3_PART_SIZE": "64MB"},
+		"AZURE_STORAGE_BLOCK_SIZE": {"STORAGE_TYPE": "azure", "AZURE_STORAGE_BLOCK_SIZE": "-1"},
+		"GCS_CHUNK_SIZE":           {"STORAGE_TYPE": "gcs", "GCS_CHUNK_SIZE": "8MiB"},
+		"RESILIENT_MAX_ATTEMPTS":   {"STORAGE_TYPE": "resilient", "RESILIENT_MAX_ATTEMPTS": "three"},
+		"RESILIENT_TIMEOUT":        {"STORAGE_TYPE": "resilient", "RESILIENT_TIMEOUT": "10"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for key, value := range env {
+				t.Setenv(key, value)
+			}
+
+			_, err := NewStorageFromEnv()
+			assert.ErrorContains(t, err, "parse "+name)
+		})
+	}
+}
+
+func TestNewStorageFromEnv_ConfigFile(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(t.TempDir(), "storage.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"default": "media",
+		"instances": {"media": {"type": "local", "config": {"rootDir": "${TEST_MEDIA_ROOT}", "signingKey": "test"}}}
+	}`), 0o644))
+	t.Setenv("STORAGE_CONFIG", path)
+	t.Setenv("TEST_MEDIA_ROOT", root)
+
+	provider, err := NewStorageFromEnv()
+	require.NoError(t, err)
+
+	instance := InstanceNamed(provider, "media")
+	require.IsType(t, &LocalStorage{}, instance)
+	assert.Equal(t, root, instance.(*LocalStorage).RootDir)
+}
+
+func TestNewStorageFromEnv_NamesInstanceAfterType(t *testing.T) {
+	t.Setenv("STORAGE_CONFIG", "")
+	t.Setenv("STORAGE_TYPE", "local")
+	t.Setenv("LOCAL_STORAGE_ROOT", t.TempDir())
+
+	provider, err := NewStorageFromEnv()
+	require.NoError(t, err)
+	assert.IsType(t, &LocalStorage{}, InstanceNamed(provider, "local"))
+
+	name, err := DefaultInstanceName()
+	require.NoError(t, err)
+	assert.Equal(t, "local", name)
+}
+
+func TestRouter(t *testing.T) {
+	provider, err := NewStorage(&Config{
+		Default:   "documents",
+		Instances: map[string]InstanceConfig{"documents": localInstance(t), "images": localInstance(t)},
+		Routes:    []RouteConfig{{ContentType: "image/*", Instance: "images"}},
+	})
+	require.NoError(t, err)
+	require.IsType(t, &Router{}, provider)
+	router := provider.(*Router)
+	ctx := context.Background()
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 4096)...)
+	image, err := router.UploadFile(ctx, bytes.NewReader(png), "picture.png")
+	require.NoError(t, err)
+	text, err := router.UploadFile(ctx, strings.NewReader("plain text"), "notes.txt")
+	require.NoError(t, err)
+
+	inImages, _ := router.Instances["images"].Exists(ctx, image.Key)
+	inDocuments, _ := router.Instances["documents"].Exists(ctx, image.Key)
+	assert.True(t, inImages)
+	assert.False(t, inDocuments)
+	inDocuments, _ = router.Instances["documents"].Exists(ctx, text.Key)
+	assert.True(t, inDocuments)
+	assert.Equal(t, "images", image.Provider)
+	assert.Equal(t, "documents", text.Provider)
+
+	reader, err := router.Open(ctx, image.Key)
+	require.NoError(t, err)
+	stored := new(bytes.Buffer)
+	stored.ReadFrom(reader)
+	reader.Close()
+	assert.Equal(t, png, stored.Bytes())
+
+	require.NoError(t, router.Release(ctx, image.Key))
+	exists, err := router.Exists(ctx, image.Key)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+type countingProvider struct {
+	*LocalStorage
+	exists int
+}
+
+func (p *countingProvider) Exists(ctx context.Context, key string) (bool, error) {
+	p.exists++
+	return p.LocalStorage.Exists(ctx, key)
+}
+
+func TestRouterVerifySignedURL(t *testing.T) {
+	documents := &countingProvider{LocalStorage: newTestLocalStorage(t)}
+	images := &countingProvider{LocalStorage: newTestLocalStorage(t)}
+	router := NewRouter(map[string]StorageProvider{"documents": documents, "images": images}, "documents", nil)
+	ctx := context.Background()
+
+	object, err := images.UploadFile(ctx, strings.NewReader("file content"), "photo.jpg")
+	require.NoError(t, err)
+	signedURL, err := images.SignedURL(ctx, object.Key, time.Minute)
+	require.NoError(t, err)
+	parsed, err := url.Parse(signedURL)
+	require.NoError(t, err)
+	documents.exists, images.exists = 0, 0
+
+	assert.NoError(t, router.VerifySignedURL(object.Key, parsed.Query()))
+	assert.ErrorIs(t, router.VerifySignedURL("made-up.jpg", parsed.Query()), ErrInvalidSignature)
+	assert.Zero(t, documents.exists)
+	assert.Zero(t, images.exists)
+}
+
+func TestMatchContentType(t *testing.T) {
+	assert.True(t, MatchContentType("image/*", "image/png"))
+	assert.True(t, MatchContentType("image/png", "image/png"))
+	assert.True(t, MatchContentType("*/*", "video/mp4"))
+	assert.False(t, MatchContentType("image/*", "video/mp4"))
+	assert.False(t, MatchContentType("image/jpeg", "image/png"))
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"mime"
+	"os"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// sniffLength is how many leading bytes are kept for content type detection.
+const sniffLength = 3072
+
+// HashingWriter computes the SHA-256 digest and size of everything written to
+// it, and keeps the first bytes for content sniffing, so a single pass over an
+// upload yields its content key, length and type.
+type HashingWriter struct {
+	sum    hash.Hash
+	size   int64
+	header []byte
+}
+
+func NewHashingWriter() *HashingWriter {
+	return &HashingWriter{sum: sha256.New()}
+}
+
+func (w *HashingWriter) Write(p []byte) (int, error) {
+	if missing := sniffLength - len(w.header); missing > 0 {
+		w.header = append(w.header, p[:min(missing, len(p))]...)
+	}
+	n, err := w.sum.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes written so far.
+func (w *HashingWriter) Size() int64 {
+	return w.size
+}
+
+func (w *HashingWriter) Digest() string {
+	return hex.EncodeToString(w.sum.Sum(nil))
+}
+
+// ContentType returns the MIME type detected from the magic bytes of the
+// content written so far, along with its canonical file extension.
+func (w *HashingWriter) ContentType() (string, string) {
+	return DetectContentType(w.header)
+}
+
+// DetectContentType sniffs the MIME type of header, the leading bytes of a
+// file, and returns it without parameters together with its extension.
+func DetectContentType(header []byte) (string, string) {
+	detected := mimetype.Detect(header)
+	contentType, _, err := mime.ParseMediaType(detected.String())
+	if err != nil {
+		contentType = detected.String()
+	}
+	return contentType, detected.Extension()
+}
+
+// DisplayInline reports whether browsers may display content of contentType
+// in the origin it is served from: images, video and audio. Anything else,
+// HTML and SVG in particular, can run scripts there and must be served as an
+// attachment.
+func DisplayInline(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "image/svg+xml" {
+		return false
+	}
+	for _, prefix := range []string{"image/", "video/", "audio/"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SniffContentType reads the leading bytes of r and detects its content type
+// the same way stored objects are typed. The returned reader yields all of r,
+// including the bytes read for detection.
+func SniffContentType(r io.Reader) (string, io.Reader, error) {
+	buffered := bufio.NewReaderSize(r, sniffLength)
+	header, err := buffered.Peek(sniffLength)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return "", nil, err
+	}
+
+	contentType, _ := DetectContentType(header)
+	return contentType, buffered, nil
+}
+
+// spooledFile is an upload copied to a local temp file along with what was
+// learned about it on the way.
+type spooledFile struct {
+	Path        string
+	ContentHash string
+	ContentType string
+	Extension   string
+	Size        int64
+}
+
+func (f *spooledFile) Key() string {
+	return ObjectKey(f.ContentHash, f.Extension)
+}
+
+// spoolFile copies r into a new temporary file in dir while hashing and
+// sniffing it. The file is fsynced and closed before returning; the caller
+// owns its removal.
+func spoolFile(dir string, r io.Reader) (_ *spooledFile, err error) {
+	tmp, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	hw := NewHashingWriter()
+	if _, err = io.Copy(io.MultiWriter(tmp, hw), r); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	contentType, extension := hw.ContentType()
+	return &spooledFile{
+		Path:        tmp.Name(),
+		ContentHash: hw.Digest(),
+		ContentType: contentType,
+		Extension:   extension,
+		Size:        hw.size,
+	}, nil
+}
@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Encrypted objects start with a header naming the master key that wrapped
+// the object's data key, followed by the plaintext in chunks of chunkSize
+// bytes, each sealed with AES-256-GCM under the data key:
+//
+//	"MIE1" | keyID len (1) | keyID | wrapped key len (2) | wrapped key |
+//	chunk size (4) | plaintext size (8) | content type len (1) | content type |
+//	chunk 0 | chunk 1 | ...
+//
+// The nonce of a chunk is its index plus a flag marking the last chunk, so
+// chunks cannot be reordered or the object truncated. Everything after the
+// wrapped key is authenticated with every chunk; the wrapped key itself is
+// not, so rotating master keys only rewrites the header.
+const (
+	encryptionMagic     = "MIE1"
+	encryptionChunkSize = 64 << 10
+	dataKeySize         = 32
+)
+
+var ErrUnknownMasterKey = errors.New("encrypted object: unknown master key")
+
+type encryptionHeader struct {
+	KeyID       string
+	WrappedKey  []byte
+	ChunkSize   uint32
+	Size        int64
+	ContentType string
+}
+
+func (h *encryptionHeader) marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(encryptionMagic)
+	buf.WriteByte(byte(len(h.KeyID)))
+	buf.WriteString(h.KeyID)
+	binary.Write(&buf, binary.BigEndian, uint16(len(h.WrappedKey)))
+	buf.Write(h.WrappedKey)
+	buf.Write(h.additionalData())
+	return buf.Bytes()
+}
+
+// additionalData is the part of the header authenticated with every chunk.
+func (h *encryptionHeader) additionalData() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, h.ChunkSize)
+	binary.Write(&buf, binary.BigEndian, uint64(h.Size))
+	buf.WriteByte(byte(len(h.ContentType)))
+	buf.WriteString(h.ContentType)
+	return buf.Bytes()
+}
+
+func (h *encryptionHeader) chunks() int64 {
+	return max(1, (h.Size+int64(h.ChunkSize)-1)/int64(h.ChunkSize))
+}
+
+// readEncryptionHeader reads exactly the header from r and returns it along
+// with its length in bytes.
+func readEncryptionHeader(r io.Reader) (*encryptionHeader, int64, error) {
+	counter := &countingReader{r: r}
+	h := &encryptionHeader{}
+
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(counter, magic); err != nil || string(magic) != encryptionMagic {
+		return nil, 0, errors.New("encrypted object: invalid header")
+	}
+
+	keyID, err := readPrefixed(counter, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	h.KeyID = string(keyID)
+	if h.WrappedKey, err = readPrefixed(counter, 2); err != nil {
+		return nil, 0, err
+	}
+
+	var size uint64
+	if err := binary.Read(counter, binary.BigEndian, &h.ChunkSize); err != nil {
+		return nil, 0, err
+	}
+	if err := binary.Read(counter, binary.BigEndian, &size); err != nil {
+		return nil, 0, err
+	}
+	h.Size = int64(size)
+	contentType, err := readPrefixed(counter, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	h.ContentType = string(contentType)
+
+	if h.ChunkSize == 0 {
+		return nil, 0, errors.New("encrypted object: invalid chunk size")
+	}
+	return h, counter.n, nil
+}
+
+func readPrefixed(r io.Reader, lengthBytes int) ([]byte, error) {
+	var length int
+	if lengthBytes == 1 {
+		var n uint8
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		length = int(n)
+	} else {
+		var n uint16
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		length = int(n)
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptObject writes header and the sealed chunks of r, which must yield
+// exactly header.Size bytes, to w.
+func encryptObject(w io.Writer, r io.Reader, header *encryptionHeader, dataKey []byte) error {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(header.marshal()); err != nil {
+		return err
+	}
+
+	additionalData := header.additionalData()
+	chunk := make([]byte, header.ChunkSize)
+	sealed := make([]byte, 0, int(header.ChunkSize)+aead.Overhead())
+	chunks := header.chunks()
+	for index := int64(0); index < chunks; index++ {
+		length := min(int64(header.ChunkSize), header.Size-index*int64(header.ChunkSize))
+		if _, err := io.ReadFull(r, chunk[:length]); err != nil {
+			return err
+		}
+		sealed = aead.Seal(sealed[:0], chunkNonce(index, index == chunks-1), chunk[:length], additionalData)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptingReader decrypts an encrypted object chunk by chunk. Seeking only
+// moves the position; the chunk holding it is fetched on the next Read.
+type decryptingReader struct {
+	inner     ObjectReader
+	aead      cipher.AEAD
+	header    *encryptionHeader
+	headerLen int64
+	aad       []byte
+
+	pos        int64
+	chunk      []byte
+	chunkIndex int64
+}
+
+func newDecryptingReader(inner ObjectReader, header *encryptionHeader, headerLen int64, dataKey []byte) (*decryptingReader, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		inner:      inner,
+		aead:       aead,
+		header:     header,
+		headerLen:  headerLen,
+		aad:        header.additionalData(),
+		chunkIndex: -1,
+	}, nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.pos >= r.header.Size {
+		return 0, io.EOF
+	}
+
+	chunkSize := int64(r.header.ChunkSize)
+	index := r.pos / chunkSize
+	if index != r.chunkIndex {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.chunk[r.pos-index*chunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *decryptingReader) load(index int64) error {
+	chunkSize := int64(r.header.ChunkSize)
+	sealedSize := chunkSize + int64(r.aead.Overhead())
+	if _, err := r.inner.Seek(r.headerLen+index*sealedSize, io.SeekStart); err != nil {
+		return err
+	}
+
+	length := min(chunkSize, r.header.Size-index*chunkSize) + int64(r.aead.Overhead())
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(r.inner, sealed); err != nil {
+		return fmt.Errorf("encrypted object: read chunk %d: %w", index, err)
+	}
+
+	chunk, err := r.aead.Open(r.chunk[:0], chunkNonce(index, index == r.header.chunks()-1), sealed, r.aad)
+	if err != nil {
+		return fmt.Errorf("encrypted object: chunk %d failed authentication", index)
+	}
+	r.chunk = chunk
+	r.chunkIndex = index
+	return nil
+}
+
+func (r *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.header.Size
+	default:
+		return 0, errors.New("encrypted object: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("encrypted object: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.inner.Close()
+}
+
+// keyring holds the master keys data keys are wrapped with. New objects use
+// the active key; the others are kept to read objects not yet rotated.
+type keyring struct {
+	Active string
+	Keys   map[string][]byte
+}
+
+// keyFile is the format of EncryptedConfig.KeyFile and of the inline keys:
+// base64 encoded 32-byte master keys by ID.
+type keyFile struct {
+	ActiveKey string            `json:"activeKey"`
+	Keys      map[string]string `json:"keys"`
+}
+
+func newKeyring(activeKey string, keys map[string]string, path string) (*keyring, error) {
+	merged := keyFile{Keys: make(map[string]string)}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read key file: %w", err)
+		}
+		if err := json.Unmarshal(data, &merged); err != nil {
+			return nil, fmt.Errorf("parse key file %s: %w", path, err)
+		}
+	}
+	for id, key := range keys {
+		merged.Keys[id] = key
+	}
+	if activeKey != "" {
+		merged.ActiveKey = activeKey
+	}
+
+	ring := &keyring{Active: merged.ActiveKey, Keys: make(map[string][]byte)}
+	for id, encoded := range merged.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("master key %q must be 32 base64 encoded bytes", id)
+		}
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("master key ID %q must be 1 to 255 bytes long", id)
+		}
+		ring.Keys[id] = key
+	}
+	if len(ring.Keys) == 0 {
+		return nil, errors.New("no master keys configured")
+	}
+	if ring.Active == "" && len(ring.Keys) == 1 {
+		for id := range ring.Keys {
+			ring.Active = id
+		}
+	}
+	if _, ok := ring.Keys[ring.Active]; !ok {
+		return nil, fmt.Errorf("active master key %q is not configured (have: %v)", ring.Active, ring.ids())
+	}
+	return ring, nil
+}
+
+func (k *keyring) ids() []string {
+	ids := make([]string, 0, len(k.Keys))
+	for id := range k.Keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// wrap seals dataKey with the active master key.
+func (k *keyring) wrap(dataKey []byte) (keyID string, wrapped []byte, err error) {
+	aead, err := newGCM(k.Keys[k.Active])
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return k.Active, aead.Seal(nonce, nonce, dataKey, []byte(k.Active)), nil
+}
+
+func (k *keyring) unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	masterKey, ok := k.Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownMasterKey, keyID)
+	}
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("encrypted object: invalid wrapped key")
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("encrypted object: data key does not unwrap with master key %q", keyID)
+	}
+	return dataKey, nil
+}
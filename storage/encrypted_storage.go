@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"time"
+)
+
+var ErrSignedURLUnsupported = errors.New("storage provider cannot issue signed urls")
+
+// encryptedContentType is what the inner provider is told about every object,
+// so the real type does not leak to the backend.
+const encryptedContentType = "application/octet-stream"
+
+type EncryptedConfig struct {
+	// Inner is the provider holding the encrypted objects. Without a
+	// "config" it is configured from its environment variables.
+	Inner InstanceConfig `json:"inner"`
+	// ActiveKey is the ID of the master key new objects are encrypted with.
+	ActiveKey string `json:"activeKey"`
+	// Keys maps master key IDs to base64 encoded 32-byte keys.
+	Keys map[string]string `json:"keys"`
+	// KeyFile is a JSON file with the same activeKey and keys fields, so
+	// keys can stay out of the storage config.
+	KeyFile string `json:"keyFile"`
+	TempDir string `json:"tempDir"`
+}
+
+func init() {
+	Register("encrypted", func(cfg EncryptedConfig) (StorageProvider, error) {
+		if cfg.Inner.Type == "" {
+			return nil, errors.New("encrypted storage: inner storage is required")
+		}
+
+		var inner StorageProvider
+		var err error
+		if len(cfg.Inner.Config) == 0 {
+			inner, err = newInstanceFromEnv(cfg.Inner.Type)
+		} else {
+			inner, err = NewInstance(cfg.Inner)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("encrypted storage inner: %w", err)
+		}
+
+		s, err := NewEncryptedStorage(inner, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}, EncryptedConfigFromEnv)
+}
+
+// EncryptedStorage encrypts blobs before handing them to another provider.
+// Every object gets its own random AES-256-GCM data key, stored in the
+// object's header wrapped by a master key. Objects keep the key of their
+// plaintext, so deduplication and reference counting work as before, and are
+// decrypted transparently by Open.
+type EncryptedStorage struct {
+	Inner   StorageProvider
+	TempDir string
+
+	writer KeyedWriter
+	keys   *keyring
+}
+
+type RotationReport struct {
+	Checked   int
+	Rewrapped int
+	Failed    map[string]error
+}
+
+func NewEncryptedStorage(inner StorageProvider, cfg EncryptedConfig) (*EncryptedStorage, error) {
+	writer, ok := inner.(KeyedWriter)
+	if !ok {
+		return nil, fmt.Errorf("encrypted storage: %T cannot store objects under their plaintext key", inner)
+	}
+	keys, err := newKeyring(cfg.ActiveKey, cfg.Keys, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted storage: %w", err)
+	}
+	if cfg.TempDir == "" {
+		cfg.TempDir = os.TempDir()
+	}
+	return &EncryptedStorage{Inner: inner, TempDir: cfg.TempDir, writer: writer, keys: keys}, nil
+}
+
+func (s *EncryptedStorage) UploadFile(ctx context.Context, file io.Reader, _filename string) (*Object, error) {
+	// The plaintext is spooled first: the key and header need its hash and
+	// size before the first encrypted byte is written.
+	spooled, err := spoolFile(s.TempDir, file)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spooled.Path)
+
+	contentType := spooled.ContentType
+	if len(contentType) > 255 {
+		contentType = encryptedContentType
+	}
+	header, dataKey, err := s.newHeader(spooled.Size, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := os.Open(spooled.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer plaintext.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encryptObject(pw, plaintext, header, dataKey))
+	}()
+	object, err := s.writer.UploadFileAs(ctx, spooled.Key(), pr, encryptedContentType)
+	pr.CloseWithError(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Object{
+		Key:         object.Key,
+		URL:         object.URL,
+		ContentHash: spooled.ContentHash,
+		ContentType: spooled.ContentType,
+		Size:        spooled.Size,
+	}, nil
+}
+
+func (s *EncryptedStorage) Release(ctx context.Context, key string) error {
+	return s.Inner.Release(ctx, key)
+}
+
+func (s *EncryptedStorage) References(ctx context.Context, key string) (int, error) {
+	counter, ok := s.Inner.(ReferenceCounter)
+	if !ok {
+		return 0, fmt.Errorf("encrypted storage: %T does not count references", s.Inner)
+	}
+	return counter.References(ctx, key)
+}
+
+func (s *EncryptedStorage) SetReferences(ctx context.Context, key string, refs int) error {
+	counter, ok := s.Inner.(ReferenceCounter)
+	if !ok {
+		return fmt.Errorf("encrypted storage: %T does not count references", s.Inner)
+	}
+	return counter.SetReferences(ctx, key, refs)
+}
+
+// SignedURL only works when the inner provider signs URLs served by this
+// application, which decrypts them through Open. A backend URL would hand out
+// ciphertext.
+func (s *EncryptedStorage) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if _, ok := s.Inner.(URLVerifier); !ok {
+		return "", ErrSignedURLUnsupported
+	}
+	return s.Inner.SignedURL(ctx, key, expiry)
+}
+
+func (s *EncryptedStorage) VerifySignedURL(key string, query url.Values) error {
+	verifier, ok := s.Inner.(URLVerifier)
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return verifier.VerifySignedURL(key, query)
+}
+
+func (s *EncryptedStorage) Open(ctx context.Context, key string) (ObjectReader, error) {
+	inner, err := s.Inner.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	header, headerLen, err := readEncryptionHeader(inner)
+	if err != nil {
+		inner.Close()
+		return nil, err
+	}
+	dataKey, err := s.keys.unwrap(header.KeyID, header.WrappedKey)
+	if err != nil {
+		inner.Close()
+		return nil, err
+	}
+
+	reader, err := newDecryptingReader(inner, header, headerLen, dataKey)
+	if err != nil {
+		inner.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (s *EncryptedStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := s.Inner.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	header, err := s.readHeader(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: header.Size, ContentType: header.ContentType, LastModified: info.LastModified}, nil
+}
+
+func (s *EncryptedStorage) Delete(ctx context.Context, key string) error {
+	return s.Inner.Delete(ctx, key)
+}
+
+func (s *EncryptedStorage) Exists(ctx context.Context, key string) (bool, error) {
+	return s.Inner.Exists(ctx, key)
+}
+
+// List lists the inner objects. Sizes are those of the encrypted objects.
+func (s *EncryptedStorage) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	return ListObjects(ctx, s.Inner, fn)
+}
+
+// RotateKeys re-wraps the data key of every object not wrapped by the active
+// master key. Only headers change; the encrypted content is copied as is.
+// Once it reports no failures, retired master keys can be removed.
+func (s *EncryptedStorage) RotateKeys(ctx context.Context) (*RotationReport, error) {
+	report := &RotationReport{Failed: make(map[string]error)}
+	err := s.List(ctx, func(info ObjectInfo) error {
+		report.Checked++
+		rewrapped, err := s.rewrap(ctx, info.Key)
+		if err != nil {
+			log.Printf("encrypted storage: failed to rotate key of %s: %v", info.Key, err)
+			report.Failed[info.Key] = err
+		} else if rewrapped {
+			report.Rewrapped++
+		}
+		return ctx.Err()
+	})
+	return report, err
+}
+
+func (s *EncryptedStorage) rewrap(ctx context.Context, key string) (bool, error) {
+	inner, err := s.Inner.Open(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer inner.Close()
+
+	header, _, err := readEncryptionHeader(inner)
+	if err != nil {
+		return false, err
+	}
+	if header.KeyID == s.keys.Active {
+		return false, nil
+	}
+
+	dataKey, err := s.keys.unwrap(header.KeyID, header.WrappedKey)
+	if err != nil {
+		return false, err
+	}
+	if header.KeyID, header.WrappedKey, err = s.keys.wrap(dataKey); err != nil {
+		return false, err
+	}
+
+	// inner is positioned right after the old header, at the first chunk.
+	body := io.MultiReader(bytes.NewReader(header.marshal()), inner)
+	if err := s.writer.ReplaceFile(ctx, key, body, encryptedContentType); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *EncryptedStorage) newHeader(size int64, contentType string) (*encryptionHeader, []byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	keyID, wrapped, err := s.keys.wrap(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &encryptionHeader{
+		KeyID:       keyID,
+		WrappedKey:  wrapped,
+		ChunkSize:   encryptionChunkSize,
+		Size:        size,
+		ContentType: contentType,
+	}, dataKey, nil
+}
+
+func (s *EncryptedStorage) readHeader(ctx context.Context, key string) (*encryptionHeader, error) {
+	inner, err := s.Inner.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer inner.Close()
+
+	header, _, err := readEncryptionHeader(inner)
+	return header, err
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testMasterKey1 = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	testMasterKey2 = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+)
+
+func newTestEncryptedStorage(t *testing.T, inner StorageProvider, activeKey string) *EncryptedStorage {
+	t.Helper()
+
+	s, err := NewEncryptedStorage(inner, EncryptedConfig{
+		ActiveKey: activeKey,
+		Keys:      map[string]string{"k1": testMasterKey1, "k2": testMasterKey2},
+		TempDir:   t.TempDir(),
+	})
+	require.NoError(t, err)
+	return s
+}
+
+func readAllFrom(t *testing.T, provider StorageProvider, key string) []byte {
+	t.Helper()
+
+	reader, err := provider.Open(context.Background(), key)
+	require.NoError(t, err)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return data
+}
+
+func TestEncryptedStorageLifecycle(t *testing.T) {
+	testProviderLifecycle(t, newTestEncryptedStorage(t, newTestLocalStorage(t), "k1"))
+}
+
+func TestEncryptedStorageLifecycle_S3(t *testing.T) {
+	inner, _ := newTestS3Storage(t)
+	testProviderLifecycle(t, newTestEncryptedStorage(t, inner, "k1"))
+}
+
+func TestEncryptedStorageUploadFile(t *testing.T) {
+	inner := newTestLocalStorage(t)
+	s := newTestEncryptedStorage(t, inner, "k1")
+	ctx := context.Background()
+	content := "sensitive footage, sensitive footage"
+
+	object, err := s.UploadFile(ctx, strings.NewReader(content), "notes.txt")
+	require.NoError(t, err)
+
+	sum := sha256.Sum256([]byte(content))
+	assert.Equal(t, hex.EncodeToString(sum[:])+".txt", object.Key)
+	assert.Equal(t, hex.EncodeToString(sum[:]), object.ContentHash)
+	assert.Equal(t, "text/plain", object.ContentType)
+	assert.Equal(t, int64(len(content)), object.Size)
+
+	stored := readAllFrom(t, inner, object.Key)
+	assert.NotContains(t, string(stored), "sensitive")
+	assert.Equal(t, content, string(readAllFrom(t, s, object.Key)))
+
+	// Identical content shares the encrypted blob and its reference count.
+	again, err := s.UploadFile(ctx, strings.NewReader(content), "copy.txt")
+	require.NoError(t, err)
+	assert.Equal(t, object.Key, again.Key)
+	require.NoError(t, s.Release(ctx, object.Key))
+	assert.Equal(t, content, string(readAllFrom(t, s, object.Key)))
+}
+
+func TestEncryptedStorageOpen_Seek(t *testing.T) {
+	inner, _ := newTestS3Storage(t)
+	s := newTestEncryptedStorage(t, inner, "k1")
+	ctx := context.Background()
+
+	content := make([]byte, 3*encryptionChunkSize+1234)
+	rand.New(rand.NewSource(1)).Read(content)
+	object, err := s.UploadFile(ctx, bytes.NewReader(content), "random.bin")
+	require.NoError(t, err)
+
+	info, err := s.Stat(ctx, object.Key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+
+	reader, err := s.Open(ctx, object.Key)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	for _, offset := range []int64{encryptionChunkSize - 10, 0, 2*encryptionChunkSize + 5, int64(len(content)) - 100} {
+		_, err := reader.Seek(offset, io.SeekStart)
+		require.NoError(t, err)
+		part := make([]byte, 100)
+		_, err = io.ReadFull(reader, part)
+		require.NoError(t, err)
+		assert.Equal(t, content[offset:offset+100], part, "offset %d", offset)
+	}
+
+	end, err := reader.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), end)
+	_, err = reader.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestEncryptedStorageOpen_DetectsTampering(t *testing.T) {
+	inner := newTestLocalStorage(t)
+	s := newTestEncryptedStorage(t, inner, "k1")
+
+	object, err := s.UploadFile(context.Background(), strings.NewReader("do not touch"), "notes.txt")
+	require.NoError(t, err)
+
+	path := inner.path(object.Key)
+	stored, err := os.ReadFile(path)
+	require.NoError(t, err)
+	stored[len(stored)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, stored, 0o644))
+
+	reader, err := s.Open(context.Background(), object.Key)
+	require.NoError(t, err)
+	defer reader.Close()
+	_, err = io.ReadAll(reader)
+	assert.ErrorContains(t, err, "failed authentication")
+}
+
+func TestEncryptedStorageRotateKeys(t *testing.T) {
+	inner := newTestLocalStorage(t)
+	old := newTestEncryptedStorage(t, inner, "k1")
+	ctx := context.Background()
+
+	first, err := old.UploadFile(ctx, strings.NewReader("first"), "notes.txt")
+	require.NoError(t, err)
+	second, err := old.UploadFile(ctx, strings.NewReader("second"), "notes.txt")
+	require.NoError(t, err)
+
+	rotated := newTestEncryptedStorage(t, inner, "k2")
+	report, err := rotated.RotateKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Checked)
+	assert.Equal(t, 2, report.Rewrapped)
+	assert.Empty(t, report.Failed)
+
+	// Without the retired key, everything is still readable.
+	s, err := NewEncryptedStorage(inner, EncryptedConfig{Keys: map[string]string{"k2": testMasterKey2}})
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(readAllFrom(t, s, first.Key)))
+	assert.Equal(t, "second", string(readAllFrom(t, s, second.Key)))
+
+	report, err = rotated.RotateKeys(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, report.Rewrapped)
+}
+
+func TestEncryptedStorageOpen_UnknownMasterKey(t *testing.T) {
+	inner := newTestLocalStorage(t)
+	object, err := newTestEncryptedStorage(t, inner, "k1").UploadFile(context.Background(), strings.NewReader("secret"), "notes.txt")
+	require.NoError(t, err)
+
+	s, err := NewEncryptedStorage(inner, EncryptedConfig{Keys: map[string]string{"k2": testMasterKey2}})
+	require.NoError(t, err)
+	_, err = s.Open(context.Background(), object.Key)
+	assert.ErrorIs(t, err, ErrUnknownMasterKey)
+}
+
+func TestEncryptedStorageSignedURL(t *testing.T) {
+	local := newTestEncryptedStorage(t, newTestLocalStorage(t), "k1")
+	_, err := local.SignedURL(context.Background(), "key.txt", time.Minute)
+	assert.NoError(t, err)
+
+	inner, _ := newTestS3Storage(t)
+	remote := newTestEncryptedStorage(t, inner, "k1")
+	_, err = remote.SignedURL(context.Background(), "key.txt", time.Minute)
+	assert.ErrorIs(t, err, ErrSignedURLUnsupported)
+}
+
+func TestNewStorage_EncryptedWithKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(keyFile, []byte(`{"activeKey": "k2", "keys": {"k1": "`+testMasterKey1+`", "k2": "`+testMasterKey2+`"}}`), 0o600))
+	raw, err := json.Marshal(EncryptedConfig{Inner: localInstance(t), KeyFile: keyFile})
+	require.NoError(t, err)
+
+	provider, err := NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": {Type: "encrypted", Config: raw}},
+	})
+	require.NoError(t, err)
+	encrypted := InstanceNamed(provider, "media")
+	require.IsType(t, &EncryptedStorage{}, encrypted)
+	assert.Equal(t, "k2", encrypted.(*EncryptedStorage).keys.Active)
+	assert.IsType(t, &LocalStorage{}, encrypted.(*EncryptedStorage).Inner)
+}
+
+func TestNewEncryptedStorage_Misconfigured(t *testing.T) {
+	inner := newTestLocalStorage(t)
+	for name, cfg := range map[string]EncryptedConfig{
+		"no keys":        {},
+		"short key":      {Keys: map[string]string{"k1": base64.StdEncoding.EncodeToString([]byte("short"))}},
+		"unknown active": {ActiveKey: "k3", Keys: map[string]string{"k1": testMasterKey1}},
+		"ambiguous":      {Keys: map[string]string{"k1": testMasterKey1, "k2": testMasterKey2}},
+	} {
+		_, err := NewEncryptedStorage(inner, cfg)
+		assert.Error(t, err, name)
+	}
+}
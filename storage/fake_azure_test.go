@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAzure is an in-process stand-in for the Blob service as Azurite serves
+// it, with the account in the path. It supports single and block uploads,
+// checks the Shared Key signature of every request and the signature of
+// service SAS URLs.
+type fakeAzure struct {
+	Account   string
+	Key       []byte
+	Container string
+	// ListPageSize limits the blobs returned per List Blobs page.
+	ListPageSize int
+
+	mu       sync.Mutex
+	blobs    map[string]*fakeAzureBlob
+	blocks   map[string]map[string][]byte
+	requests []string
+}
+
+type fakeAzureBlob struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+func newFakeAzure(t *testing.T) (*fakeAzure, *httptest.Server) {
+	t.Helper()
+
+	fake := &fakeAzure{
+		Account:      "devstoreaccount1",
+		Key:          []byte("test-account-key"),
+		Container:    "media",
+		ListPageSize: 5000,
+		blobs:        make(map[string]*fakeAzureBlob),
+		blocks:       make(map[string]map[string][]byte),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func newTestAzureStorage(t *testing.T) (*AzureStorage, *fakeAzure) {
+	t.Helper()
+
+	fake, server := newFakeAzure(t)
+	s, err := NewAzureStorage(AzureConfig{
+		Account:    fake.Account,
+		AccountKey: base64.StdEncoding.EncodeToString(fake.Key),
+		Container:  fake.Container,
+		Endpoint:   server.URL + "/" + fake.Account,
+		BlockSize:  1024,
+		TempDir:    t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake
+}
+
+func (f *fakeAzure) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeAzure) Blob(name string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	blob, ok := f.blobs[name]
+	if !ok {
+		return nil, false
+	}
+	return blob.data, true
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if !f.verify(r) {
+		writeFakeAzureError(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+
+	account, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	container, name, _ := strings.Cut(rest, "/")
+	if account != f.Account || container != f.Container {
+		writeFakeAzureError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	f.requests = append(f.requests, r.Method+" "+name+" "+query.Get("comp"))
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		if f.blocks[name] == nil {
+			f.blocks[name] = make(map[string][]byte)
+		}
+		f.blocks[name][query.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		xml.Unmarshal(body, &list)
+
+		var assembled []byte
+		for _, blockID := range list.Latest {
+			data, ok := f.blocks[name][blockID]
+			if !ok {
+				writeFakeAzureError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			assembled = append(assembled, data...)
+		}
+		f.blobs[name] = &fakeAzureBlob{data: assembled, contentType: r.Header.Get("X-Ms-Blob-Content-Type"), modTime: time.Now()}
+		delete(f.blocks, name)
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut && name != "":
+		if r.Header.Get("X-Ms-Blob-Type") != "BlockBlob" {
+			writeFakeAzureError(w, http.StatusBadRequest, "MissingRequiredHeader")
+			return
+		}
+		f.blobs[name] = &fakeAzureBlob{data: body, contentType: r.Header.Get("X-Ms-Blob-Content-Type"), modTime: time.Now()}
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodGet && name == "" && query.Get("comp") == "list":
+		f.list(w, query.Get("marker"))
+
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && name != "":
+		blob, ok := f.blobs[name]
+		if !ok {
+			writeFakeAzureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if blob.contentType != "" {
+			w.Header().Set("Content-Type", blob.contentType)
+		}
+		if rangeHeader := r.Header.Get("X-Ms-Range"); rangeHeader != "" {
+			r.Header.Set("Range", rangeHeader)
+		}
+		http.ServeContent(w, r, name, blob.modTime, bytes.NewReader(blob.data))
+
+	case r.Method == http.MethodDelete && name != "":
+		if _, ok := f.blobs[name]; !ok {
+			writeFakeAzureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		writeFakeAzureError(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+// list writes a List Blobs page of the blobs after marker. The caller must
+// hold f.mu.
+func (f *fakeAzure) list(w http.ResponseWriter, marker string) {
+	names := make([]string, 0, len(f.blobs))
+	for name := range f.blobs {
+		if name >= marker {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	next := ""
+	if len(names) > f.ListPageSize {
+		next = names[f.ListPageSize]
+		names = names[:f.ListPageSize]
+	}
+
+	fmt.Fprint(w, "<EnumerationResults><Blobs>")
+	for _, name := range names {
+		blob := f.blobs[name]
+		fmt.Fprintf(w, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified><Content-Length>%d</Content-Length></Properties></Blob>",
+			name, blob.modTime.UTC().Format(http.TimeFormat), len(blob.data))
+	}
+	fmt.Fprintf(w, "</Blobs><NextMarker>%s</NextMarker></EnumerationResults>", next)
+}
+
+// verify signs a copy of the request with the account key and compares the
+// Authorization headers, or checks the SAS of a signed URL.
+func (f *fakeAzure) verify(r *http.Request) bool {
+	client := &azureClient{Account: f.Account, Key: f.Key, Container: f.Container}
+	if r.URL.Query().Has("sig") {
+		return f.verifySAS(client, r)
+	}
+
+	signedAt, err := http.ParseTime(r.Header.Get("x-ms-date"))
+	if err != nil {
+		return false
+	}
+	clone, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	clone.Header = r.Header.Clone()
+	clone.ContentLength = r.ContentLength
+	client.sign(clone, signedAt)
+	return clone.Header.Get("Authorization") == r.Header.Get("Authorization")
+}
+
+// verifySAS recomputes the signature of a read-only service SAS and rejects
+// it once se has passed.
+func (f *fakeAzure) verifySAS(client *azureClient, r *http.Request) bool {
+	query := r.URL.Query()
+	expiry, err := time.Parse(azureSASTimeFormat, query.Get("se"))
+	if err != nil || time.Now().After(expiry) || r.Method != http.MethodGet {
+		return false
+	}
+
+	prefix := "/" + f.Account + "/" + f.Container + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		return false
+	}
+	client.Endpoint = &url.URL{Scheme: "http", Host: r.Host, Path: "/" + f.Account}
+	signed := client.sasURL(strings.TrimPrefix(r.URL.Path, prefix), query.Get("sp"), expiry)
+	return signed.Query().Get("sig") == query.Get("sig")
+}
+
+func writeFakeAzureError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGCS is an in-process stand-in for the Cloud Storage JSON API. It
+// supports media and resumable uploads, issues access tokens for JWTs signed
+// with the service account key, requires them on every API request and
+// checks V4 signed URLs.
+type fakeGCS struct {
+	Bucket      string
+	Credentials *gcsCredentials
+	// ListPageSize limits the objects returned per list page.
+	ListPageSize int
+
+	mu             sync.Mutex
+	objects        map[string]*fakeGCSObject
+	sessions       map[string]*fakeGCSSession
+	tokens         map[string]bool
+	tokenExchanges int
+	requests       []string
+	serverURL      string
+}
+
+type fakeGCSObject struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+type fakeGCSSession struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+func newFakeGCS(t *testing.T) (*fakeGCS, *httptest.Server, string) {
+	t.Helper()
+
+	fake := &fakeGCS{
+		Bucket:       "media",
+		ListPageSize: 1000,
+		objects:      make(map[string]*fakeGCSObject),
+		sessions:     make(map[string]*fakeGCSSession),
+		tokens:       make(map[string]bool),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.serverURL = server.URL
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	keyFile, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "media@test.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    server.URL + "/token",
+	})
+	path := filepath.Join(t.TempDir(), "service-account.json")
+	if err := os.WriteFile(path, keyFile, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Credentials, err = parseGCSCredentials(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	return fake, server, path
+}
+
+func newTestGCSStorage(t *testing.T) (*GCSStorage, *fakeGCS) {
+	t.Helper()
+
+	fake, server, credentialsFile := newFakeGCS(t)
+	s, err := NewGCSStorage(GCSConfig{
+		Bucket:          fake.Bucket,
+		CredentialsFile: credentialsFile,
+		Endpoint:        server.URL,
+		ChunkSize:       gcsChunkAlignment,
+		TempDir:         t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake
+}
+
+func (f *fakeGCS) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeGCS) TokenExchanges() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tokenExchanges
+}
+
+func (f *fakeGCS) Object(name string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, ok := f.objects[name]
+	if !ok {
+		return nil, false
+	}
+	return object.data, true
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		f.token(w, body)
+		return
+	}
+	if r.URL.Query().Has("X-Goog-Signature") {
+		f.serveSigned(w, r)
+		return
+	}
+	if !f.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		writeFakeGCSError(w, http.StatusUnauthorized, "Invalid Credentials")
+		return
+	}
+
+	query := r.URL.Query()
+	apiPrefix := "/storage/v1/b/" + f.Bucket + "/o"
+	uploadPrefix := "/upload/storage/v1/b/" + f.Bucket + "/o"
+	path := r.URL.EscapedPath()
+	name, _ := url.PathUnescape(strings.TrimPrefix(path, apiPrefix+"/"))
+	if path == uploadPrefix {
+		name = query.Get("name")
+		if session, ok := f.sessions[query.Get("upload_id")]; ok {
+			name = session.name
+		}
+	}
+	f.requests = append(f.requests, strings.TrimSpace(r.Method+" "+name+" "+query.Get("uploadType")))
+
+	switch {
+	case path == uploadPrefix && r.Method == http.MethodPost && query.Get("uploadType") == "media":
+		f.objects[query.Get("name")] = &fakeGCSObject{data: body, contentType: r.Header.Get("Content-Type"), modTime: time.Now()}
+		f.writeObject(w, query.Get("name"))
+
+	case path == uploadPrefix && r.Method == http.MethodPost && query.Get("uploadType") == "resumable":
+		var metadata struct {
+			Name        string `json:"name"`
+			ContentType string `json:"contentType"`
+		}
+		json.Unmarshal(body, &metadata)
+		uploadID := strconv.Itoa(len(f.sessions) + 1)
+		f.sessions[uploadID] = &fakeGCSSession{name: metadata.Name, contentType: metadata.ContentType}
+		w.Header().Set("Location", f.serverURL+uploadPrefix+"?uploadType=resumable&upload_id="+uploadID)
+
+	case path == uploadPrefix && r.Method == http.MethodPut && query.Has("upload_id"):
+		session, ok := f.sessions[query.Get("upload_id")]
+		if !ok {
+			writeFakeGCSError(w, http.StatusNotFound, "No such upload")
+			return
+		}
+		var first, last, total int
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &total); err != nil || first != len(session.data) {
+			writeFakeGCSError(w, http.StatusBadRequest, "Invalid Content-Range")
+			return
+		}
+		session.data = append(session.data, body...)
+		if len(session.data) < total {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+			w.WriteHeader(gcsResumeIncomplete)
+			return
+		}
+		f.objects[session.name] = &fakeGCSObject{data: session.data, contentType: session.contentType, modTime: time.Now()}
+		delete(f.sessions, query.Get("upload_id"))
+		f.writeObject(w, session.name)
+
+	case path == uploadPrefix && r.Method == http.MethodDelete && query.Has("upload_id"):
+		delete(f.sessions, query.Get("upload_id"))
+		w.WriteHeader(499)
+
+	case path == apiPrefix && r.Method == http.MethodGet:
+		f.list(w, query.Get("pageToken"))
+
+	case strings.HasPrefix(path, apiPrefix+"/") && r.Method == http.MethodGet:
+		object, ok := f.objects[name]
+		if !ok {
+			writeFakeGCSError(w, http.StatusNotFound, "No such object")
+			return
+		}
+		if query.Get("alt") != "media" {
+			f.writeObject(w, name)
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		http.ServeContent(w, r, name, object.modTime, bytes.NewReader(object.data))
+
+	case strings.HasPrefix(path, apiPrefix+"/") && r.Method == http.MethodDelete:
+		if _, ok := f.objects[name]; !ok {
+			writeFakeGCSError(w, http.StatusNotFound, "No such object")
+			return
+		}
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeFakeGCSError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// token exchanges a JWT bearer assertion signed with the service account key
+// for an access token. The caller must hold f.mu.
+func (f *fakeGCS) token(w http.ResponseWriter, body []byte) {
+	form, _ := url.ParseQuery(string(body))
+	parts := strings.Split(form.Get("assertion"), ".")
+	if form.Get("grant_type") != gcsJWTBearerType || len(parts) != 3 {
+		writeFakeGCSError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(&f.Credentials.key.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+		writeFakeGCSError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	var claims struct {
+		Iss string `json:"iss"`
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+	}
+	data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(data, &claims)
+	if claims.Iss != f.Credentials.ClientEmail || claims.Aud != f.Credentials.TokenURI || time.Now().Unix() > claims.Exp {
+		writeFakeGCSError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	f.tokenExchanges++
+	token := fmt.Sprintf("token-%d", f.tokenExchanges)
+	f.tokens[token] = true
+	json.NewEncoder(w).Encode(map[string]interface{}{"access_token": token, "expires_in": 3600, "token_type": "Bearer"})
+}
+
+// serveSigned serves a download through a V4 signed URL. The signature is
+// deterministic, so signing the same request again must reproduce it. The
+// caller must hold f.mu.
+func (f *fakeGCS) serveSigned(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	signedAt, err := time.Parse(s3TimeFormat, query.Get("X-Goog-Date"))
+	if err != nil {
+		writeFakeGCSError(w, http.StatusBadRequest, "Invalid X-Goog-Date")
+		return
+	}
+	expires, err := strconv.Atoi(query.Get("X-Goog-Expires"))
+	if err != nil || time.Now().After(signedAt.Add(time.Duration(expires)*time.Second)) {
+		writeFakeGCSError(w, http.StatusBadRequest, "Request has expired")
+		return
+	}
+
+	unsigned := *r.URL
+	unsigned.Scheme = "http"
+	unsigned.Host = r.Host
+	unsignedQuery := url.Values{}
+	for name, vals := range query {
+		if !strings.HasPrefix(name, "X-Goog-") {
+			unsignedQuery[name] = vals
+		}
+	}
+	unsigned.RawQuery = unsignedQuery.Encode()
+	signed, err := f.Credentials.signedURL(r.Method, &unsigned, time.Duration(expires)*time.Second, signedAt)
+	if err != nil || signed.Query().Get("X-Goog-Signature") != query.Get("X-Goog-Signature") {
+		writeFakeGCSError(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	object, ok := f.objects[strings.TrimPrefix(r.URL.Path, "/"+f.Bucket+"/")]
+	if !ok {
+		writeFakeGCSError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("Content-Type", object.contentType)
+	http.ServeContent(w, r, r.URL.Path, object.modTime, bytes.NewReader(object.data))
+}
+
+// list writes a page of the objects after token. The caller must hold f.mu.
+func (f *fakeGCS) list(w http.ResponseWriter, token string) {
+	names := make([]string, 0, len(f.objects))
+	for name := range f.objects {
+		if name > token {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := struct {
+		Items         []map[string]interface{} `json:"items"`
+		NextPageToken string                   `json:"nextPageToken,omitempty"`
+	}{}
+	if len(names) > f.ListPageSize {
+		names = names[:f.ListPageSize]
+		result.NextPageToken = names[len(names)-1]
+	}
+	for _, name := range names {
+		result.Items = append(result.Items, f.metadata(name))
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// writeObject writes the metadata of an object. The caller must hold f.mu.
+func (f *fakeGCS) writeObject(w http.ResponseWriter, name string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.metadata(name))
+}
+
+func (f *fakeGCS) metadata(name string) map[string]interface{} {
+	object := f.objects[name]
+	return map[string]interface{}{
+		"bucket":      f.Bucket,
+		"name":        name,
+		"size":        strconv.Itoa(len(object.data)),
+		"contentType": object.contentType,
+		"updated":     object.modTime.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+func writeFakeGCSError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": status, "message": message}})
+}
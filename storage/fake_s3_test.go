@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var signedHeadersPattern = regexp.MustCompile(`SignedHeaders=([^,]+)`)
+
+// fakeS3 is an in-process stand-in for an S3-compatible server. It supports
+// path-style addressing, single and multipart uploads, and checks the SigV4
+// signature of every request.
+type fakeS3 struct {
+	Bucket string
+	Signer *s3Signer
+	// ListPageSize limits the keys returned per ListObjectsV2 page.
+	ListPageSize int
+
+	mu           sync.Mutex
+	objects      map[string][]byte
+	contentTypes map[string]string
+	modTimes     map[string]time.Time
+	uploads      map[string]*fakeS3Upload
+	requests     []string
+}
+
+type fakeS3Upload struct {
+	contentType string
+	parts       map[int][]byte
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	t.Helper()
+
+	fake := &fakeS3{
+		Bucket:       "media",
+		Signer:       &s3Signer{Region: "us-east-1", AccessKeyID: "test-key", SecretAccessKey: "test-secret"},
+		ListPageSize: 1000,
+		objects:      make(map[string][]byte),
+		contentTypes: make(map[string]string),
+		modTimes:     make(map[string]time.Time),
+		uploads:      make(map[string]*fakeS3Upload),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func newTestS3Storage(t *testing.T) (*S3Storage, *fakeS3) {
+	t.Helper()
+
+	fake, server := newFakeS3(t)
+	s, err := NewS3Storage(S3Config{
+		Bucket:          fake.Bucket,
+		Region:          fake.Signer.Region,
+		Endpoint:        server.URL,
+		ForcePathStyle:  true,
+		AccessKeyID:     fake.Signer.AccessKeyID,
+		SecretAccessKey: fake.Signer.SecretAccessKey,
+		PartSize:        minS3PartSize,
+		TempDir:         t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake
+}
+
+func (f *fakeS3) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeS3) Object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[key]
+	return data, ok
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if !f.verify(r, body) {
+		writeFakeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.Bucket {
+		writeFakeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	f.requests = append(f.requests, r.Method+" "+key)
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadID := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[uploadID] = &fakeS3Upload{contentType: r.Header.Get("Content-Type"), parts: make(map[int][]byte)}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeFakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		upload.parts[partNumber] = body
+		w.Header().Set("ETag", fakeETag(body))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeFakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete struct {
+			Parts []s3CompletedPart `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		sort.Slice(complete.Parts, func(i, j int) bool { return complete.Parts[i].PartNumber < complete.Parts[j].PartNumber })
+
+		var assembled []byte
+		for _, part := range complete.Parts {
+			data := upload.parts[part.PartNumber]
+			if fakeETag(data) != part.ETag {
+				writeFakeS3Error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			assembled = append(assembled, data...)
+		}
+		f.objects[key] = assembled
+		f.contentTypes[key] = upload.contentType
+		f.modTimes[key] = time.Now()
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+		f.contentTypes[key] = r.Header.Get("Content-Type")
+		f.modTimes[key] = time.Now()
+		w.Header().Set("ETag", fakeETag(body))
+
+	case r.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		f.list(w, query.Get("continuation-token"))
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			writeFakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", fakeETag(data))
+		if contentType := f.contentTypes[key]; contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		http.ServeContent(w, r, key, f.modTimes[key], bytes.NewReader(data))
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		delete(f.contentTypes, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeFakeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// list writes a ListObjectsV2 page of the keys after token. The caller must
+// hold f.mu.
+func (f *fakeS3) list(w http.ResponseWriter, token string) {
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		if key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	truncated := len(keys) > f.ListPageSize
+	if truncated {
+		keys = keys[:f.ListPageSize]
+	}
+
+	fmt.Fprint(w, "<ListBucketResult>")
+	for _, key := range keys {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+			key, len(f.objects[key]), f.modTimes[key].UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "<IsTruncated>%t</IsTruncated>", truncated)
+	if truncated {
+		fmt.Fprintf(w, "<NextContinuationToken>%s</NextContinuationToken>", keys[len(keys)-1])
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+// verify recomputes the SigV4 signature from the headers the client claims
+// to have signed and checks the payload hash when it is not UNSIGNED-PAYLOAD.
+func (f *fakeS3) verify(r *http.Request, body []byte) bool {
+	if r.URL.Query().Has("X-Amz-Signature") {
+		return f.verifyPresigned(r)
+	}
+
+	payloadHash := r.Header.Get("x-amz-content-sha256")
+	if payloadHash != s3UnsignedPayload && payloadHash != sha256Hex(body) {
+		return false
+	}
+
+	match := signedHeadersPattern.FindStringSubmatch(r.Header.Get("Authorization"))
+	if match == nil {
+		return false
+	}
+
+	clone, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	for _, name := range strings.Split(match[1], ";") {
+		switch name {
+		case "host", "x-amz-date", "x-amz-content-sha256", "x-amz-security-token":
+		default:
+			clone.Header.Set(name, r.Header.Get(name))
+		}
+	}
+	signedAt, err := time.Parse(s3TimeFormat, r.Header.Get("x-amz-date"))
+	if err != nil {
+		return false
+	}
+	f.Signer.Sign(clone, payloadHash, signedAt)
+	return clone.Header.Get("Authorization") == r.Header.Get("Authorization")
+}
+
+// verifyPresigned checks a query-string signature by presigning the same
+// request again and rejects it once X-Amz-Expires has elapsed.
+func (f *fakeS3) verifyPresigned(r *http.Request) bool {
+	query := r.URL.Query()
+	signedAt, err := time.Parse(s3TimeFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || time.Now().After(signedAt.Add(time.Duration(expires)*time.Second)) {
+		return false
+	}
+
+	unsigned := *r.URL
+	unsigned.Scheme = "http"
+	unsigned.Host = r.Host
+	unsignedQuery := url.Values{}
+	for name, vals := range query {
+		if !strings.HasPrefix(name, "X-Amz-") {
+			unsignedQuery[name] = vals
+		}
+	}
+	unsigned.RawQuery = unsignedQuery.Encode()
+
+	presigned := f.Signer.Presign(r.Method, &unsigned, time.Duration(expires)*time.Second, signedAt)
+	return presigned.Query().Get("X-Amz-Signature") == query.Get("X-Amz-Signature")
+}
+
+func writeFakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func fakeETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
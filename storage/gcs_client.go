@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gcsResumeIncomplete is the status a resumable upload session answers
+// chunks with until the last one arrives.
+const gcsResumeIncomplete = 308
+
+// gcsClient is a minimal client for the subset of the Cloud Storage JSON API
+// the storage layer needs. It works with Google Cloud Storage as well as
+// fake-gcs-server.
+type gcsClient struct {
+	Endpoint *url.URL
+	Bucket   string
+	// Tokens authorizes requests; emulators are called without one.
+	Tokens     *gcsTokenSource
+	HTTPClient *http.Client
+}
+
+type gcsError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *gcsError) Error() string {
+	return fmt.Sprintf("gcs: %d %s", e.StatusCode, e.Message)
+}
+
+// Retryable reports whether the request may succeed when sent again.
+func (e *gcsError) Retryable() bool {
+	return retryableStatus(e.StatusCode)
+}
+
+func (e *gcsError) Unwrap() error {
+	if e.StatusCode == http.StatusNotFound {
+		return ErrObjectNotFound
+	}
+	return nil
+}
+
+type gcsObject struct {
+	Name        string    `json:"name"`
+	Size        string    `json:"size"`
+	ContentType string    `json:"contentType"`
+	Updated     time.Time `json:"updated"`
+}
+
+func (o *gcsObject) info() ObjectInfo {
+	size, _ := strconv.ParseInt(o.Size, 10, 64)
+	return ObjectInfo{Key: o.Name, Size: size, ContentType: o.ContentType, LastModified: o.Updated}
+}
+
+// objectURL returns the JSON API URL of the object called name.
+func (c *gcsClient) objectURL(name string) string {
+	return c.bucketURL("/storage/v1") + "/o/" + url.PathEscape(name)
+}
+
+func (c *gcsClient) bucketURL(prefix string) string {
+	return strings.TrimRight(c.Endpoint.String(), "/") + prefix + "/b/" + url.PathEscape(c.Bucket)
+}
+
+// downloadURL is where the object is served from outside the JSON API, and
+// what signed URLs point at.
+func (c *gcsClient) downloadURL(name string) *url.URL {
+	u := *c.Endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + c.Bucket + "/" + name
+	return &u
+}
+
+func (c *gcsClient) do(ctx context.Context, method string, rawURL string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	if len(query) > 0 {
+		rawURL += "?" + query.Encode()
+	}
+	if size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for name, vals := range header {
+		req.Header[name] = vals
+	}
+	if c.Tokens != nil {
+		token, err := c.Tokens.Token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotModified && resp.StatusCode != gcsResumeIncomplete {
+		defer resp.Body.Close()
+		gcsErr := &gcsError{StatusCode: resp.StatusCode}
+		var result struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if data, _ := io.ReadAll(resp.Body); json.Unmarshal(data, &result) == nil {
+			gcsErr.Message = result.Error.Message
+		}
+		if gcsErr.Message == "" {
+			gcsErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return nil, gcsErr
+	}
+	return resp, nil
+}
+
+func (c *gcsClient) insertObject(ctx context.Context, name string, body io.Reader, size int64, contentType string) error {
+	query := url.Values{"uploadType": {"media"}, "name": {name}}
+	header := http.Header{"Content-Type": {contentType}}
+	resp, err := c.do(ctx, http.MethodPost, c.bucketURL("/upload/storage/v1")+"/o", query, header, body, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// startResumableUpload opens an upload session for name and returns its URL.
+func (c *gcsClient) startResumableUpload(ctx context.Context, name string, contentType string) (string, error) {
+	payload, err := json.Marshal(map[string]string{"name": name, "contentType": contentType})
+	if err != nil {
+		return "", err
+	}
+	header := http.Header{"Content-Type": {"application/json"}, "X-Upload-Content-Type": {contentType}}
+	query := url.Values{"uploadType": {"resumable"}}
+	resp, err := c.do(ctx, http.MethodPost, c.bucketURL("/upload/storage/v1")+"/o", query, header, bytes.NewReader(payload), int64(len(payload)))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return "", fmt.Errorf("gcs: resumable upload of %s returned no session", name)
+	}
+	return session, nil
+}
+
+// uploadChunk sends the bytes at offset of a file of total bytes to an
+// upload session.
+func (c *gcsClient) uploadChunk(ctx context.Context, session string, body io.Reader, offset int64, size int64, total int64) error {
+	header := http.Header{"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", offset, offset+size-1, total)}}
+	resp, err := c.do(ctx, http.MethodPut, session, nil, header, body, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *gcsClient) cancelResumableUpload(ctx context.Context, session string) {
+	if resp, err := c.do(ctx, http.MethodDelete, session, nil, nil, nil, 0); err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (c *gcsClient) getObject(ctx context.Context, name string) (*gcsObject, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.objectURL(name), nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var object gcsObject
+	if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+		return nil, err
+	}
+	return &object, nil
+}
+
+func (c *gcsClient) downloadObject(ctx context.Context, name string, header http.Header) (*http.Response, error) {
+	return c.do(ctx, http.MethodGet, c.objectURL(name), url.Values{"alt": {"media"}}, header, nil, 0)
+}
+
+func (c *gcsClient) deleteObject(ctx context.Context, name string) error {
+	resp, err := c.do(ctx, http.MethodDelete, c.objectURL(name), nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listObjects pages through every object of the bucket.
+func (c *gcsClient) listObjects(ctx context.Context, fn func(gcsObject) error) error {
+	query := url.Values{}
+	for {
+		resp, err := c.do(ctx, http.MethodGet, c.bucketURL("/storage/v1")+"/o", query, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+
+		var result struct {
+			Items         []gcsObject `json:"items"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Items {
+			if err := fn(object); err != nil {
+				return err
+			}
+		}
+		if result.NextPageToken == "" {
+			return nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGCSChunkSize = 16 << 20
+	// gcsChunkAlignment is what every chunk of a resumable upload but the
+	// last must be a multiple of.
+	gcsChunkAlignment = 256 << 10
+)
+
+type GCSConfig struct {
+	Bucket string `json:"bucket"`
+	// CredentialsFile is a service account key file. Without one requests
+	// are sent unauthenticated, which only emulators accept, and links cannot
+	// be signed.
+	CredentialsFile string `json:"credentialsFile"`
+	// Endpoint defaults to https://storage.googleapis.com.
+	Endpoint string `json:"endpoint"`
+	// PublicBaseURL, when set, replaces the bucket URL in returned links,
+	// e.g. to serve objects through a CDN.
+	PublicBaseURL string `json:"publicBaseUrl"`
+	// Files larger than ChunkSize are sent in chunks with a resumable upload.
+	ChunkSize int64 `json:"chunkSize"`
+	// TempDir holds uploads while they are hashed, before they are sent.
+	TempDir string `json:"tempDir"`
+}
+
+func init() {
+	Register("gcs", func(cfg GCSConfig) (StorageProvider, error) {
+		s, err := NewGCSStorage(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}, GCSConfigFromEnv)
+}
+
+// GCSStorage stores blobs in a Google Cloud Storage bucket. Reference counts
+// are kept in a "<key>.refs" object next to each blob.
+type GCSStorage struct {
+	Config GCSConfig
+
+	client      *gcsClient
+	credentials *gcsCredentials
+	mu          sync.Mutex
+}
+
+func NewGCSStorage(cfg GCSConfig) (*GCSStorage, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("gcs storage: bucket is required")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://storage.googleapis.com"
+	}
+	if cfg.ChunkSize == 0 {
+		cfg.ChunkSize = defaultGCSChunkSize
+	}
+	if cfg.ChunkSize < 0 || cfg.ChunkSize%gcsChunkAlignment != 0 {
+		return nil, fmt.Errorf("gcs storage: chunk size must be a multiple of %d bytes", gcsChunkAlignment)
+	}
+	if cfg.TempDir == "" {
+		cfg.TempDir = os.TempDir()
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("gcs storage: invalid endpoint %q", cfg.Endpoint)
+	}
+
+	s := &GCSStorage{
+		Config: cfg,
+		client: &gcsClient{Endpoint: endpoint, Bucket: cfg.Bucket, HTTPClient: http.DefaultClient},
+	}
+	if cfg.CredentialsFile != "" {
+		s.credentials, err = loadGCSCredentials(cfg.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("gcs storage: %w", err)
+		}
+		s.client.Tokens = &gcsTokenSource{Credentials: s.credentials, HTTPClient: http.DefaultClient}
+	}
+	return s, nil
+}
+
+func (s *GCSStorage) UploadFile(ctx context.Context, file io.Reader, _filename string) (*Object, error) {
+	spooled, err := spoolFile(s.Config.TempDir, file)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spooled.Path)
+
+	return s.store(ctx, spooled.Key(), spooled)
+}
+
+func (s *GCSStorage) UploadFileAs(ctx context.Context, key string, file io.Reader, contentType string) (*Object, error) {
+	spooled, err := spoolFile(s.Config.TempDir, file)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spooled.Path)
+
+	spooled.ContentType = contentType
+	return s.store(ctx, key, spooled)
+}
+
+func (s *GCSStorage) ReplaceFile(ctx context.Context, key string, file io.Reader, contentType string) error {
+	spooled, err := spoolFile(s.Config.TempDir, file)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spooled.Path)
+	spooled.ContentType = contentType
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs(ctx, key)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		return ErrObjectNotFound
+	}
+	return s.putFile(ctx, key, spooled)
+}
+
+// store uploads a spooled file under key, unless the blob is already
+// stored, and adds a reference to it.
+func (s *GCSStorage) store(ctx context.Context, key string, spooled *spooledFile) (*Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if refs == 0 {
+		if err := s.putFile(ctx, key, spooled); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.writeRefs(ctx, key, refs+1); err != nil {
+		return nil, err
+	}
+
+	return &Object{
+		Key:         key,
+		URL:         s.url(key),
+		ContentHash: spooled.ContentHash,
+		ContentType: spooled.ContentType,
+		Size:        spooled.Size,
+	}, nil
+}
+
+func (s *GCSStorage) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs(ctx, key)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		return ErrObjectNotFound
+	}
+	if refs > 1 {
+		return s.writeRefs(ctx, key, refs-1)
+	}
+	return s.remove(ctx, key)
+}
+
+func (s *GCSStorage) References(ctx context.Context, key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readRefs(ctx, key)
+}
+
+func (s *GCSStorage) SetReferences(ctx context.Context, key string, refs int) error {
+	if refs <= 0 {
+		return fmt.Errorf("set references of %s: %d is not a positive count", key, refs)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.readRefs(ctx, key)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return ErrObjectNotFound
+	}
+	return s.writeRefs(ctx, key, refs)
+}
+
+// SignedURL returns a V4 signed GET URL for the object, signed with the
+// service account key. Signed URLs always point at the bucket, not
+// PublicBaseURL, and are valid for at most seven days.
+func (s *GCSStorage) SignedURL(_ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if s.credentials == nil {
+		return "", ErrSignedURLUnsupported
+	}
+	signed, err := s.credentials.signedURL(http.MethodGet, s.client.downloadURL(key), expiry, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return signed.String(), nil
+}
+
+func (s *GCSStorage) Open(ctx context.Context, key string) (ObjectReader, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	fetch := func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		resp, err := s.client.downloadObject(ctx, key, http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}})
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	return &rangeReader{ctx: ctx, size: info.Size, fetch: fetch}, nil
+}
+
+func (s *GCSStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	object, err := s.client.getObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	info := object.info()
+	info.Key = key
+	return &info, nil
+}
+
+func (s *GCSStorage) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	return s.client.listObjects(ctx, func(object gcsObject) error {
+		if strings.HasSuffix(object.Name, ".refs") {
+			return nil
+		}
+		return fn(object.info())
+	})
+}
+
+func (s *GCSStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remove(ctx, key)
+}
+
+func (s *GCSStorage) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.getObject(ctx, key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// remove deletes a blob together with its reference count. The caller must
+// hold s.mu. Deleting a missing object fails in Cloud Storage, which is not
+// an error here.
+func (s *GCSStorage) remove(ctx context.Context, key string) error {
+	for _, name := range []string{key, key + ".refs"} {
+		if err := s.client.deleteObject(ctx, name); err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *GCSStorage) url(key string) string {
+	if s.Config.PublicBaseURL != "" {
+		return strings.TrimRight(s.Config.PublicBaseURL, "/") + "/" + key
+	}
+	return s.client.downloadURL(key).String()
+}
+
+// putFile uploads a spooled file under key, switching to a resumable upload
+// sent in chunks when it does not fit into a single request.
+func (s *GCSStorage) putFile(ctx context.Context, key string, spooled *spooledFile) error {
+	f, err := os.Open(spooled.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size := spooled.Size
+	if size <= s.Config.ChunkSize {
+		return s.client.insertObject(ctx, key, f, size, spooled.ContentType)
+	}
+
+	session, err := s.client.startResumableUpload(ctx, key, spooled.ContentType)
+	if err != nil {
+		return err
+	}
+	for offset := int64(0); offset < size; offset += s.Config.ChunkSize {
+		chunkSize := min(s.Config.ChunkSize, size-offset)
+		if err := s.client.uploadChunk(ctx, session, io.NewSectionReader(f, offset, chunkSize), offset, chunkSize, size); err != nil {
+			s.client.cancelResumableUpload(context.WithoutCancel(ctx), session)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *GCSStorage) readRefs(ctx context.Context, key string) (int, error) {
+	resp, err := s.client.downloadObject(ctx, key+".refs", nil)
+	if errors.Is(err, ErrObjectNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func (s *GCSStorage) writeRefs(ctx context.Context, key string, refs int) error {
+	data := strconv.Itoa(refs)
+	return s.client.insertObject(ctx, key+".refs", strings.NewReader(data), int64(len(data)), "text/plain")
+}
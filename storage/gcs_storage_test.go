@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeGCSServerStorage connects to the fake-gcs-server in
+// GCS_EMULATOR_ENDPOINT, e.g. http://127.0.0.1:4443, and creates a fresh
+// bucket for the test. The emulator does not check credentials, so none are
+// configured. The test is skipped without an endpoint.
+func newFakeGCSServerStorage(t *testing.T) *GCSStorage {
+	t.Helper()
+
+	endpoint := os.Getenv("GCS_EMULATOR_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("GCS_EMULATOR_ENDPOINT is not set")
+	}
+	s, err := NewGCSStorage(GCSConfig{
+		Bucket:    fmt.Sprintf("test-%d", time.Now().UnixNano()),
+		Endpoint:  endpoint,
+		ChunkSize: gcsChunkAlignment,
+		TempDir:   t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	payload, _ := json.Marshal(map[string]string{"name": s.Config.Bucket})
+	resp, err := s.client.do(context.Background(), http.MethodPost, strings.TrimRight(endpoint, "/")+"/storage/v1/b", nil,
+		http.Header{"Content-Type": {"application/json"}}, bytes.NewReader(payload), int64(len(payload)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	return s
+}
+
+func TestGCSStorageLifecycle(t *testing.T) {
+	s, _ := newTestGCSStorage(t)
+	testProviderLifecycle(t, s)
+}
+
+func TestGCSStorageList(t *testing.T) {
+	s, fake := newTestGCSStorage(t)
+	fake.ListPageSize = 2
+	testProviderList(t, s)
+}
+
+func TestGCSStorageUploadFile(t *testing.T) {
+	s, fake := newTestGCSStorage(t)
+
+	object, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "photo.jpg")
+	require.NoError(t, err)
+
+	assert.Equal(t, s.Config.Endpoint+"/media/"+object.Key, object.URL)
+	stored, ok := fake.Object(object.Key)
+	require.True(t, ok)
+	assert.Equal(t, "file content", string(stored))
+	refs, _ := fake.Object(object.Key + ".refs")
+	assert.Equal(t, "1", string(refs))
+	assert.Equal(t, 1, fake.TokenExchanges())
+}
+
+func TestGCSStorageUploadFile_Resumable(t *testing.T) {
+	s, fake := newTestGCSStorage(t)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), (2*gcsChunkAlignment+1024)/16)
+	object, err := s.UploadFile(context.Background(), bytes.NewReader(content), "video.mp4")
+	require.NoError(t, err)
+
+	stored, ok := fake.Object(object.Key)
+	require.True(t, ok)
+	assert.Equal(t, content, stored)
+	assert.Contains(t, fake.Requests(), "PUT "+object.Key+" resumable")
+}
+
+func TestGCSStorageUploadFile_SameContentSharesBlob(t *testing.T) {
+	s, fake := newTestGCSStorage(t)
+
+	first, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "photo.jpg")
+	require.NoError(t, err)
+	second, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "copy.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, first.Key, second.Key)
+
+	blobInserts := 0
+	for _, request := range fake.Requests() {
+		if request == "POST "+first.Key+" media" {
+			blobInserts++
+		}
+	}
+	assert.Equal(t, 1, blobInserts)
+
+	require.NoError(t, s.Release(context.Background(), first.Key))
+	_, ok := fake.Object(first.Key)
+	assert.True(t, ok)
+
+	require.NoError(t, s.Release(context.Background(), first.Key))
+	_, ok = fake.Object(first.Key)
+	assert.False(t, ok)
+	_, ok = fake.Object(first.Key + ".refs")
+	assert.False(t, ok)
+}
+
+func TestGCSStorageSignedURL(t *testing.T) {
+	s, _ := newTestGCSStorage(t)
+
+	object, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "photo.jpg")
+	require.NoError(t, err)
+
+	signedURL, err := s.SignedURL(context.Background(), object.Key, time.Minute)
+	require.NoError(t, err)
+
+	resp, err := http.Get(signedURL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "file content", string(body))
+
+	tampered := strings.Replace(signedURL, object.Key, strings.Repeat("0", 64)+".txt", 1)
+	resp, err = http.Get(tampered)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestGCSStorageSignedURL_WithoutCredentials(t *testing.T) {
+	s, err := NewGCSStorage(GCSConfig{Bucket: "media"})
+	require.NoError(t, err)
+
+	_, err = s.SignedURL(context.Background(), "abc.jpg", time.Minute)
+	assert.ErrorIs(t, err, ErrSignedURLUnsupported)
+	assert.Equal(t, "https://storage.googleapis.com/media/abc.jpg", s.url("abc.jpg"))
+}
+
+func TestNewStorage_GCS(t *testing.T) {
+	_, err := NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": {Type: "gcs", Config: json.RawMessage(`{"bucket": "media", "chunkSize": 1000}`)}},
+	})
+	assert.ErrorContains(t, err, "chunk size must be a multiple")
+
+	provider, err := NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": {Type: "gcs", Config: json.RawMessage(`{"bucket": "media"}`)}},
+	})
+	require.NoError(t, err)
+	assert.IsType(t, &GCSStorage{}, InstanceNamed(provider, "media"))
+}
+
+func TestFakeGCSServerLifecycle(t *testing.T) {
+	s := newFakeGCSServerStorage(t)
+	testProviderLifecycle(t, s)
+	testProviderList(t, s)
+}
+
+func TestFakeGCSServerUploadFile_Resumable(t *testing.T) {
+	s := newFakeGCSServerStorage(t)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), (2*gcsChunkAlignment+1024)/16)
+	object, err := s.UploadFile(context.Background(), bytes.NewReader(content), "video.mp4")
+	require.NoError(t, err)
+
+	reader, err := s.Open(context.Background(), object.Key)
+	require.NoError(t, err)
+	defer reader.Close()
+	stored, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, content, stored)
+}
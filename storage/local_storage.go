@@ -0,0 +1,376 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LocalConfig struct {
+	RootDir string `json:"rootDir"`
+	BaseURL string `json:"baseUrl"`
+	// SigningKey is the HMAC secret for signed URLs. When empty a random key
+	// is generated, so signed URLs do not survive a restart.
+	SigningKey string `json:"signingKey"`
+}
+
+func init() {
+	Register("local", func(cfg LocalConfig) (StorageProvider, error) {
+		s, err := NewLocalStorage(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}, LocalConfigFromEnv)
+}
+
+// LocalStorage keeps uploaded files on the local filesystem. Files are
+// sharded into two levels of subdirectories derived from their key so that no
+// single directory grows unbounded. Each blob has a ".refs" sidecar holding
+// the number of media that point at it.
+type LocalStorage struct {
+	RootDir string
+	BaseURL string
+
+	signingKey []byte
+	mu         sync.Mutex
+}
+
+func NewLocalStorage(cfg LocalConfig) (*LocalStorage, error) {
+	if cfg.RootDir == "" {
+		return nil, errors.New("local storage: root dir is required")
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.RootDir, ".tmp"), 0o755); err != nil {
+		return nil, fmt.Errorf("create local storage root: %w", err)
+	}
+
+	signingKey := []byte(cfg.SigningKey)
+	if len(signingKey) == 0 {
+		log.Println("local storage: no signing key configured, generating a random one")
+		signingKey = make([]byte, 32)
+		if _, err := rand.Read(signingKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return &LocalStorage{
+		RootDir:    cfg.RootDir,
+		BaseURL:    strings.TrimRight(cfg.BaseURL, "/"),
+		signingKey: signingKey,
+	}, nil
+}
+
+func (s *LocalStorage) UploadFile(_ctx context.Context, file io.Reader, _filename string) (*Object, error) {
+	spooled, err := spoolFile(filepath.Join(s.RootDir, ".tmp"), file)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spooled.Path)
+
+	return s.store(spooled.Key(), spooled)
+}
+
+func (s *LocalStorage) UploadFileAs(_ctx context.Context, key string, file io.Reader, contentType string) (*Object, error) {
+	spooled, err := spoolFile(filepath.Join(s.RootDir, ".tmp"), file)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spooled.Path)
+
+	spooled.ContentType = contentType
+	return s.store(key, spooled)
+}
+
+func (s *LocalStorage) ReplaceFile(_ctx context.Context, key string, file io.Reader, _contentType string) error {
+	spooled, err := spoolFile(filepath.Join(s.RootDir, ".tmp"), file)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spooled.Path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs(key)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		return ErrObjectNotFound
+	}
+	return s.commit(spooled.Path, s.path(key))
+}
+
+// store moves a spooled upload into place under key, unless the blob is
+// already stored, and adds a reference to it.
+func (s *LocalStorage) store(key string, spooled *spooledFile) (*Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs(key)
+	if err != nil {
+		return nil, err
+	}
+	if refs == 0 {
+		if err := s.commit(spooled.Path, s.path(key)); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.writeRefs(key, refs+1); err != nil {
+		return nil, err
+	}
+
+	return &Object{
+		Key:         key,
+		URL:         s.url(key),
+		ContentHash: spooled.ContentHash,
+		ContentType: spooled.ContentType,
+		Size:        spooled.Size,
+	}, nil
+}
+
+func (s *LocalStorage) Release(_ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs(key)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		return ErrObjectNotFound
+	}
+	if refs > 1 {
+		return s.writeRefs(key, refs-1)
+	}
+	return s.remove(key)
+}
+
+func (s *LocalStorage) References(_ctx context.Context, key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readRefs(key)
+}
+
+func (s *LocalStorage) SetReferences(_ctx context.Context, key string, refs int) error {
+	if refs <= 0 {
+		return fmt.Errorf("set references of %s: %d is not a positive count", key, refs)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.readRefs(key)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return ErrObjectNotFound
+	}
+	return s.writeRefs(key, refs)
+}
+
+// SignedURL returns a link to the blob that carries its expiry time and an
+// HMAC over key and expiry. It is checked by VerifySignedURL when served.
+func (s *LocalStorage) SignedURL(_ctx context.Context, key string, expiry time.Duration) (string, error) {
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+	query := url.Values{
+		"expires":   {expires},
+		"signature": {s.sign(key, expires)},
+	}
+	return s.url(key) + "?" + query.Encode(), nil
+}
+
+func (s *LocalStorage) VerifySignedURL(key string, query url.Values) error {
+	expires := query.Get("expires")
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	expected := s.sign(key, expires)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+		return ErrInvalidSignature
+	}
+	if time.Now().Unix() > expiresAt {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+func (s *LocalStorage) sign(key string, expires string) string {
+	mac := hmac.New(sha256.New, s.signingKey)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *LocalStorage) Open(_ctx context.Context, key string) (ObjectReader, error) {
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *LocalStorage) Stat(_ctx context.Context, key string) (*ObjectInfo, error) {
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// The filesystem keeps no content type, so sniff it like on upload.
+	header := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	contentType, _ := DetectContentType(header[:n])
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		ContentType:  contentType,
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+func (s *LocalStorage) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	return filepath.WalkDir(s.RootDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == ".tmp" {
+				return filepath.SkipDir
+			}
+			return ctx.Err()
+		}
+		// Skip reference counts and anything not laid out like a blob.
+		key := entry.Name()
+		if strings.HasSuffix(key, ".refs") || path != s.path(key) {
+			return nil
+		}
+
+		fi, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()})
+	})
+}
+
+func (s *LocalStorage) Delete(_ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remove(key)
+}
+
+func (s *LocalStorage) Exists(_ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// remove deletes a blob together with its reference count. The caller must
+// hold s.mu.
+func (s *LocalStorage) remove(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(s.refsPath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return syncDir(filepath.Dir(s.path(key)))
+}
+
+// commit renames a fully written temp file into place and flushes the parent
+// directory, so readers never observe a partially written blob.
+func (s *LocalStorage) commit(tmpPath string, dst string) error {
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func (s *LocalStorage) readRefs(key string) (int, error) {
+	data, err := os.ReadFile(s.refsPath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func (s *LocalStorage) writeRefs(key string, refs int) error {
+	spooled, err := spoolFile(filepath.Join(s.RootDir, ".tmp"), strings.NewReader(strconv.Itoa(refs)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spooled.Path)
+	return s.commit(spooled.Path, s.refsPath(key))
+}
+
+func (s *LocalStorage) url(key string) string {
+	return s.BaseURL + "/" + filepath.ToSlash(shardPath(key))
+}
+
+func (s *LocalStorage) path(key string) string {
+	return filepath.Join(s.RootDir, shardPath(key))
+}
+
+func (s *LocalStorage) refsPath(key string) string {
+	return s.path(key) + ".refs"
+}
+
+// shardPath maps a key such as "abcdef.jpg" to "ab/cd/abcdef.jpg".
+func shardPath(key string) string {
+	if len(key) < 4 {
+		return key
+	}
+	return filepath.Join(key[0:2], key[2:4], key)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLocalStorage(t *testing.T) *LocalStorage {
+	t.Helper()
+
+	s, err := NewLocalStorage(LocalConfig{
+		RootDir:    t.TempDir(),
+		BaseURL:    "http://files.example.com/media/",
+		SigningKey: "test-signing-key",
+	})
+	require.NoError(t, err)
+	return s
+}
+
+func TestLocalStorageUploadFile(t *testing.T) {
+	s := newTestLocalStorage(t)
+
+	object, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "photo.jpg")
+	require.NoError(t, err)
+
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte("file content")))
+	assert.Equal(t, digest, object.ContentHash)
+	assert.Equal(t, int64(len("file content")), object.Size)
+	assert.Equal(t, "http://files.example.com/media/"+digest[0:2]+"/"+digest[2:4]+"/"+object.Key, object.URL)
+
+	stored, err := os.ReadFile(filepath.Join(s.RootDir, digest[0:2], digest[2:4], object.Key))
+	require.NoError(t, err)
+	assert.Equal(t, "file content", string(stored))
+
+	leftovers, err := os.ReadDir(filepath.Join(s.RootDir, ".tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func TestLocalStorageUploadFile_SameContentSharesBlob(t *testing.T) {
+	s := newTestLocalStorage(t)
+
+	first, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "photo.jpg")
+	require.NoError(t, err)
+	second, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "copy.jpg")
+	require.NoError(t, err)
+	other, err := s.UploadFile(context.Background(), strings.NewReader("other content"), "photo.jpg")
+	require.NoError(t, err)
+
+	assert.Equal(t, first.Key, second.Key)
+	assert.NotEqual(t, first.Key, other.Key)
+
+	require.NoError(t, s.Release(context.Background(), first.Key))
+	assert.FileExists(t, s.path(first.Key))
+
+	require.NoError(t, s.Release(context.Background(), second.Key))
+	assert.NoFileExists(t, s.path(first.Key))
+	assert.NoFileExists(t, s.refsPath(first.Key))
+
+	assert.ErrorIs(t, s.Release(context.Background(), first.Key), ErrObjectNotFound)
+}
+
+func TestLocalStorageUploadFile_DetectsContentType(t *testing.T) {
+	s := newTestLocalStorage(t)
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...)
+	object, err := s.UploadFile(context.Background(), bytes.NewReader(png), "picture.jpg")
+	require.NoError(t, err)
+
+	assert.Equal(t, "image/png", object.ContentType)
+	assert.Equal(t, object.ContentHash+".png", object.Key)
+	assert.True(t, strings.HasSuffix(object.URL, ".png"))
+}
+
+func TestLocalStorageSignedURL(t *testing.T) {
+	s := newTestLocalStorage(t)
+
+	object, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "photo.jpg")
+	require.NoError(t, err)
+
+	signedURL, err := s.SignedURL(context.Background(), object.Key, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(signedURL, object.URL+"?"))
+
+	parsed, err := url.Parse(signedURL)
+	require.NoError(t, err)
+	query := parsed.Query()
+	assert.NoError(t, s.VerifySignedURL(object.Key, query))
+	assert.ErrorIs(t, s.VerifySignedURL("other.jpg", query), ErrInvalidSignature)
+
+	query.Set("expires", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	assert.ErrorIs(t, s.VerifySignedURL(object.Key, query), ErrInvalidSignature)
+
+	expiredURL, err := s.SignedURL(context.Background(), object.Key, -time.Minute)
+	require.NoError(t, err)
+	parsed, _ = url.Parse(expiredURL)
+	assert.ErrorIs(t, s.VerifySignedURL(object.Key, parsed.Query()), ErrSignatureExpired)
+}
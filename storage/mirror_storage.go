@@ -0,0 +1,465 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultMirrorQueueSize = 1024
+
+type MirrorConfig struct {
+	Primary  InstanceConfig   `json:"primary"`
+	Replicas []InstanceConfig `json:"replicas"`
+	// Async replicates writes through a background queue instead of
+	// completing them on every replica before returning.
+	Async     bool   `json:"async"`
+	QueueSize int    `json:"queueSize"`
+	TempDir   string `json:"tempDir"`
+}
+
+func init() {
+	Register("mirror", func(cfg MirrorConfig) (StorageProvider, error) {
+		if cfg.Primary.Type == "" || len(cfg.Replicas) == 0 {
+			return nil, errors.New("mirror storage: a primary and at least one replica are required")
+		}
+		primary, err := NewInstance(cfg.Primary)
+		if err != nil {
+			return nil, fmt.Errorf("mirror primary: %w", err)
+		}
+		replicas := make([]StorageProvider, len(cfg.Replicas))
+		for i, replicaConfig := range cfg.Replicas {
+			if replicas[i], err = NewInstance(replicaConfig); err != nil {
+				return nil, fmt.Errorf("mirror replica %d: %w", i, err)
+			}
+		}
+		return NewMirrorStorage(primary, replicas, cfg), nil
+	}, func() (MirrorConfig, error) { return MirrorConfig{}, nil })
+}
+
+// MirrorStorage writes every blob to a primary provider and one or more
+// replicas, and reads from the first of them that answers. Replica writes
+// that fail are only logged: Repair finds the blobs they left behind by
+// listing the members, or checking the keys it is given, so it also finds
+// them after a restart or from another process.
+type MirrorStorage struct {
+	Primary  StorageProvider
+	Replicas []StorageProvider
+	Async    bool
+	TempDir  string
+
+	queue   chan mirrorJob
+	pending sync.WaitGroup
+}
+
+// mirrorJob is a replica write queued in async mode. For uploads, path is a
+// spooled copy of the file which the job removes once done.
+type mirrorJob struct {
+	key     string
+	release bool
+	path    string
+}
+
+// RepairReport summarizes a Repair run. Recounted counts the copies whose
+// reference count was set to that of the primary. Stray lists the blobs
+// that are not among the keys asked for and that only some replicas hold,
+// such as those of a release that failed on a replica; they are left alone.
+type RepairReport struct {
+	Checked   int
+	Copied    int
+	Recounted int
+	Missing   []string
+	Stray     []string
+	Failed    map[string]error
+}
+
+func NewMirrorStorage(primary StorageProvider, replicas []StorageProvider, cfg MirrorConfig) *MirrorStorage {
+	if cfg.TempDir == "" {
+		cfg.TempDir = os.TempDir()
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultMirrorQueueSize
+	}
+
+	s := &MirrorStorage{
+		Primary:  primary,
+		Replicas: replicas,
+		Async:    cfg.Async,
+		TempDir:  cfg.TempDir,
+	}
+	if s.Async {
+		s.queue = make(chan mirrorJob, cfg.QueueSize)
+		go s.worker()
+	}
+	return s
+}
+
+func (s *MirrorStorage) UploadFile(ctx context.Context, file io.Reader, filename string) (*Object, error) {
+	spooled, err := spoolFile(s.TempDir, file)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := s.uploadFrom(ctx, s.Primary, spooled.Path, filename)
+	if err != nil {
+		os.Remove(spooled.Path)
+		return nil, err
+	}
+
+	job := mirrorJob{key: object.Key, path: spooled.Path}
+	if s.enqueue(job) {
+		return object, nil
+	}
+	s.replicate(ctx, job)
+	return object, nil
+}
+
+func (s *MirrorStorage) Release(ctx context.Context, key string) error {
+	if err := s.Primary.Release(ctx, key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+
+	job := mirrorJob{key: key, release: true}
+	if !s.enqueue(job) {
+		s.replicate(ctx, job)
+	}
+	return nil
+}
+
+func (s *MirrorStorage) Open(ctx context.Context, key string) (ObjectReader, error) {
+	return firstAvailable(s.providers(), func(provider StorageProvider) (ObjectReader, error) {
+		return provider.Open(ctx, key)
+	})
+}
+
+func (s *MirrorStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	return firstAvailable(s.providers(), func(provider StorageProvider) (*ObjectInfo, error) {
+		return provider.Stat(ctx, key)
+	})
+}
+
+func (s *MirrorStorage) Delete(ctx context.Context, key string) error {
+	var errs []error
+	for _, provider := range s.providers() {
+		if err := provider.Delete(ctx, key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *MirrorStorage) Exists(ctx context.Context, key string) (bool, error) {
+	exists, err := firstAvailable(s.providers(), func(provider StorageProvider) (bool, error) {
+		exists, err := provider.Exists(ctx, key)
+		if err == nil && !exists {
+			return false, ErrObjectNotFound
+		}
+		return exists, err
+	})
+	if errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	}
+	return exists, err
+}
+
+func (s *MirrorStorage) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return firstAvailable(s.providers(), func(provider StorageProvider) (string, error) {
+		exists, err := provider.Exists(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", ErrObjectNotFound
+		}
+		return provider.SignedURL(ctx, key, expiry)
+	})
+}
+
+func (s *MirrorStorage) VerifySignedURL(key string, query url.Values) error {
+	for _, provider := range s.providers() {
+		if verifier, ok := provider.(URLVerifier); ok {
+			if err := verifier.VerifySignedURL(key, query); err == nil {
+				return nil
+			}
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// List enumerates the blobs held by any member of the mirror, each once.
+func (s *MirrorStorage) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	seen := make(map[string]bool)
+	for _, provider := range s.providers() {
+		err := ListObjects(ctx, provider, func(info ObjectInfo) error {
+			if seen[info.Key] {
+				return nil
+			}
+			seen[info.Key] = true
+			return fn(info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush blocks until every queued replica write has been attempted.
+func (s *MirrorStorage) Flush() {
+	s.pending.Wait()
+}
+
+// Lagging lists every member of the mirror and returns the keys of the blobs
+// some of them do not hold, sorted. It fails with ErrListUnsupported when a
+// member cannot list its blobs.
+func (s *MirrorStorage) Lagging(ctx context.Context) ([]string, error) {
+	holders := make(map[string]int)
+	for _, provider := range s.providers() {
+		err := ListObjects(ctx, provider, func(info ObjectInfo) error {
+			holders[info.Key]++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []string
+	for key, count := range holders {
+		if count < len(s.providers()) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Repair makes sure every provider of the mirror holds each of keys, with
+// the reference count of the primary. Missing copies are taken from whichever
+// provider still has the blob, its count from the first that has it. Keys
+// found nowhere are reported as missing.
+//
+// The lagging blobs found by listing the members are repaired as well, from
+// the primary only: a blob the primary no longer holds and that is not among
+// keys was released, and is reported as stray rather than copied back.
+func (s *MirrorStorage) Repair(ctx context.Context, keys []string) *RepairReport {
+	report := &RepairReport{Failed: make(map[string]error)}
+
+	requested := make(map[string]bool)
+	for _, key := range keys {
+		requested[key] = true
+	}
+	lagging, err := s.Lagging(ctx)
+	if err != nil && !errors.Is(err, ErrListUnsupported) {
+		log.Printf("mirror storage: failed to list lagging blobs: %v", err)
+	}
+	for _, key := range lagging {
+		if requested[key] {
+			continue
+		}
+		inPrimary, err := s.Primary.Exists(ctx, key)
+		if err != nil {
+			report.Failed[key] = err
+			continue
+		}
+		if !inPrimary {
+			report.Stray = append(report.Stray, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		report.Checked++
+
+		copied, recounted, err := s.repairKey(ctx, key)
+		report.Copied += copied
+		report.Recounted += recounted
+		switch {
+		case errors.Is(err, ErrObjectNotFound):
+			report.Missing = append(report.Missing, key)
+		case err != nil:
+			report.Failed[key] = err
+		}
+	}
+	return report
+}
+
+// repairKey copies the blob under key to the providers missing it, then
+// gives every copy the reference count of the source. It returns how many
+// copies it made and how many counts it corrected.
+func (s *MirrorStorage) repairKey(ctx context.Context, key string) (int, int, error) {
+	var source StorageProvider
+	var holders, lagging []StorageProvider
+	for _, provider := range s.providers() {
+		exists, err := provider.Exists(ctx, key)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !exists {
+			lagging = append(lagging, provider)
+			continue
+		}
+		if source == nil {
+			source = provider
+		} else {
+			holders = append(holders, provider)
+		}
+	}
+	if source == nil {
+		return 0, 0, ErrObjectNotFound
+	}
+
+	copied := 0
+	for _, target := range lagging {
+		if err := copyObject(ctx, source, target, key); err != nil {
+			return copied, 0, err
+		}
+		copied++
+	}
+
+	counter, ok := source.(ReferenceCounter)
+	if !ok {
+		return copied, 0, nil
+	}
+	refs, err := counter.References(ctx, key)
+	if err != nil || refs == 0 {
+		return copied, 0, err
+	}
+	recounted := 0
+	for _, target := range append(holders, lagging...) {
+		targetCounter, ok := target.(ReferenceCounter)
+		if !ok {
+			continue
+		}
+		current, err := targetCounter.References(ctx, key)
+		if err != nil {
+			return copied, recounted, err
+		}
+		if current == refs {
+			continue
+		}
+		if err := targetCounter.SetReferences(ctx, key, refs); err != nil {
+			return copied, recounted, err
+		}
+		recounted++
+	}
+	return copied, recounted, nil
+}
+
+func (s *MirrorStorage) providers() []StorageProvider {
+	return append([]StorageProvider{s.Primary}, s.Replicas...)
+}
+
+// enqueue hands job to the async worker. It reports false when the mirror
+// is synchronous or the queue is full, in which case the caller replicates
+// inline.
+func (s *MirrorStorage) enqueue(job mirrorJob) bool {
+	if !s.Async {
+		return false
+	}
+	s.pending.Add(1)
+	select {
+	case s.queue <- job:
+		return true
+	default:
+		s.pending.Done()
+		return false
+	}
+}
+
+func (s *MirrorStorage) worker() {
+	for job := range s.queue {
+		s.replicate(context.Background(), job)
+		s.pending.Done()
+	}
+}
+
+// replicate applies an upload or release to every replica. Failures are not
+// returned to the client, whose write already reached the primary; they are
+// left for Repair.
+func (s *MirrorStorage) replicate(ctx context.Context, job mirrorJob) {
+	if job.path != "" {
+		defer os.Remove(job.path)
+	}
+
+	for i, replica := range s.Replicas {
+		var err error
+		if job.release {
+			err = replica.Release(ctx, job.key)
+			if errors.Is(err, ErrObjectNotFound) {
+				err = nil
+			}
+		} else {
+			var object *Object
+			object, err = s.uploadFrom(ctx, replica, job.path, job.key)
+			if err == nil && object.Key != job.key {
+				err = fmt.Errorf("replica stored %s as %s", job.key, object.Key)
+			}
+		}
+		if err != nil {
+			log.Printf("mirror storage: failed to replicate %s to replica %d: %v", job.key, i, err)
+		}
+	}
+}
+
+func (s *MirrorStorage) uploadFrom(ctx context.Context, provider StorageProvider, path string, filename string) (*Object, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return provider.UploadFile(ctx, f, filename)
+}
+
+// copyObject streams the blob under key from source into target, where it
+// has a single reference.
+func copyObject(ctx context.Context, source StorageProvider, target StorageProvider, key string) error {
+	reader, err := source.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	object, err := target.UploadFile(ctx, reader, key)
+	if err != nil {
+		return err
+	}
+	if object.Key != key {
+		target.Release(ctx, object.Key)
+		return fmt.Errorf("copy of %s was stored as %s", key, object.Key)
+	}
+	return nil
+}
+
+// firstAvailable returns the result of the first provider op succeeds on,
+// falling back to the next provider whenever one fails.
+func firstAvailable[T any](providers []StorageProvider, op func(StorageProvider) (T, error)) (T, error) {
+	var result T
+	var firstErr error
+	for i, provider := range providers {
+		value, err := op(provider)
+		if err == nil {
+			return value, nil
+		}
+		if i == 0 && !errors.Is(err, ErrObjectNotFound) {
+			log.Printf("mirror storage: primary failed, falling back to replicas: %v", err)
+		}
+		if firstErr == nil || errors.Is(firstErr, ErrObjectNotFound) {
+			firstErr = err
+		}
+	}
+	return result, firstErr
+}
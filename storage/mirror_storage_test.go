@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyProvider fails uploads while Down is set.
+type flakyProvider struct {
+	StorageProvider
+	Down bool
+}
+
+func (p *flakyProvider) UploadFile(ctx context.Context, file io.Reader, filename string) (*Object, error) {
+	if p.Down {
+		return nil, errors.New("replica unavailable")
+	}
+	return p.StorageProvider.UploadFile(ctx, file, filename)
+}
+
+func (p *flakyProvider) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	return ListObjects(ctx, p.StorageProvider, fn)
+}
+
+func (p *flakyProvider) References(ctx context.Context, key string) (int, error) {
+	return p.StorageProvider.(ReferenceCounter).References(ctx, key)
+}
+
+func (p *flakyProvider) SetReferences(ctx context.Context, key string, refs int) error {
+	return p.StorageProvider.(ReferenceCounter).SetReferences(ctx, key, refs)
+}
+
+func newTestMirrorStorage(t *testing.T, async bool) (*MirrorStorage, *LocalStorage, *flakyProvider) {
+	t.Helper()
+
+	primary := newTestLocalStorage(t)
+	replica := &flakyProvider{StorageProvider: newTestLocalStorage(t)}
+	s := NewMirrorStorage(primary, []StorageProvider{replica}, MirrorConfig{Async: async, TempDir: t.TempDir()})
+	return s, primary, replica
+}
+
+func TestMirrorStorage_Lifecycle(t *testing.T) {
+	s, _, _ := newTestMirrorStorage(t, false)
+	testProviderLifecycle(t, s)
+}
+
+func TestMirrorStorage_ReadsFallBackToReplica(t *testing.T) {
+	s, primary, replica := newTestMirrorStorage(t, false)
+	ctx := context.Background()
+
+	object, err := s.UploadFile(ctx, strings.NewReader("mirrored content"), "notes.txt")
+	require.NoError(t, err)
+	inReplica, err := replica.Exists(ctx, object.Key)
+	require.NoError(t, err)
+	assert.True(t, inReplica)
+
+	require.NoError(t, primary.Delete(ctx, object.Key))
+
+	reader, err := s.Open(ctx, object.Key)
+	require.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "mirrored content", string(content))
+
+	exists, err := s.Exists(ctx, object.Key)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	_, err = s.SignedURL(ctx, object.Key, time.Minute)
+	assert.NoError(t, err)
+}
+
+func TestMirrorStorage_AsyncReplication(t *testing.T) {
+	s, _, replica := newTestMirrorStorage(t, true)
+	ctx := context.Background()
+
+	object, err := s.UploadFile(ctx, strings.NewReader("async content"), "notes.txt")
+	require.NoError(t, err)
+	s.Flush()
+
+	inReplica, err := replica.Exists(ctx, object.Key)
+	require.NoError(t, err)
+	assert.True(t, inReplica)
+
+	require.NoError(t, s.Release(ctx, object.Key))
+	s.Flush()
+
+	inReplica, err = replica.Exists(ctx, object.Key)
+	require.NoError(t, err)
+	assert.False(t, inReplica)
+}
+
+func TestMirrorStorage_Repair(t *testing.T) {
+	s, primary, replica := newTestMirrorStorage(t, false)
+	ctx := context.Background()
+
+	// Repair finds the blob written while the replica was down by listing,
+	// without being told about it, and copies its reference count.
+	replica.Down = true
+	lagging, err := s.UploadFile(ctx, strings.NewReader("written while replica was down"), "notes.txt")
+	require.NoError(t, err)
+	_, err = s.UploadFile(ctx, strings.NewReader("written while replica was down"), "copy.txt")
+	require.NoError(t, err)
+	replica.Down = false
+	keys, err := s.Lagging(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{lagging.Key}, keys)
+
+	onlyReplica, err := replica.UploadFile(ctx, strings.NewReader("lost from primary"), "notes.txt")
+	require.NoError(t, err)
+	stray, err := replica.UploadFile(ctx, strings.NewReader("released from primary only"), "notes.txt")
+	require.NoError(t, err)
+
+	report := s.Repair(ctx, []string{onlyReplica.Key, "missing.txt"})
+	assert.Equal(t, 3, report.Checked)
+	assert.Equal(t, 2, report.Copied)
+	assert.Equal(t, 1, report.Recounted)
+	assert.Equal(t, []string{"missing.txt"}, report.Missing)
+	assert.Equal(t, []string{stray.Key}, report.Stray)
+	assert.Empty(t, report.Failed)
+	keys, err = s.Lagging(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{stray.Key}, keys)
+
+	refs, err := replica.References(ctx, lagging.Key)
+	require.NoError(t, err)
+	assert.Equal(t, 2, refs)
+	inPrimary, _ := primary.Exists(ctx, onlyReplica.Key)
+	assert.True(t, inPrimary)
+}
+
+func TestMirrorStorage_RepairCopiesReferenceCounts(t *testing.T) {
+	s, _, replica := newTestMirrorStorage(t, false)
+	ctx := context.Background()
+
+	// The second upload of the same bytes only adds a reference, which the
+	// replica misses while it is down.
+	object, err := s.UploadFile(ctx, strings.NewReader("shared content"), "a.txt")
+	require.NoError(t, err)
+	replica.Down = true
+	_, err = s.UploadFile(ctx, strings.NewReader("shared content"), "b.txt")
+	require.NoError(t, err)
+	replica.Down = false
+
+	report := s.Repair(ctx, []string{object.Key})
+	assert.Equal(t, 0, report.Copied)
+	assert.Equal(t, 1, report.Recounted)
+
+	// Releasing one of the two media keeps the replica copy.
+	require.NoError(t, s.Release(ctx, object.Key))
+	inReplica, err := replica.Exists(ctx, object.Key)
+	require.NoError(t, err)
+	assert.True(t, inReplica)
+}
+
+func TestNewStorage_Mirror(t *testing.T) {
+	raw, err := json.Marshal(MirrorConfig{Primary: localInstance(t), Replicas: []InstanceConfig{localInstance(t)}})
+	require.NoError(t, err)
+
+	provider, err := NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": {Type: "mirror", Config: raw}},
+	})
+	require.NoError(t, err)
+	mirror := InstanceNamed(provider, "media")
+	require.IsType(t, &MirrorStorage{}, mirror)
+	assert.Len(t, mirror.(*MirrorStorage).Replicas, 1)
+
+	_, err = NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": {Type: "mirror", Config: json.RawMessage(`{}`)}},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type registration struct {
+	fromJSON func(raw json.RawMessage) (StorageProvider, error)
+	fromEnv  func() (StorageProvider, error)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]registration)
+)
+
+// Register makes a provider available under name. The constructor receives
+// the provider's own typed config, decoded either from the "config" object of
+// a storage config file or, for single-instance setups, from fromEnv.
+// Providers call Register from an init function.
+func Register[C any](name string, constructor func(C) (StorageProvider, error), fromEnv func() (C, error)) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("storage: provider %q registered twice", name))
+	}
+	registry[name] = registration{
+		fromJSON: func(raw json.RawMessage) (StorageProvider, error) {
+			var cfg C
+			if len(raw) > 0 {
+				decoder := json.NewDecoder(bytes.NewReader(raw))
+				decoder.DisallowUnknownFields()
+				if err := decoder.Decode(&cfg); err != nil {
+					return nil, fmt.Errorf("invalid %s config: %w", name, err)
+				}
+			}
+			return constructor(cfg)
+		},
+		fromEnv: func() (StorageProvider, error) {
+			cfg, err := fromEnv()
+			if err != nil {
+				return nil, err
+			}
+			return constructor(cfg)
+		},
+	}
+}
+
+// Providers returns the names of all registered providers.
+func Providers() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	return providersLocked()
+}
+
+func lookupProvider(providerType string) (registration, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	reg, ok := registry[providerType]
+	if !ok {
+		return registration{}, fmt.Errorf("unknown storage type %q (available: %s)", providerType, strings.Join(providersLocked(), ", "))
+	}
+	return reg, nil
+}
+
+func providersLocked() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,562 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"media-indexer/utils"
+)
+
+// ErrUnavailable is returned when a backend keeps failing: its circuit is
+// open, or an operation failed on every attempt.
+var ErrUnavailable = errors.New("storage backend unavailable")
+
+const (
+	defaultStorageTimeout   = 10 * time.Second
+	defaultUploadTimeout    = 5 * time.Minute
+	defaultMaxAttempts      = 3
+	defaultInitialBackoff   = 100 * time.Millisecond
+	defaultMaxBackoff       = 2 * time.Second
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = 30 * time.Second
+)
+
+// Operations as named in ResilientConfig.Timeouts.
+const (
+	opUpload    = "upload"
+	opRelease   = "release"
+	opOpen      = "open"
+	opStat      = "stat"
+	opDelete    = "delete"
+	opExists    = "exists"
+	opSignedURL = "signedUrl"
+	opList      = "list"
+	opReplace   = "replace"
+	opRefs      = "references"
+)
+
+type ResilientConfig struct {
+	// Inner is the provider whose calls are guarded. Without a "config" it
+	// is configured from its environment variables.
+	Inner InstanceConfig `json:"inner"`
+	// Timeout bounds every attempt of an operation, except uploads, which
+	// get five minutes, and listing, which is not bounded.
+	Timeout Duration `json:"timeout"`
+	// Timeouts overrides Timeout per operation: "upload", "replace",
+	// "release", "open", "stat", "delete", "exists", "signedUrl", "list" or
+	// "references".
+	// A zero timeout does not bound the operation.
+	Timeouts map[string]Duration `json:"timeouts"`
+	// MaxAttempts is how often an operation failing with a network error, a
+	// timeout or a 408, 429 or 5xx answer is tried before giving up. Uploads
+	// and releases are tried once.
+	MaxAttempts int `json:"maxAttempts"`
+	// The wait before a retry doubles from InitialBackoff up to MaxBackoff,
+	// with random jitter.
+	InitialBackoff Duration `json:"initialBackoff"`
+	MaxBackoff     Duration `json:"maxBackoff"`
+	// FailureThreshold consecutive failed operations open the circuit, after
+	// which calls fail fast with ErrUnavailable for OpenTimeout. Then a
+	// single call is let through to probe the backend.
+	FailureThreshold int      `json:"failureThreshold"`
+	OpenTimeout      Duration `json:"openTimeout"`
+	// TempDir holds uploads so they can be sent again on a retry.
+	TempDir string `json:"tempDir"`
+}
+
+func init() {
+	Register("resilient", func(cfg ResilientConfig) (StorageProvider, error) {
+		if cfg.Inner.Type == "" {
+			return nil, errors.New("resilient storage: inner storage is required")
+		}
+
+		var inner StorageProvider
+		var err error
+		if len(cfg.Inner.Config) == 0 {
+			inner, err = newInstanceFromEnv(cfg.Inner.Type)
+		} else {
+			inner, err = NewInstance(cfg.Inner)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("resilient storage inner: %w", err)
+		}
+		return NewResilientStorage(inner, cfg), nil
+	}, ResilientConfigFromEnv)
+}
+
+// ResilientStorage guards the calls to another provider with per-operation
+// timeouts, retries with exponential backoff and a circuit breaker, so a slow
+// or failing backend cannot hold requests indefinitely and is not hammered
+// while it is down.
+//
+// Uploads and Release are never retried: an attempt that reached the backend
+// before failing may already have added or dropped a reference, and the retry
+// would add or drop a second one. ReplaceFile overwrites the blob without
+// touching its references, so it is retried. List is not retried either, as
+// fn may already have seen part of the listing.
+type ResilientStorage struct {
+	Inner  StorageProvider
+	Config ResilientConfig
+
+	breaker *circuitBreaker
+}
+
+// CircuitState is the state of the circuit breaker of a ResilientStorage.
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// Health is what a HealthReporter tells health checks about its backend.
+type Health struct {
+	State     CircuitState `json:"state"`
+	Failures  int          `json:"failures"`
+	LastError string       `json:"lastError,omitempty"`
+	// RetryAt is when an open circuit lets the next call through.
+	RetryAt *time.Time `json:"retryAt,omitempty"`
+}
+
+// HealthReporter is implemented by providers that track the health of their
+// backend.
+type HealthReporter interface {
+	Health() Health
+}
+
+func NewResilientStorage(inner StorageProvider, cfg ResilientConfig) *ResilientStorage {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = Duration(defaultStorageTimeout)
+	}
+	timeouts := map[string]Duration{opUpload: Duration(defaultUploadTimeout), opReplace: Duration(defaultUploadTimeout), opList: 0}
+	for op, timeout := range cfg.Timeouts {
+		timeouts[op] = timeout
+	}
+	cfg.Timeouts = timeouts
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = Duration(defaultInitialBackoff)
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = Duration(defaultMaxBackoff)
+	}
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = defaultFailureThreshold
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = Duration(defaultOpenTimeout)
+	}
+	if cfg.TempDir == "" {
+		cfg.TempDir = os.TempDir()
+	}
+
+	return &ResilientStorage{
+		Inner:  inner,
+		Config: cfg,
+		breaker: &circuitBreaker{
+			threshold:   cfg.FailureThreshold,
+			openTimeout: time.Duration(cfg.OpenTimeout),
+			now:         time.Now,
+			state:       CircuitClosed,
+		},
+	}
+}
+
+// UploadFile spools file to disk when retries are enabled, so the upload
+// timeout starts once the file is spooled and does not depend on how fast the
+// client sends it. The upload itself is tried once, as it adds a reference.
+func (s *ResilientStorage) UploadFile(ctx context.Context, file io.Reader, filename string) (*Object, error) {
+	var object *Object
+	err := s.withReplayableFile(file, func(rewind func() (io.Reader, error)) error {
+		return s.do(ctx, opUpload, false, func(ctx context.Context) error {
+			file, err := rewind()
+			if err != nil {
+				return err
+			}
+			object, err = s.Inner.UploadFile(ctx, file, filename)
+			return err
+		})
+	})
+	return object, err
+}
+
+func (s *ResilientStorage) UploadFileAs(ctx context.Context, key string, file io.Reader, contentType string) (*Object, error) {
+	writer, ok := s.Inner.(KeyedWriter)
+	if !ok {
+		return nil, fmt.Errorf("resilient storage: %T cannot store objects under a chosen key", s.Inner)
+	}
+
+	var object *Object
+	err := s.withReplayableFile(file, func(rewind func() (io.Reader, error)) error {
+		return s.do(ctx, opUpload, false, func(ctx context.Context) error {
+			file, err := rewind()
+			if err != nil {
+				return err
+			}
+			object, err = writer.UploadFileAs(ctx, key, file, contentType)
+			return err
+		})
+	})
+	return object, err
+}
+
+func (s *ResilientStorage) ReplaceFile(ctx context.Context, key string, file io.Reader, contentType string) error {
+	writer, ok := s.Inner.(KeyedWriter)
+	if !ok {
+		return fmt.Errorf("resilient storage: %T cannot store objects under a chosen key", s.Inner)
+	}
+
+	return s.withReplayableFile(file, func(rewind func() (io.Reader, error)) error {
+		return s.do(ctx, opReplace, true, func(ctx context.Context) error {
+			file, err := rewind()
+			if err != nil {
+				return err
+			}
+			return writer.ReplaceFile(ctx, key, file, contentType)
+		})
+	})
+}
+
+func (s *ResilientStorage) References(ctx context.Context, key string) (int, error) {
+	counter, ok := s.Inner.(ReferenceCounter)
+	if !ok {
+		return 0, fmt.Errorf("resilient storage: %T does not count references", s.Inner)
+	}
+
+	var refs int
+	err := s.do(ctx, opRefs, true, func(ctx context.Context) error {
+		var err error
+		refs, err = counter.References(ctx, key)
+		return err
+	})
+	return refs, err
+}
+
+// SetReferences sets the count rather than adding to it, so it is retried.
+func (s *ResilientStorage) SetReferences(ctx context.Context, key string, refs int) error {
+	counter, ok := s.Inner.(ReferenceCounter)
+	if !ok {
+		return fmt.Errorf("resilient storage: %T does not count references", s.Inner)
+	}
+
+	return s.do(ctx, opRefs, true, func(ctx context.Context) error {
+		return counter.SetReferences(ctx, key, refs)
+	})
+}
+
+func (s *ResilientStorage) Release(ctx context.Context, key string) error {
+	return s.do(ctx, opRelease, false, func(ctx context.Context) error {
+		return s.Inner.Release(ctx, key)
+	})
+}
+
+// Open bounds the time until the reader is returned. Reading from it is not
+// bounded, so large blobs can be streamed.
+func (s *ResilientStorage) Open(ctx context.Context, key string) (ObjectReader, error) {
+	var reader ObjectReader
+	err := s.do(ctx, opOpen, true, func(attemptCtx context.Context) error {
+		readerCtx, cancel := context.WithCancel(ctx)
+		stop := context.AfterFunc(attemptCtx, cancel)
+		opened, err := s.Inner.Open(readerCtx, key)
+		if !stop() {
+			if err == nil {
+				opened.Close()
+			}
+			cancel()
+			return attemptCtx.Err()
+		}
+		if err != nil {
+			cancel()
+			return err
+		}
+		reader = &cancelOnClose{ObjectReader: opened, cancel: cancel}
+		return nil
+	})
+	return reader, err
+}
+
+func (s *ResilientStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	var info *ObjectInfo
+	err := s.do(ctx, opStat, true, func(ctx context.Context) error {
+		var err error
+		info, err = s.Inner.Stat(ctx, key)
+		return err
+	})
+	return info, err
+}
+
+func (s *ResilientStorage) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	return s.do(ctx, opList, false, func(ctx context.Context) error {
+		return ListObjects(ctx, s.Inner, fn)
+	})
+}
+
+func (s *ResilientStorage) Delete(ctx context.Context, key string) error {
+	return s.do(ctx, opDelete, true, func(ctx context.Context) error {
+		return s.Inner.Delete(ctx, key)
+	})
+}
+
+func (s *ResilientStorage) Exists(ctx context.Context, key string) (bool, error) {
+	var exists bool
+	err := s.do(ctx, opExists, true, func(ctx context.Context) error {
+		var err error
+		exists, err = s.Inner.Exists(ctx, key)
+		return err
+	})
+	return exists, err
+}
+
+func (s *ResilientStorage) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	var signed string
+	err := s.do(ctx, opSignedURL, true, func(ctx context.Context) error {
+		var err error
+		signed, err = s.Inner.SignedURL(ctx, key, expiry)
+		return err
+	})
+	return signed, err
+}
+
+// VerifySignedURL checks URLs signed by the inner provider. Verification does
+// not call the backend, so it is not guarded.
+func (s *ResilientStorage) VerifySignedURL(key string, query url.Values) error {
+	verifier, ok := s.Inner.(URLVerifier)
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return verifier.VerifySignedURL(key, query)
+}
+
+func (s *ResilientStorage) Health() Health {
+	return s.breaker.health()
+}
+
+// InstanceHealth reports the health of every instance of a Router that tracks
+// it, or of provider itself under the name "default".
+func InstanceHealth(provider StorageProvider) map[string]Health {
+	instances := map[string]StorageProvider{"default": provider}
+	if router, ok := provider.(*Router); ok {
+		instances = router.Instances
+	}
+
+	health := make(map[string]Health)
+	for name, instance := range instances {
+		if reporter, ok := instance.(HealthReporter); ok {
+			health[name] = reporter.Health()
+		}
+	}
+	return health
+}
+
+// do runs fn through the circuit breaker, bounding every attempt by the
+// timeout of op and, when retry is set, trying again after a backoff while it
+// fails with a retryable error.
+func (s *ResilientStorage) do(ctx context.Context, op string, retry bool, fn func(ctx context.Context) error) error {
+	if err := s.breaker.allow(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	attempts := 1
+	if retry {
+		attempts = s.Config.MaxAttempts
+	}
+	var err error
+	attempt := 0
+	for {
+		err = s.attempt(ctx, op, fn)
+		attempt++
+		if err == nil || !retryable(err) || ctx.Err() != nil || attempt >= attempts {
+			break
+		}
+		if sleepErr := utils.Sleep(ctx, s.backoff(attempt)); sleepErr != nil {
+			break
+		}
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		// The caller gave up; that says nothing about the backend.
+		s.breaker.abandon()
+	case err != nil && retryable(err):
+		s.breaker.failure(err)
+		return fmt.Errorf("%w: %s failed after %d attempts: %w", ErrUnavailable, op, attempt, err)
+	default:
+		s.breaker.success()
+	}
+	return err
+}
+
+func (s *ResilientStorage) attempt(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	timeout, ok := s.Config.Timeouts[op]
+	if !ok {
+		timeout = s.Config.Timeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout))
+		defer cancel()
+	}
+	return fn(ctx)
+}
+
+// backoff returns the wait before retry number attempt: the initial backoff
+// doubled per attempt, capped, of which a random half is waited.
+func (s *ResilientStorage) backoff(attempt int) time.Duration {
+	wait := time.Duration(s.Config.InitialBackoff) << (attempt - 1)
+	if wait <= 0 || wait > time.Duration(s.Config.MaxBackoff) {
+		wait = time.Duration(s.Config.MaxBackoff)
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// withReplayableFile calls fn with a function returning file from its start,
+// so every attempt can send all of it. With retries enabled, file is spooled
+// to disk first; without, it is passed through as is.
+func (s *ResilientStorage) withReplayableFile(file io.Reader, fn func(rewind func() (io.Reader, error)) error) error {
+	if s.Config.MaxAttempts <= 1 {
+		return fn(func() (io.Reader, error) { return file, nil })
+	}
+
+	spool, err := os.CreateTemp(s.Config.TempDir, "resilient-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if _, err := io.Copy(spool, file); err != nil {
+		return err
+	}
+	return fn(func() (io.Reader, error) {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return spool, nil
+	})
+}
+
+// cancelOnClose releases the context of an opened reader once it is closed.
+type cancelOnClose struct {
+	ObjectReader
+	cancel context.CancelFunc
+}
+
+func (r *cancelOnClose) Close() error {
+	err := r.ObjectReader.Close()
+	r.cancel()
+	return err
+}
+
+// retryable reports whether an operation failing with err may succeed when
+// tried again: the backend answered 408, 429 or 5xx, the attempt timed out, or
+// the network failed.
+func retryable(err error) bool {
+	var status interface{ Retryable() bool }
+	if errors.As(err, &status) {
+		return status.Retryable()
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryableStatus reports whether a request answered with status may succeed
+// when sent again.
+func retryableStatus(status int) bool {
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+// circuitBreaker opens after threshold consecutive failures and fails calls
+// fast until openTimeout has passed. It then lets a single probe through,
+// which closes the circuit again on success and reopens it on failure.
+type circuitBreaker struct {
+	threshold   int
+	openTimeout time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	lastErr  error
+}
+
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		retryAt := b.openedAt.Add(b.openTimeout)
+		if b.now().Before(retryAt) {
+			return fmt.Errorf("%w: circuit open until %s", ErrUnavailable, retryAt.Format(time.RFC3339))
+		}
+		b.state = CircuitHalfOpen
+		return nil
+	case CircuitHalfOpen:
+		return fmt.Errorf("%w: circuit half-open, waiting for a probe", ErrUnavailable)
+	}
+	return nil
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = CircuitClosed
+	b.failures = 0
+	b.lastErr = nil
+}
+
+func (b *circuitBreaker) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.lastErr = err
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		b.state = CircuitOpen
+		b.openedAt = b.now()
+	}
+}
+
+// abandon is called when a call ended without telling whether the backend is
+// healthy. A probe that was abandoned lets the next call probe instead.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CircuitHalfOpen {
+		b.state = CircuitOpen
+		b.openedAt = b.now().Add(-b.openTimeout)
+	}
+}
+
+func (b *circuitBreaker) health() Health {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	health := Health{State: b.state, Failures: b.failures}
+	if b.lastErr != nil {
+		health.LastError = b.lastErr.Error()
+	}
+	if b.state == CircuitOpen {
+		retryAt := b.openedAt.Add(b.openTimeout)
+		health.RetryAt = &retryAt
+	}
+	return health
+}
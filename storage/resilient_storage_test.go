@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unreliableProvider fails the next Failures calls with Err, and blocks every
+// call for Delay or until its context is done.
+type unreliableProvider struct {
+	StorageProvider
+	Err   error
+	Delay time.Duration
+
+	mu       sync.Mutex
+	Failures int
+	Calls    int
+}
+
+func (p *unreliableProvider) call(ctx context.Context) error {
+	p.mu.Lock()
+	p.Calls++
+	fail := p.Failures > 0
+	if fail {
+		p.Failures--
+	}
+	p.mu.Unlock()
+
+	if p.Delay > 0 {
+		select {
+		case <-time.After(p.Delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fail {
+		return p.Err
+	}
+	return nil
+}
+
+func (p *unreliableProvider) UploadFile(ctx context.Context, file io.Reader, filename string) (*Object, error) {
+	if err := p.call(ctx); err != nil {
+		io.Copy(io.Discard, io.LimitReader(file, 4))
+		return nil, err
+	}
+	return p.StorageProvider.UploadFile(ctx, file, filename)
+}
+
+func (p *unreliableProvider) Release(ctx context.Context, key string) error {
+	if err := p.call(ctx); err != nil {
+		return err
+	}
+	return p.StorageProvider.Release(ctx, key)
+}
+
+func (p *unreliableProvider) Open(ctx context.Context, key string) (ObjectReader, error) {
+	if err := p.call(ctx); err != nil {
+		return nil, err
+	}
+	return p.StorageProvider.Open(ctx, key)
+}
+
+func (p *unreliableProvider) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	if err := p.call(ctx); err != nil {
+		return nil, err
+	}
+	return p.StorageProvider.Stat(ctx, key)
+}
+
+func (p *unreliableProvider) CallCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Calls
+}
+
+func newTestResilientStorage(t *testing.T, inner StorageProvider) *ResilientStorage {
+	t.Helper()
+
+	return NewResilientStorage(inner, ResilientConfig{
+		Timeout:          Duration(50 * time.Millisecond),
+		InitialBackoff:   Duration(time.Millisecond),
+		MaxBackoff:       Duration(5 * time.Millisecond),
+		FailureThreshold: 2,
+		OpenTimeout:      Duration(time.Minute),
+		TempDir:          t.TempDir(),
+	})
+}
+
+func TestResilientStorageLifecycle(t *testing.T) {
+	testProviderLifecycle(t, newTestResilientStorage(t, newTestLocalStorage(t)))
+}
+
+func TestResilientStorage_RetriesReads(t *testing.T) {
+	inner := &unreliableProvider{StorageProvider: newTestLocalStorage(t), Err: &s3Error{StatusCode: http.StatusServiceUnavailable}}
+	s := newTestResilientStorage(t, inner)
+	object, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "notes.txt")
+	require.NoError(t, err)
+
+	inner.Failures = 2
+	info, err := s.Stat(context.Background(), object.Key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("file content")), info.Size)
+	assert.Equal(t, 4, inner.CallCount())
+	assert.Equal(t, CircuitClosed, s.Health().State)
+}
+
+func TestResilientStorage_DoesNotRetryUploads(t *testing.T) {
+	// The upload may have added a reference before failing; a retry would
+	// add a second one that is never released.
+	inner := &unreliableProvider{StorageProvider: newTestLocalStorage(t), Err: &s3Error{StatusCode: http.StatusServiceUnavailable}, Failures: 1}
+	s := newTestResilientStorage(t, inner)
+
+	_, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "notes.txt")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, 1, inner.CallCount())
+}
+
+func TestResilientStorage_DoesNotRetryPermanentErrors(t *testing.T) {
+	inner := &unreliableProvider{StorageProvider: newTestLocalStorage(t), Err: &s3Error{StatusCode: http.StatusForbidden}, Failures: 3}
+	s := newTestResilientStorage(t, inner)
+
+	_, err := s.Stat(context.Background(), "missing.txt")
+	var s3Err *s3Error
+	assert.ErrorAs(t, err, &s3Err)
+	assert.NotErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, 1, inner.CallCount())
+
+	inner.Failures = 0
+	_, err = s.Stat(context.Background(), "missing.txt")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	assert.Equal(t, 2, inner.CallCount())
+	assert.Equal(t, CircuitClosed, s.Health().State)
+}
+
+func TestResilientStorage_DoesNotRetryRelease(t *testing.T) {
+	inner := &unreliableProvider{StorageProvider: newTestLocalStorage(t), Err: &s3Error{StatusCode: http.StatusInternalServerError}, Failures: 1}
+	s := newTestResilientStorage(t, inner)
+
+	err := s.Release(context.Background(), "abc.txt")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, 1, inner.CallCount())
+}
+
+func TestResilientStorage_TimesOutSlowBackend(t *testing.T) {
+	inner := &unreliableProvider{StorageProvider: newTestLocalStorage(t), Delay: time.Hour}
+	s := newTestResilientStorage(t, inner)
+
+	start := time.Now()
+	_, err := s.Stat(context.Background(), "abc.txt")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 3, inner.CallCount())
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestResilientStorage_OpenReaderOutlivesTimeout(t *testing.T) {
+	s := newTestResilientStorage(t, newTestLocalStorage(t))
+	object, err := s.UploadFile(context.Background(), strings.NewReader("file content"), "notes.txt")
+	require.NoError(t, err)
+
+	reader, err := s.Open(context.Background(), object.Key)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	time.Sleep(2 * time.Duration(s.Config.Timeout))
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "file content", string(content))
+}
+
+func TestResilientStorage_CircuitBreaker(t *testing.T) {
+	inner := &unreliableProvider{StorageProvider: newTestLocalStorage(t), Err: &s3Error{StatusCode: http.StatusBadGateway}, Failures: 6}
+	s := newTestResilientStorage(t, inner)
+	now := time.Now()
+	s.breaker.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := s.Stat(ctx, "abc.txt")
+		assert.ErrorIs(t, err, ErrUnavailable)
+	}
+	assert.Equal(t, 6, inner.CallCount())
+
+	health := s.Health()
+	assert.Equal(t, CircuitOpen, health.State)
+	assert.Equal(t, 2, health.Failures)
+	assert.Contains(t, health.LastError, "502")
+	require.NotNil(t, health.RetryAt)
+	assert.Equal(t, now.Add(time.Minute), *health.RetryAt)
+
+	// Calls fail fast without reaching the backend while the circuit is open.
+	_, err := s.Stat(ctx, "abc.txt")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, 6, inner.CallCount())
+
+	// After the open timeout a probe is let through and closes the circuit.
+	now = now.Add(time.Minute)
+	_, err = s.Stat(ctx, "abc.txt")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	assert.Equal(t, 7, inner.CallCount())
+	assert.Equal(t, Health{State: CircuitClosed}, s.Health())
+}
+
+func TestResilientStorage_FailedProbeReopensCircuit(t *testing.T) {
+	inner := &unreliableProvider{StorageProvider: newTestLocalStorage(t), Err: errors.New("boom"), Delay: time.Hour}
+	s := newTestResilientStorage(t, inner)
+	now := time.Now()
+	s.breaker.now = func() time.Time { return now }
+	s.breaker.state = CircuitOpen
+	s.breaker.openedAt = now.Add(-time.Minute)
+
+	_, err := s.Stat(context.Background(), "abc.txt")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, 3, inner.CallCount())
+	assert.Equal(t, CircuitOpen, s.Health().State)
+	assert.Equal(t, now.Add(time.Minute), *s.Health().RetryAt)
+}
+
+func TestInstanceHealth(t *testing.T) {
+	guarded := newTestResilientStorage(t, newTestLocalStorage(t))
+	router := NewRouter(map[string]StorageProvider{"media": guarded, "archive": newTestLocalStorage(t)}, "media", nil)
+
+	assert.Equal(t, map[string]Health{"media": {State: CircuitClosed}}, InstanceHealth(router))
+	assert.Equal(t, map[string]Health{"default": {State: CircuitClosed}}, InstanceHealth(guarded))
+}
+
+func TestNewStorage_Resilient(t *testing.T) {
+	local, err := json.Marshal(LocalConfig{RootDir: t.TempDir(), SigningKey: "test"})
+	require.NoError(t, err)
+	raw, err := json.Marshal(map[string]interface{}{
+		"inner":    InstanceConfig{Type: "local", Config: local},
+		"timeout":  "2s",
+		"timeouts": map[string]string{"upload": "1m"},
+	})
+	require.NoError(t, err)
+
+	provider, err := NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": {Type: "resilient", Config: raw}},
+	})
+	require.NoError(t, err)
+
+	instance := InstanceNamed(provider, "media")
+	require.IsType(t, &ResilientStorage{}, instance)
+	cfg := instance.(*ResilientStorage).Config
+	assert.Equal(t, Duration(2*time.Second), cfg.Timeout)
+	assert.Equal(t, Duration(time.Minute), cfg.Timeouts["upload"])
+	assert.Equal(t, defaultMaxAttempts, cfg.MaxAttempts)
+
+	_, err = NewStorage(&Config{
+		Default:   "media",
+		Instances: map[string]InstanceConfig{"media": {Type: "resilient", Config: json.RawMessage(`{"inner": {"type": "local"}, "timeout": 5}`)}},
+	})
+	assert.ErrorContains(t, err, "duration must be a string")
+}
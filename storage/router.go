@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Router is a StorageProvider spreading blobs over several named instances.
+// Uploads go to the instance of the first route matching their sniffed
+// content type, or to the default instance. Operations on an existing key
+// look the blob up in the instance its extension routes to first and then
+// in the others.
+type Router struct {
+	Instances map[string]StorageProvider
+	Default   string
+	Routes    []RouteConfig
+
+	names []string
+}
+
+func NewRouter(instances map[string]StorageProvider, defaultInstance string, routes []RouteConfig) *Router {
+	names := make([]string, 0, len(instances))
+	for name := range instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return &Router{Instances: instances, Default: defaultInstance, Routes: routes, names: names}
+}
+
+func (r *Router) UploadFile(ctx context.Context, file io.Reader, filename string) (*Object, error) {
+	contentType, file, err := SniffContentType(file)
+	if err != nil {
+		return nil, err
+	}
+
+	name := r.route(contentType)
+	object, err := r.Instances[name].UploadFile(ctx, file, filename)
+	if err != nil {
+		return nil, err
+	}
+	object.Provider = name
+	return object, nil
+}
+
+func (r *Router) Release(ctx context.Context, key string) error {
+	provider, err := r.locate(ctx, key)
+	if err != nil {
+		return err
+	}
+	return provider.Release(ctx, key)
+}
+
+func (r *Router) Open(ctx context.Context, key string) (ObjectReader, error) {
+	provider, err := r.locate(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Open(ctx, key)
+}
+
+func (r *Router) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	provider, err := r.locate(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Stat(ctx, key)
+}
+
+// List enumerates the blobs of every instance.
+func (r *Router) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	for _, name := range r.names {
+		if err := ListObjects(ctx, r.Instances[name], fn); err != nil {
+			return fmt.Errorf("storage instance %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (r *Router) Delete(ctx context.Context, key string) error {
+	provider, err := r.locate(ctx, key)
+	if err != nil {
+		return err
+	}
+	return provider.Delete(ctx, key)
+}
+
+func (r *Router) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := r.locate(ctx, key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *Router) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	provider, err := r.locate(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return provider.SignedURL(ctx, key, expiry)
+}
+
+// VerifySignedURL accepts URLs signed by any instance. It checks the
+// signature only, so forged URLs never reach the instances' backends.
+func (r *Router) VerifySignedURL(key string, query url.Values) error {
+	for _, name := range r.names {
+		if verifier, ok := r.Instances[name].(URLVerifier); ok {
+			if err := verifier.VerifySignedURL(key, query); err == nil {
+				return nil
+			}
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// InstanceNamed returns the instance called name when provider is a Router
+// holding one, and provider itself otherwise. It lets callers that know where
+// a blob was stored skip the lookup across instances.
+func InstanceNamed(provider StorageProvider, name string) StorageProvider {
+	if router, ok := provider.(*Router); ok {
+		if instance, ok := router.Instances[name]; ok {
+			return instance
+		}
+	}
+	return provider
+}
+
+// InstanceFor returns the name of the instance uploads of contentType go to
+// when provider is a Router, and "" otherwise: the Provider of the objects
+// UploadFile will return for them.
+func InstanceFor(provider StorageProvider, contentType string) string {
+	if router, ok := provider.(*Router); ok {
+		return router.route(contentType)
+	}
+	return ""
+}
+
+// route returns the instance uploads of contentType are stored in.
+func (r *Router) route(contentType string) string {
+	for _, route := range r.Routes {
+		if MatchContentType(route.ContentType, contentType) {
+			return route.Instance
+		}
+	}
+	return r.Default
+}
+
+// locate finds the instance holding key.
+func (r *Router) locate(ctx context.Context, key string) (StorageProvider, error) {
+	candidates := []string{r.Default}
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		candidates = []string{r.route(contentType), r.Default}
+	}
+	candidates = append(candidates, r.names...)
+
+	tried := make(map[string]bool, len(r.Instances))
+	for _, name := range candidates {
+		if tried[name] {
+			continue
+		}
+		tried[name] = true
+
+		exists, err := r.Instances[name].Exists(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return r.Instances[name], nil
+		}
+	}
+	return nil, ErrObjectNotFound
+}
+
+// MatchContentType reports whether contentType matches pattern, which is
+// either a full MIME type or a wildcard such as "image/*" or "*/*".
+func MatchContentType(pattern string, contentType string) bool {
+	if pattern == "*/*" || pattern == contentType {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(pattern, "/*")
+	return ok && strings.HasPrefix(contentType, prefix+"/")
+}
@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Client is a minimal client for the subset of the S3 REST API the storage
+// layer needs. It works with AWS as well as S3-compatible stores such as MinIO.
+type s3Client struct {
+	Endpoint       *url.URL
+	Bucket         string
+	ForcePathStyle bool
+	Signer         *s3Signer
+	HTTPClient     *http.Client
+}
+
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Retryable reports whether the request may succeed when sent again.
+func (e *s3Error) Retryable() bool {
+	return retryableStatus(e.StatusCode)
+}
+
+func (e *s3Error) Unwrap() error {
+	if e.StatusCode == http.StatusNotFound {
+		return ErrObjectNotFound
+	}
+	return nil
+}
+
+type s3ListedObject struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// objectURL returns the URL of key using virtual-hosted or path-style
+// addressing depending on configuration.
+func (c *s3Client) objectURL(key string) *url.URL {
+	u := *c.Endpoint
+	if c.ForcePathStyle {
+		u.Path = strings.TrimRight(u.Path, "/") + "/" + c.Bucket + "/" + key
+	} else {
+		u.Host = c.Bucket + "." + u.Host
+		u.Path = strings.TrimRight(u.Path, "/") + "/" + key
+	}
+	return &u
+}
+
+func (c *s3Client) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := c.objectURL(key)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for name, vals := range header {
+		req.Header[name] = vals
+	}
+	c.Signer.Sign(req, payloadHash, time.Now())
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotModified {
+		defer resp.Body.Close()
+		s3Err := &s3Error{StatusCode: resp.StatusCode}
+		if data, _ := io.ReadAll(resp.Body); len(data) > 0 {
+			xml.Unmarshal(data, s3Err)
+		}
+		if s3Err.Code == "" {
+			s3Err.Code = http.StatusText(resp.StatusCode)
+		}
+		return nil, s3Err
+	}
+	return resp, nil
+}
+
+func (c *s3Client) putObject(ctx context.Context, key string, body io.Reader, size int64, payloadHash string, header http.Header) error {
+	resp, err := c.do(ctx, http.MethodPut, key, nil, header, body, size, payloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) getObject(ctx context.Context, key string, header http.Header) (*http.Response, error) {
+	return c.do(ctx, http.MethodGet, key, nil, header, nil, 0, s3EmptyPayload)
+}
+
+func (c *s3Client) headObject(ctx context.Context, key string) (*http.Response, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, nil, 0, s3EmptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func (c *s3Client) deleteObject(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil, 0, s3EmptyPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listObjects pages through every object of the bucket with ListObjectsV2.
+func (c *s3Client) listObjects(ctx context.Context, fn func(s3ListedObject) error) error {
+	query := url.Values{"list-type": {"2"}}
+	for {
+		resp, err := c.do(ctx, http.MethodGet, "", query, nil, nil, 0, s3EmptyPayload)
+		if err != nil {
+			return err
+		}
+
+		var result struct {
+			Contents              []s3ListedObject `xml:"Contents"`
+			IsTruncated           bool             `xml:"IsTruncated"`
+			NextContinuationToken string           `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Contents {
+			if err := fn(object); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (c *s3Client) createMultipartUpload(ctx context.Context, key string, header http.Header) (string, error) {
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, 0, s3EmptyPayload)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+func (c *s3Client) uploadPart(ctx context.Context, key string, uploadID string, partNumber int, body io.Reader, size int64) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+	resp, err := c.do(ctx, http.MethodPut, key, query, nil, body, size, s3UnsignedPayload)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (c *s3Client) completeMultipartUpload(ctx context.Context, key string, uploadID string, parts []s3CompletedPart) error {
+	payload, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, bytes.NewReader(payload), int64(len(payload)), sha256Hex(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 may report a failed completion with a 200 status and an error body.
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		s3Err := &s3Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(data, s3Err)
+		return s3Err
+	}
+	return nil
+}
+
+func (c *s3Client) abortMultipartUpload(ctx context.Context, key string, uploadID string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, 0, s3EmptyPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -1,20 +1,343 @@
 package storage
 
 import (
-	"crypto/sha256"
+	"context"
+	"errors"
 	"fmt"
-	"mime/multipart"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-type S3Storage struct{}
+const (
+	defaultS3PartSize = 16 << 20
+	minS3PartSize     = 5 << 20
+)
+
+type S3Config struct {
+	Bucket          string `json:"bucket"`
+	Region          string `json:"region"`
+	Endpoint        string `json:"endpoint"`
+	ForcePathStyle  bool   `json:"forcePathStyle"`
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken"`
+	// PublicBaseURL, when set, replaces the bucket URL in returned links,
+	// e.g. to serve objects through a CDN.
+	PublicBaseURL string `json:"publicBaseUrl"`
+	// Files larger than PartSize are sent with a multipart upload.
+	PartSize int64 `json:"partSize"`
+	// TempDir holds uploads while they are hashed, before they are sent.
+	TempDir string `json:"tempDir"`
+}
+
+func init() {
+	Register("s3", func(cfg S3Config) (StorageProvider, error) {
+		s, err := NewS3Storage(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}, S3ConfigFromEnv)
+}
+
+// S3Storage stores blobs in an S3 bucket, or any store speaking the S3 API.
+// Reference counts are kept in a "<key>.refs" object next to each blob.
+type S3Storage struct {
+	Config S3Config
+
+	client *s3Client
+	mu     sync.Mutex
+}
+
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 storage: bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = defaultS3PartSize
+	}
+	if cfg.PartSize < minS3PartSize {
+		return nil, fmt.Errorf("s3 storage: part size must be at least %d bytes", minS3PartSize)
+	}
+	if cfg.TempDir == "" {
+		cfg.TempDir = os.TempDir()
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 storage: invalid endpoint %q", cfg.Endpoint)
+	}
+
+	return &S3Storage{
+		Config: cfg,
+		client: &s3Client{
+			Endpoint:       endpoint,
+			Bucket:         cfg.Bucket,
+			ForcePathStyle: cfg.ForcePathStyle,
+			Signer: &s3Signer{
+				Region:          cfg.Region,
+				AccessKeyID:     cfg.AccessKeyID,
+				SecretAccessKey: cfg.SecretAccessKey,
+				SessionToken:    cfg.SessionToken,
+			},
+			HTTPClient: http.DefaultClient,
+		},
+	}, nil
+}
+
+func (s *S3Storage) UploadFile(ctx context.Context, file io.Reader, _filename string) (*Object, error) {
+	spooled, err := spoolFile(s.Config.TempDir, file)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spooled.Path)
+
+	return s.store(ctx, spooled.Key(), spooled)
+}
+
+func (s *S3Storage) UploadFileAs(ctx context.Context, key string, file io.Reader, contentType string) (*Object, error) {
+	spooled, err := spoolFile(s.Config.TempDir, file)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spooled.Path)
+
+	spooled.ContentType = contentType
+	return s.store(ctx, key, spooled)
+}
+
+func (s *S3Storage) ReplaceFile(ctx context.Context, key string, file io.Reader, contentType string) error {
+	spooled, err := spoolFile(s.Config.TempDir, file)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spooled.Path)
+	spooled.ContentType = contentType
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs(ctx, key)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		return ErrObjectNotFound
+	}
+	return s.putFile(ctx, key, spooled)
+}
+
+// store uploads a spooled file under key, unless the blob is already
+// stored, and adds a reference to it.
+func (s *S3Storage) store(ctx context.Context, key string, spooled *spooledFile) (*Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if refs == 0 {
+		if err := s.putFile(ctx, key, spooled); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.writeRefs(ctx, key, refs+1); err != nil {
+		return nil, err
+	}
+
+	return &Object{
+		Key:         key,
+		URL:         s.url(key),
+		ContentHash: spooled.ContentHash,
+		ContentType: spooled.ContentType,
+		Size:        spooled.Size,
+	}, nil
+}
+
+func (s *S3Storage) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs(ctx, key)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		return ErrObjectNotFound
+	}
+	if refs > 1 {
+		return s.writeRefs(ctx, key, refs-1)
+	}
+	return s.remove(ctx, key)
+}
 
-func NewS3Storage() *S3Storage {
-	return &S3Storage{}
+func (s *S3Storage) References(ctx context.Context, key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readRefs(ctx, key)
 }
 
-func (s *S3Storage) UploadFile(_fileHeader *multipart.FileHeader, filename string) (string, error) {
-	hash := sha256.Sum256([]byte(filename))
-	hashString := fmt.Sprintf("%x", hash)
+func (s *S3Storage) SetReferences(ctx context.Context, key string, refs int) error {
+	if refs <= 0 {
+		return fmt.Errorf("set references of %s: %d is not a positive count", key, refs)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.readRefs(ctx, key)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return ErrObjectNotFound
+	}
+	return s.writeRefs(ctx, key, refs)
+}
+
+// SignedURL returns a presigned GET URL for the object. Presigned URLs are
+// always issued against the bucket, not PublicBaseURL.
+func (s *S3Storage) SignedURL(_ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return s.client.Signer.Presign(http.MethodGet, s.client.objectURL(key), expiry, time.Now()).String(), nil
+}
+
+func (s *S3Storage) Open(ctx context.Context, key string) (ObjectReader, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	fetch := func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		resp, err := s.client.getObject(ctx, key, http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}})
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	return &rangeReader{ctx: ctx, size: info.Size, fetch: fetch}, nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	resp, err := s.client.headObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &ObjectInfo{
+		Key:          key,
+		Size:         resp.ContentLength,
+		ContentType:  resp.Header.Get("Content-Type"),
+		LastModified: lastModified,
+	}, nil
+}
+
+func (s *S3Storage) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	return s.client.listObjects(ctx, func(object s3ListedObject) error {
+		if strings.HasSuffix(object.Key, ".refs") {
+			return nil
+		}
+		return fn(ObjectInfo{Key: object.Key, Size: object.Size, LastModified: object.LastModified})
+	})
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remove(ctx, key)
+}
+
+func (s *S3Storage) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.headObject(ctx, key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// remove deletes a blob together with its reference count. The caller must
+// hold s.mu.
+func (s *S3Storage) remove(ctx context.Context, key string) error {
+	if err := s.client.deleteObject(ctx, key); err != nil {
+		return err
+	}
+	return s.client.deleteObject(ctx, key+".refs")
+}
+
+func (s *S3Storage) url(key string) string {
+	if s.Config.PublicBaseURL != "" {
+		return strings.TrimRight(s.Config.PublicBaseURL, "/") + "/" + key
+	}
+	return s.client.objectURL(key).String()
+}
+
+// putFile uploads a spooled file under key, switching to a multipart upload
+// when it does not fit into a single part.
+func (s *S3Storage) putFile(ctx context.Context, key string, spooled *spooledFile) error {
+	f, err := os.Open(spooled.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := http.Header{"Content-Type": {spooled.ContentType}}
+	size := spooled.Size
+	if size <= s.Config.PartSize {
+		return s.client.putObject(ctx, key, f, size, spooled.ContentHash, header)
+	}
+
+	uploadID, err := s.client.createMultipartUpload(ctx, key, header)
+	if err != nil {
+		return err
+	}
+
+	var parts []s3CompletedPart
+	for offset, partNumber := int64(0), 1; offset < size; offset, partNumber = offset+s.Config.PartSize, partNumber+1 {
+		partSize := min(s.Config.PartSize, size-offset)
+		etag, err := s.client.uploadPart(ctx, key, uploadID, partNumber, io.NewSectionReader(f, offset, partSize), partSize)
+		if err != nil {
+			s.client.abortMultipartUpload(context.WithoutCancel(ctx), key, uploadID)
+			return err
+		}
+		parts = append(parts, s3CompletedPart{PartNumber: partNumber, ETag: etag})
+	}
+
+	if err := s.client.completeMultipartUpload(ctx, key, uploadID, parts); err != nil {
+		s.client.abortMultipartUpload(context.WithoutCancel(ctx), key, uploadID)
+		return err
+	}
+	return nil
+}
+
+func (s *S3Storage) readRefs(ctx context.Context, key string) (int, error) {
+	resp, err := s.client.getObject(ctx, key+".refs", nil)
+	if errors.Is(err, ErrObjectNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
 
-	return fmt.Sprintf("https://s3.amazonaws.com/bucket/%s.jpg", hashString), nil
+func (s *S3Storage) writeRefs(ctx context.Context, key string, refs int) error {
+	data := []byte(strconv.Itoa(refs))
+	return s.client.putObject(ctx, key+".refs", strings.NewReader(string(data)), int64(len(data)), sha256Hex(data), nil)
 }
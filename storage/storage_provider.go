@@ -1,7 +1,121 @@
 package storage
 
-import "mime/multipart"
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"time"
+)
+
+var (
+	ErrObjectNotFound   = errors.New("object not found")
+	ErrInvalidSignature = errors.New("invalid url signature")
+	ErrSignatureExpired = errors.New("url signature expired")
+	ErrListUnsupported  = errors.New("storage provider cannot list objects")
+)
+
+// Object describes a blob held by a StorageProvider. Blobs are content
+// addressed: the key is derived from the SHA-256 of the file bytes, so
+// identical uploads share a single blob. Provider is the name of the storage
+// instance holding the blob; it is set by the Router.
+type Object struct {
+	Key         string
+	Provider    string
+	URL         string
+	ContentHash string
+	ContentType string
+	Size        int64
+}
+
+// ObjectInfo is the metadata a StorageProvider reports for a stored blob.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// ObjectReader streams a stored blob. It is seekable so that callers can
+// serve byte ranges without reading the whole object.
+type ObjectReader interface {
+	io.ReadSeekCloser
+}
 
 type StorageProvider interface {
-	UploadFile(fileHeader *multipart.FileHeader, filename string) (string, error)
+	// UploadFile stores the contents of file and returns the resulting
+	// object. Uploading bytes that are already stored adds a reference to
+	// the existing blob instead of writing a second copy.
+	UploadFile(ctx context.Context, file io.Reader, filename string) (*Object, error)
+	// Release drops one reference to the blob under key and deletes it once
+	// nothing refers to it anymore.
+	Release(ctx context.Context, key string) error
+	// Open returns a reader for the blob under key.
+	Open(ctx context.Context, key string) (ObjectReader, error)
+	// Stat returns the metadata of the blob under key.
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// Delete removes the blob under key regardless of how many references
+	// it still has.
+	Delete(ctx context.Context, key string) error
+	// Exists reports whether a blob is stored under key.
+	Exists(ctx context.Context, key string) (bool, error)
+	// SignedURL returns a link to the blob under key that stops working
+	// once expiry has elapsed.
+	SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// Lister is implemented by providers that can enumerate the blobs they hold.
+// fn is called once per blob; the ContentType of listed objects may be empty.
+// Listing stops at the first error returned by fn.
+type Lister interface {
+	List(ctx context.Context, fn func(ObjectInfo) error) error
+}
+
+// KeyedWriter is implemented by providers that can store a blob under a key
+// chosen by the caller rather than its content hash. Decorators that
+// transform content, such as encryption, use it so keys keep describing the
+// original content.
+type KeyedWriter interface {
+	// UploadFileAs stores file under key with the reference counting of
+	// UploadFile: uploading to an existing key adds a reference and keeps
+	// the stored blob.
+	UploadFileAs(ctx context.Context, key string, file io.Reader, contentType string) (*Object, error)
+	// ReplaceFile overwrites the blob of an existing key, keeping its
+	// reference count.
+	ReplaceFile(ctx context.Context, key string, file io.Reader, contentType string) error
+}
+
+// ReferenceCounter is implemented by providers that count the references to
+// their blobs, so that a blob copied from one provider to another can keep
+// its count.
+type ReferenceCounter interface {
+	// References returns how many references the blob under key has, zero
+	// when it is not stored.
+	References(ctx context.Context, key string) (int, error)
+	// SetReferences sets the reference count of the blob under key, failing
+	// with ErrObjectNotFound when it is not stored.
+	SetReferences(ctx context.Context, key string, refs int) error
+}
+
+// ListObjects lists the blobs of provider, or returns ErrListUnsupported if it
+// does not implement Lister.
+func ListObjects(ctx context.Context, provider StorageProvider, fn func(ObjectInfo) error) error {
+	lister, ok := provider.(Lister)
+	if !ok {
+		return ErrListUnsupported
+	}
+	return lister.List(ctx, fn)
+}
+
+// URLVerifier is implemented by providers that sign URLs themselves, rather
+// than delegating to the backend, and so must check the signature when a
+// signed URL is requested.
+type URLVerifier interface {
+	VerifySignedURL(key string, query url.Values) error
+}
+
+// ObjectKey builds the key of a blob from its content hash and the extension
+// matching its detected content type, e.g. "<sha256>.png".
+func ObjectKey(contentHash string, extension string) string {
+	return contentHash + extension
 }
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testProviderLifecycle runs an upload through every operation of the
+// StorageProvider contract.
+func testProviderLifecycle(t *testing.T, provider StorageProvider) {
+	t.Helper()
+
+	ctx := context.Background()
+	content := "0123456789 lifecycle content"
+
+	object, err := provider.UploadFile(ctx, strings.NewReader(content), "notes.txt")
+	require.NoError(t, err)
+
+	exists, err := provider.Exists(ctx, object.Key)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	info, err := provider.Stat(ctx, object.Key)
+	require.NoError(t, err)
+	assert.Equal(t, object.Key, info.Key)
+	assert.Equal(t, int64(len(content)), info.Size)
+	assert.Equal(t, "text/plain", info.ContentType)
+	assert.False(t, info.LastModified.IsZero())
+
+	reader, err := provider.Open(ctx, object.Key)
+	require.NoError(t, err)
+	_, err = reader.Seek(11, io.SeekStart)
+	require.NoError(t, err)
+	part := make([]byte, 9)
+	_, err = io.ReadFull(reader, part)
+	require.NoError(t, err)
+	assert.Equal(t, "lifecycle", string(part))
+	_, err = reader.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	all, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(all))
+	require.NoError(t, reader.Close())
+
+	require.NoError(t, provider.Delete(ctx, object.Key))
+
+	exists, err = provider.Exists(ctx, object.Key)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	_, err = provider.Open(ctx, object.Key)
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	_, err = provider.Stat(ctx, object.Key)
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
+
+func TestLocalStorageLifecycle(t *testing.T) {
+	testProviderLifecycle(t, newTestLocalStorage(t))
+}
+
+func TestS3StorageLifecycle(t *testing.T) {
+	s, _ := newTestS3Storage(t)
+	testProviderLifecycle(t, s)
+}
+
+// testProviderList uploads a few blobs, one of them twice, and checks each is
+// listed exactly once without its reference count.
+func testProviderList(t *testing.T, provider StorageProvider) {
+	t.Helper()
+
+	ctx := context.Background()
+	want := map[string]int64{}
+	for _, content := range []string{"first", "second", "third", "first"} {
+		object, err := provider.UploadFile(ctx, strings.NewReader(content), "notes.txt")
+		require.NoError(t, err)
+		want[object.Key] = object.Size
+	}
+
+	got := map[string]int64{}
+	err := ListObjects(ctx, provider, func(info ObjectInfo) error {
+		assert.NotContains(t, got, info.Key)
+		assert.False(t, info.LastModified.IsZero())
+		got[info.Key] = info.Size
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestLocalStorageList(t *testing.T) {
+	testProviderList(t, newTestLocalStorage(t))
+}
+
+func TestS3StorageList(t *testing.T) {
+	s, fake := newTestS3Storage(t)
+	fake.ListPageSize = 2
+	testProviderList(t, s)
+}
+
+func TestMirrorStorageList(t *testing.T) {
+	s, _, _ := newTestMirrorStorage(t, false)
+	testProviderList(t, s)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"media-indexer/config"
+	mediaRepo "media-indexer/repositories/media"
+	"media-indexer/services/fsck"
+	"media-indexer/storage"
+)
+
+// fsck compares the configured storage with the media table. It reports
+// orphaned blobs, media whose blob is missing and, with -verify, checksum
+// mismatches. With -gc it deletes orphans older than the grace period.
+func main() {
+	verify := flag.Bool("verify", false, "hash every referenced blob and compare it with its media")
+	gc := flag.Bool("gc", false, "delete orphaned blobs older than the grace period")
+	gracePeriod := flag.Duration("grace", fsck.DefaultGracePeriod, "minimum age of orphaned blobs deleted by -gc")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	config.ConnectDB()
+	storageProvider, err := storage.NewStorageFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+	service := fsck.NewFsckService(mediaRepo.NewMediaRepository(config.DB), storageProvider)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	report, err := service.Check(ctx, fsck.Options{Verify: *verify, Repair: *gc, GracePeriod: *gracePeriod})
+	if err != nil {
+		log.Fatalf("Check failed: %v", err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		printReport(report)
+	}
+	if !report.Clean() {
+		os.Exit(1)
+	}
+}
+
+func printReport(report *fsck.Report) {
+	for _, orphan := range report.Orphans {
+		state := "orphaned"
+		if orphan.Collected {
+			state = "collected"
+		}
+		fmt.Printf("%s blob: %s (%d bytes, modified %s)\n", state, orphan.Key, orphan.Size, orphan.LastModified.Format("2006-01-02 15:04"))
+	}
+	for _, missing := range report.MissingBlobs {
+		fmt.Printf("missing blob: %s for media %s\n", missing.Key, missing.MediaID)
+	}
+	for _, mismatch := range report.ChecksumMismatches {
+		fmt.Printf("checksum mismatch: %s for media %s (expected %s, got %s)\n", mismatch.Key, mismatch.MediaID, mismatch.Expected, mismatch.Actual)
+	}
+	for _, message := range report.Errors {
+		fmt.Printf("error: %s\n", message)
+	}
+	fmt.Printf("Checked %d media and %d blobs in %s: %d orphaned, %d missing, %d mismatched\n",
+		report.CheckedMedia, report.CheckedBlobs, report.Duration, len(report.Orphans), len(report.MissingBlobs), len(report.ChecksumMismatches))
+}
@@ -5,15 +5,35 @@ import (
 
 	"media-indexer/config"
 	"media-indexer/models"
+	"media-indexer/storage"
 )
 
 func main() {
 	config.ConnectDB()
 
-	if err := config.DB.AutoMigrate(&models.Media{}, &models.Tag{}, &models.MediaTag{}); err != nil {
+	if err := config.DB.AutoMigrate(&models.Media{}, &models.Tag{}, &models.MediaTag{}, &models.Rendition{}, &models.PerceptualHash{}); err != nil {
 		fmt.Printf("Error during migration: %v\n", err)
 		return
 	}
 
+	// Media created before storage keys were saved only have a link, whose
+	// last path segment is the key. They are assumed to live in the default
+	// storage instance.
+	provider, err := storage.DefaultInstanceName()
+	if err != nil {
+		fmt.Printf("Error reading storage config: %v\n", err)
+		return
+	}
+	result := config.DB.Exec(`UPDATE media
+		SET storage_key = regexp_replace(split_part(link, '?', 1), '^.*/', ''), storage_provider = ?
+		WHERE (storage_key IS NULL OR storage_key = '') AND link <> ''`, provider)
+	if result.Error != nil {
+		fmt.Printf("Error backfilling storage keys: %v\n", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		fmt.Printf("Backfilled the storage key of %d media\n", result.RowsAffected)
+	}
+
 	fmt.Println("Migration has finished successfully!")
 }
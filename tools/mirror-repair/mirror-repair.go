@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"media-indexer/config"
+	"media-indexer/models"
+	"media-indexer/storage"
+)
+
+// mirror-repair copies every blob referenced by a media record or thumbnail
+// to the members of its mirror storage instance that are missing it, and
+// gives every copy the reference count of the primary. Blobs some members
+// lack are also found by listing them.
+func main() {
+	config.ConnectDB()
+
+	provider, err := storage.NewStorageFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+	router := provider.(*storage.Router)
+
+	mirrors := 0
+	for name, instance := range router.Instances {
+		mirror, ok := instance.(*storage.MirrorStorage)
+		if !ok {
+			continue
+		}
+		mirrors++
+
+		var keys, renditionKeys []string
+		err := config.DB.Model(&models.Media{}).Where("storage_provider = ?", name).Distinct().Pluck("storage_key", &keys).Error
+		if err != nil {
+			log.Fatalf("Failed to load media: %v", err)
+		}
+		err = config.DB.Model(&models.Rendition{}).Where("storage_provider = ?", name).Distinct().Pluck("storage_key", &renditionKeys).Error
+		if err != nil {
+			log.Fatalf("Failed to load thumbnails: %v", err)
+		}
+		keys = append(keys, renditionKeys...)
+
+		report := mirror.Repair(context.Background(), keys)
+		for _, key := range report.Missing {
+			fmt.Printf("%s: missing from every member: %s\n", name, key)
+		}
+		for _, key := range report.Stray {
+			fmt.Printf("%s: not referenced, held by some members only: %s\n", name, key)
+		}
+		for key, err := range report.Failed {
+			fmt.Printf("%s: failed to repair %s: %v\n", name, key, err)
+		}
+		fmt.Printf("%s: checked %d blobs, copied %d, recounted %d, %d missing, %d stray, %d failed\n",
+			name, report.Checked, report.Copied, report.Recounted, len(report.Missing), len(report.Stray), len(report.Failed))
+	}
+	if mirrors == 0 {
+		log.Fatal("No mirror storage instance is configured")
+	}
+}
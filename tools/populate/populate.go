@@ -3,9 +3,11 @@ package main
 import (
 	"fmt"
 	"log"
+	"math/rand"
 	"time"
 
 	"github.com/brianvoe/gofakeit/v6"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 
 	"media-indexer/config"
@@ -16,6 +18,9 @@ const (
 	NumTags   = 1000000
 	BatchSize = 10000
 	NumMedia  = 1000000
+	// ClusterSize media in a row get perceptual hashes a few bits apart,
+	// like near-duplicate photos, so similar media lookups find some.
+	ClusterSize = 5
 )
 
 func init() {
@@ -76,11 +81,21 @@ func main() {
 	}
 
 	var mediaItems []models.Media
+	var base uint64
 	for i := 0; i < NumMedia; i++ {
+		if i%ClusterSize == 0 {
+			base = rand.Uint64()
+		}
+		id := uuid.New()
+		hash := base ^ 1<<rand.Intn(64) ^ 1<<rand.Intn(64)
 		mediaItems = append(mediaItems, models.Media{
-			Name: fmt.Sprintf("Media %d", i+1),
-			Link: fmt.Sprintf("https://example.com/media%d.jpg", i+1),
-			Tags: []models.Tag{{Name: tags[i%len(tags)]}},
+			ID:              id,
+			Name:            fmt.Sprintf("Media %d", i+1),
+			StorageProvider: "local",
+			StorageKey:      fmt.Sprintf("media%d.jpg", i+1),
+			ContentType:     "image/jpeg",
+			Tags:            []models.Tag{{Name: tags[i%len(tags)]}},
+			PerceptualHash:  models.NewPerceptualHash(id, hash),
 		})
 	}
 
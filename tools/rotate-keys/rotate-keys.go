@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"media-indexer/storage"
+)
+
+// rotate-keys re-wraps the data keys of every encrypted object with the
+// active master key, so retired master keys can be removed from the config.
+func main() {
+	provider, err := storage.NewStorageFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	encrypted := findEncrypted(provider)
+	if len(encrypted) == 0 {
+		log.Fatalf("Configured storage %T is not encrypted", provider)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	failed := 0
+	for _, s := range encrypted {
+		report, err := s.RotateKeys(ctx)
+		if err != nil {
+			log.Fatalf("Rotation stopped: %v", err)
+		}
+		for key, err := range report.Failed {
+			fmt.Printf("failed to rotate %s: %v\n", key, err)
+		}
+		fmt.Printf("Checked %d objects, re-wrapped %d, %d failed\n", report.Checked, report.Rewrapped, len(report.Failed))
+		failed += len(report.Failed)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// findEncrypted returns the encrypted instances of provider, looking inside
+// routers and mirrors.
+func findEncrypted(provider storage.StorageProvider) []*storage.EncryptedStorage {
+	switch p := provider.(type) {
+	case *storage.EncryptedStorage:
+		return []*storage.EncryptedStorage{p}
+	case *storage.Router:
+		var found []*storage.EncryptedStorage
+		for _, instance := range p.Instances {
+			found = append(found, findEncrypted(instance)...)
+		}
+		return found
+	case *storage.MirrorStorage:
+		found := findEncrypted(p.Primary)
+		for _, replica := range p.Replicas {
+			found = append(found, findEncrypted(replica)...)
+		}
+		return found
+	}
+	return nil
+}
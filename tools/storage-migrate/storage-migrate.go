@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"media-indexer/config"
+	mediaRepo "media-indexer/repositories/media"
+	"media-indexer/services/migration"
+	"media-indexer/storage"
+)
+
+// storage-migrate copies the files of all media from one storage backend to
+// another and rewrites the media records to point at the copies. Backends are
+// named instances of the STORAGE_CONFIG file or, without one, provider types
+// configured through the usual environment variables.
+func main() {
+	from := flag.String("from", "", "storage instance (or type) to copy from")
+	to := flag.String("to", "", "storage instance (or type) to copy to")
+	workers := flag.Int("workers", 4, "number of media copied in parallel")
+	dryRun := flag.Bool("dry-run", false, "only report what would be copied")
+	interval := flag.Duration("progress", 10*time.Second, "interval between progress reports")
+	flag.Parse()
+
+	if *from == "" || *to == "" || *from == *to {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	source, err := storage.NewNamedInstanceFromEnv(*from)
+	if err != nil {
+		log.Fatalf("Failed to initialize source storage: %v", err)
+	}
+	destination, err := storage.NewNamedInstanceFromEnv(*to)
+	if err != nil {
+		log.Fatalf("Failed to initialize destination storage: %v", err)
+	}
+
+	config.ConnectDB()
+	service := migration.NewMigrationService(mediaRepo.NewMediaRepository(config.DB), *from, source, *to, destination)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	report, err := service.Migrate(ctx, migration.Options{
+		Workers:          *workers,
+		DryRun:           *dryRun,
+		ProgressInterval: *interval,
+		Progress: func(report migration.Report) {
+			fmt.Printf("%d/%d media done, %d skipped, %d failed, %d bytes\n",
+				report.Migrated, report.Total, report.Skipped, len(report.Failed), report.Bytes)
+		},
+	})
+	if report != nil {
+		for id, err := range report.Failed {
+			fmt.Printf("failed to migrate media %s: %v\n", id, err)
+		}
+		verb := "Migrated"
+		if *dryRun {
+			verb = "Would migrate"
+		}
+		fmt.Printf("%s %d of %d media (%d bytes) in %s; %d already done, %d failed\n",
+			verb, report.Migrated, report.Total, report.Bytes, report.Duration.Round(time.Second), report.Skipped, len(report.Failed))
+	}
+	if err != nil {
+		log.Fatalf("Migration stopped: %v", err)
+	}
+	if len(report.Failed) > 0 {
+		os.Exit(1)
+	}
+}
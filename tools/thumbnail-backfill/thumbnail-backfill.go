@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/google/uuid"
+
+	"media-indexer/config"
+	"media-indexer/models"
+	mediaRepo "media-indexer/repositories/media"
+	"media-indexer/services/thumbnail"
+	"media-indexer/storage"
+)
+
+const batchSize = 100
+
+// thumbnail-backfill renders the thumbnails and perceptual hashes missing
+// from images stored before they were computed on upload, or before a
+// thumbnail size was added to THUMBNAIL_SIZES.
+func main() {
+	config.ConnectDB()
+
+	provider, err := storage.NewStorageFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+	thumbnailConfig, err := thumbnail.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to read thumbnail config: %v", err)
+	}
+	repo := mediaRepo.NewMediaRepository(config.DB)
+	thumbnailService := thumbnail.NewThumbnailService(repo, provider, thumbnailConfig)
+	ctx := context.Background()
+
+	checked, updated, failed := 0, 0, 0
+	afterID := uuid.Nil
+	for {
+		batch, err := repo.FindBatch(afterID, batchSize)
+		if err != nil {
+			log.Fatalf("Failed to load media: %v", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		afterID = batch[len(batch)-1].ID
+
+		for i := range batch {
+			m := &batch[i]
+			if !thumbnail.Supported(m.ContentType) {
+				continue
+			}
+			checked++
+			if m.PerceptualHash != nil && complete(m.Renditions, thumbnailConfig.Sizes) {
+				continue
+			}
+			if err := backfill(ctx, thumbnailService, provider, m); err != nil {
+				fmt.Printf("failed to render thumbnails of media %s: %v\n", m.ID, err)
+				failed++
+				continue
+			}
+			updated++
+		}
+	}
+	fmt.Printf("checked %d images, updated %d, %d failed\n", checked, updated, failed)
+}
+
+// complete reports whether renditions include every size.
+func complete(renditions []models.Rendition, sizes []thumbnail.Size) bool {
+	names := make(map[string]bool, len(renditions))
+	for _, rendition := range renditions {
+		names[rendition.Name] = true
+	}
+	for _, size := range sizes {
+		if !names[size.Name] {
+			return false
+		}
+	}
+	return true
+}
+
+func backfill(ctx context.Context, thumbnailService thumbnail.ThumbnailService, provider storage.StorageProvider, m *models.Media) error {
+	reader, err := storage.InstanceNamed(provider, m.StorageProvider).Open(ctx, m.StorageKey)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	_, err = thumbnailService.Generate(ctx, m, bytes.NewReader(data), int64(len(data)))
+	return err
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// GetEnv returns the value of the environment variable key, or fallback when
+// it is unset or empty.
+func GetEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// GetEnvDuration parses the environment variable name as a positive duration
+// such as "90s", returning fallback when it is unset or empty.
+func GetEnvDuration(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("parse %s: %q is not a duration", name, value)
+	}
+	return duration, nil
+}
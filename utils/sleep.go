@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+// Sleep waits for d, or until ctx is done, in which case it returns the error
+// of ctx.
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}